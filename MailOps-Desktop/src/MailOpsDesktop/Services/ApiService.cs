@@ -1,3 +1,4 @@
+using System.Net.Http.Headers;
 using System.Text;
 using System.Text.Json;
 using MailOpsDesktop.Models;
@@ -10,7 +11,7 @@ public class ApiService
     private readonly string _baseUrl;
     private readonly SecurityManager _securityManager;
 
-    public ApiService(string baseUrl, SecurityManager securityManager)
+    public ApiService(string baseUrl, string httpToken, SecurityManager securityManager)
     {
         _baseUrl = baseUrl.EndsWith("/") ? baseUrl.TrimEnd('/') : baseUrl;
         _securityManager = securityManager;
@@ -18,6 +19,8 @@ public class ApiService
         {
             Timeout = TimeSpan.FromSeconds(30)
         };
+        // 每個請求都需帶上 Service 啟動時的 Token
+        _httpClient.DefaultRequestHeaders.Authorization = new AuthenticationHeaderValue("Bearer", httpToken);
     }
 
     /// <summary>
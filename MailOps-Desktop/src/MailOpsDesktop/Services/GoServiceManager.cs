@@ -10,6 +10,7 @@ public class GoServiceManager : IDisposable
     private readonly SecurityManager _securityManager;
     private readonly string _serviceExecutablePath;
     private readonly string _httpAddr;
+    private readonly string _httpToken;
     private bool _disposed = false;
 
     public event EventHandler<string>? OnLogReceived;
@@ -18,10 +19,12 @@ public class GoServiceManager : IDisposable
     public GoServiceManager(
         string serviceExecutablePath,
         string httpAddr,
+        string httpToken,
         SecurityManager securityManager)
     {
         _serviceExecutablePath = serviceExecutablePath;
         _httpAddr = httpAddr;
+        _httpToken = httpToken;
         _securityManager = securityManager;
     }
 
@@ -51,7 +54,8 @@ public class GoServiceManager : IDisposable
             {
                 // 將 Token 注入環境變數（不使用命令列）
                 { "CF_API_TOKEN", _securityManager.GetTokenForEnvironment() ?? "" },
-                { "MAILOPS_HTTP_ADDR", _httpAddr }
+                { "MAILOPS_HTTP_ADDR", _httpAddr },
+                { "MAILOPS_HTTP_TOKEN", _httpToken }
             };
 
             // 構建進程啟動資訊
@@ -1,3 +1,4 @@
+using System.Security.Cryptography;
 using System.Text.Json;
 using Microsoft.Web.WebView2.Core;
 using Microsoft.Web.WebView2.WinForms;
@@ -15,6 +16,9 @@ public partial class MainForm : Form
     
     private const string DefaultHttpAddr = "127.0.0.1:8080";
 
+    // Service 啟動時注入的 API Token，每次啟動重新產生
+    private readonly string httpToken = Convert.ToHexString(RandomNumberGenerator.GetBytes(32));
+
     public MainForm()
     {
         InitializeComponent();
@@ -448,7 +452,7 @@ public partial class MainForm : Form
         }
         
         // Initialize service manager
-        goServiceManager = new GoServiceManager(servicePath, DefaultHttpAddr, securityManager);
+        goServiceManager = new GoServiceManager(servicePath, DefaultHttpAddr, httpToken, securityManager);
         goServiceManager.OnLogReceived += OnServiceLogReceived;
         goServiceManager.OnStatusChanged += OnServiceStatusChanged;
         
@@ -460,7 +464,7 @@ public partial class MainForm : Form
         }
         
         // Initialize API service
-        apiService = new ApiService($"http://{DefaultHttpAddr}", securityManager);
+        apiService = new ApiService($"http://{DefaultHttpAddr}", httpToken, securityManager);
         
         // Wait for service to be ready
         bool ready = await apiService.WaitForServiceReadyAsync();
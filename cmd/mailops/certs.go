@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mailops/internal/protocol"
+	"mailops/internal/scheduler"
+	"mailops/internal/security"
+	"os"
+)
+
+// runCertRenewCommand renews the TLS certificate of each row's mail host
+// once it is within the renewal window, and installs it on the server. Run
+// it periodically, e.g. daily from cron.
+func runCertRenewCommand(args []string) int {
+	fs := flag.NewFlagSet("cert-renew", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the CSV config file of the servers")
+	appConfigPath := fs.String("app-config", "examples/app.config.json", "Path to app config file")
+	row := fs.Int("row", 0, "Only renew the certificate of this row ID")
+	force := fs.Bool("force", false, "Renew even when the certificate is not due")
+	fs.Parse(args)
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Usage: mailops cert-renew --config <servers.csv> [--row <row_id>] [--force]")
+		return 2
+	}
+
+	appConfig, err := loadAppConfig(*appConfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load app config: %v\n", err)
+		return 1
+	}
+	if !appConfig.ACME.Enabled {
+		fmt.Fprintln(os.Stderr, "ACME certificates are not enabled in the app config (acme.enabled)")
+		return 1
+	}
+	if err := appConfig.ACME.options().Check(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid ACME settings: %v\n", err)
+		return 1
+	}
+
+	servers, err := loadServerConfigs(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load servers: %v\n", err)
+		return 1
+	}
+	if servers, err = selectRow(servers, *row); err != nil {
+		fmt.Fprintf(os.Stderr, "%v in %s\n", err, *configPath)
+		return 1
+	}
+
+	masker := security.NewMasker()
+	schedConfig := &scheduler.Config{
+		SSHTimeoutMs:        appConfig.SSHTimeoutMs,
+		CmdTimeoutMs:        appConfig.CmdTimeoutMs,
+		DKIMSelector:        appConfig.DKIMSelector,
+		DNSProviderDefaults: appConfig.dnsProviderDefaults(),
+		DNSVerify:           appConfig.DNSVerify.options(),
+		MTASTS:              appConfig.MTASTS.Enabled,
+		ACME:                true,
+		ACMEOptions:         appConfig.ACME.options(),
+		SSHHostKeys:         appConfig.SSHHostKeys.policy(),
+	}
+	runID := protocol.GenerateRunID()
+	sched := scheduler.NewScheduler(1, 0, 0, nil, &consoleLogger{masker: masker}, schedConfig, false, runID, masker)
+
+	if err := sched.RenewCertificates(servers, *force); err != nil {
+		fmt.Fprintf(os.Stderr, "Certificate renewal failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mailops/internal/protocol"
+	"mailops/internal/scheduler"
+	"mailops/internal/security"
+	"os"
+	"time"
+)
+
+// runDKIMRotateCommand advances the DKIM selector rotation of each row by at
+// most one phase: publish a new key, switch the signer once it has
+// propagated, retire the old key once mail signed with it has been
+// delivered. Run it periodically, e.g. daily from cron.
+func runDKIMRotateCommand(args []string) int {
+	fs := flag.NewFlagSet("dkim-rotate", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the CSV config file of the servers")
+	appConfigPath := fs.String("app-config", "examples/app.config.json", "Path to app config file")
+	row := fs.Int("row", 0, "Only rotate this row ID")
+	start := fs.Bool("start", false, "Start a new rotation when none is in progress")
+	fs.Parse(args)
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Usage: mailops dkim-rotate --config <servers.csv> [--row <row_id>] [--start]")
+		return 2
+	}
+
+	appConfig, err := loadAppConfig(*appConfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load app config: %v\n", err)
+		return 1
+	}
+
+	servers, err := loadServerConfigs(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load servers: %v\n", err)
+		return 1
+	}
+	if servers, err = selectRow(servers, *row); err != nil {
+		fmt.Fprintf(os.Stderr, "%v in %s\n", err, *configPath)
+		return 1
+	}
+
+	masker := security.NewMasker()
+	rotation := appConfig.DKIMRotation
+	schedConfig := &scheduler.Config{
+		SSHTimeoutMs:        appConfig.SSHTimeoutMs,
+		CmdTimeoutMs:        appConfig.CmdTimeoutMs,
+		DKIMSelector:        appConfig.DKIMSelector,
+		DKIMKeyType:         appConfig.DKIMKeyType,
+		DKIMKeyBits:         appConfig.DKIMKeyBits,
+		DNSProviderDefaults: appConfig.dnsProviderDefaults(),
+		DNSVerify:           appConfig.DNSVerify.options(),
+		DKIMPublishWait:     time.Duration(rotation.PublishWaitHours) * time.Hour,
+		DKIMRetireWait:      time.Duration(rotation.RetireWaitHours) * time.Hour,
+		DKIMRotateInterval:  time.Duration(rotation.IntervalDays) * 24 * time.Hour,
+		SSHHostKeys:         appConfig.SSHHostKeys.policy(),
+	}
+	runID := protocol.GenerateRunID()
+	sched := scheduler.NewScheduler(1, 0, 0, nil, &consoleLogger{masker: masker}, schedConfig, false, runID, masker)
+
+	if err := sched.RotateDKIM(servers, *start); err != nil {
+		fmt.Fprintf(os.Stderr, "DKIM rotation failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mailops/internal/dmarc"
+	"mailops/internal/protocol"
+	"mailops/internal/scheduler"
+	"mailops/internal/security"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// runDMARCReportCommand summarizes DMARC aggregate reports by domain and
+// source IP. Reports are read from a local directory, from the report
+// mailbox on each server of a CSV, or both. Source IPs are matched against
+// the servers of successful runs in output/reports, so mail from our own
+// servers can be told apart from mail sent by others in the domain's name.
+func runDMARCReportCommand(args []string) int {
+	fs := flag.NewFlagSet("dmarc-report", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory of report files (XML, gzip, zip or mail messages)")
+	configPath := fs.String("config", "", "Path to the CSV config file of the servers to fetch reports from")
+	appConfigPath := fs.String("app-config", "examples/app.config.json", "Path to app config file")
+	row := fs.Int("row", 0, "Only fetch reports from this row ID")
+	mailbox := fs.String("mailbox", "", "Mailbox receiving the reports (default: the local part of the rua address)")
+	jsonOutput := fs.Bool("json", false, "Print the summary as JSON")
+	fs.Parse(args)
+
+	if *dir == "" && *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Usage: mailops dmarc-report [--dir <reports>] [--config <servers.csv> [--row <row_id>] [--mailbox <user>]] [--json]")
+		return 2
+	}
+
+	masker := security.NewMasker()
+	logger := &consoleLogger{masker: masker}
+	failed := false
+
+	var reports []*dmarc.Report
+	if *dir != "" {
+		found, err := dmarc.ReadDir(*dir, func(path string, err error) {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", path, err)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read reports: %v\n", err)
+			return 1
+		}
+		reports = append(reports, found...)
+	}
+
+	if *configPath != "" {
+		appConfig, err := loadAppConfig(*appConfigPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load app config: %v\n", err)
+			return 1
+		}
+
+		servers, err := loadServerConfigs(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load servers: %v\n", err)
+			return 1
+		}
+		if servers, err = selectRow(servers, *row); err != nil {
+			fmt.Fprintf(os.Stderr, "%v in %s\n", err, *configPath)
+			return 1
+		}
+
+		schedConfig := &scheduler.Config{
+			SSHTimeoutMs:  appConfig.SSHTimeoutMs,
+			CmdTimeoutMs:  appConfig.CmdTimeoutMs,
+			DMARCTemplate: appConfig.DMARCTemplate,
+			SSHHostKeys:   appConfig.SSHHostKeys.policy(),
+		}
+		sched := scheduler.NewScheduler(1, 0, 0, nil, logger, schedConfig, false, protocol.GenerateRunID(), masker)
+
+		found, err := sched.FetchDMARCReports(servers, *mailbox)
+		if err != nil {
+			// Summarize what could be fetched, but fail the command
+			failed = true
+		}
+		reports = append(reports, found...)
+	}
+
+	deployed, err := scheduler.LoadDeployedServers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load run reports: %v\n", err)
+		return 1
+	}
+
+	summaries := dmarc.Summarize(reports, deployed)
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summaries); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encode summary: %v\n", err)
+			return 1
+		}
+	} else {
+		printDMARCSummaries(os.Stdout, summaries)
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// printDMARCSummaries prints a table of source IPs for each domain
+func printDMARCSummaries(w io.Writer, summaries []*dmarc.DomainSummary) {
+	if len(summaries) == 0 {
+		fmt.Fprintln(w, "No DMARC reports found")
+		return
+	}
+
+	for i, summary := range summaries {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if summary.Reports == 0 {
+			fmt.Fprintf(w, "%s: no reports\n", summary.Domain)
+		} else {
+			fmt.Fprintf(w, "%s: %d reports from %s, %s to %s\n", summary.Domain, summary.Reports, strings.Join(summary.Reporters, ", "),
+				summary.Begin.Format("2006-01-02"), summary.End.Format("2006-01-02"))
+			fmt.Fprintf(w, "  %d messages, %d pass (%s), %d fail\n", summary.Messages, summary.Pass, percent(summary.Pass, summary.Messages), summary.Fail)
+		}
+
+		for _, server := range summary.Servers {
+			sending := false
+			for _, source := range summary.Sources {
+				if source.Server != nil && source.Server.IP == server.IP {
+					sending = true
+				}
+			}
+			note := ""
+			if summary.Reports > 0 && !sending {
+				note = ", no mail reported"
+			}
+			fmt.Fprintf(w, "  deployed: %s (run %s, row %d%s)\n", server.IP, server.RunID, server.RowID, note)
+		}
+
+		if len(summary.Sources) == 0 {
+			continue
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  SOURCE IP\tMESSAGES\tPASS\tFAIL\tDKIM\tSPF\tQUARANTINE\tREJECT\tSERVER")
+		for _, source := range summary.Sources {
+			server := "-"
+			if source.Server != nil {
+				server = fmt.Sprintf("row %d", source.Server.RowID)
+			}
+			fmt.Fprintf(tw, "  %s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", source.SourceIP, source.Messages, source.Pass, source.Fail,
+				source.DKIMPass, source.SPFPass, source.Quarantined, source.Rejected, server)
+		}
+		tw.Flush()
+	}
+}
+
+func percent(part, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+}
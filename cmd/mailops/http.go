@@ -0,0 +1,828 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mailops/internal/dns"
+	"mailops/internal/protocol"
+	"mailops/internal/scheduler"
+	"mailops/internal/security"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// previewWait bounds how long a DNS preview request waits for its run to
+// finish. It stays below the desktop client's 30s HTTP timeout.
+const previewWait = 25 * time.Second
+
+// executeWait bounds how long a DNS execute request waits for its apply run,
+// which includes verifying the records and rolling them back if that fails.
+// A longer run is reported as in progress and its outcome by /api/runs.
+const executeWait = 25 * time.Second
+
+// defaultConfirmTTL is used when dns_confirm_ttl_ms is not configured
+const defaultConfirmTTL = 10 * time.Minute
+
+// Run states reported over HTTP
+const (
+	runStatusRunning   = "RUNNING"
+	runStatusCompleted = "COMPLETED"
+	runStatusExecuted  = "EXECUTED"
+	runStatusFailed    = "FAILED"
+)
+
+// The desktop client deserializes responses with System.Text.Json defaults,
+// which match property names exactly, so response fields use PascalCase.
+
+type statusResponse struct {
+	Status     string    `json:"Status"`
+	StartTime  time.Time `json:"StartTime"`
+	ActiveRuns int       `json:"ActiveRuns"`
+	HttpAddr   string    `json:"HttpAddr"`
+}
+
+type createRunRequest struct {
+	ConfigFile string         `json:"ConfigFile"`
+	Params     map[string]any `json:"Params"`
+}
+
+type runResponse struct {
+	RunId     string `json:"RunId"`
+	Status    string `json:"Status"`
+	Total     int    `json:"Total,omitempty"`
+	Success   int    `json:"Success,omitempty"`
+	Failed    int    `json:"Failed,omitempty"`
+	Cancelled int    `json:"Cancelled,omitempty"`
+	DNSDryRun bool   `json:"DnsDryRun"`
+}
+
+type dnsRecordResponse struct {
+	Type     string `json:"Type"`
+	Name     string `json:"Name"`
+	Value    string `json:"Value"`
+	Priority int    `json:"Priority"`
+	Action   string `json:"Action"`
+	Note     string `json:"Note,omitempty"`
+}
+
+type dnsPreviewResponse struct {
+	Domain  string              `json:"Domain"`
+	Records []dnsRecordResponse `json:"Records"`
+}
+
+type confirmRequest struct {
+	RunID        string `json:"run_id"`
+	ConfirmToken string `json:"confirm_token"`
+}
+
+type confirmResponse struct {
+	ConfirmToken string    `json:"ConfirmToken"`
+	Status       string    `json:"Status"`
+	ExpiresAt    time.Time `json:"ExpiresAt"`
+}
+
+type validateResponse struct {
+	Valid   bool   `json:"Valid"`
+	Status  string `json:"Status"`
+	Message string `json:"Message"`
+}
+
+type executeResponse struct {
+	Success bool   `json:"Success"`
+	Status  string `json:"Status"`
+	Message string `json:"Message"`
+}
+
+type errorResponse struct {
+	Error string `json:"Error"`
+}
+
+// httpRun tracks a run started through the HTTP control plane
+type httpRun struct {
+	ID        string
+	Servers   []scheduler.ServerConfig
+	DNSDryRun bool
+	DNSOnly   bool
+	Status    string
+	StartTime time.Time
+
+	sched    *scheduler.Scheduler
+	done     chan struct{}
+	executed bool   // The DNS plan was applied and verified
+	applyRun string // ID of the DNS apply run executing the plan
+}
+
+// httpServer exposes the scheduler over the /api contract used by MailOps-Desktop
+type httpServer struct {
+	addr      string
+	token     string // Bearer token every request must carry
+	appConfig *Config
+	masker    *security.Masker
+	encoder   *protocol.Encoder
+	signer    *security.ConfirmSigner
+	startTime time.Time
+
+	mu   sync.Mutex
+	runs map[string]*httpRun
+}
+
+func runHTTPMode(appConfig *Config, addr string) {
+	addr, err := listenAddr(addr, appConfig.HTTP.AllowRemote)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid HTTP address: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Without a token from the environment a random one is generated, which
+	// the operator has to pass on to the client
+	token := os.Getenv("MAILOPS_HTTP_TOKEN")
+	if token == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate HTTP token: %v\n", err)
+			os.Exit(1)
+		}
+		token = hex.EncodeToString(secret)
+		fmt.Fprintf(os.Stderr, "MAILOPS_HTTP_TOKEN is not set, clients must send: Authorization: Bearer %s\n", token)
+	}
+
+	ttl := time.Duration(appConfig.DNSConfirmTTLMs) * time.Millisecond
+	if ttl <= 0 {
+		ttl = defaultConfirmTTL
+	}
+
+	signer, err := security.NewConfirmSigner([]byte(os.Getenv("MAILOPS_CONFIRM_SECRET")), ttl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create confirm signer: %v\n", err)
+		os.Exit(1)
+	}
+
+	srv := &httpServer{
+		addr:      addr,
+		token:     token,
+		appConfig: appConfig,
+		masker:    security.NewMasker(),
+		encoder:   protocol.NewEncoder(os.Stdout),
+		signer:    signer,
+		startTime: time.Now(),
+		runs:      make(map[string]*httpRun),
+	}
+
+	httpSrv := &http.Server{
+		Addr:              addr,
+		Handler:           srv.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.cancelAll()
+		httpSrv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "MailOps HTTP control plane listening on %s\n", addr)
+	if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "HTTP server failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func (h *httpServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", h.handleStatus)
+	mux.HandleFunc("/api/runs", h.handleRuns)
+	mux.HandleFunc("/api/dns/preview", h.handleDNSPreview)
+	mux.HandleFunc("/api/dns/confirm", h.handleDNSConfirm)
+	mux.HandleFunc("/api/dns/validate", h.handleDNSValidate)
+	mux.HandleFunc("/api/dns/execute", h.handleDNSExecute)
+	return h.authorize(mux)
+}
+
+// authorize rejects requests that do not carry the server's bearer token
+func (h *httpServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mailops"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenAddr returns the address to serve on. A missing host means loopback,
+// and other hosts must be loopback unless allowRemote is set.
+func listenAddr(addr string, allowRemote bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if allowRemote {
+		return addr, nil
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("%s is not a loopback address, set http.allow_remote to serve on it", host)
+	}
+	return addr, nil
+}
+
+func (h *httpServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	h.mu.Lock()
+	active := 0
+	for _, run := range h.runs {
+		if run.Status == runStatusRunning {
+			active++
+		}
+	}
+	h.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, statusResponse{
+		Status:     "running",
+		StartTime:  h.startTime,
+		ActiveRuns: active,
+		HttpAddr:   h.addr,
+	})
+}
+
+func (h *httpServer) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if runID := r.URL.Query().Get("run_id"); runID != "" {
+			run, ok := h.getRun(runID)
+			if !ok {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("run not found: %s", runID))
+				return
+			}
+			writeJSON(w, http.StatusOK, h.describeRun(run))
+			return
+		}
+
+		h.mu.Lock()
+		runs := make([]*httpRun, 0, len(h.runs))
+		for _, run := range h.runs {
+			runs = append(runs, run)
+		}
+		h.mu.Unlock()
+
+		sort.Slice(runs, func(i, j int) bool { return runs[i].StartTime.Before(runs[j].StartTime) })
+		resp := make([]runResponse, 0, len(runs))
+		for _, run := range runs {
+			resp = append(resp, h.describeRun(run))
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodPost:
+		var req createRunRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+
+		servers, dnsOnly, err := serversFromRequest(&req, h.appConfig.HTTP.ConfigDir)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// DNS changes of HTTP runs are only planned, whatever dry_run says.
+		// They are applied by /api/dns/execute with the plan's confirm token.
+		run := h.startRun(protocol.GenerateRunID(), servers, true, dnsOnly, nil)
+		writeJSON(w, http.StatusAccepted, runResponse{
+			RunId:     run.ID,
+			Status:    runStatusRunning,
+			Total:     len(servers),
+			DNSDryRun: run.DNSDryRun,
+		})
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *httpServer) handleDNSPreview(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	run, ok := h.getRun(r.URL.Query().Get("run_id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "run not found")
+		return
+	}
+
+	if !waitRun(r.Context(), run, previewWait) {
+		writeError(w, http.StatusConflict, "run is still in progress")
+		return
+	}
+
+	plans, err := scheduler.LoadDNSPlans(run.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	preview := dnsPreviewResponse{Records: make([]dnsRecordResponse, 0)}
+	if len(run.Servers) > 0 {
+		preview.Domain = run.Servers[0].Domain
+	}
+
+	for _, plan := range plans {
+		for _, record := range plan.Records {
+			value := record.Content
+			if record.Action == scheduler.PlanDelete {
+				value = record.Current
+			}
+			preview.Records = append(preview.Records, dnsRecordResponse{
+				Type:     record.Type,
+				Name:     record.Name,
+				Value:    value,
+				Priority: record.Priority,
+				Action:   record.Action,
+				Note:     record.Note,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, preview)
+}
+
+func (h *httpServer) handleDNSConfirm(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	req, run, ok := h.decodeConfirmRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !waitRun(r.Context(), run, previewWait) {
+		writeError(w, http.StatusConflict, "run is still in progress")
+		return
+	}
+	if !run.DNSDryRun {
+		writeError(w, http.StatusConflict, fmt.Sprintf("run %s already applied DNS changes", req.RunID))
+		return
+	}
+	if _, _, failed, cancelled, _, _ := run.sched.GetProgress(); failed > 0 || cancelled > 0 {
+		writeError(w, http.StatusConflict, fmt.Sprintf("run %s did not complete successfully (%d failed, %d cancelled)", req.RunID, failed, cancelled))
+		return
+	}
+
+	plans, err := scheduler.LoadDNSPlans(run.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(plans) == 0 {
+		writeError(w, http.StatusConflict, fmt.Sprintf("run %s has no DNS plan to confirm", req.RunID))
+		return
+	}
+
+	token, expiresAt := h.signer.Issue(run.ID, scheduler.PlanDigest(plans))
+	writeJSON(w, http.StatusOK, confirmResponse{ConfirmToken: token, Status: "CONFIRMED", ExpiresAt: expiresAt})
+}
+
+func (h *httpServer) handleDNSValidate(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	req, run, ok := h.decodeConfirmRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := h.checkConfirmToken(run, req.ConfirmToken); err != nil {
+		writeJSON(w, http.StatusOK, validateResponse{Valid: false, Status: "INVALID", Message: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, validateResponse{Valid: true, Status: "VALID", Message: "Confirm token is valid"})
+}
+
+func (h *httpServer) handleDNSExecute(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	req, run, ok := h.decodeConfirmRequest(w, r)
+	if !ok {
+		return
+	}
+
+	plans, err := h.checkConfirmToken(run, req.ConfirmToken)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, executeResponse{Success: false, Status: "INVALID", Message: err.Error()})
+		return
+	}
+
+	// A confirmed plan is executed at most once, and by one apply run at a time
+	h.mu.Lock()
+	if run.executed {
+		h.mu.Unlock()
+		writeJSON(w, http.StatusConflict, executeResponse{Success: false, Status: runStatusExecuted, Message: fmt.Sprintf("run %s has already been executed", run.ID)})
+		return
+	}
+	if run.applyRun != "" {
+		h.mu.Unlock()
+		writeJSON(w, http.StatusConflict, executeResponse{Success: false, Status: runStatusRunning, Message: fmt.Sprintf("run %s is being executed by DNS apply run %s", run.ID, run.applyRun)})
+		return
+	}
+	applyID := protocol.GenerateRunID()
+	run.applyRun = applyID
+	h.mu.Unlock()
+
+	approved := make(map[int]*scheduler.DNSPlan, len(plans))
+	for _, plan := range plans {
+		approved[plan.RowID] = plan
+	}
+
+	// The apply run ends after dns_verify and any rollback, so its outcome is
+	// only known then. The run is settled whether or not this request waits.
+	applyRun := h.startRun(applyID, run.Servers, false, true, approved)
+	go func() {
+		<-applyRun.done
+		h.settleExecute(run, applyRun)
+	}()
+
+	if !waitRun(r.Context(), applyRun, executeWait) {
+		writeJSON(w, http.StatusAccepted, executeResponse{
+			Success: false,
+			Status:  runStatusRunning,
+			Message: fmt.Sprintf("DNS apply run %s is still in progress, see /api/runs?run_id=%s", applyRun.ID, applyRun.ID),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.settleExecute(run, applyRun))
+}
+
+// settleExecute records the outcome of a finished DNS apply run as its status
+// and on the run it executed. A failed apply run allows a retry with a fresh
+// confirmation.
+func (h *httpServer) settleExecute(run, applyRun *httpRun) executeResponse {
+	_, success, failed, cancelled, _, _ := applyRun.sched.GetProgress()
+	resp := executeResponse{
+		Success: failed == 0 && cancelled == 0,
+		Status:  runStatusExecuted,
+		Message: fmt.Sprintf("DNS apply run %s: %d success, %d failed, %d cancelled", applyRun.ID, success, failed, cancelled),
+	}
+	if !resp.Success {
+		resp.Status = runStatusFailed
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	applyRun.Status = resp.Status
+	if run.applyRun == applyRun.ID {
+		run.applyRun = ""
+		if resp.Success {
+			run.executed = true
+			run.Status = runStatusExecuted
+		}
+	}
+	return resp
+}
+
+// startRun registers a run and executes it in the background
+func (h *httpServer) startRun(runID string, servers []scheduler.ServerConfig, dnsDryRun, dnsOnly bool, approved map[int]*scheduler.DNSPlan) *httpRun {
+	run := &httpRun{
+		ID:        runID,
+		Servers:   servers,
+		DNSDryRun: dnsDryRun,
+		DNSOnly:   dnsOnly,
+		Status:    runStatusRunning,
+		StartTime: time.Now(),
+		done:      make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	h.runs[runID] = run
+	h.mu.Unlock()
+
+	cmd := &protocol.StartRunCommand{
+		Type_:       string(protocol.StartRun),
+		RunID:       runID,
+		Concurrency: h.appConfig.ConcurrencyDefault,
+		DNSDryRun:   dnsDryRun,
+		DNSOnly:     dnsOnly,
+	}
+
+	started := make(chan struct{})
+	go func() {
+		defer close(run.done)
+
+		logger := NewTaskLogger(h.masker, h.encoder)
+		logger.Log(runID, 0, protocol.Info, fmt.Sprintf("Starting run: %s", runID))
+		executeRun(runID, servers, cmd, h.appConfig, logger, h.encoder, h.masker, approved, func(sched *scheduler.Scheduler) {
+			h.mu.Lock()
+			run.sched = sched
+			h.mu.Unlock()
+			close(started)
+		})
+
+		h.mu.Lock()
+		if run.Status == runStatusRunning {
+			run.Status = runStatusCompleted
+		}
+		h.mu.Unlock()
+	}()
+	<-started
+
+	return run
+}
+
+// cancelAll cancels every run that is still executing
+func (h *httpServer) cancelAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, run := range h.runs {
+		if run.Status == runStatusRunning && run.sched != nil {
+			run.sched.CancelRun()
+		}
+	}
+}
+
+func (h *httpServer) getRun(runID string) (*httpRun, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	run, ok := h.runs[runID]
+	return run, ok
+}
+
+func (h *httpServer) describeRun(run *httpRun) runResponse {
+	h.mu.Lock()
+	status := run.Status
+	h.mu.Unlock()
+
+	_, success, failed, cancelled, _, _ := run.sched.GetProgress()
+	return runResponse{
+		RunId:     run.ID,
+		Status:    status,
+		Total:     len(run.Servers),
+		Success:   success,
+		Failed:    failed,
+		Cancelled: cancelled,
+		DNSDryRun: run.DNSDryRun,
+	}
+}
+
+func (h *httpServer) decodeConfirmRequest(w http.ResponseWriter, r *http.Request) (*confirmRequest, *httpRun, bool) {
+	var req confirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return nil, nil, false
+	}
+
+	run, ok := h.getRun(req.RunID)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("run not found: %s", req.RunID))
+		return nil, nil, false
+	}
+
+	return &req, run, true
+}
+
+// checkConfirmToken verifies a confirm token against the run's persisted
+// DNS plans and returns those plans
+func (h *httpServer) checkConfirmToken(run *httpRun, token string) ([]*scheduler.DNSPlan, error) {
+	h.mu.Lock()
+	executed, applyRun := run.executed, run.applyRun
+	h.mu.Unlock()
+
+	if executed {
+		return nil, fmt.Errorf("run %s has already been executed", run.ID)
+	}
+	if applyRun != "" {
+		return nil, fmt.Errorf("run %s is being executed by DNS apply run %s", run.ID, applyRun)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("confirm token is required")
+	}
+
+	plans, err := scheduler.LoadDNSPlans(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("run %s has no DNS plan", run.ID)
+	}
+
+	if err := h.signer.Verify(token, run.ID, scheduler.PlanDigest(plans)); err != nil {
+		return nil, err
+	}
+
+	return plans, nil
+}
+
+// serversFromRequest builds the server list for a new run, either from a CSV
+// file in configDir or from the single-domain parameters sent by the desktop
+// wizard. Runs built from parameters carry no SSH credentials and therefore
+// only touch DNS.
+func serversFromRequest(req *createRunRequest, configDir string) ([]scheduler.ServerConfig, bool, error) {
+	if req.ConfigFile != "" {
+		path, err := configFilePath(configDir, req.ConfigFile)
+		if err != nil {
+			return nil, false, err
+		}
+		servers, err := loadServerConfigs(path)
+		return servers, paramBool(req.Params, "dns_only"), err
+	}
+
+	domain := paramString(req.Params, "domain")
+	if domain == "" {
+		return nil, false, fmt.Errorf("either ConfigFile or Params.domain is required")
+	}
+
+	serverIP := paramString(req.Params, "vps_ip")
+	if serverIP == "" {
+		serverIP = paramString(req.Params, "server_ip")
+	}
+	if serverIP == "" {
+		return nil, false, fmt.Errorf("Params.vps_ip is required")
+	}
+
+	provider := paramString(req.Params, "dns_provider")
+	if provider == "" {
+		provider = paramString(req.Params, "profile")
+	}
+	provider = strings.ToLower(provider)
+	if !dns.IsRegistered(provider) {
+		return nil, false, fmt.Errorf("unknown DNS provider: %s", provider)
+	}
+
+	token := paramString(req.Params, "dns_api_token")
+	if token == "" {
+		token = paramString(req.Params, "cf_api_token")
+	}
+	if token == "" && (provider == "" || provider == "cloudflare") {
+		token = os.Getenv("CF_API_TOKEN")
+	}
+
+	zone := paramString(req.Params, "dns_zone")
+	if zone == "" {
+		zone = paramString(req.Params, "cf_zone")
+	}
+
+	options := make(map[string]string)
+	if raw, ok := req.Params["dns_options"].(map[string]any); ok {
+		for k, v := range raw {
+			options[strings.ToLower(k)] = fmt.Sprint(v)
+		}
+	}
+
+	host := paramString(req.Params, "host")
+	if host == "" {
+		host = "mail"
+	}
+
+	// dns_extras is a list or a comma separated string
+	var extras []string
+	switch v := req.Params["dns_extras"].(type) {
+	case string:
+		parsed, err := scheduler.ParseDNSExtras(v)
+		if err != nil {
+			return nil, false, err
+		}
+		extras = parsed
+	case []any:
+		names := make([]string, 0, len(v))
+		for _, name := range v {
+			names = append(names, fmt.Sprint(name))
+		}
+		parsed, err := scheduler.ParseDNSExtras(strings.Join(names, ","))
+		if err != nil {
+			return nil, false, err
+		}
+		extras = parsed
+	}
+
+	server := scheduler.ServerConfig{
+		RowID:       1,
+		DNSProvider: provider,
+		DNSToken:    token,
+		DNSZone:     zone,
+		DNSOptions:  options,
+		DNSExtras:   extras,
+		ServerIP:    serverIP,
+		ServerPort:  22,
+		Host:        host,
+		Domain:      domain,
+	}
+
+	return []scheduler.ServerConfig{server}, true, nil
+}
+
+// configFilePath resolves a ConfigFile named by a request inside dir. Absolute
+// names and names leaving dir, directly or through a symlink, are refused.
+func configFilePath(dir, name string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("ConfigFile is not accepted, set http.config_dir to allow it")
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("ConfigFile %s must be a relative path inside the config directory", name)
+	}
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid http.config_dir: %w", err)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("ConfigFile %s not found in the config directory", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid ConfigFile %s: %w", name, err)
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("ConfigFile %s must be a relative path inside the config directory", name)
+	}
+	return path, nil
+}
+
+func paramString(params map[string]any, key string) string {
+	if v, ok := params[key].(string); ok {
+		return strings.TrimSpace(v)
+	}
+	return ""
+}
+
+func paramBool(params map[string]any, key string) bool {
+	switch v := params[key].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true" || v == "1"
+	}
+	return false
+}
+
+// waitRun waits for a run to finish, up to timeout
+func waitRun(ctx context.Context, run *httpRun, timeout time.Duration) bool {
+	select {
+	case <-run.done:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-run.done:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
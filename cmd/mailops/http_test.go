@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mailops/internal/dkim"
+	"mailops/internal/dns"
+	"mailops/internal/protocol"
+	"mailops/internal/security"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	dns.Register("memory", func(cfg dns.Config) (dns.Provider, error) {
+		return memoryZone, nil
+	})
+}
+
+// memoryZone is the zone of the "memory" DNS provider, shared by every task
+var memoryZone = &memoryProvider{}
+
+// memoryProvider keeps the records of example.com in memory
+type memoryProvider struct {
+	mu      sync.Mutex
+	next    int
+	records []dns.Record
+}
+
+func (p *memoryProvider) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next = 0
+	p.records = nil
+}
+
+func (p *memoryProvider) Name() string { return "memory" }
+
+func (p *memoryProvider) FindZone(name string) (string, error) { return "example.com", nil }
+
+func (p *memoryProvider) FindRecord(recordType, name string) (*dns.Record, error) {
+	records, _ := p.ListRecords(recordType, name)
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return &records[0], nil
+}
+
+func (p *memoryProvider) ListRecords(recordType, name string) ([]dns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var records []dns.Record
+	for _, record := range p.records {
+		if record.Type == recordType && record.Name == name {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (p *memoryProvider) UpsertRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, existing := range p.records {
+		if (record.ID != "" && existing.ID == record.ID) || (record.ID == "" && existing.Type == record.Type && existing.Name == record.Name) {
+			record.ID = existing.ID
+			p.records[i] = record
+			return nil
+		}
+	}
+	p.next++
+	record.ID = strconv.Itoa(p.next)
+	p.records = append(p.records, record)
+	return nil
+}
+
+func (p *memoryProvider) CreateRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next++
+	record.ID = strconv.Itoa(p.next)
+	p.records = append(p.records, record)
+	return nil
+}
+
+func (p *memoryProvider) DeleteRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, existing := range p.records {
+		if existing.ID == record.ID {
+			p.records = append(p.records[:i], p.records[i+1:]...)
+			return nil
+		}
+	}
+	return dns.ErrNotFound
+}
+
+func (p *memoryProvider) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.records)
+}
+
+// testToken is the bearer token of test servers
+const testToken = "test-token"
+
+// newTestServer returns a control plane working in a temporary directory,
+// with the DKIM key of example.com archived so runs never need SSH
+func newTestServer(t *testing.T, appConfig *Config) *httptest.Server {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	memoryZone.reset()
+
+	key, err := dkim.GenerateKey("rsa", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := key.PrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join("output/dkim/example.com", dkim.DefaultSelector+".private")
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := security.NewConfirmSigner(nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &httpServer{
+		addr:      "127.0.0.1:0",
+		token:     testToken,
+		appConfig: appConfig,
+		masker:    security.NewMasker(),
+		encoder:   protocol.NewEncoder(io.Discard),
+		signer:    signer,
+		startTime: time.Now(),
+		runs:      make(map[string]*httpRun),
+	}
+	srv := httptest.NewServer(h.routes())
+	t.Cleanup(func() {
+		srv.Close()
+		h.cancelAll()
+		h.mu.Lock()
+		runs := h.runs
+		h.mu.Unlock()
+		for _, run := range runs {
+			<-run.done
+		}
+	})
+	return srv
+}
+
+// call sends an authorized JSON request and decodes the JSON response into out
+func call(t *testing.T, srv *httptest.Server, method, path string, body, out any) int {
+	t.Helper()
+	return callAs(t, testToken, srv, method, path, body, out)
+}
+
+// callAs sends a JSON request with a bearer token, none when empty, and
+// decodes the JSON response into out
+func callAs(t *testing.T, token string, srv *httptest.Server, method, path string, body, out any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// confirmedRun creates a DNS run for example.com, waits for its plan and
+// confirms it
+func confirmedRun(t *testing.T, srv *httptest.Server) (runID, token string) {
+	t.Helper()
+	var run runResponse
+	params := map[string]any{"domain": "example.com", "vps_ip": "192.0.2.10", "dns_provider": "memory"}
+	if status := call(t, srv, http.MethodPost, "/api/runs", createRunRequest{Params: params}, &run); status != http.StatusAccepted {
+		t.Fatalf("POST /api/runs = %d", status)
+	}
+	var preview dnsPreviewResponse
+	if status := call(t, srv, http.MethodGet, "/api/dns/preview?run_id="+run.RunId, nil, &preview); status != http.StatusOK {
+		t.Fatalf("GET /api/dns/preview = %d", status)
+	}
+	var confirm confirmResponse
+	if status := call(t, srv, http.MethodPost, "/api/dns/confirm", confirmRequest{RunID: run.RunId}, &confirm); status != http.StatusOK {
+		t.Fatalf("POST /api/dns/confirm = %d", status)
+	}
+	return run.RunId, confirm.ConfirmToken
+}
+
+// closedPort returns a local UDP address nothing answers on
+func closedPort(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestDNSExecute(t *testing.T) {
+	tests := []struct {
+		name     string
+		required bool // Verification failures fail the apply run
+		success  bool
+		status   string
+		records  bool // Records left in the zone
+	}{
+		{name: "verification warns", success: true, status: runStatusExecuted, records: true},
+		{name: "verification fails and rolls back", required: true, status: runStatusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, &Config{
+				ConcurrencyDefault: 1,
+				DNSVerify: DNSVerifyConfig{
+					Nameservers:    []string{closedPort(t)},
+					TimeoutMs:      200,
+					IntervalMs:     50,
+					QueryTimeoutMs: 50,
+					Required:       tt.required,
+				},
+			})
+			runID, token := confirmedRun(t, srv)
+
+			var resp executeResponse
+			if status := call(t, srv, http.MethodPost, "/api/dns/execute", confirmRequest{RunID: runID, ConfirmToken: token}, &resp); status != http.StatusOK {
+				t.Fatalf("POST /api/dns/execute = %d %+v", status, resp)
+			}
+			if resp.Success != tt.success || resp.Status != tt.status {
+				t.Errorf("execute = %+v, want success %v and status %s", resp, tt.success, tt.status)
+			}
+			if got := memoryZone.count() > 0; got != tt.records {
+				t.Errorf("zone holds records: %v, want %v", got, tt.records)
+			}
+
+			// The apply run reports the same outcome, and only a successful
+			// one executes the confirmed run
+			var runs []runResponse
+			call(t, srv, http.MethodGet, "/api/runs", nil, &runs)
+			if len(runs) != 2 || runs[0].RunId != runID {
+				t.Fatalf("runs = %+v, want the confirmed run and its apply run", runs)
+			}
+			run, applyRun := runs[0], runs[1]
+			if applyRun.Status != tt.status {
+				t.Errorf("apply run status = %s, want %s", applyRun.Status, tt.status)
+			}
+			if executed := run.Status == runStatusExecuted; executed != tt.success {
+				t.Errorf("run status = %s after execute success %v", run.Status, tt.success)
+			}
+
+			var retry executeResponse
+			status := call(t, srv, http.MethodPost, "/api/dns/execute", confirmRequest{RunID: runID, ConfirmToken: token}, &retry)
+			if tt.success && status != http.StatusForbidden {
+				t.Errorf("second execute = %d %+v, want it refused", status, retry)
+			}
+			if !tt.success && status != http.StatusOK {
+				t.Errorf("retry after a failed execute = %d %+v", status, retry)
+			}
+		})
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	srv := newTestServer(t, &Config{ConcurrencyDefault: 1})
+	paths := []string{"/api/status", "/api/runs", "/api/dns/preview?run_id=x", "/api/dns/confirm", "/api/dns/validate", "/api/dns/execute"}
+
+	for _, path := range paths {
+		for _, token := range []string{"", "wrong-token", testToken + "x"} {
+			var resp map[string]any
+			if status := callAs(t, token, srv, http.MethodGet, path, nil, &resp); status != http.StatusUnauthorized {
+				t.Errorf("GET %s with token %q = %d, want %d", path, token, status, http.StatusUnauthorized)
+			}
+			if _, ok := resp["Error"].(string); !ok || len(resp) != 1 {
+				t.Errorf("GET %s unauthorized body = %v", path, resp)
+			}
+		}
+	}
+
+	// Only the bearer scheme is accepted
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/status", nil)
+	req.SetBasicAuth("mailops", testToken)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("basic auth = %d, WWW-Authenticate %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+
+	if status := call(t, srv, http.MethodGet, "/api/status", nil, nil); status != http.StatusOK {
+		t.Errorf("GET /api/status with the token = %d", status)
+	}
+
+	// A server without a token accepts nothing
+	open := httptest.NewServer((&httpServer{}).authorize(http.NotFoundHandler()))
+	defer open.Close()
+	if status := callAs(t, "", open, http.MethodGet, "/", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("server without a token = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		addr        string
+		allowRemote bool
+		want        string // Empty when refused
+	}{
+		{"127.0.0.1:8080", false, "127.0.0.1:8080"},
+		{"[::1]:8080", false, "[::1]:8080"},
+		{"localhost:8080", false, "localhost:8080"},
+		{":8080", false, "127.0.0.1:8080"},
+		{"0.0.0.0:8080", false, ""},
+		{"192.0.2.1:8080", false, ""},
+		{"mailops.example.com:8080", false, ""},
+		{"0.0.0.0:8080", true, "0.0.0.0:8080"},
+		{":8080", true, ":8080"},
+		{"8080", false, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := listenAddr(tt.addr, tt.allowRemote)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("listenAddr(%q, %v) = %q, %v, want %q", tt.addr, tt.allowRemote, got, err, tt.want)
+		}
+	}
+}
+
+func TestConfigFilePath(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "configs")
+	for _, path := range []string{filepath.Join(dir, "team"), filepath.Join(base, "private")} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"configs/servers.csv", "configs/team/servers.csv", "private/servers.csv"} {
+		if err := os.WriteFile(filepath.Join(base, path), []byte("domain\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(base, "private"), filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("team/servers.csv", filepath.Join(dir, "linked.csv")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir, name string
+		want      string // Path below dir, empty when refused
+		err       string
+	}{
+		{dir, "servers.csv", "servers.csv", ""},
+		{dir, "team/servers.csv", "team/servers.csv", ""},
+		{dir, "team/../servers.csv", "servers.csv", ""},
+		{dir, "linked.csv", "team/servers.csv", ""},
+		{dir, "../private/servers.csv", "", "relative path inside the config directory"},
+		{dir, filepath.Join(base, "private/servers.csv"), "", "relative path inside the config directory"},
+		{dir, "escape/servers.csv", "", "relative path inside the config directory"},
+		{dir, "missing.csv", "", "not found"},
+		{"", "servers.csv", "", "set http.config_dir"},
+	}
+
+	for _, tt := range tests {
+		got, err := configFilePath(tt.dir, tt.name)
+		if tt.want != "" {
+			if want, _ := filepath.EvalSymlinks(filepath.Join(dir, tt.want)); err != nil || got != want {
+				t.Errorf("configFilePath(%q) = %q, %v, want %q", tt.name, got, err, want)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("configFilePath(%q) = %q, %v, want error %q", tt.name, got, err, tt.err)
+		}
+	}
+}
+
+func TestCreateRunConfigFile(t *testing.T) {
+	tests := []struct {
+		configDir  string
+		configFile string
+		want       string
+	}{
+		{"", "servers.csv", "set http.config_dir"},
+		{".", "/etc/passwd", "relative path inside the config directory"},
+		{".", "../servers.csv", "relative path inside the config directory"},
+	}
+
+	for _, tt := range tests {
+		srv := newTestServer(t, &Config{ConcurrencyDefault: 1, HTTP: HTTPConfig{ConfigDir: tt.configDir}})
+		var resp errorResponse
+		status := call(t, srv, http.MethodPost, "/api/runs", createRunRequest{ConfigFile: tt.configFile}, &resp)
+		if status != http.StatusBadRequest || !strings.Contains(resp.Error, tt.want) {
+			t.Errorf("ConfigFile %q in %q = %d %q, want %q", tt.configFile, tt.configDir, status, resp.Error, tt.want)
+		}
+	}
+}
+
+// checkKeys fails unless obj holds every required key, and otherwise only
+// optional ones
+func checkKeys(t *testing.T, what string, obj map[string]any, required []string, optional ...string) {
+	t.Helper()
+	allowed := make(map[string]bool)
+	for _, key := range optional {
+		allowed[key] = true
+	}
+	for _, key := range required {
+		if _, ok := obj[key]; !ok {
+			t.Errorf("%s lacks %s: %v", what, key, obj)
+		}
+		allowed[key] = true
+	}
+	for key := range obj {
+		if !allowed[key] {
+			t.Errorf("%s has unexpected field %s: %v", what, key, obj)
+		}
+	}
+}
+
+// The desktop client deserializes responses with case-sensitive property
+// names, so every field must keep its PascalCase name and JSON type
+func TestResponseShapes(t *testing.T) {
+	srv := newTestServer(t, &Config{
+		ConcurrencyDefault: 1,
+		DNSVerify:          DNSVerifyConfig{Nameservers: []string{closedPort(t)}, TimeoutMs: 200, IntervalMs: 50, QueryTimeoutMs: 50},
+	})
+
+	var status map[string]any
+	call(t, srv, http.MethodGet, "/api/status", nil, &status)
+	checkKeys(t, "status", status, []string{"Status", "StartTime", "ActiveRuns", "HttpAddr"})
+	if status["Status"] != "running" {
+		t.Errorf("status Status = %v, want running", status["Status"])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, status["StartTime"].(string)); err != nil {
+		t.Errorf("status StartTime: %v", err)
+	}
+	if _, ok := status["ActiveRuns"].(float64); !ok {
+		t.Errorf("status ActiveRuns = %#v, want a number", status["ActiveRuns"])
+	}
+
+	var created map[string]any
+	params := map[string]any{"domain": "example.com", "vps_ip": "192.0.2.10", "dns_provider": "memory"}
+	if code := call(t, srv, http.MethodPost, "/api/runs", createRunRequest{Params: params}, &created); code != http.StatusAccepted {
+		t.Fatalf("POST /api/runs = %d", code)
+	}
+	checkKeys(t, "created run", created, []string{"RunId", "Status", "Total", "DnsDryRun"})
+	runID, _ := created["RunId"].(string)
+	if runID == "" || created["Status"] != runStatusRunning || created["DnsDryRun"] != true {
+		t.Errorf("created run = %v", created)
+	}
+
+	var preview map[string]any
+	call(t, srv, http.MethodGet, "/api/dns/preview?run_id="+runID, nil, &preview)
+	checkKeys(t, "preview", preview, []string{"Domain", "Records"})
+	records, _ := preview["Records"].([]any)
+	if preview["Domain"] != "example.com" || len(records) == 0 {
+		t.Fatalf("preview = %v", preview)
+	}
+	for _, raw := range records {
+		record := raw.(map[string]any)
+		checkKeys(t, "preview record", record, []string{"Type", "Name", "Value", "Priority", "Action"}, "Note")
+		if _, ok := record["Priority"].(float64); !ok {
+			t.Errorf("preview record Priority = %#v, want a number", record["Priority"])
+		}
+	}
+
+	var run map[string]any
+	call(t, srv, http.MethodGet, "/api/runs?run_id="+runID, nil, &run)
+	checkKeys(t, "run", run, []string{"RunId", "Status", "Total", "Success", "DnsDryRun"}, "Failed", "Cancelled")
+	var runs []map[string]any
+	call(t, srv, http.MethodGet, "/api/runs", nil, &runs)
+	if len(runs) != 1 {
+		t.Fatalf("runs = %v", runs)
+	}
+	checkKeys(t, "listed run", runs[0], []string{"RunId", "Status", "Total", "Success", "DnsDryRun"}, "Failed", "Cancelled")
+
+	var confirm map[string]any
+	call(t, srv, http.MethodPost, "/api/dns/confirm", confirmRequest{RunID: runID}, &confirm)
+	checkKeys(t, "confirm", confirm, []string{"ConfirmToken", "Status", "ExpiresAt"})
+	token, _ := confirm["ConfirmToken"].(string)
+	if token == "" || confirm["Status"] != "CONFIRMED" {
+		t.Errorf("confirm = %v", confirm)
+	}
+
+	for _, tt := range []struct {
+		token string
+		valid bool
+	}{{token, true}, {"1.forged", false}} {
+		var validate map[string]any
+		call(t, srv, http.MethodPost, "/api/dns/validate", confirmRequest{RunID: runID, ConfirmToken: tt.token}, &validate)
+		checkKeys(t, "validate", validate, []string{"Valid", "Status", "Message"})
+		if validate["Valid"] != tt.valid {
+			t.Errorf("validate %q = %v, want Valid %v", tt.token, validate, tt.valid)
+		}
+	}
+
+	var execute map[string]any
+	call(t, srv, http.MethodPost, "/api/dns/execute", confirmRequest{RunID: runID, ConfirmToken: token}, &execute)
+	checkKeys(t, "execute", execute, []string{"Success", "Status", "Message"})
+	if execute["Success"] != true || execute["Status"] != runStatusExecuted {
+		t.Errorf("execute = %v", execute)
+	}
+
+	var notFound map[string]any
+	if code := call(t, srv, http.MethodGet, "/api/runs?run_id=missing", nil, &notFound); code != http.StatusNotFound {
+		t.Errorf("GET unknown run = %d", code)
+	}
+	checkKeys(t, "error", notFound, []string{"Error"})
+}
@@ -6,28 +6,183 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"mailops/internal/acme"
+	"mailops/internal/deploy/profiles"
+	"mailops/internal/dns"
+	"mailops/internal/dns/verify"
 	"mailops/internal/protocol"
 	"mailops/internal/scheduler"
 	"mailops/internal/security"
+	"mailops/internal/ssh"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 // Config represents application configuration
 type Config struct {
-	ConcurrencyDefault int               `json:"concurrency_default"`
-	RetryMax           int               `json:"retry_max"`
-	RetryBackoffMs     int               `json:"retry_backoff_ms"`
-	SSHTimeoutMs       int               `json:"ssh_timeout_ms"`
-	CmdTimeoutMs       int               `json:"cmd_timeout_ms"`
-	DNSDryRunDefault   bool              `json:"dns_dry_run_default"`
-	LogMasking         bool              `json:"log_masking"`
-	DKIMSelector       string            `json:"dkim_selector"`
-	SPFTemplate        string            `json:"spf_template"`
-	DMARCTemplate      string            `json:"dmarc_template"`
+	ConcurrencyDefault int                `json:"concurrency_default"`
+	RetryMax           int                `json:"retry_max"`
+	RetryBackoffMs     int                `json:"retry_backoff_ms"`
+	SSHTimeoutMs       int                `json:"ssh_timeout_ms"`
+	CmdTimeoutMs       int                `json:"cmd_timeout_ms"`
+	DNSDryRunDefault   bool               `json:"dns_dry_run_default"`
+	LogMasking         bool               `json:"log_masking"`
+	DKIMSelector       string             `json:"dkim_selector"`
+	DKIMKeyType        string             `json:"dkim_key_type"` // "rsa" (default) or "ed25519"
+	DKIMKeyBits        int                `json:"dkim_key_bits"` // RSA key size, defaults to 2048
+	SPFTemplate        string             `json:"spf_template"`
+	DMARCTemplate      string             `json:"dmarc_template"`
+	DNSConfirmTTLMs    int                `json:"dns_confirm_ttl_ms"`
+	Cloudflare         CloudflareConfig   `json:"cloudflare"`
+	DNSVerify          DNSVerifyConfig    `json:"dns_verify"`
+	DNSRollback        DNSRollbackConfig  `json:"dns_rollback"`
+	MTASTS             MTASTSConfig       `json:"mta_sts"`
+	DNSExtras          DNSExtrasConfig    `json:"dns_extras"`
+	DKIMRotation       DKIMRotationConfig `json:"dkim_rotation"`
+	ACME               ACMEConfig         `json:"acme"`
+	SSHHostKeys        SSHHostKeysConfig  `json:"ssh_host_keys"`
+	HTTP               HTTPConfig         `json:"http"`
+}
+
+// HTTPConfig restricts the HTTP control plane. Clients authenticate with the
+// bearer token from MAILOPS_HTTP_TOKEN.
+type HTTPConfig struct {
+	AllowRemote bool   `json:"allow_remote"` // Listen on addresses other than loopback
+	ConfigDir   string `json:"config_dir"`   // Directory holding the CSV files runs may name, none when empty
+}
+
+// SSHHostKeysConfig selects the SSH host keys trusted when connecting to the
+// servers. A row's server_host_key overrides it.
+type SSHHostKeysConfig struct {
+	Policy     string   `json:"policy"`      // "tofu" (default), "strict" or "insecure"
+	KnownHosts []string `json:"known_hosts"` // OpenSSH known_hosts files, defaults to ~/.ssh/known_hosts
+	Store      string   `json:"store"`       // Where tofu records new keys, defaults to output/known_hosts
+}
+
+// policy converts the settings to a host key policy
+func (c SSHHostKeysConfig) policy() *ssh.HostKeyPolicy {
+	policy := ssh.DefaultHostKeyPolicy()
+	if c.Policy != "" {
+		policy.Mode = c.Policy
+	}
+	if c.KnownHosts != nil {
+		home, _ := os.UserHomeDir()
+		policy.KnownHosts = nil
+		for _, path := range c.KnownHosts {
+			if rest, ok := strings.CutPrefix(path, "~/"); ok && home != "" {
+				path = filepath.Join(home, rest)
+			}
+			policy.KnownHosts = append(policy.KnownHosts, path)
+		}
+	}
+	if c.Store != "" {
+		policy.Store = c.Store
+	}
+	return policy
+}
+
+// ACMEConfig selects how the TLS certificate of each mail host is obtained
+// from an ACME CA
+type ACMEConfig struct {
+	Enabled         bool   `json:"enabled"`
+	DirectoryURL    string `json:"directory_url"`     // Defaults to Let's Encrypt
+	Email           string `json:"email"`             // Account contact
+	Challenge       string `json:"challenge"`         // "http-01" (default) or "dns-01"
+	CAFile          string `json:"ca_file"`           // Roots trusted for the CA's API, e.g. Pebble's
+	RenewBeforeDays int    `json:"renew_before_days"` // Defaults to 30
+}
+
+// options converts the settings to ACME options
+func (c ACMEConfig) options() acme.Options {
+	return acme.Options{
+		DirectoryURL: c.DirectoryURL,
+		Email:        c.Email,
+		Challenge:    c.Challenge,
+		CAFile:       c.CAFile,
+		RenewBefore:  time.Duration(c.RenewBeforeDays) * 24 * time.Hour,
+	}
+}
+
+// DKIMRotationConfig holds the waits between the phases of a DKIM selector
+// rotation run by the dkim-rotate command
+type DKIMRotationConfig struct {
+	PublishWaitHours int `json:"publish_wait_hours"` // Defaults to 48
+	RetireWaitHours  int `json:"retire_wait_hours"`  // Defaults to 168
+	IntervalDays     int `json:"interval_days"`      // 0 rotates only with --start
+}
+
+// DNSExtrasConfig selects the optional record sets (caa, bimi, autoconfig)
+// and holds their templates. A row's dns_extras column overrides both lists.
+type DNSExtrasConfig struct {
+	Default      []string            `json:"default"`
+	Profiles     map[string][]string `json:"profiles"` // By deploy profile, overriding the default
+	CAATemplate  string              `json:"caa_template"`
+	BIMITemplate string              `json:"bimi_template"`
+}
+
+// MTASTSConfig holds the MTA-STS policy and TLS reporting settings
+type MTASTSConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Mode      string `json:"mode"`       // "enforce", "testing" or "none"
+	MaxAge    int    `json:"max_age"`    // Seconds
+	TLSRPTRua string `json:"tlsrpt_rua"` // Defaults to mailto:tlsrpt@{domain}
+}
+
+// DNSRollbackConfig selects when applied DNS changes are undone
+type DNSRollbackConfig struct {
+	OnFailure *bool `json:"on_failure"` // Defaults to true
+	OnCancel  bool  `json:"on_cancel"`
+}
+
+// rollbackOnFailure reports whether a failed task rolls back its DNS changes
+func (c DNSRollbackConfig) rollbackOnFailure() bool {
+	return c.OnFailure == nil || *c.OnFailure
+}
+
+// DNSVerifyConfig holds settings of the dns_verify step
+type DNSVerifyConfig struct {
+	TimeoutMs      int      `json:"timeout_ms"`
+	IntervalMs     int      `json:"interval_ms"`
+	QueryTimeoutMs int      `json:"query_timeout_ms"`
+	Nameservers    []string `json:"nameservers"` // Override the zone's NS records, e.g. with a local stub
+	Resolvers      []string `json:"resolvers"`
+	Required       bool     `json:"required"`
+}
+
+// options converts the settings to verifier options
+func (c DNSVerifyConfig) options() verify.Options {
+	return verify.Options{
+		Nameservers:  c.Nameservers,
+		Resolvers:    c.Resolvers,
+		Timeout:      time.Duration(c.TimeoutMs) * time.Millisecond,
+		Interval:     time.Duration(c.IntervalMs) * time.Millisecond,
+		QueryTimeout: time.Duration(c.QueryTimeoutMs) * time.Millisecond,
+	}
+}
+
+// CloudflareConfig holds Cloudflare API client settings
+type CloudflareConfig struct {
+	APITimeoutMs int     `json:"api_timeout_ms"`
+	RateLimitRPS float64 `json:"rate_limit_rps"`
+}
+
+// dnsProviderDefaults returns the default options of each DNS provider
+func (c *Config) dnsProviderDefaults() map[string]map[string]string {
+	cloudflare := make(map[string]string)
+	if c.Cloudflare.APITimeoutMs > 0 {
+		cloudflare["api_timeout_ms"] = strconv.Itoa(c.Cloudflare.APITimeoutMs)
+	}
+	if c.Cloudflare.RateLimitRPS > 0 {
+		cloudflare["rate_limit_rps"] = strconv.FormatFloat(c.Cloudflare.RateLimitRPS, 'f', -1, 64)
+	}
+	
+	return map[string]map[string]string{
+		"cloudflare": cloudflare,
+	}
 }
 
 var (
@@ -37,6 +192,7 @@ var (
 	concurrencyFlag = flag.Int("concurrency", 10, "Number of concurrent tasks")
 	dnsDryRunFlag   = flag.Bool("dns-dry-run", false, "DNS dry-run mode")
 	appConfigFlag   = flag.String("app-config", "examples/app.config.json", "Path to app config file")
+	httpAddrFlag    = flag.String("http-addr", "", "Serve the HTTP control plane on this address (e.g. 127.0.0.1:8080)")
 )
 
 // Global scheduler instance for cancellation
@@ -47,6 +203,22 @@ var (
 )
 
 func main() {
+	// Subcommands take their own flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rollback":
+			os.Exit(runRollbackCommand(os.Args[2:]))
+		case "dkim-rotate":
+			os.Exit(runDKIMRotateCommand(os.Args[2:]))
+		case "dmarc-report":
+			os.Exit(runDMARCReportCommand(os.Args[2:]))
+		case "cert-renew":
+			os.Exit(runCertRenewCommand(os.Args[2:]))
+		case "users":
+			os.Exit(runUsersCommand(os.Args[2:]))
+		}
+	}
+	
 	flag.Parse()
 	
 	// Load app config
@@ -56,8 +228,15 @@ func main() {
 		os.Exit(1)
 	}
 	
+	httpAddr := *httpAddrFlag
+	if httpAddr == "" {
+		httpAddr = os.Getenv("MAILOPS_HTTP_ADDR")
+	}
+	
 	// Determine mode
-	if *eventStreamFlag {
+	if httpAddr != "" && !*eventStreamFlag && !*runOnceFlag {
+		runHTTPMode(appConfig, httpAddr)
+	} else if *eventStreamFlag {
 		runEventStreamMode(appConfig)
 	} else if *runOnceFlag {
 		runOnceMode(appConfig)
@@ -77,6 +256,12 @@ func loadAppConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
 	
+	switch config.SSHHostKeys.Policy {
+	case "", ssh.HostKeyTOFU, ssh.HostKeyStrict, ssh.HostKeyInsecure:
+	default:
+		return nil, fmt.Errorf("unknown ssh_host_keys.policy %q (available: %s, %s, %s)", config.SSHHostKeys.Policy, ssh.HostKeyTOFU, ssh.HostKeyStrict, ssh.HostKeyInsecure)
+	}
+	
 	return &config, nil
 }
 
@@ -97,6 +282,14 @@ func loadServerConfigs(path string) ([]scheduler.ServerConfig, error) {
 		return nil, fmt.Errorf("CSV file must have at least a header and one data row")
 	}
 	
+	header := make(map[string]int, len(records[0]))
+	for i, name := range records[0] {
+		header[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := header["row_id"]; !ok {
+		return nil, fmt.Errorf("CSV header must contain a row_id column")
+	}
+	
 	configs := make([]scheduler.ServerConfig, 0)
 	
 	for i, record := range records[1:] {
@@ -104,20 +297,59 @@ func loadServerConfigs(path string) ([]scheduler.ServerConfig, error) {
 			return nil, fmt.Errorf("row %d has incorrect number of columns", i+2)
 		}
 		
+		// column returns the first of the given columns present in the header
+		column := func(names ...string) string {
+			for _, name := range names {
+				if idx, ok := header[name]; ok && strings.TrimSpace(record[idx]) != "" {
+					return strings.TrimSpace(record[idx])
+				}
+			}
+			return ""
+		}
+		
+		dnsProvider := strings.ToLower(column("dns_provider"))
+		if !dns.IsRegistered(dnsProvider) {
+			return nil, fmt.Errorf("row %d: unknown dns_provider %q (available: %s)", i+2, dnsProvider, strings.Join(dns.Registered(), ", "))
+		}
+		
+		// An empty profile is only accepted for DNS-only runs, checked by validate_input
+		deployProfile := strings.ToLower(column("deploy_profile"))
+		if deployProfile != "" && !profiles.IsRegistered(deployProfile) {
+			return nil, fmt.Errorf("row %d: unknown deploy_profile %q (available: %s)", i+2, deployProfile, strings.Join(profiles.Registered(), ", "))
+		}
+		
+		dnsOptions, err := dns.ParseOptions(column("dns_options"))
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+2, err)
+		}
+		
+		// An empty column keeps the profile or default extras
+		var dnsExtras []string
+		if extras := column("dns_extras"); extras != "" {
+			dnsExtras, err = scheduler.ParseDNSExtras(extras)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %w", i+2, err)
+			}
+		}
+		
 		config := scheduler.ServerConfig{
-			RowID:          parseInt(record[0], 0),
-			CFAPIToken:     record[1],
-			CFZone:         record[2],
-			ServerIP:       record[3],
-			ServerPort:     parseInt(record[4], 22),
-			ServerUser:     record[5],
-			ServerPassword: record[6],
-			ServerKeyPath:  record[7],
-			Host:           record[8],
-			Domain:         record[9],
-			DeployProfile:  record[10],
-			EmailUse:       record[11],
-			Solution:       record[12],
+			RowID:          parseInt(column("row_id"), 0),
+			DNSProvider:    dnsProvider,
+			DNSToken:       column("dns_api_token", "cf_api_token"),
+			DNSZone:        column("dns_zone", "cf_zone"),
+			DNSOptions:     dnsOptions,
+			DNSExtras:      dnsExtras,
+			ServerIP:       column("server_ip"),
+			ServerPort:     parseInt(column("server_port"), 22),
+			ServerUser:     column("server_user"),
+			ServerPassword: column("server_password"),
+			ServerKeyPath:  column("server_key_path"),
+			ServerHostKey:  column("server_host_key"),
+			Host:           column("host"),
+			Domain:         column("domain"),
+			DeployProfile:  deployProfile,
+			EmailUse:       column("email_use"),
+			Solution:       column("solution"),
 		}
 		
 		configs = append(configs, config)
@@ -279,6 +511,23 @@ func handleStartRun(cmd *protocol.StartRunCommand, appConfig *Config, logger *Ta
 		return
 	}
 	
+	executeRun(runID, servers, cmd, appConfig, logger, encoder, masker, nil, func(sched *scheduler.Scheduler) {
+		currentRunMutex.Lock()
+		currentScheduler = sched
+		currentRunMutex.Unlock()
+	})
+	
+	currentRunMutex.Lock()
+	currentScheduler = nil
+	currentRunID = ""
+	currentRunMutex.Unlock()
+}
+
+// executeRun runs the scheduler over the given servers and blocks until every
+// task has finished. approvedPlans, when non-nil, are confirmed DNS plans to
+// apply as-is. started is invoked once the scheduler exists so callers can
+// register it for cancellation.
+func executeRun(runID string, servers []scheduler.ServerConfig, cmd *protocol.StartRunCommand, appConfig *Config, logger *TaskLogger, encoder *protocol.Encoder, masker *security.Masker, approvedPlans map[int]*scheduler.DNSPlan, started func(*scheduler.Scheduler)) {
 	logger.Log(runID, 0, protocol.Info, fmt.Sprintf("Loaded %d server configurations", len(servers)))
 	
 	createOutputDirectories(runID)
@@ -296,12 +545,37 @@ func handleStartRun(cmd *protocol.StartRunCommand, appConfig *Config, logger *Ta
 		SSHTimeoutMs:   appConfig.SSHTimeoutMs,
 		CmdTimeoutMs:   appConfig.CmdTimeoutMs,
 		DKIMSelector:   appConfig.DKIMSelector,
+		DKIMKeyType:    appConfig.DKIMKeyType,
+		DKIMKeyBits:    appConfig.DKIMKeyBits,
 		SPFTemplate:    appConfig.SPFTemplate,
 		DMARCTemplate:  appConfig.DMARCTemplate,
+		DNSOnly:        cmd.DNSOnly,
+		ApprovedDNSPlans: approvedPlans,
+		DNSProviderDefaults: appConfig.dnsProviderDefaults(),
+		DNSVerify:         appConfig.DNSVerify.options(),
+		DNSVerifyRequired: appConfig.DNSVerify.Required,
+		DNSRollbackOnFailure: appConfig.DNSRollback.rollbackOnFailure(),
+		DNSRollbackOnCancel:  appConfig.DNSRollback.OnCancel,
+		MTASTS:       appConfig.MTASTS.Enabled,
+		MTASTSMode:   appConfig.MTASTS.Mode,
+		MTASTSMaxAge: appConfig.MTASTS.MaxAge,
+		TLSRPTRua:    appConfig.MTASTS.TLSRPTRua,
+		DNSExtras:          appConfig.DNSExtras.Default,
+		DNSExtrasByProfile: appConfig.DNSExtras.Profiles,
+		CAATemplate:        appConfig.DNSExtras.CAATemplate,
+		BIMITemplate:       appConfig.DNSExtras.BIMITemplate,
+		ACME:        appConfig.ACME.Enabled,
+		ACMEOptions: appConfig.ACME.options(),
+		SSHHostKeys: appConfig.SSHHostKeys.policy(),
+	}
+	
+	concurrency := cmd.Concurrency
+	if concurrency <= 0 {
+		concurrency = appConfig.ConcurrencyDefault
 	}
 	
 	sched := scheduler.NewScheduler(
-		cmd.Concurrency,
+		concurrency,
 		appConfig.RetryMax,
 		time.Duration(appConfig.RetryBackoffMs)*time.Millisecond,
 		encoder,
@@ -312,9 +586,9 @@ func handleStartRun(cmd *protocol.StartRunCommand, appConfig *Config, logger *Ta
 		masker,
 	)
 	
-	currentRunMutex.Lock()
-	currentScheduler = sched
-	currentRunMutex.Unlock()
+	if started != nil {
+		started(sched)
+	}
 	
 	for _, server := range servers {
 		task := &scheduler.Task{
@@ -330,6 +604,7 @@ func handleStartRun(cmd *protocol.StartRunCommand, appConfig *Config, logger *Ta
 		encoder.Encode(protocol.ErrorEvt, runID, "", errorEvent)
 		return
 	}
+	defer sched.Stop()
 	
 	progressTicker := time.NewTicker(500 * time.Millisecond)
 	defer progressTicker.Stop()
@@ -367,11 +642,6 @@ func handleStartRun(cmd *protocol.StartRunCommand, appConfig *Config, logger *Ta
 	encoder.Encode(protocol.RunFinished, runID, "", finishedEvent)
 	
 	logger.Log(runID, 0, protocol.Info, fmt.Sprintf("Run completed: %d success, %d failed, %d cancelled in %dms", success, failed, cancelled, duration))
-	
-	currentRunMutex.Lock()
-	currentScheduler = nil
-	currentRunID = ""
-	currentRunMutex.Unlock()
 }
 
 func runOnceMode(appConfig *Config) {
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mailops/internal/protocol"
+	"mailops/internal/scheduler"
+	"mailops/internal/security"
+	"os"
+)
+
+// consoleLogger writes task logs to stderr for interactive subcommands
+type consoleLogger struct {
+	masker *security.Masker
+}
+
+func (l *consoleLogger) Log(runID string, rowID int, level protocol.LogLevel, msg string) {
+	fmt.Fprintf(os.Stderr, "[%s] [%s:%d] %s\n", level, runID, rowID, l.masker.MaskInString(msg))
+}
+
+// runRollbackCommand undoes the DNS changes of a past run, using the
+// snapshots persisted in its report directory. The rows' credentials come
+// from the same CSV the run used.
+func runRollbackCommand(args []string) int {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	runID := fs.String("run-id", "", "Run whose DNS changes are rolled back")
+	configPath := fs.String("config", "", "Path to the CSV config file of the run")
+	appConfigPath := fs.String("app-config", "examples/app.config.json", "Path to app config file")
+	row := fs.Int("row", 0, "Only roll back this row ID")
+	fs.Parse(args)
+
+	if *runID == "" || *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Usage: mailops rollback --run-id <run_id> --config <servers.csv> [--row <row_id>]")
+		return 2
+	}
+
+	appConfig, err := loadAppConfig(*appConfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load app config: %v\n", err)
+		return 1
+	}
+
+	servers, err := loadServerConfigs(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load servers: %v\n", err)
+		return 1
+	}
+	if servers, err = selectRow(servers, *row); err != nil {
+		fmt.Fprintf(os.Stderr, "%v in %s\n", err, *configPath)
+		return 1
+	}
+
+	masker := security.NewMasker()
+	schedConfig := &scheduler.Config{
+		DNSProviderDefaults: appConfig.dnsProviderDefaults(),
+	}
+	sched := scheduler.NewScheduler(1, 0, 0, nil, &consoleLogger{masker: masker}, schedConfig, false, *runID, masker)
+
+	if err := sched.RollbackRun(servers); err != nil {
+		fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Rollback of run %s completed\n", *runID)
+	return 0
+}
+
+// selectRow returns the server of a row ID, or every server when row is 0
+func selectRow(servers []scheduler.ServerConfig, row int) ([]scheduler.ServerConfig, error) {
+	if row <= 0 {
+		return servers, nil
+	}
+	for _, server := range servers {
+		if server.RowID == row {
+			return []scheduler.ServerConfig{server}, nil
+		}
+	}
+	return nil, fmt.Errorf("row %d not found", row)
+}
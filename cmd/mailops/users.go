@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mailops/internal/protocol"
+	"mailops/internal/scheduler"
+	"mailops/internal/security"
+	"mailops/internal/users"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// runUsersCommand adds, removes and lists the mailboxes and aliases of
+// deployed servers. Commands are read from a CSV or NDJSON file and run on
+// the servers of their domain; each server's results are printed and
+// written to output/reports/<run_id>/<row_id>.users.json.
+func runUsersCommand(args []string) int {
+	fs := flag.NewFlagSet("users", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the CSV config file of the servers")
+	appConfigPath := fs.String("app-config", "examples/app.config.json", "Path to app config file")
+	commandsPath := fs.String("commands", "", "CSV or NDJSON file of user commands (action, address, password, destination, row_id)")
+	row := fs.Int("row", 0, "Only manage the users of this row ID")
+	list := fs.Bool("list", false, "List the mailboxes and aliases of each server")
+	jsonOutput := fs.Bool("json", false, "Print the reports as JSON")
+	fs.Parse(args)
+
+	if *configPath == "" || (*commandsPath == "" && !*list) {
+		fmt.Fprintln(os.Stderr, "Usage: mailops users --config <servers.csv> (--commands <users.csv|users.ndjson> | --list) [--row <row_id>] [--json]")
+		return 2
+	}
+
+	appConfig, err := loadAppConfig(*appConfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load app config: %v\n", err)
+		return 1
+	}
+
+	servers, err := loadServerConfigs(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load servers: %v\n", err)
+		return 1
+	}
+	if servers, err = selectRow(servers, *row); err != nil {
+		fmt.Fprintf(os.Stderr, "%v in %s\n", err, *configPath)
+		return 1
+	}
+
+	var commands []users.Command
+	if *commandsPath != "" {
+		if commands, err = users.ReadFile(*commandsPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid commands in %s:\n%v\n", *commandsPath, err)
+			return 1
+		}
+	}
+	if *list {
+		for _, server := range servers {
+			commands = append(commands, users.Command{Action: users.ActionList, RowID: server.RowID})
+		}
+	}
+
+	masker := security.NewMasker()
+	schedConfig := &scheduler.Config{
+		SSHTimeoutMs: appConfig.SSHTimeoutMs,
+		CmdTimeoutMs: appConfig.CmdTimeoutMs,
+		DKIMSelector: appConfig.DKIMSelector,
+		ACME:         appConfig.ACME.Enabled,
+		SSHHostKeys:  appConfig.SSHHostKeys.policy(),
+	}
+	runID := protocol.GenerateRunID()
+	sched := scheduler.NewScheduler(1, 0, 0, nil, &consoleLogger{masker: masker}, schedConfig, false, runID, masker)
+
+	reports, err := sched.ManageUsers(servers, commands)
+	if reports == nil && err != nil {
+		fmt.Fprintf(os.Stderr, "User commands not run:\n%v\n", err)
+		return 1
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(reports); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encode reports: %v\n", err)
+			return 1
+		}
+	} else {
+		printUserReports(os.Stdout, reports)
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// printUserReports prints the results and listing of each server
+func printUserReports(w io.Writer, reports []*scheduler.UserReport) {
+	if len(reports) == 0 {
+		fmt.Fprintln(w, "No user commands to run")
+		return
+	}
+
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "row %d: %s (%s)\n", report.RowID, report.Domain, report.ServerIP)
+		if report.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", report.Error)
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, result := range report.Results {
+			if result.Action == users.ActionList && result.Success {
+				continue
+			}
+			status := "ok"
+			if !result.Success {
+				status = "FAILED: " + result.Error
+			}
+			target := result.Address
+			if result.Destination != "" {
+				target += " -> " + result.Destination
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", result.Action, target, status)
+		}
+		tw.Flush()
+
+		if report.Users == nil {
+			continue
+		}
+		fmt.Fprintf(w, "  mailboxes (%d):\n", len(report.Users.Mailboxes))
+		for _, mailbox := range report.Users.Mailboxes {
+			fmt.Fprintf(w, "    %s\n", mailbox)
+		}
+		fmt.Fprintf(w, "  aliases (%d):\n", len(report.Users.Aliases))
+		for _, alias := range report.Users.Aliases {
+			fmt.Fprintf(w, "    %s -> %s\n", alias.Address, strings.Join(alias.Destinations, ", "))
+		}
+	}
+}
@@ -0,0 +1,325 @@
+// Package acme obtains TLS certificates for mail servers from an ACME
+// certificate authority (RFC 8555), such as Let's Encrypt or a local Pebble
+// test server.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+)
+
+// Challenge types
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+)
+
+const (
+	// DefaultDirectoryURL is the production directory of Let's Encrypt
+	DefaultDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+	// DefaultRenewBefore renews certificates a month before they expire,
+	// a third of a Let's Encrypt certificate's lifetime
+	DefaultRenewBefore = 30 * 24 * time.Hour
+
+	// orderTimeout bounds validating and finalizing one order
+	orderTimeout = 10 * time.Minute
+
+	// certKeyBits is the size of certificate keys, RSA for the MTAs that
+	// still cannot do ECDSA
+	certKeyBits = 2048
+)
+
+// caaIssuers maps the directory hosts of public ACME CAs to the issuer
+// domain their CAA records name
+var caaIssuers = map[string]string{
+	"acme-v02.api.letsencrypt.org":         "letsencrypt.org",
+	"acme-staging-v02.api.letsencrypt.org": "letsencrypt.org",
+	"acme.zerossl.com":                     "sectigo.com",
+	"dv.acme-v02.api.pki.goog":             "pki.goog",
+	"dv.acme-v02.test-api.pki.goog":        "pki.goog",
+	"api.buypass.com":                      "buypass.com",
+	"api.test4.buypass.no":                 "buypass.com",
+}
+
+// Options configure how certificates are obtained
+type Options struct {
+	DirectoryURL string        // Defaults to DefaultDirectoryURL
+	Email        string        // Account contact, optional
+	Challenge    string        // ChallengeHTTP01 (default) or ChallengeDNS01
+	CAFile       string        // PEM roots trusted for the CA's API, e.g. Pebble's test root
+	RenewBefore  time.Duration // Defaults to DefaultRenewBefore
+}
+
+// Check validates the options
+func (o Options) Check() error {
+	switch o.Challenge {
+	case "", ChallengeHTTP01, ChallengeDNS01:
+	default:
+		return fmt.Errorf("unknown ACME challenge %q (available: %s, %s)", o.Challenge, ChallengeHTTP01, ChallengeDNS01)
+	}
+	if o.CAFile != "" {
+		if _, err := os.Stat(o.CAFile); err != nil {
+			return fmt.Errorf("ACME CA file: %w", err)
+		}
+	}
+	return nil
+}
+
+// ChallengeType returns the configured challenge type
+func (o Options) ChallengeType() string {
+	if o.Challenge == "" {
+		return ChallengeHTTP01
+	}
+	return o.Challenge
+}
+
+// Directory returns the configured directory URL
+func (o Options) Directory() string {
+	if o.DirectoryURL == "" {
+		return DefaultDirectoryURL
+	}
+	return o.DirectoryURL
+}
+
+// CAAIssuer returns the issuer domain a CAA record has to allow for the
+// configured CA, or "" when the CA is not known
+func (o Options) CAAIssuer() string {
+	u, err := url.Parse(o.Directory())
+	if err != nil {
+		return ""
+	}
+	return caaIssuers[strings.ToLower(u.Hostname())]
+}
+
+// RenewWindow returns how long before expiry certificates are renewed
+func (o Options) RenewWindow() time.Duration {
+	if o.RenewBefore <= 0 {
+		return DefaultRenewBefore
+	}
+	return o.RenewBefore
+}
+
+// Challenge is what has to be published to prove control of a domain
+type Challenge struct {
+	Type    string
+	Domain  string
+	Token   string
+	KeyAuth string // http-01: served at /.well-known/acme-challenge/<Token>
+	Record  string // dns-01: name of the TXT record
+	Value   string // dns-01: content of the TXT record
+}
+
+// Solver publishes challenges and removes them once validated
+type Solver interface {
+	Present(ctx context.Context, ch Challenge) error
+	CleanUp(ctx context.Context, ch Challenge) error
+}
+
+// Obtain orders a certificate for domains, the first one being its common
+// name, proving control of each domain with solver
+func Obtain(ctx context.Context, opts Options, accountKey crypto.Signer, domains []string, solver Solver) (*Certificate, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("no domains to certify")
+	}
+	ctx, cancel := context.WithTimeout(ctx, orderTimeout)
+	defer cancel()
+
+	client, err := newClient(opts, accountKey)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &xacme.Account{}
+	if opts.Email != "" {
+		account.Contact = []string{"mailto:" + opts.Email}
+	}
+	if _, err := client.Register(ctx, account, xacme.AcceptTOS); err != nil && !errors.Is(err, xacme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs(domains...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := authorize(ctx, client, opts.ChallengeType(), url, solver); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("order not ready: %w", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, certKeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+
+	var chain []byte
+	for _, cert := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(chain, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// authorize proves control of the domain of a pending authorization
+func authorize(ctx context.Context, client *xacme.Client, challengeType, url string, solver Solver) (err error) {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %w", err)
+	}
+	if authz.Status == xacme.StatusValid {
+		return nil // Validated by an earlier order of the account
+	}
+
+	var chal *xacme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("the CA offers no %s challenge for %s", challengeType, authz.Identifier.Value)
+	}
+
+	ch := Challenge{Type: chal.Type, Domain: authz.Identifier.Value, Token: chal.Token}
+	switch chal.Type {
+	case ChallengeHTTP01:
+		ch.KeyAuth, err = client.HTTP01ChallengeResponse(chal.Token)
+	case ChallengeDNS01:
+		ch.Record = "_acme-challenge." + strings.TrimPrefix(ch.Domain, "*.")
+		ch.Value, err = client.DNS01ChallengeRecord(chal.Token)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := solver.Present(ctx, ch); err != nil {
+		return fmt.Errorf("failed to publish %s challenge for %s: %w", ch.Type, ch.Domain, err)
+	}
+	defer func() {
+		if cleanErr := solver.CleanUp(ctx, ch); cleanErr != nil && err == nil {
+			err = fmt.Errorf("failed to remove %s challenge for %s: %w", ch.Type, ch.Domain, cleanErr)
+		}
+	}()
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("failed to accept %s challenge for %s: %w", ch.Type, ch.Domain, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s validation of %s failed: %w", ch.Type, ch.Domain, err)
+	}
+	return nil
+}
+
+// newClient returns a client of the configured CA
+func newClient(opts Options, accountKey crypto.Signer) (*xacme.Client, error) {
+	client := &xacme.Client{
+		Key:          accountKey,
+		DirectoryURL: opts.Directory(),
+		UserAgent:    "mailops",
+	}
+	if opts.CAFile == "" {
+		return client, nil
+	}
+
+	data, err := os.ReadFile(opts.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME CA file: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in ACME CA file %s", opts.CAFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	client.HTTPClient = &http.Client{Transport: transport}
+	return client, nil
+}
+
+// AccountKey returns the account key stored at path, generating and
+// storing one on first use
+func AccountKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in ACME account key %s", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACME account key %s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read ACME account key: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// O_EXCL keeps the key of a concurrent task registering the account
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return AccountKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store ACME account key: %w", err)
+	}
+	if _, err := file.Write(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to store ACME account key: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,653 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubCA is an ACME server (RFC 8555) issuing certificates from a throwaway
+// CA, in the manner of Pebble. It validates a challenge by asking the
+// solver of the test what it published; JWS signatures are not verified.
+type stubCA struct {
+	t          *testing.T
+	srv        *httptest.Server
+	key        *ecdsa.PrivateKey
+	cert       *x509.Certificate
+	solver     *testSolver
+	challenges []string // Challenge types offered
+
+	mu       sync.Mutex
+	next     int
+	accounts map[string]string     // Account URL by key thumbprint
+	authzs   map[string]*stubAuthz // By URL
+	orders   map[string]*stubOrder // By URL
+	certs    map[string][]byte     // PEM chain by URL
+}
+
+type stubAuthz struct {
+	url        string
+	account    string
+	domain     string
+	status     string
+	token      string
+	thumbprint string
+}
+
+type stubOrder struct {
+	url     string
+	account string
+	domains []string
+	authzs  []*stubAuthz
+	cert    string // Certificate URL once finalized
+}
+
+func newStubCA(t *testing.T, solver *testSolver, challenges ...string) *stubCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Stub ACME Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &stubCA{
+		t:          t,
+		key:        key,
+		cert:       cert,
+		solver:     solver,
+		challenges: challenges,
+		accounts:   map[string]string{},
+		authzs:     map[string]*stubAuthz{},
+		orders:     map[string]*stubOrder{},
+		certs:      map[string][]byte{},
+	}
+	ca.srv = httptest.NewTLSServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+// options returns the options of a client of the CA, trusting its TLS
+// certificate through CAFile
+func (ca *stubCA) options(t *testing.T, challenge string) Options {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.srv.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Options{DirectoryURL: ca.srv.URL + "/dir", Challenge: challenge, CAFile: path}
+}
+
+func (ca *stubCA) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", ca.nonce())
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Path == "/dir" {
+		ca.reply(w, http.StatusOK, map[string]any{
+			"newNonce":   ca.srv.URL + "/nonce",
+			"newAccount": ca.srv.URL + "/account",
+			"newOrder":   ca.srv.URL + "/order",
+			"revokeCert": ca.srv.URL + "/revoke",
+			"keyChange":  ca.srv.URL + "/key-change",
+			"meta":       map[string]any{"termsOfService": ca.srv.URL + "/terms"},
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		ca.problem(w, http.StatusMethodNotAllowed, "malformed", "POST required")
+		return
+	}
+
+	var msg struct{ Protected, Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	var header struct {
+		JWK json.RawMessage `json:"jwk"`
+		KID string          `json:"kid"`
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(msg.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(msg.Payload)
+	if err := json.Unmarshal(protected, &header); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	url := ca.srv.URL + r.URL.Path
+
+	switch {
+	case r.URL.Path == "/account":
+		ca.newAccount(w, header.JWK)
+	case r.URL.Path == "/order":
+		ca.newOrder(w, header.KID, payload)
+	case ca.orders[url] != nil:
+		ca.replyOrder(w, http.StatusOK, ca.orders[url])
+	case ca.authzs[url] != nil:
+		ca.replyAuthz(w, ca.authzs[url])
+	case strings.HasPrefix(r.URL.Path, "/chal/"):
+		ca.accept(w, strings.TrimPrefix(url, ca.srv.URL+"/chal"))
+	case strings.HasPrefix(r.URL.Path, "/finalize/"):
+		ca.finalize(w, ca.orders[strings.Replace(url, "/finalize/", "/order/", 1)], payload)
+	case ca.certs[url] != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.certs[url])
+	default:
+		ca.problem(w, http.StatusNotFound, "malformed", "no such resource")
+	}
+}
+
+func (ca *stubCA) newAccount(w http.ResponseWriter, jwk json.RawMessage) {
+	var key struct{ Crv, Kty, X, Y string }
+	if err := json.Unmarshal(jwk, &key); err != nil || key.Kty != "EC" {
+		ca.problem(w, http.StatusBadRequest, "badPublicKey", "account keys are EC keys")
+		return
+	}
+	// RFC 7638 thumbprint, as the client embeds in key authorizations
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, key.Crv, key.X, key.Y)))
+	thumbprint := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	status := http.StatusOK
+	account, ok := ca.accounts[thumbprint]
+	if !ok {
+		account = ca.url("acct")
+		ca.accounts[thumbprint] = account
+		status = http.StatusCreated
+	}
+	w.Header().Set("Location", account)
+	ca.reply(w, status, map[string]any{"status": "valid"})
+}
+
+func (ca *stubCA) newOrder(w http.ResponseWriter, account string, payload []byte) {
+	var req struct {
+		Identifiers []struct{ Type, Value string }
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	thumbprint := ""
+	for tp, url := range ca.accounts {
+		if url == account {
+			thumbprint = tp
+		}
+	}
+	if thumbprint == "" {
+		ca.problem(w, http.StatusUnauthorized, "accountDoesNotExist", "unknown account "+account)
+		return
+	}
+
+	order := &stubOrder{url: ca.url("order"), account: account}
+	for _, id := range req.Identifiers {
+		order.domains = append(order.domains, id.Value)
+		order.authzs = append(order.authzs, ca.authorization(account, thumbprint, id.Value))
+	}
+	ca.orders[order.url] = order
+	ca.replyOrder(w, http.StatusCreated, order)
+}
+
+// authorization returns the valid authorization of an account for domain,
+// or a new pending one
+func (ca *stubCA) authorization(account, thumbprint, domain string) *stubAuthz {
+	for _, authz := range ca.authzs {
+		if authz.account == account && authz.domain == domain && authz.status == "valid" {
+			return authz
+		}
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	authz := &stubAuthz{
+		url:        ca.url("authz"),
+		account:    account,
+		domain:     domain,
+		status:     "pending",
+		token:      base64.RawURLEncoding.EncodeToString(token),
+		thumbprint: thumbprint,
+	}
+	ca.authzs[authz.url] = authz
+	return authz
+}
+
+// accept validates a challenge, whose path is the authorization's path
+// followed by its type
+func (ca *stubCA) accept(w http.ResponseWriter, path string) {
+	authzPath, challengeType := path[:strings.LastIndex(path, "/")], path[strings.LastIndex(path, "/")+1:]
+	authz := ca.authzs[ca.srv.URL+authzPath]
+	if authz == nil {
+		ca.problem(w, http.StatusNotFound, "malformed", "no such challenge")
+		return
+	}
+
+	if authz.status == "pending" {
+		authz.status = "invalid"
+		keyAuth := authz.token + "." + authz.thumbprint
+		if published, ok := ca.solver.published(authz.token); ok && published.Type == challengeType {
+			sum := sha256.Sum256([]byte(keyAuth))
+			switch {
+			case challengeType == ChallengeHTTP01 && published.KeyAuth == keyAuth,
+				challengeType == ChallengeDNS01 && published.Record == "_acme-challenge."+authz.domain && published.Value == base64.RawURLEncoding.EncodeToString(sum[:]):
+				authz.status = "valid"
+			}
+		}
+	}
+	ca.reply(w, http.StatusOK, map[string]any{"type": challengeType, "url": ca.srv.URL + path, "token": authz.token, "status": authz.status})
+}
+
+func (ca *stubCA) finalize(w http.ResponseWriter, order *stubOrder, payload []byte) {
+	if order == nil {
+		ca.problem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	if status := ca.orderStatus(order); status != "ready" {
+		ca.problem(w, http.StatusForbidden, "orderNotReady", "order is "+status)
+		return
+	}
+
+	var req struct{ CSR string }
+	json.Unmarshal(payload, &req)
+	der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	names := append([]string(nil), csr.DNSNames...)
+	domains := append([]string(nil), order.domains...)
+	sort.Strings(names)
+	sort.Strings(domains)
+	if strings.Join(names, ",") != strings.Join(domains, ",") {
+		ca.problem(w, http.StatusBadRequest, "badCSR", "CSR names do not match the order")
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.next + 100)),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute).Truncate(time.Second),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		ca.problem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+	order.cert = ca.url("cert")
+	ca.certs[order.cert] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	ca.replyOrder(w, http.StatusOK, order)
+}
+
+func (ca *stubCA) orderStatus(order *stubOrder) string {
+	if order.cert != "" {
+		return "valid"
+	}
+	status := "ready"
+	for _, authz := range order.authzs {
+		switch authz.status {
+		case "invalid":
+			return "invalid"
+		case "pending":
+			status = "pending"
+		}
+	}
+	return status
+}
+
+func (ca *stubCA) replyOrder(w http.ResponseWriter, status int, order *stubOrder) {
+	var identifiers []map[string]string
+	var authzs []string
+	for i, domain := range order.domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": domain})
+		authzs = append(authzs, order.authzs[i].url)
+	}
+	w.Header().Set("Location", order.url)
+	ca.reply(w, status, map[string]any{
+		"status":         ca.orderStatus(order),
+		"identifiers":    identifiers,
+		"authorizations": authzs,
+		"finalize":       strings.Replace(order.url, "/order/", "/finalize/", 1),
+		"certificate":    order.cert,
+	})
+}
+
+func (ca *stubCA) replyAuthz(w http.ResponseWriter, authz *stubAuthz) {
+	var challenges []map[string]string
+	for _, challengeType := range ca.challenges {
+		challenges = append(challenges, map[string]string{
+			"type":   challengeType,
+			"url":    strings.Replace(authz.url, "/authz/", "/chal/authz/", 1) + "/" + challengeType,
+			"token":  authz.token,
+			"status": authz.status,
+		})
+	}
+	ca.reply(w, http.StatusOK, map[string]any{
+		"identifier": map[string]string{"type": "dns", "value": authz.domain},
+		"status":     authz.status,
+		"challenges": challenges,
+	})
+}
+
+func (ca *stubCA) url(kind string) string {
+	ca.next++
+	return fmt.Sprintf("%s/%s/%d", ca.srv.URL, kind, ca.next)
+}
+
+func (ca *stubCA) nonce() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (ca *stubCA) reply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *stubCA) problem(w http.ResponseWriter, status int, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"type": "urn:ietf:params:acme:error:" + kind, "detail": detail, "status": status})
+}
+
+// testSolver records the challenges it publishes and removes
+type testSolver struct {
+	mu        sync.Mutex
+	presented []Challenge
+	cleaned   []Challenge
+	current   map[string]Challenge // By token
+}
+
+func (s *testSolver) Present(_ context.Context, ch Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		s.current = make(map[string]Challenge)
+	}
+	s.presented = append(s.presented, ch)
+	s.current[ch.Token] = ch
+	return nil
+}
+
+func (s *testSolver) CleanUp(_ context.Context, ch Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleaned = append(s.cleaned, ch)
+	delete(s.current, ch.Token)
+	return nil
+}
+
+// published returns the challenge currently published for token
+func (s *testSolver) published(token string) (Challenge, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.current[token]
+	return ch, ok
+}
+
+func TestObtain(t *testing.T) {
+	domains := []string{"mail.example.com", "mta-sts.example.com"}
+
+	for _, challenge := range []string{ChallengeHTTP01, ChallengeDNS01} {
+		t.Run(challenge, func(t *testing.T) {
+			solver := &testSolver{}
+			ca := newStubCA(t, solver, ChallengeHTTP01, ChallengeDNS01)
+			accountKey, err := AccountKey(filepath.Join(t.TempDir(), "account.key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cert, err := Obtain(context.Background(), ca.options(t, challenge), accountKey, domains, solver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cert.Covers(domains) || cert.Issuer != "Stub ACME Root" {
+				t.Errorf("certificate for %v issued by %q", cert.Domains, cert.Issuer)
+			}
+			if strings.Count(string(cert.Chain), "BEGIN CERTIFICATE") != 2 {
+				t.Errorf("chain holds %d certificates, want the leaf and the CA", strings.Count(string(cert.Chain), "BEGIN CERTIFICATE"))
+			}
+
+			if len(solver.presented) != 2 || len(solver.cleaned) != 2 {
+				t.Fatalf("presented %d and removed %d challenges, want 2", len(solver.presented), len(solver.cleaned))
+			}
+			for i, ch := range solver.presented {
+				if ch.Type != challenge || ch.Domain != domains[i] {
+					t.Errorf("challenge %d = %+v", i, ch)
+				}
+				if (ch.KeyAuth != "") != (challenge == ChallengeHTTP01) || (ch.Value != "") != (challenge == ChallengeDNS01) {
+					t.Errorf("challenge %d = %+v, want only the %s fields", i, ch, challenge)
+				}
+			}
+		})
+	}
+}
+
+func TestObtainReusesAccount(t *testing.T) {
+	solver := &testSolver{}
+	ca := newStubCA(t, solver, ChallengeHTTP01)
+	opts := ca.options(t, "")
+	accountKey, err := AccountKey(filepath.Join(t.TempDir(), "account.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := Obtain(context.Background(), opts, accountKey, []string{"mail.example.com"}, solver); err != nil {
+			t.Fatalf("order %d: %v", i+1, err)
+		}
+	}
+	// The second order finds the account registered and the domain validated
+	if len(ca.accounts) != 1 || len(solver.presented) != 1 {
+		t.Errorf("%d accounts and %d challenges for two orders, want 1 and 1", len(ca.accounts), len(solver.presented))
+	}
+}
+
+func TestObtainFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		challenges []string // Offered by the CA
+		challenge  string
+		solver     Solver
+		domains    []string
+		want       string
+	}{
+		{
+			name:       "challenge not offered",
+			challenges: []string{ChallengeHTTP01},
+			challenge:  ChallengeDNS01,
+			domains:    []string{"mail.example.com"},
+			want:       "the CA offers no dns-01 challenge for mail.example.com",
+		},
+		{
+			name:       "validation fails",
+			challenges: []string{ChallengeHTTP01},
+			solver:     &wrongSolver{},
+			domains:    []string{"mail.example.com"},
+			want:       "http-01 validation of mail.example.com failed",
+		},
+		{
+			name:       "solver fails",
+			challenges: []string{ChallengeHTTP01},
+			solver:     &failingSolver{},
+			domains:    []string{"mail.example.com"},
+			want:       "failed to publish http-01 challenge for mail.example.com: port 80 is closed",
+		},
+		{
+			name:       "no domains",
+			challenges: []string{ChallengeHTTP01},
+			want:       "no domains to certify",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			solver := &testSolver{}
+			ca := newStubCA(t, solver, tt.challenges...)
+			accountKey, err := AccountKey(filepath.Join(t.TempDir(), "account.key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var use Solver = solver
+			if tt.solver != nil {
+				use = tt.solver
+			}
+
+			_, err = Obtain(context.Background(), ca.options(t, tt.challenge), accountKey, tt.domains, use)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Obtain = %v, want %q", err, tt.want)
+			}
+			if wrong, ok := tt.solver.(*wrongSolver); ok && wrong.cleaned != 1 {
+				t.Errorf("challenge removed %d times after a failed validation, want 1", wrong.cleaned)
+			}
+		})
+	}
+}
+
+// wrongSolver publishes nothing the CA finds
+type wrongSolver struct{ cleaned int }
+
+func (s *wrongSolver) Present(context.Context, Challenge) error { return nil }
+func (s *wrongSolver) CleanUp(context.Context, Challenge) error { s.cleaned++; return nil }
+
+// failingSolver cannot publish challenges
+type failingSolver struct{}
+
+func (failingSolver) Present(context.Context, Challenge) error {
+	return errors.New("port 80 is closed")
+}
+func (failingSolver) CleanUp(context.Context, Challenge) error { return nil }
+
+func TestNewClientCAFile(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("no certificates"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		caFile string
+		want   string
+	}{
+		{filepath.Join(dir, "missing.pem"), "failed to read ACME CA file"},
+		{empty, "no certificates in ACME CA file"},
+	}
+	for _, tt := range tests {
+		if _, err := newClient(Options{CAFile: tt.caFile}, nil); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("newClient(%s) = %v, want %q", tt.caFile, err, tt.want)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		opts      Options
+		valid     bool
+		challenge string
+		directory string
+		issuer    string
+		renew     time.Duration
+	}{
+		{Options{}, true, ChallengeHTTP01, DefaultDirectoryURL, "letsencrypt.org", DefaultRenewBefore},
+		{
+			Options{DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory", Challenge: ChallengeDNS01, RenewBefore: time.Hour},
+			true, ChallengeDNS01, "https://acme-staging-v02.api.letsencrypt.org/directory", "letsencrypt.org", time.Hour,
+		},
+		{Options{DirectoryURL: "https://ACME.ZeroSSL.com/v2/DV90"}, true, ChallengeHTTP01, "https://ACME.ZeroSSL.com/v2/DV90", "sectigo.com", DefaultRenewBefore},
+		{Options{DirectoryURL: "https://localhost:14000/dir"}, true, ChallengeHTTP01, "https://localhost:14000/dir", "", DefaultRenewBefore},
+		{Options{Challenge: "tls-alpn-01"}, false, "tls-alpn-01", DefaultDirectoryURL, "letsencrypt.org", DefaultRenewBefore},
+		{Options{CAFile: "/nonexistent/ca.pem"}, false, ChallengeHTTP01, DefaultDirectoryURL, "letsencrypt.org", DefaultRenewBefore},
+	}
+
+	for _, tt := range tests {
+		if err := tt.opts.Check(); (err == nil) != tt.valid {
+			t.Errorf("%+v: Check = %v, want valid %v", tt.opts, err, tt.valid)
+		}
+		if got := tt.opts.ChallengeType(); got != tt.challenge {
+			t.Errorf("%+v: ChallengeType = %q, want %q", tt.opts, got, tt.challenge)
+		}
+		if got := tt.opts.Directory(); got != tt.directory {
+			t.Errorf("%+v: Directory = %q, want %q", tt.opts, got, tt.directory)
+		}
+		if got := tt.opts.CAAIssuer(); got != tt.issuer {
+			t.Errorf("%+v: CAAIssuer = %q, want %q", tt.opts, got, tt.issuer)
+		}
+		if got := tt.opts.RenewWindow(); got != tt.renew {
+			t.Errorf("%+v: RenewWindow = %v, want %v", tt.opts, got, tt.renew)
+		}
+	}
+}
+
+func TestAccountKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme", "account.key")
+
+	key, err := AccountKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("account key mode %v, want 0600", info.Mode().Perm())
+	}
+
+	again, err := AccountKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.(*ecdsa.PrivateKey).Equal(again) {
+		t.Error("second AccountKey returned another key")
+	}
+
+	if err := os.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AccountKey(path); err == nil || !strings.Contains(err.Error(), "no PEM data") {
+		t.Errorf("AccountKey of a corrupt file = %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Certificate is an issued certificate with its private key
+type Certificate struct {
+	Chain     []byte // PEM certificates, the leaf first
+	Key       []byte // PEM private key
+	Domains   []string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Parse reads a PEM certificate chain and the private key of its leaf
+func Parse(chain, key []byte) (*Certificate, error) {
+	block, _ := pem.Decode(chain)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate in chain")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	private, err := parsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := private.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(leaf.PublicKey) {
+		return nil, errors.New("private key does not match the certificate")
+	}
+
+	issuer := leaf.Issuer.CommonName
+	if issuer == "" {
+		issuer = leaf.Issuer.String()
+	}
+	return &Certificate{
+		Chain:     chain,
+		Key:       key,
+		Domains:   leaf.DNSNames,
+		Issuer:    issuer,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}, nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in private key")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// Covers reports whether the certificate is valid for every domain
+func (c *Certificate) Covers(domains []string) bool {
+	for _, domain := range domains {
+		found := false
+		for _, name := range c.Domains {
+			if strings.EqualFold(name, domain) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// NeedsRenewal reports whether the certificate misses one of domains or
+// expires within before of now
+func (c *Certificate) NeedsRenewal(domains []string, before time.Duration, now time.Time) bool {
+	return !c.Covers(domains) || !now.Add(before).Before(c.NotAfter)
+}
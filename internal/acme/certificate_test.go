@@ -0,0 +1,99 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a PEM certificate for domains and its PEM key
+func selfSigned(t *testing.T, notAfter time.Time, domains ...string) (chain, key []byte) {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		Issuer:       pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &private.PublicKey, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestParse(t *testing.T) {
+	notAfter := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	chain, key := selfSigned(t, notAfter, "mail.example.com", "mta-sts.example.com")
+	_, otherKey := selfSigned(t, notAfter, "mail.example.org")
+
+	cert, err := Parse(chain, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Issuer != "mail.example.com" || !cert.NotAfter.Equal(notAfter) || len(cert.Domains) != 2 {
+		t.Errorf("Parse = %+v", cert)
+	}
+
+	tests := []struct {
+		name       string
+		chain, key []byte
+		want       string
+	}{
+		{"no certificate", key, key, "no certificate in chain"},
+		{"corrupt certificate", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}), key, "invalid certificate"},
+		{"no key", chain, nil, "no PEM data in private key"},
+		{"corrupt key", chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("garbage")}), "invalid private key"},
+		{"key of another certificate", chain, otherKey, "private key does not match the certificate"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.chain, tt.key); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Parse = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	notAfter := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	cert := &Certificate{Domains: []string{"mail.example.com", "mta-sts.example.com"}, NotAfter: notAfter}
+
+	tests := []struct {
+		domains []string
+		now     time.Time
+		covers  bool
+		renew   bool
+	}{
+		{[]string{"mail.example.com"}, notAfter.AddDate(0, 0, -60), true, false},
+		{[]string{"MAIL.example.com", "mta-sts.example.com"}, notAfter.AddDate(0, 0, -31), true, false},
+		{[]string{"mail.example.com"}, notAfter.AddDate(0, 0, -30), true, true},
+		{[]string{"mail.example.com"}, notAfter.AddDate(0, 0, 1), true, true},
+		{[]string{"mail.example.com", "autoconfig.example.com"}, notAfter.AddDate(0, 0, -60), false, true},
+		{nil, notAfter.AddDate(0, 0, -60), true, false},
+	}
+	for _, tt := range tests {
+		if got := cert.Covers(tt.domains); got != tt.covers {
+			t.Errorf("Covers(%v) = %v, want %v", tt.domains, got, tt.covers)
+		}
+		if got := cert.NeedsRenewal(tt.domains, 30*24*time.Hour, tt.now); got != tt.renew {
+			t.Errorf("NeedsRenewal(%v, %v) = %v, want %v", tt.domains, tt.now, got, tt.renew)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package profiles
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mailops/internal/ssh"
+	"strings"
+	"time"
+)
+
+// managedHeader marks a config file as written by mailops. A file without
+// managedMark is the distribution's original and is backed up before it is
+// replaced.
+const (
+	managedMark   = "Managed by mailops"
+	managedHeader = "# " + managedMark + ": changes are overwritten on the next deployment\n"
+)
+
+// Markers around the part of a file mailops manages
+const (
+	blockBegin = "# BEGIN mailops managed block\n"
+	blockEnd   = "# END mailops managed block\n"
+)
+
+// originalSuffix is appended to the path of a backed up original
+const originalSuffix = ".mailops-orig"
+
+// ensureFile writes content to path on the server unless the file already
+// holds exactly that content. It reports whether the file changed.
+func ensureFile(client *ssh.Client, path, content string) (bool, error) {
+	current, err := remoteChecksum(client, path)
+	if err != nil {
+		return false, err
+	}
+	if current == checksum(content) {
+		return false, nil
+	}
+	if err := writeFile(client, path, content); err != nil {
+		return false, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// ensurePrivateFile is ensureFile for secrets: the file is created
+// readable by the owner only before the content is written to it, so it is
+// never readable by others. Like writeFile, it writes content as is, with or
+// without a trailing newline.
+func ensurePrivateFile(client *ssh.Client, path, content string) (bool, error) {
+	current, err := remoteChecksum(client, path)
+	if err != nil {
+		return false, err
+	}
+	if current == checksum(content) {
+		return false, nil
+	}
+	cmd := fmt.Sprintf("(umask 077 && printf '%%s' '%s' > %s) && chmod 600 %s", strings.ReplaceAll(content, "'", "'\\''"), path, path)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return false, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// ensureConfig replaces a config file the distribution ships with content,
+// marked with managedHeader. The distribution's original is backed up the
+// first time, so a backup never holds a file mailops already modified.
+func ensureConfig(client *ssh.Client, path, content string) (bool, error) {
+	content = managedHeader + strings.TrimPrefix(content, "\n")
+
+	current, err := remoteChecksum(client, path)
+	if err != nil {
+		return false, err
+	}
+	if current == checksum(content) {
+		return false, nil
+	}
+
+	cmd := fmt.Sprintf("if [ -f %s ] && [ ! -e %s%s ] && ! grep -qF '%s' %s; then cp -p %s %s%s; fi",
+		path, path, originalSuffix, managedMark, path, path, path, originalSuffix)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return false, fmt.Errorf("failed to back up %s: %v", path, err)
+	}
+
+	if err := writeFile(client, path, content); err != nil {
+		return false, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// ensureBlock keeps block between the managed block markers of a file,
+// leaving the rest of the file alone. Occurrences of legacy, content that
+// earlier versions appended without markers, are removed. The original is
+// backed up the first time the file is touched.
+func ensureBlock(client *ssh.Client, path, block string, legacy ...string) (bool, error) {
+	current, err := client.ExecuteCommandWithOutput(fmt.Sprintf("cat %s 2>/dev/null || true", path), 30*time.Second)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	updated := current
+	pristine := !strings.Contains(current, blockBegin)
+	for _, text := range legacy {
+		if strings.Contains(updated, text) {
+			updated = strings.ReplaceAll(updated, text, "")
+			pristine = false
+		}
+	}
+	updated = replaceBlock(updated, block)
+	if updated == current {
+		return false, nil
+	}
+
+	if pristine {
+		cmd := fmt.Sprintf("if [ -f %s ] && [ ! -e %s%s ]; then cp -p %s %s%s; fi", path, path, originalSuffix, path, path, originalSuffix)
+		if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+			return false, fmt.Errorf("failed to back up %s: %v", path, err)
+		}
+	}
+
+	if err := writeFile(client, path, updated); err != nil {
+		return false, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// replaceBlock returns content with its managed block set to block,
+// appending the block when content has none
+func replaceBlock(content, block string) string {
+	if !strings.HasSuffix(block, "\n") {
+		block += "\n"
+	}
+	managed := blockBegin + block + blockEnd
+
+	if begin := strings.Index(content, blockBegin); begin >= 0 {
+		if end := strings.Index(content[begin:], blockEnd); end >= 0 {
+			return content[:begin] + managed + content[begin+end+len(blockEnd):]
+		}
+	}
+
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + managed
+}
+
+// installPackages installs the packages that are not installed yet
+func installPackages(client *ssh.Client, packages ...string) error {
+	for _, pkg := range packages {
+		if _, err := client.ExecuteCommandWithOutput(fmt.Sprintf("dpkg-query -W -f='${Status}' %s 2>/dev/null | grep -q 'install ok installed'", pkg), 30*time.Second); err == nil {
+			continue
+		}
+		if err := client.InstallPackage(pkg); err != nil {
+			return fmt.Errorf("failed to install %s: %v", pkg, err)
+		}
+	}
+	return nil
+}
+
+// remoteChecksum returns the SHA-256 of a file on the server, or an empty
+// string when it does not exist
+func remoteChecksum(client *ssh.Client, path string) (string, error) {
+	output, err := client.ExecuteCommandWithOutput(fmt.Sprintf("if [ -f %s ]; then sha256sum %s; fi", path, path), 30*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to checksum %s: %v", path, err)
+	}
+	sum, _, _ := strings.Cut(strings.TrimSpace(output), " ")
+	return sum, nil
+}
+
+func checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,206 @@
+package profiles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceBlock(t *testing.T) {
+	managed := func(block string) string { return blockBegin + block + blockEnd }
+
+	tests := []struct {
+		name    string
+		content string
+		block   string
+		want    string
+	}{
+		{"empty file", "", "a = 1\n", managed("a = 1\n")},
+		{"appended", "x = 0\n", "a = 1\n", "x = 0\n" + managed("a = 1\n")},
+		{"appended after a last line without newline", "x = 0", "a = 1\n", "x = 0\n" + managed("a = 1\n")},
+		{"block without newline", "", "a = 1", managed("a = 1\n")},
+		{"replaced in place", "x = 0\n" + managed("a = 1\n") + "y = 2\n", "a = 2\nb = 3\n", "x = 0\n" + managed("a = 2\nb = 3\n") + "y = 2\n"},
+		{"unchanged", "x = 0\n" + managed("a = 1\n"), "a = 1\n", "x = 0\n" + managed("a = 1\n")},
+	}
+
+	for _, tt := range tests {
+		if got := replaceBlock(tt.content, tt.block); got != tt.want {
+			t.Errorf("%s: replaceBlock =\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// readLocal returns the content of a file, or "<missing>" when there is none
+func readLocal(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func writeLocal(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsureBlock(t *testing.T) {
+	client := testClient(t, t.TempDir())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.cf")
+	backup := path + originalSuffix
+	original := "# Distribution config\nmyhostname = localhost\n"
+	writeLocal(t, path, original)
+
+	steps := []struct {
+		name       string
+		block      string
+		legacy     []string
+		changed    bool
+		want       string
+		wantBackup string
+	}{
+		{"first run backs up the original", "a = 1\n", nil, true, original + blockBegin + "a = 1\n" + blockEnd, original},
+		{"re-run", "a = 1\n", nil, false, original + blockBegin + "a = 1\n" + blockEnd, original},
+		{"block changed", "a = 2\n", nil, true, original + blockBegin + "a = 2\n" + blockEnd, original},
+	}
+	for _, step := range steps {
+		changed, err := ensureBlock(client, path, step.block, step.legacy...)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if changed != step.changed {
+			t.Errorf("%s: changed %v, want %v", step.name, changed, step.changed)
+		}
+		if got := readLocal(t, path); got != step.want {
+			t.Errorf("%s: file =\n%q\nwant\n%q", step.name, got, step.want)
+		}
+		if got := readLocal(t, backup); got != step.wantBackup {
+			t.Errorf("%s: backup =\n%q\nwant\n%q", step.name, got, step.wantBackup)
+		}
+	}
+
+	// Content appended by an earlier version is replaced by the block. The
+	// file was modified already, so it is not backed up as the original.
+	legacyPath := filepath.Join(dir, "jail.local")
+	writeLocal(t, legacyPath, "[DEFAULT]\n[postfix]\nenabled = true\n")
+	if _, err := ensureBlock(client, legacyPath, "[postfix]\nenabled = true\nmaxretry = 5\n", "[postfix]\nenabled = true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readLocal(t, legacyPath), "[DEFAULT]\n"+blockBegin+"[postfix]\nenabled = true\nmaxretry = 5\n"+blockEnd; got != want {
+		t.Errorf("file with legacy content =\n%q\nwant\n%q", got, want)
+	}
+	if got := readLocal(t, legacyPath+originalSuffix); got != "<missing>" {
+		t.Errorf("file with legacy content backed up as the original: %q", got)
+	}
+
+	// A missing file is created without a backup
+	newPath := filepath.Join(dir, "new.conf")
+	if changed, err := ensureBlock(client, newPath, "a = 1\n"); err != nil || !changed {
+		t.Fatalf("ensureBlock on a missing file = %v, %v", changed, err)
+	}
+	if got, want := readLocal(t, newPath), blockBegin+"a = 1\n"+blockEnd; got != want {
+		t.Errorf("created file = %q, want %q", got, want)
+	}
+	if got := readLocal(t, newPath+originalSuffix); got != "<missing>" {
+		t.Errorf("missing file backed up: %q", got)
+	}
+}
+
+func TestEnsureConfig(t *testing.T) {
+	client := testClient(t, t.TempDir())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dovecot.conf")
+	backup := path + originalSuffix
+	original := "# Distribution config\nprotocols = imap pop3\n"
+	writeLocal(t, path, original)
+
+	steps := []struct {
+		name    string
+		content string
+		changed bool
+	}{
+		{"first run", "\nprotocols = imap\n", true},
+		{"re-run", "\nprotocols = imap\n", false},
+		{"content changed", "\nprotocols = imap lmtp\n", true},
+	}
+	for _, step := range steps {
+		changed, err := ensureConfig(client, path, step.content)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if changed != step.changed {
+			t.Errorf("%s: changed %v, want %v", step.name, changed, step.changed)
+		}
+		if got, want := readLocal(t, path), managedHeader+step.content[1:]; got != want {
+			t.Errorf("%s: file =\n%q\nwant\n%q", step.name, got, want)
+		}
+		if got := readLocal(t, backup); got != original {
+			t.Errorf("%s: backup = %q, want the distribution's original", step.name, got)
+		}
+	}
+
+	// A file mailops wrote is never backed up as the original, even when
+	// the backup was removed
+	if err := os.Remove(backup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ensureConfig(client, path, "protocols = imap\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLocal(t, backup); got != "<missing>" {
+		t.Errorf("managed file backed up as the original: %q", got)
+	}
+
+	// A missing file is created without a backup
+	newPath := filepath.Join(dir, "new.conf")
+	if changed, err := ensureConfig(client, newPath, "a = 1\n"); err != nil || !changed {
+		t.Fatalf("ensureConfig on a missing file = %v, %v", changed, err)
+	}
+	if got := readLocal(t, newPath+originalSuffix); got != "<missing>" {
+		t.Errorf("missing file backed up: %q", got)
+	}
+}
+
+func TestEnsurePrivateFile(t *testing.T) {
+	client := testClient(t, t.TempDir())
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"trailing newline", "a@example.com:{BLF-CRYPT}$2y$05$abc\n"},
+		{"no trailing newline", "a@example.com:{BLF-CRYPT}$2y$05$abc"},
+		{"heredoc delimiter", "first\nEOF\nlast\n"},
+		{"quotes", "it's \"quoted\" and `run` $(not)\n"},
+		{"empty", ""},
+	}
+
+	for i, tt := range tests {
+		path := filepath.Join(dir, "secret"+string(rune('a'+i)))
+		changed, err := ensurePrivateFile(client, path, tt.content)
+		if err != nil || !changed {
+			t.Fatalf("%s: ensurePrivateFile = %v, %v", tt.name, changed, err)
+		}
+		if got := readLocal(t, path); got != tt.content {
+			t.Errorf("%s: file = %q, want %q", tt.name, got, tt.content)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s: mode %o, want 600", tt.name, mode)
+		}
+		if changed, err := ensurePrivateFile(client, path, tt.content); err != nil || changed {
+			t.Errorf("%s: re-run = %v, %v, want unchanged", tt.name, changed, err)
+		}
+	}
+}
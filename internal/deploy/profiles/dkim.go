@@ -0,0 +1,111 @@
+package profiles
+
+import (
+	"fmt"
+	"mailops/internal/dkim"
+	"mailops/internal/ssh"
+	"strings"
+	"time"
+)
+
+// dkimSigningTable returns an OpenDKIM SigningTable that signs all mail of
+// domain with the key of selector
+func dkimSigningTable(domain, selector string) string {
+	return fmt.Sprintf("*@%s %s\n", domain, dkim.RecordName(selector, domain))
+}
+
+// dkimKeyTable returns an OpenDKIM KeyTable with the key of selector, read
+// from keyDir as seen by opendkim
+func dkimKeyTable(domain, selector, keyDir string) string {
+	return fmt.Sprintf("%s %s:%s:%s/%s.private\n", dkim.RecordName(selector, domain), domain, selector, keyDir, selector)
+}
+
+// setDKIMSigningEntry returns an OpenDKIM SigningTable with the entry of
+// domain pointed at the key of selector, keeping the entries of other domains
+func setDKIMSigningEntry(content, domain, selector string) string {
+	return setTableEntry(content, "", "*@"+domain, strings.TrimSuffix(dkimSigningTable(domain, selector), "\n"))
+}
+
+// setDKIMKeyEntry returns an OpenDKIM KeyTable with the key of domain
+// replaced in place by the key of selector, keeping the keys of other
+// domains, so deploying a domain again leaves the table unchanged
+func setDKIMKeyEntry(content, domain, selector, keyDir string) string {
+	entry := strings.TrimSuffix(dkimKeyTable(domain, selector, keyDir), "\n")
+	var kept []string
+	replaced := false
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[1], domain+":") {
+			if !replaced {
+				kept = append(kept, entry)
+				replaced = true
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return setTableEntry(strings.Join(kept, "\n"), "", dkim.RecordName(selector, domain), entry)
+}
+
+// readDKIMKey reads the public key file of a selector and returns its TXT
+// content, with a key split over several strings joined back together
+func readDKIMKey(client *ssh.Client, keyDir, selector string) (string, error) {
+	content, err := client.ExecuteCommandWithOutput(fmt.Sprintf("cat %s/%s.txt", keyDir, selector), 30*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to read DKIM public key: %v", err)
+	}
+
+	record, err := dkim.ParseKeyFile(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse DKIM public key of selector %s: %v", selector, err)
+	}
+	if record.PublicKey == "" {
+		return "", fmt.Errorf("DKIM public key of selector %s is empty", selector)
+	}
+	return record.String(), nil
+}
+
+// installDKIMKey writes the private key and public key file of a selector
+// to keyDir on the server, unless they are already there, and reports
+// whether they changed. owner, when set, is given the key files.
+func installDKIMKey(client *ssh.Client, keyDir, domain, selector, owner string, key *dkim.Key) (bool, error) {
+	private, err := key.PrivateKeyPEM()
+	if err != nil {
+		return false, err
+	}
+	record, err := key.Record()
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := client.ExecuteCommandWithOutput(fmt.Sprintf("mkdir -p %s && chmod 750 %s", keyDir, keyDir), 30*time.Second); err != nil {
+		return false, err
+	}
+
+	privatePath := fmt.Sprintf("%s/%s.private", keyDir, selector)
+	privateChanged, err := ensurePrivateFile(client, privatePath, string(private))
+	if err != nil {
+		return false, fmt.Errorf("failed to upload DKIM private key: %v", err)
+	}
+
+	publicPath := fmt.Sprintf("%s/%s.txt", keyDir, selector)
+	publicChanged, err := ensureFile(client, publicPath, dkim.KeyFile(selector, domain, record))
+	if err != nil {
+		return false, err
+	}
+
+	if owner != "" {
+		cmd := fmt.Sprintf("chown %s %s %s %s", owner, keyDir, publicPath, privatePath)
+		if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+			return false, err
+		}
+	}
+	return privateChanged || publicChanged, nil
+}
+
+// writeFile replaces a file on the server with content
+func writeFile(client *ssh.Client, path, content string) error {
+	cmd := fmt.Sprintf("printf '%%s' '%s' > %s", strings.ReplaceAll(content, "'", "'\\''"), path)
+	_, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	return err
+}
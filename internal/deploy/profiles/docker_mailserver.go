@@ -2,6 +2,8 @@ package profiles
 
 import (
 	"fmt"
+	"mailops/internal/dkim"
+	"mailops/internal/mtasts"
 	"mailops/internal/ssh"
 	"strings"
 	"time"
@@ -13,6 +15,35 @@ type DockerMailserverProfile struct {
 	Hostname      string
 	ContainerName string
 	DKIMSelector  string
+	MTASTSPolicy  string // MTA-STS policy text served at mta-sts.<domain>, empty to skip
+	ACME          bool   // Serve the certificate of InstallCertificate instead of a self-signed one
+}
+
+func init() {
+	Register("docker_mailserver", func(opts Options) Profile {
+		return &DockerMailserverProfile{
+			Domain:        opts.Domain,
+			Hostname:      opts.Hostname,
+			ContainerName: fmt.Sprintf("mailserver-%d", opts.RowID),
+			DKIMSelector:  opts.DKIMSelector,
+			MTASTSPolicy:  opts.MTASTSPolicy,
+			ACME:          opts.ACME,
+		}
+	})
+}
+
+// Describe returns the name of the stack
+func (p *DockerMailserverProfile) Describe() string {
+	return "Docker MailServer"
+}
+
+// HealthSpec returns the ports published by the container and the host
+// services it depends on
+func (p *DockerMailserverProfile) HealthSpec() HealthSpec {
+	return HealthSpec{
+		Ports:    []int{25, 587, 465, 143, 993},
+		Services: []string{"docker"},
+	}
 }
 
 // Deploy deploys Docker MailServer
@@ -32,6 +63,23 @@ func (p *DockerMailserverProfile) Deploy(sshClient *ssh.Client) (*DeployResult,
 		return nil, fmt.Errorf("failed to create docker-compose: %v", err)
 	}
 	
+	// Prepare the MTA-STS policy site
+	if p.MTASTSPolicy != "" {
+		if err := p.configureMTASTS(sshClient); err != nil {
+			return nil, fmt.Errorf("failed to configure MTA-STS: %v", err)
+		}
+	}
+	
+	// Install a placeholder until the ACME certificate is issued
+	if p.ACME {
+		if _, err := sshClient.ExecuteCommandWithOutput("mkdir -p "+dockerTLSDir, 30*time.Second); err != nil {
+			return nil, err
+		}
+		if err := placeholderCertificate(sshClient, p.mailHost(), dockerTLSDir+"/fullchain.pem", dockerTLSDir+"/privkey.pem"); err != nil {
+			return nil, err
+		}
+	}
+	
 	// Start containers
 	if err := p.startContainers(sshClient); err != nil {
 		return nil, fmt.Errorf("failed to start containers: %v", err)
@@ -43,7 +91,7 @@ func (p *DockerMailserverProfile) Deploy(sshClient *ssh.Client) (*DeployResult,
 	}
 	
 	return &DeployResult{
-		Version: "Docker MailServer",
+		Version: p.Describe(),
 		Message: "Deployment successful",
 	}, nil
 }
@@ -145,10 +193,7 @@ func (p *DockerMailserverProfile) checkAndInstallDockerCompose(sshClient *ssh.Cl
 
 // createDockerCompose creates docker-compose.yml file
 func (p *DockerMailserverProfile) createDockerCompose(sshClient *ssh.Client) error {
-	selector := p.DKIMSelector
-	if selector == "" {
-		selector = "mail"
-	}
+	selector := p.selector()
 
 	dockerCompose := fmt.Sprintf(`
 version: '3.8'
@@ -174,7 +219,7 @@ services:
       - ENABLE_MANAGESIEVE=1
       - ONE_DIR=1
       - ENABLE_POP3=1
-      - SSL_TYPE=self-signed
+      - %s
       - ENABLE_OPENDKIM=1
       - ENABLE_OPENDMARC=1
       - ENABLE_POLICYD_SPF=1
@@ -192,9 +237,27 @@ services:
 		p.ContainerName,
 		p.Hostname,
 		p.Domain,
+		p.sslEnvironment(),
 		selector,
 	)
 	
+	// Serve the MTA-STS policy from a separate nginx container
+	if p.MTASTSPolicy != "" {
+		dockerCompose += fmt.Sprintf(`  mta-sts:
+    image: nginx:alpine
+    container_name: %s-mta-sts
+    ports:
+      - "443:443"
+    volumes:
+      - ./mta-sts/html:/usr/share/nginx/html:ro
+      - ./mta-sts/default.conf:/etc/nginx/conf.d/default.conf:ro
+      - ./mta-sts/certs:/etc/nginx/certs:ro
+    restart: always
+`,
+			p.ContainerName,
+		)
+	}
+	
 	cmd := fmt.Sprintf("mkdir -p /opt/mailserver && cd /opt/mailserver && cat > docker-compose.yml << 'EOF'\n%s\nEOF", dockerCompose)
 	_, err := sshClient.ExecuteCommandWithOutput(cmd, 60*time.Second)
 	if err != nil {
@@ -204,6 +267,45 @@ services:
 	return nil
 }
 
+// configureMTASTS writes the policy, the nginx site and a self-signed
+// certificate for the mta-sts container
+func (p *DockerMailserverProfile) configureMTASTS(sshClient *ssh.Client) error {
+	dir := "/opt/mailserver/mta-sts"
+	_, err := sshClient.ExecuteCommandWithOutput(fmt.Sprintf("mkdir -p %s/html/.well-known %s/certs", dir, dir), 30*time.Second)
+	if err != nil {
+		return err
+	}
+	
+	// Write the policy
+	cmd := fmt.Sprintf("printf '%%s' '%s' > %s/html%s", strings.ReplaceAll(p.MTASTSPolicy, "'", "'\\''"), dir, mtasts.PolicyPath)
+	_, err = sshClient.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	
+	// Write the site configuration
+	siteConf := mtaSTSSiteConfig(p.Domain, "/usr/share/nginx/html", "/etc/nginx/certs/cert.pem", "/etc/nginx/certs/key.pem")
+	cmd = fmt.Sprintf("cat > %s/default.conf << 'EOF'\n%s\nEOF", dir, siteConf)
+	_, err = sshClient.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	
+	// Create a certificate unless one is already installed
+	cmd = fmt.Sprintf("test -f %s/certs/cert.pem || openssl req -x509 -newkey rsa:2048 -nodes -days 365 -subj '/CN=%s' -keyout %s/certs/key.pem -out %s/certs/cert.pem",
+		dir,
+		mtasts.PolicyHost(p.Domain),
+		dir,
+		dir,
+	)
+	_, err = sshClient.ExecuteCommandWithOutput(cmd, 60*time.Second)
+	if err != nil {
+		return err
+	}
+	
+	return nil
+}
+
 // startContainers starts the mailserver container
 func (p *DockerMailserverProfile) startContainers(sshClient *ssh.Client) error {
 	cmd := "cd /opt/mailserver && docker-compose pull"
@@ -234,8 +336,7 @@ func (p *DockerMailserverProfile) healthCheck(sshClient *ssh.Client) error {
 	}
 	
 	// Check critical ports
-	ports := []int{25, 587, 465, 143, 993}
-	for _, port := range ports {
+	for _, port := range p.HealthSpec().Ports {
 		if !sshClient.CheckPort(port, 5*time.Second) {
 			return fmt.Errorf("port %d is not responding", port)
 		}
@@ -244,70 +345,253 @@ func (p *DockerMailserverProfile) healthCheck(sshClient *ssh.Client) error {
 	return nil
 }
 
-// GenerateDKIM generates DKIM keys using docker-mailserver
-func (p *DockerMailserverProfile) GenerateDKIM(sshClient *ssh.Client) (string, error) {
-	selector := p.DKIMSelector
-	if selector == "" {
-		selector = "mail"
+// InstallDKIMKey uploads the key of a selector to the config volume next
+// to the existing keys, without changing the key mail is signed with.
+// docker-mailserver fixes the ownership when it copies the keys into place.
+func (p *DockerMailserverProfile) InstallDKIMKey(sshClient *ssh.Client, selector string, key *dkim.Key) error {
+	_, err := installDKIMKey(sshClient, p.dkimKeyDir(), p.Domain, selector, "", key)
+	return err
+}
+
+// ReadDKIMKey returns the TXT content of the key of a selector
+func (p *DockerMailserverProfile) ReadDKIMKey(sshClient *ssh.Client, selector string) (string, error) {
+	return readDKIMKey(sshClient, p.dkimKeyDir(), selector)
+}
+
+// SwitchDKIMSelector makes the container sign with the key of a selector.
+// docker-mailserver copies the tables into place when it starts.
+func (p *DockerMailserverProfile) SwitchDKIMSelector(sshClient *ssh.Client, selector string) error {
+	keyFile := fmt.Sprintf("%s/%s.private", p.dkimKeyDir(), selector)
+	if _, err := sshClient.ExecuteCommandWithOutput(fmt.Sprintf("test -f %s", keyFile), 30*time.Second); err != nil {
+		return fmt.Errorf("DKIM key %s not found", keyFile)
 	}
 	
-	// Generate DKIM keys using docker-mailserver's setup script
-	cmd := fmt.Sprintf("docker exec %s setup config dkim", p.ContainerName)
-	output, err := sshClient.ExecuteCommandWithOutput(cmd, 60*time.Second)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate DKIM keys: %v, output: %s", err, output)
+	configDir := "/opt/mailserver/config/opendkim"
+	if err := writeFile(sshClient, configDir+"/SigningTable", dkimSigningTable(p.Domain, selector)); err != nil {
+		return err
+	}
+	if err := writeFile(sshClient, configDir+"/KeyTable", dkimKeyTable(p.Domain, selector, "/etc/opendkim/keys/"+p.Domain)); err != nil {
+		return err
 	}
 	
-	// Read DKIM public key from the config volume
-	// The key file is located at: /tmp/docker-mailserver/opendkim/<selector>.txt
-	dkimKeyPath := fmt.Sprintf("/opt/mailserver/config/opendkim/%s.txt", selector)
+	cmd := fmt.Sprintf("sed -i 's|POSTFIX_DKIM_SELECTOR=.*|POSTFIX_DKIM_SELECTOR=%s|' /opt/mailserver/docker-compose.yml", selector)
+	if _, err := sshClient.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return err
+	}
 	
-	// Wait a moment for files to be written
-	time.Sleep(2 * time.Second)
+	_, err := sshClient.ExecuteCommandWithOutput(fmt.Sprintf("docker restart %s", p.ContainerName), 120*time.Second)
+	return err
+}
+
+// RemoveDKIMKey deletes the key files of a retired selector
+func (p *DockerMailserverProfile) RemoveDKIMKey(sshClient *ssh.Client, selector string) error {
+	_, err := sshClient.ExecuteCommandWithOutput(fmt.Sprintf("rm -f %s/%s.private %s/%s.txt", p.dkimKeyDir(), selector, p.dkimKeyDir(), selector), 30*time.Second)
+	return err
+}
+
+// GenerateDKIM installs the key of a selector and makes the container sign
+// with it
+func (p *DockerMailserverProfile) GenerateDKIM(sshClient *ssh.Client, selector string, key *dkim.Key) (string, error) {
+	return generateDKIM(p, sshClient, selector, key)
+}
+
+// Uninstall stops and removes the container. The mail data, state and
+// config volumes under /opt/mailserver are kept.
+func (p *DockerMailserverProfile) Uninstall(sshClient *ssh.Client) error {
+	cmd := "if [ -f /opt/mailserver/docker-compose.yml ]; then cd /opt/mailserver && docker-compose down; fi"
+	if _, err := sshClient.ExecuteCommandWithOutput(cmd, 120*time.Second); err != nil {
+		return fmt.Errorf("failed to stop containers: %v", err)
+	}
+	return nil
+}
+
+// MaildirPath returns the Maildir of a mailbox of the domain on the host
+func (p *DockerMailserverProfile) MaildirPath(user string) string {
+	return fmt.Sprintf("/opt/mailserver/maildata/%s/%s", p.Domain, user)
+}
+
+// dkimKeyDir returns the directory on the host holding the DKIM keys of the domain
+func (p *DockerMailserverProfile) dkimKeyDir() string {
+	return fmt.Sprintf("/opt/mailserver/config/opendkim/keys/%s", p.Domain)
+}
+
+// selector returns the configured DKIM selector
+func (p *DockerMailserverProfile) selector() string {
+	if p.DKIMSelector == "" {
+		return "mail"
+	}
+	return p.DKIMSelector
+}
+
+// dockerTLSDir is where the ACME certificate is installed on the host, in
+// the config volume mounted at /tmp/docker-mailserver
+const dockerTLSDir = "/opt/mailserver/config/ssl"
+
+// sslEnvironment returns the compose environment selecting the certificate
+func (p *DockerMailserverProfile) sslEnvironment() string {
+	if !p.ACME {
+		return "SSL_TYPE=self-signed"
+	}
+	return strings.Join([]string{
+		"SSL_TYPE=manual",
+		"SSL_CERT_PATH=/tmp/docker-mailserver/ssl/fullchain.pem",
+		"SSL_KEY_PATH=/tmp/docker-mailserver/ssl/privkey.pem",
+	}, "\n      - ")
+}
+
+// mailHost returns the host name of the mail server
+func (p *DockerMailserverProfile) mailHost() string {
+	return fmt.Sprintf("%s.%s", p.Hostname, p.Domain)
+}
+
+// ServeHTTPChallenge serves a key authorization from a temporary nginx
+// container on port 80, which the mail container leaves free
+func (p *DockerMailserverProfile) ServeHTTPChallenge(sshClient *ssh.Client, token, keyAuth string) (func() error, error) {
+	root := "/opt/mailserver/acme-challenge"
+	name := p.ContainerName + "-acme"
+	stop := func() error {
+		_, err := sshClient.ExecuteCommandWithOutput(fmt.Sprintf("docker rm -f %s >/dev/null 2>&1; rm -rf %s", name, root), 60*time.Second)
+		return err
+	}
 	
-	// Read the public key file
-	dkimPublicKey, err := sshClient.ExecuteCommandWithOutput(fmt.Sprintf("cat %s", dkimKeyPath), 30*time.Second)
+	// Remove a container left behind by an interrupted run
+	if err := stop(); err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("mkdir -p %s && docker run -d --name %s -p 80:80 -v %s:/usr/share/nginx/html:ro nginx:alpine", root, name, root)
+	if _, err := sshClient.ExecuteCommandWithOutput(cmd, 120*time.Second); err != nil {
+		stop()
+		return nil, fmt.Errorf("failed to start challenge server: %v", err)
+	}
+	if err := writeChallenge(sshClient, root, p.mailHost(), token, keyAuth); err != nil {
+		stop()
+		return nil, err
+	}
+	return stop, nil
+}
+
+// InstallCertificate installs the certificate in the config volume, and in
+// the MTA-STS container's when it runs, restarting the containers whose
+// certificate changed
+func (p *DockerMailserverProfile) InstallCertificate(sshClient *ssh.Client, chain, key []byte) error {
+	if _, err := sshClient.ExecuteCommandWithOutput("mkdir -p "+dockerTLSDir, 30*time.Second); err != nil {
+		return err
+	}
+	changed, err := installCertificate(sshClient, dockerTLSDir+"/fullchain.pem", dockerTLSDir+"/privkey.pem", chain, key)
 	if err != nil {
-		return "", fmt.Errorf("failed to read DKIM public key: %v", err)
+		return err
 	}
-	
-	// Normalize DKIM key - extract just the p= value
-	dkimPublicKey = p.normalizeDKIMKey(dkimPublicKey)
-	
-	if dkimPublicKey == "" {
-		return "", fmt.Errorf("DKIM public key is empty")
+	if changed {
+		if _, err := sshClient.ExecuteCommandWithOutput(fmt.Sprintf("docker restart %s", p.ContainerName), 120*time.Second); err != nil {
+			return err
+		}
 	}
 	
-	return dkimPublicKey, nil
+	certDir := "/opt/mailserver/mta-sts/certs"
+	if _, err := sshClient.ExecuteCommandWithOutput("test -d "+certDir, 30*time.Second); err != nil {
+		return nil
+	}
+	changed, err = installCertificate(sshClient, certDir+"/cert.pem", certDir+"/key.pem", chain, key)
+	if err != nil || !changed {
+		return err
+	}
+	_, err = sshClient.ExecuteCommandWithOutput(fmt.Sprintf("docker restart %s-mta-sts", p.ContainerName), 120*time.Second)
+	return err
+}
+
+// The account and alias tables docker-mailserver's setup CLI maintains in
+// the config volume
+const (
+	dockerAccountsFile = "/opt/mailserver/config/postfix-accounts.cf"
+	dockerAliasesFile  = "/opt/mailserver/config/postfix-virtual.cf"
+)
+
+// setup runs a command of docker-mailserver's setup CLI in the container,
+// with input on its standard input for the prompts it would show
+func (p *DockerMailserverProfile) setup(sshClient *ssh.Client, input string, args ...string) error {
+	cmd := fmt.Sprintf("docker exec %s setup %s", p.ContainerName, strings.Join(args, " "))
+	if input != "" {
+		cmd = fmt.Sprintf("docker exec -i %s setup %s << 'MAILOPS_INPUT'\n%s\nMAILOPS_INPUT", p.ContainerName, strings.Join(args, " "), input)
+	}
+	if _, err := sshClient.ExecuteCommandWithOutput(cmd, 60*time.Second); err != nil {
+		return fmt.Errorf("setup %s %s failed: %v", args[0], args[1], err)
+	}
+	return nil
+}
+
+// AddMailbox creates a mailbox with setup email add. The password is given
+// at its prompt, so it does not show up in the container's processes.
+func (p *DockerMailserverProfile) AddMailbox(sshClient *ssh.Client, address, password string) error {
+	return p.setup(sshClient, password, "email", "add", address)
+}
+
+// RemoveMailbox removes a mailbox with setup email del, declining to delete
+// its mail
+func (p *DockerMailserverProfile) RemoveMailbox(sshClient *ssh.Client, address string) error {
+	return p.setup(sshClient, "n", "email", "del", address)
+}
+
+// SetPassword changes the password of a mailbox with setup email update
+func (p *DockerMailserverProfile) SetPassword(sshClient *ssh.Client, address, password string) error {
+	return p.setup(sshClient, password, "email", "update", address)
 }
 
-// normalizeDKIMKey extracts the p= value from DKIM record
-func (p *DockerMailserverProfile) normalizeDKIMKey(dkimContent string) string {
-	lines := strings.Split(dkimContent, "\n")
-	var keyParts []string
+// AddAlias forwards address to each destination with setup alias add
+func (p *DockerMailserverProfile) AddAlias(sshClient *ssh.Client, address string, destinations []string) error {
+	content, err := readFile(sshClient, dockerAliasesFile)
+	if err != nil {
+		return err
+	}
+	var existing []string
+	if alias := findAlias(parseAliases(content), address); alias != nil {
+		existing = alias.Destinations
+	}
 	
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, ";") {
+	for _, destination := range destinations {
+		if len(addDestinations(existing, []string{destination})) == len(existing) {
 			continue
 		}
-		if strings.Contains(line, "p=") {
-			// Extract the p= value
-			parts := strings.SplitN(line, "p=", 2)
-			if len(parts) == 2 {
-				keyValue := strings.TrimSpace(parts[1])
-				// Remove quotes and trailing semicolon
-				keyValue = strings.Trim(keyValue, `"`)
-				keyValue = strings.TrimSuffix(keyValue, ";")
-				keyValue = strings.TrimSpace(keyValue)
-				keyParts = append(keyParts, keyValue)
-			}
+		if err := p.setup(sshClient, "", "alias", "add", address, destination); err != nil {
+			return err
 		}
 	}
-	
-	if len(keyParts) == 0 {
-		return dkimContent
+	return nil
+}
+
+// RemoveAlias stops forwarding address to destinations, or to all of them,
+// with setup alias del
+func (p *DockerMailserverProfile) RemoveAlias(sshClient *ssh.Client, address string, destinations []string) error {
+	content, err := readFile(sshClient, dockerAliasesFile)
+	if err != nil {
+		return err
+	}
+	alias := findAlias(parseAliases(content), address)
+	if alias == nil {
+		return fmt.Errorf("alias %s does not exist", address)
+	}
+	if len(destinations) == 0 {
+		destinations = alias.Destinations
+	} else if _, err := removeDestinations(address, alias.Destinations, destinations); err != nil {
+		return err
 	}
 	
-	return fmt.Sprintf("v=DKIM1; k=rsa; p=%s", keyParts[0])
-}
\ No newline at end of file
+	for _, destination := range destinations {
+		if err := p.setup(sshClient, "", "alias", "del", address, destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListUsers returns the mailboxes and aliases of the tables setup maintains
+func (p *DockerMailserverProfile) ListUsers(sshClient *ssh.Client) (*UserList, error) {
+	accounts, err := readFile(sshClient, dockerAccountsFile)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := readFile(sshClient, dockerAliasesFile)
+	if err != nil {
+		return nil, err
+	}
+	return &UserList{Mailboxes: tableKeys(accounts, "|"), Aliases: parseAliases(aliases)}, nil
+}
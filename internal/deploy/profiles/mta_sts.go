@@ -0,0 +1,38 @@
+package profiles
+
+import (
+	"fmt"
+	"mailops/internal/mtasts"
+)
+
+// mtaSTSSiteConfig returns an nginx server block that serves only the
+// MTA-STS policy over HTTPS for the policy host of domain
+func mtaSTSSiteConfig(domain, root, certFile, keyFile string) string {
+	return fmt.Sprintf(`server {
+    listen 443 ssl;
+    listen [::]:443 ssl;
+    server_name %s;
+
+    ssl_certificate     %s;
+    ssl_certificate_key %s;
+    ssl_protocols       TLSv1.2 TLSv1.3;
+
+    root %s;
+
+    location = %s {
+        default_type text/plain;
+        add_header Cache-Control "max-age=300";
+    }
+
+    location / {
+        return 404;
+    }
+}
+`,
+		mtasts.PolicyHost(domain),
+		certFile,
+		keyFile,
+		root,
+		mtasts.PolicyPath,
+	)
+}
@@ -2,7 +2,11 @@ package profiles
 
 import (
 	"fmt"
+	"mailops/internal/dkim"
+	"mailops/internal/mtasts"
 	"mailops/internal/ssh"
+	"mailops/internal/users"
+	"path"
 	"strings"
 	"time"
 )
@@ -12,7 +16,10 @@ type PostfixDovecotProfile struct {
 	Domain       string
 	Hostname     string
 	DKIMSelector string
-	DKIMKeySize  int
+	DKIMKey      *dkim.Key // Installed for DKIMSelector during deployment
+	MTASTSPolicy string // MTA-STS policy text served at mta-sts.<domain>, empty to skip
+	ServerHost   string // Host name of a server hosting several domains, empty for the mail host
+	ACME         bool   // Serve the certificate of InstallCertificate instead of the snakeoil one
 }
 
 // DeployResult represents deployment result
@@ -21,74 +28,176 @@ type DeployResult struct {
 	Message string
 }
 
-// Deploy deploys Postfix + Dovecot mail server
+func init() {
+	Register("postfix_dovecot", func(opts Options) Profile {
+		return &PostfixDovecotProfile{
+			Domain:       opts.Domain,
+			Hostname:     opts.Hostname,
+			DKIMSelector: opts.DKIMSelector,
+			DKIMKey:      opts.DKIMKey,
+			MTASTSPolicy: opts.MTASTSPolicy,
+			ServerHost:   opts.ServerHost,
+			ACME:         opts.ACME,
+		}
+	})
+}
+
+// Describe returns the name of the stack
+func (p *PostfixDovecotProfile) Describe() string {
+	return "Postfix + Dovecot"
+}
+
+// HealthSpec returns the ports and services of the stack
+func (p *PostfixDovecotProfile) HealthSpec() HealthSpec {
+	return HealthSpec{
+		Ports:    []int{25, 587, 465, 143, 993},
+		Services: []string{"postfix", "dovecot", "opendkim"},
+	}
+}
+
+// Deploy deploys Postfix + Dovecot mail server. It converges: a re-run
+// rewrites only config that differs and restarts only affected services.
+// Domains deployed to the same server earlier are kept: the mailbox, DKIM
+// and certificate tables gain an entry for the domain.
 func (p *PostfixDovecotProfile) Deploy(client *ssh.Client) (*DeployResult, error) {
 	// Step 1: Install mail packages
-	packages := []string{
-		"postfix",
-		"dovecot-core",
-		"dovecot-imapd",
-		"dovecot-pop3d",
-		"opendkim",
-		"opendkim-tools",
-		"mailutils",
-	}
-	
-	for _, pkg := range packages {
-		if err := client.InstallPackage(pkg); err != nil {
-			return nil, fmt.Errorf("failed to install %s: %v", pkg, err)
+	if err := installPackages(client, "postfix", "dovecot-core", "dovecot-imapd", "dovecot-pop3d", "opendkim", "opendkim-tools", "mailutils"); err != nil {
+		return nil, err
+	}
+	
+	// Step 2: Install placeholders until the ACME certificates are issued,
+	// for the mail host and for the server's default host
+	if p.ACME {
+		for _, host := range []string{p.serverHost(), p.mailHost()} {
+			certFile, keyFile := p.certFiles(host)
+			if _, err := client.ExecuteCommandWithOutput("mkdir -p "+path.Dir(certFile), 30*time.Second); err != nil {
+				return nil, err
+			}
+			if err := placeholderCertificate(client, host, certFile, keyFile); err != nil {
+				return nil, err
+			}
 		}
 	}
 	
-	// Step 2: Configure Postfix
-	if err := p.configurePostfix(client); err != nil {
-		return nil, fmt.Errorf("failed to configure Postfix: %v", err)
+	// Step 3: Create the owner of the virtual mailboxes and their tables
+	uid, gid, err := p.configureMailboxes(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure mailboxes: %w", err)
 	}
 	
-	// Step 3: Configure Dovecot
-	if err := p.configureDovecot(client); err != nil {
-		return nil, fmt.Errorf("failed to configure Dovecot: %v", err)
+	// Step 4: Configure Postfix
+	postfixChanged, err := p.configurePostfix(client, uid, gid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure Postfix: %w", err)
 	}
 	
-	// Step 4: Configure OpenDKIM
-	if err := p.configureOpenDKIM(client); err != nil {
-		return nil, fmt.Errorf("failed to configure OpenDKIM: %v", err)
+	// Step 5: Configure Dovecot
+	dovecotChanged, err := p.configureDovecot(client, uid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure Dovecot: %w", err)
 	}
 	
-	// Step 5: Start services
-	services := []string{"postfix", "dovecot"}
-	for _, svc := range services {
-		_, err := client.ExecuteCommandWithOutput(fmt.Sprintf("systemctl enable %s", svc), 30*time.Second)
-		if err != nil {
-			return nil, fmt.Errorf("failed to enable %s: %v", svc, err)
+	// Step 6: Configure OpenDKIM
+	opendkimChanged, err := p.configureOpenDKIM(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure OpenDKIM: %w", err)
+	}
+	
+	// Step 7: Serve the MTA-STS policy
+	if p.MTASTSPolicy != "" {
+		if err := p.configureMTASTS(client); err != nil {
+			return nil, fmt.Errorf("failed to configure MTA-STS: %w", err)
 		}
-		
-		_, err = client.ExecuteCommandWithOutput(fmt.Sprintf("systemctl restart %s", svc), 30*time.Second)
-		if err != nil {
-			return nil, fmt.Errorf("failed to restart %s: %v", svc, err)
+	}
+	
+	// Step 8: Start services, the milter before the MTA that uses it
+	services := []struct {
+		name    string
+		changed bool
+	}{
+		{"opendkim", opendkimChanged},
+		{"postfix", postfixChanged},
+		{"dovecot", dovecotChanged},
+	}
+	for _, svc := range services {
+		if err := startService(client, svc.name, svc.changed); err != nil {
+			return nil, err
 		}
 	}
 	
 	return &DeployResult{
-		Version: "Postfix + Dovecot",
+		Version: p.Describe(),
 		Message: "Deployment successful",
 	}, nil
 }
 
-// configurePostfix configures Postfix
-func (p *PostfixDovecotProfile) configurePostfix(client *ssh.Client) error {
+// masterCfLegacy is the service block earlier versions appended to
+// master.cf on every run, without markers
+const masterCfLegacy = `
+submission inet n       -       y       -       -       smtpd
+  -o syslog_name=postfix/submission
+  -o smtpd_tls_security_level=encrypt
+  -o smtpd_sasl_auth_enable=yes
+  -o smtpd_tls_auth_only=yes
+  -o smtpd_reject_unlisted_recipient=no
+  -o smtpd_client_restrictions=$mua_client_restrictions
+  -o smtpd_helo_restrictions=$mua_helo_restrictions
+  -o smtpd_sender_restrictions=$mua_sender_restrictions
+  -o smtpd_recipient_restrictions=
+  -o smtpd_relay_restrictions=permit_sasl_authenticated,reject
+  -o milter_macro_daemon_name=ORIGINATING
+
+smtps     inet  n       -       y       -       -       smtpd
+  -o syslog_name=postfix/smtps
+  -o smtpd_tls_wrappermode=yes
+  -o smtpd_sasl_auth_enable=yes
+  -o smtpd_reject_unlisted_recipient=no
+  -o smtpd_client_restrictions=$mua_client_restrictions
+  -o smtpd_helo_restrictions=$mua_helo_restrictions
+  -o smtpd_sender_restrictions=$mua_sender_restrictions
+  -o smtpd_recipient_restrictions=
+  -o smtpd_relay_restrictions=permit_sasl_authenticated,reject
+  -o milter_macro_daemon_name=ORIGINATING
+`
+
+// configurePostfix configures Postfix to deliver the virtual mailboxes as
+// uid and gid and reports whether its configuration changed
+func (p *PostfixDovecotProfile) configurePostfix(client *ssh.Client, uid, gid int) (bool, error) {
+	certFile, keyFile := p.tlsFiles()
+	serverHost := p.serverHost()
+	_, serverDomain, _ := strings.Cut(serverHost, ".")
+	
+	// Serve the certificate of each mail host by SNI, the server's default
+	// host getting the one of main.cf
+	sniMaps := ""
+	if p.ACME {
+		if err := p.updateSNIMap(client); err != nil {
+			return false, err
+		}
+		sniMaps = fmt.Sprintf("tls_server_sni_maps = hash:%s\n", sniMap)
+	}
+	
 	// Configure main.cf
 	mainCf := fmt.Sprintf(`
 # Basic configuration
-myhostname = %s.%s
+myhostname = %s
 mydomain = %s
 myorigin = $mydomain
 inet_interfaces = all
 inet_protocols = all
-mydestination = $myhostname, localhost.$mydomain, localhost, $mydomain
+mydestination = $myhostname, localhost.$mydomain, localhost
 mynetworks = 127.0.0.0/8 [::ffff:127.0.0.0]/104 [::1]/128
 home_mailbox = Maildir/
 
+# Virtual mailboxes and aliases, managed with mailops users
+virtual_mailbox_domains = hash:%s
+virtual_mailbox_base = %s
+virtual_mailbox_maps = hash:%s
+virtual_alias_maps = hash:%s
+virtual_minimum_uid = %d
+virtual_uid_maps = static:%d
+virtual_gid_maps = static:%d
+
 # SMTP authentication
 smtpd_sasl_auth_enable = yes
 smtpd_sasl_type = dovecot
@@ -97,12 +206,12 @@ smtpd_sasl_security_options = noanonymous, noplaintext
 smtpd_sasl_tls_security_options = noanonymous
 
 # TLS configuration
-smtpd_tls_cert_file = /etc/ssl/certs/ssl-cert-snakeoil.pem
-smtpd_tls_key_file = /etc/ssl/private/ssl-cert-snakeoil.key
+smtpd_tls_cert_file = %s
+smtpd_tls_key_file = %s
 smtpd_tls_security_level = may
 smtp_tls_security_level = may
 smtpd_tls_protocols = !SSLv2, !SSLv3
-
+%s
 # Message size limits
 message_size_limit = 25600000
 mailbox_size_limit = 1000000000
@@ -113,65 +222,42 @@ milter_default_action = accept
 smtpd_milters = inet:localhost:12301
 non_smtpd_milters = inet:localhost:12301
 `,
-		p.Hostname,
-		p.Domain,
-		p.Domain,
+		serverHost,
+		serverDomain,
+		vdomainsMap,
+		vmailDir,
+		vmailboxMap,
+		virtualMap,
+		uid,
+		uid,
+		gid,
+		certFile,
+		keyFile,
+		sniMaps,
 	)
 	
-	// Backup original config
-	_, err := client.ExecuteCommandWithOutput("cp /etc/postfix/main.cf /etc/postfix/main.cf.bak", 30*time.Second)
+	mainChanged, err := ensureConfig(client, "/etc/postfix/main.cf", mainCf)
 	if err != nil {
-		return err
+		return false, err
 	}
 	
-	// Write new config
-	cmd := fmt.Sprintf("echo '%s' > /etc/postfix/main.cf", strings.ReplaceAll(mainCf, "'", "'\\''"))
-	_, err = client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	// Add the submission and smtps services to master.cf, replacing any
+	// copies appended by earlier versions
+	masterChanged, err := ensureBlock(client, "/etc/postfix/master.cf", strings.TrimSpace(masterCfLegacy), masterCfLegacy+"\n")
 	if err != nil {
-		return err
+		return false, err
 	}
 	
-	// Configure master.cf for submission and smtps
-	masterCfExtra := `
-submission inet n       -       y       -       -       smtpd
-  -o syslog_name=postfix/submission
-  -o smtpd_tls_security_level=encrypt
-  -o smtpd_sasl_auth_enable=yes
-  -o smtpd_tls_auth_only=yes
-  -o smtpd_reject_unlisted_recipient=no
-  -o smtpd_client_restrictions=$mua_client_restrictions
-  -o smtpd_helo_restrictions=$mua_helo_restrictions
-  -o smtpd_sender_restrictions=$mua_sender_restrictions
-  -o smtpd_recipient_restrictions=
-  -o smtpd_relay_restrictions=permit_sasl_authenticated,reject
-  -o milter_macro_daemon_name=ORIGINATING
-
-smtps     inet  n       -       y       -       -       smtpd
-  -o syslog_name=postfix/smtps
-  -o smtpd_tls_wrappermode=yes
-  -o smtpd_sasl_auth_enable=yes
-  -o smtpd_reject_unlisted_recipient=no
-  -o smtpd_client_restrictions=$mua_client_restrictions
-  -o smtpd_helo_restrictions=$mua_helo_restrictions
-  -o smtpd_sender_restrictions=$mua_sender_restrictions
-  -o smtpd_recipient_restrictions=
-  -o smtpd_relay_restrictions=permit_sasl_authenticated,reject
-  -o milter_macro_daemon_name=ORIGINATING
-`
-	
-	cmd = fmt.Sprintf("echo '%s' >> /etc/postfix/master.cf", strings.ReplaceAll(masterCfExtra, "'", "'\\''"))
-	_, err = client.ExecuteCommandWithOutput(cmd, 30*time.Second)
-	if err != nil {
-		return err
-	}
-	
-	return nil
+	return mainChanged || masterChanged, nil
 }
 
-// configureDovecot configures Dovecot
-func (p *PostfixDovecotProfile) configureDovecot(client *ssh.Client) error {
+// configureDovecot configures Dovecot to authenticate the virtual mailboxes
+// and read them as uid, and reports whether its configuration changed
+func (p *PostfixDovecotProfile) configureDovecot(client *ssh.Client, uid int) (bool, error) {
+	certFile, keyFile := p.tlsFiles()
+	
 	// Configure dovecot.conf
-	dovecotConf := `
+	dovecotConf := fmt.Sprintf(`
 # Dovecot configuration
 protocols = imap pop3
 listen = *
@@ -180,8 +266,8 @@ instance_name = dovecot
 
 # SSL
 ssl = yes
-ssl_cert = </etc/ssl/certs/ssl-cert-snakeoil.pem
-ssl_key = </etc/ssl/private/ssl-cert-snakeoil.key
+ssl_cert = <%s
+ssl_key = <%s
 ssl_protocols = !SSLv2 !SSLv3
 
 # Logging
@@ -191,6 +277,7 @@ verbose_ssl = no
 
 # Mail location
 mail_location = maildir:~/Maildir
+first_valid_uid = %d
 
 # Authentication
 auth_mechanisms = plain login
@@ -200,25 +287,43 @@ disable_plaintext_auth = yes
 auth_socket_path = /var/run/dovecot/auth-client
 
 !include conf.d/*.conf
-`
+`,
+		certFile,
+		keyFile,
+		uid,
+	)
 	
-	cmd := fmt.Sprintf("echo '%s' > /etc/dovecot/dovecot.conf", strings.ReplaceAll(dovecotConf, "'", "'\\''"))
-	_, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	changed, err := ensureConfig(client, "/etc/dovecot/dovecot.conf", dovecotConf)
 	if err != nil {
-		return err
+		return false, err
 	}
 	
-	// Configure 10-auth.conf
-	authConf := `
+	// Configure 10-auth.conf for the virtual mailboxes, logging in with
+	// their address
+	authConf := fmt.Sprintf(`
 disable_plaintext_auth = yes
 auth_mechanisms = plain login
-!include auth-system.conf.ext
-`
+auth_username_format = %%Lu
+
+passdb {
+  driver = passwd-file
+  args = scheme=SHA512-CRYPT username_format=%%u %s
+}
+
+userdb {
+  driver = static
+  args = uid=%s gid=%s home=%s/%%d/%%n
+}
+`,
+		dovecotUsers,
+		vmailUser,
+		vmailUser,
+		vmailDir,
+	)
 	
-	cmd = fmt.Sprintf("echo '%s' > /etc/dovecot/conf.d/10-auth.conf", strings.ReplaceAll(authConf, "'", "'\\''"))
-	_, err = client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	authChanged, err := ensureConfig(client, "/etc/dovecot/conf.d/10-auth.conf", authConf)
 	if err != nil {
-		return err
+		return false, err
 	}
 	
 	// Configure 10-master.conf for Postfix SASL
@@ -244,6 +349,11 @@ service pop3-login {
 }
 
 service auth {
+  unix_listener /var/spool/postfix/private/auth {
+    mode = 0660
+    user = postfix
+    group = postfix
+  }
   unix_listener /var/run/dovecot/auth-client {
     mode = 0666
     user = postfix
@@ -256,20 +366,30 @@ service auth-worker {
 }
 `
 	
-	cmd = fmt.Sprintf("echo '%s' > /etc/dovecot/conf.d/10-master.conf", strings.ReplaceAll(masterConf, "'", "'\\''"))
-	_, err = client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	masterChanged, err := ensureConfig(client, "/etc/dovecot/conf.d/10-master.conf", masterConf)
 	if err != nil {
-		return err
+		return false, err
 	}
 	
-	return nil
+	// Serve the certificate of the mail host to clients asking for it
+	sniChanged := false
+	if p.ACME {
+		hostCert, hostKey := p.certFiles(p.mailHost())
+		sniConf := fmt.Sprintf("local_name %s {\n  ssl_cert = <%s\n  ssl_key = <%s\n}\n", p.mailHost(), hostCert, hostKey)
+		if sniChanged, err = ensureFile(client, fmt.Sprintf("/etc/dovecot/conf.d/90-sni-%s.conf", p.mailHost()), sniConf); err != nil {
+			return false, err
+		}
+	}
+	
+	return changed || authChanged || masterChanged || sniChanged, nil
 }
 
-// configureOpenDKIM configures OpenDKIM
-func (p *PostfixDovecotProfile) configureOpenDKIM(client *ssh.Client) error {
+// configureOpenDKIM configures OpenDKIM to sign with the key of
+// DKIMSelector and reports whether its configuration changed
+func (p *PostfixDovecotProfile) configureOpenDKIM(client *ssh.Client) (bool, error) {
 	// Create directory structure
 	dirs := []string{
-		fmt.Sprintf("/etc/opendkim/keys/%s", p.Domain),
+		p.dkimKeyDir(),
 		"/var/run/opendkim",
 	}
 	
@@ -277,12 +397,79 @@ func (p *PostfixDovecotProfile) configureOpenDKIM(client *ssh.Client) error {
 		cmd := fmt.Sprintf("mkdir -p %s", dir)
 		_, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second)
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
 	
-	// Configure opendkim.conf
-	opendkimConf := fmt.Sprintf(`
+	// Install the DKIM key generated by the caller
+	if p.DKIMKey == nil {
+		return false, fmt.Errorf("no DKIM key for selector %s", p.DKIMSelector)
+	}
+	keyChanged, err := installDKIMKey(client, p.dkimKeyDir(), p.Domain, p.DKIMSelector, "opendkim:opendkim", p.DKIMKey)
+	if err != nil {
+		return false, err
+	}
+	
+	signingChanged, err := p.configureSigning(client, p.DKIMSelector)
+	if err != nil {
+		return false, err
+	}
+	
+	// Add the domain and mail host to InternalHosts, keeping the ones of
+	// other domains
+	internalHosts, err := readFile(client, "/etc/opendkim/InternalHosts")
+	if err != nil {
+		return false, err
+	}
+	for _, host := range []string{"127.0.0.1", "localhost", p.Domain, p.mailHost()} {
+		internalHosts = setTableEntry(internalHosts, "", host, host)
+	}
+	hostsChanged, err := ensureFile(client, "/etc/opendkim/InternalHosts", internalHosts)
+	if err != nil {
+		return false, err
+	}
+	
+	_, err = client.ExecuteCommandWithOutput("chown -R opendkim:opendkim /etc/opendkim", 30*time.Second)
+	if err != nil {
+		return false, err
+	}
+	
+	return keyChanged || signingChanged || hostsChanged, nil
+}
+
+// configureSigning points the signing tables entries of the domain at the
+// key of selector, keeping the entries of other domains, and reports whether
+// opendkim.conf or the tables changed
+func (p *PostfixDovecotProfile) configureSigning(client *ssh.Client, selector string) (bool, error) {
+	confChanged, err := ensureConfig(client, "/etc/opendkim.conf", opendkimConf)
+	if err != nil {
+		return false, err
+	}
+	
+	signingTable, err := readFile(client, "/etc/opendkim/SigningTable")
+	if err != nil {
+		return false, err
+	}
+	signingChanged, err := ensureFile(client, "/etc/opendkim/SigningTable", setDKIMSigningEntry(signingTable, p.Domain, selector))
+	if err != nil {
+		return false, err
+	}
+	
+	keyTable, err := readFile(client, "/etc/opendkim/KeyTable")
+	if err != nil {
+		return false, err
+	}
+	keyChanged, err := ensureFile(client, "/etc/opendkim/KeyTable", setDKIMKeyEntry(keyTable, p.Domain, selector, p.dkimKeyDir()))
+	if err != nil {
+		return false, err
+	}
+	
+	return confChanged || signingChanged || keyChanged, nil
+}
+
+// opendkimConf is opendkim.conf, signing the mail of each domain with the
+// key the SigningTable and KeyTable name for it
+const opendkimConf = `
 Syslog                  yes
 SyslogSuccess            yes
 LogWhy                  yes
@@ -314,87 +501,458 @@ InternalHosts           refile:/etc/opendkim/InternalHosts
 # Trusted hosts
 TrustAnchorsFile        /etc/opendkim/TrustAnchors
 
-# Key settings
-KeyFile                 /etc/opendkim/keys/%s/%s.private
-Selector                %s
+# Restart settings
 AutoRestart             Yes
 AutoRestartRate         10/1h
-`,
-		p.Domain,
-		p.DKIMSelector,
-		p.DKIMSelector,
-	)
+`
+
+// dkimKeyDir returns the directory holding the DKIM keys of the domain
+func (p *PostfixDovecotProfile) dkimKeyDir() string {
+	return fmt.Sprintf("/etc/opendkim/keys/%s", p.Domain)
+}
+
+// InstallDKIMKey uploads the key of a selector next to the existing keys,
+// without changing the key mail is signed with
+func (p *PostfixDovecotProfile) InstallDKIMKey(client *ssh.Client, selector string, key *dkim.Key) error {
+	_, err := installDKIMKey(client, p.dkimKeyDir(), p.Domain, selector, "opendkim:opendkim", key)
+	return err
+}
+
+// ReadDKIMKey returns the TXT content of the key of a selector
+func (p *PostfixDovecotProfile) ReadDKIMKey(client *ssh.Client, selector string) (string, error) {
+	return readDKIMKey(client, p.dkimKeyDir(), selector)
+}
+
+// SwitchDKIMSelector makes OpenDKIM sign with the key of a selector,
+// restarting it only when it was signing with another key
+func (p *PostfixDovecotProfile) SwitchDKIMSelector(client *ssh.Client, selector string) error {
+	keyFile := fmt.Sprintf("%s/%s.private", p.dkimKeyDir(), selector)
+	if _, err := client.ExecuteCommandWithOutput(fmt.Sprintf("test -f %s", keyFile), 30*time.Second); err != nil {
+		return fmt.Errorf("DKIM key %s not found", keyFile)
+	}
+	
+	changed, err := p.configureSigning(client, selector)
+	if err != nil || !changed {
+		return err
+	}
+	
+	return restartService(client, "opendkim")
+}
+
+// RemoveDKIMKey deletes the key files of a retired selector
+func (p *PostfixDovecotProfile) RemoveDKIMKey(client *ssh.Client, selector string) error {
+	_, err := client.ExecuteCommandWithOutput(fmt.Sprintf("rm -f %s/%s.private %s/%s.txt", p.dkimKeyDir(), selector, p.dkimKeyDir(), selector), 30*time.Second)
+	return err
+}
+
+// GenerateDKIM installs the key of a selector and makes OpenDKIM sign with it
+func (p *PostfixDovecotProfile) GenerateDKIM(client *ssh.Client, selector string, key *dkim.Key) (string, error) {
+	return generateDKIM(p, client, selector, key)
+}
+
+// Uninstall stops the mail services and purges their packages. Mailboxes
+// under /var/mail/vhosts and the DKIM keys are kept.
+func (p *PostfixDovecotProfile) Uninstall(client *ssh.Client) error {
+	if _, err := client.ExecuteCommandWithOutput("systemctl disable --now postfix dovecot opendkim || true", 60*time.Second); err != nil {
+		return err
+	}
+	
+	cmd := "DEBIAN_FRONTEND=noninteractive apt-get purge -y postfix 'dovecot-*' opendkim opendkim-tools"
+	if _, err := client.ExecuteCommandWithOutput(cmd, 300*time.Second); err != nil {
+		return fmt.Errorf("failed to remove packages: %v", err)
+	}
+	return nil
+}
+
+// MaildirPath returns the Maildir of a virtual mailbox of the domain
+func (p *PostfixDovecotProfile) MaildirPath(user string) string {
+	return fmt.Sprintf("%s/%s/%s/Maildir", vmailDir, p.Domain, user)
+}
+
+// configureMTASTS serves the MTA-STS policy over HTTPS with nginx
+func (p *PostfixDovecotProfile) configureMTASTS(client *ssh.Client) error {
+	if err := installPackages(client, "nginx"); err != nil {
+		return err
+	}
 	
-	cmd := fmt.Sprintf("echo '%s' > /etc/opendkim.conf", strings.ReplaceAll(opendkimConf, "'", "'\\''"))
-	_, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	root := "/var/www/mta-sts/" + p.Domain
+	_, err := client.ExecuteCommandWithOutput(fmt.Sprintf("mkdir -p %s/.well-known", root), 30*time.Second)
 	if err != nil {
 		return err
 	}
 	
-	// Configure SigningTable
-	signingTable := fmt.Sprintf("*@%s %s._domainkey.%s\n", p.Domain, p.DKIMSelector, p.Domain)
-	cmd = fmt.Sprintf("echo '%s' > /etc/opendkim/SigningTable", strings.ReplaceAll(signingTable, "'", "'\\''"))
-	_, err = client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	// Write the policy, a static file nginx picks up without a reload
+	if _, err := ensureFile(client, root+mtasts.PolicyPath, p.MTASTSPolicy); err != nil {
+		return err
+	}
+	
+	// Configure a site of its own for the domain, replacing the one earlier
+	// versions shared between domains, using the certificate of the mail host
+	if err := removeLegacySite(client, "mta-sts", mtasts.PolicyHost(p.Domain)); err != nil {
+		return err
+	}
+	certFile, keyFile := p.certFiles(p.mailHost())
+	return enableNginxSite(client, "mta-sts-"+p.Domain, mtaSTSSiteConfig(p.Domain, root, certFile, keyFile))
+}
+
+// removeLegacySite disables and deletes an nginx site of earlier versions
+// when it serves host. Sites of other hosts are left to their deployment.
+func removeLegacySite(client *ssh.Client, name, host string) error {
+	site := "/etc/nginx/sites-available/" + name
+	cmd := fmt.Sprintf("if grep -qE 'server_name( .*)? %s( .*)?;' %s 2>/dev/null; then rm -f /etc/nginx/sites-enabled/%s %s; fi",
+		strings.ReplaceAll(host, ".", "\\."), site, name, site)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return fmt.Errorf("failed to remove nginx site %s: %v", name, err)
+	}
+	return nil
+}
+
+// enableNginxSite writes and enables an nginx site. nginx may serve other
+// sites, so it is only reloaded, and only when the site changed.
+func enableNginxSite(client *ssh.Client, name, conf string) error {
+	siteChanged, err := ensureFile(client, "/etc/nginx/sites-available/"+name, conf)
 	if err != nil {
 		return err
 	}
 	
-	// Configure KeyTable
-	keyTable := fmt.Sprintf("%s._domainkey.%s %s:%s:/etc/opendkim/keys/%s/%s.private\n",
-		p.DKIMSelector,
-		p.Domain,
-		p.Domain,
-		p.DKIMSelector,
-		p.Domain,
-		p.DKIMSelector,
-	)
-	cmd = fmt.Sprintf("echo '%s' > /etc/opendkim/KeyTable", strings.ReplaceAll(keyTable, "'", "'\\''"))
-	_, err = client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	_, err = client.ExecuteCommandWithOutput(fmt.Sprintf("ln -sf /etc/nginx/sites-available/%s /etc/nginx/sites-enabled/%s", name, name), 30*time.Second)
 	if err != nil {
 		return err
 	}
 	
-	// Configure InternalHosts
-	internalHosts := fmt.Sprintf("127.0.0.1\nlocalhost\n%s\n%s.%s\n",
-		p.Domain,
-		p.Hostname,
-		p.Domain,
-	)
-	cmd = fmt.Sprintf("echo '%s' > /etc/opendkim/InternalHosts", strings.ReplaceAll(internalHosts, "'", "'\\''"))
-	_, err = client.ExecuteCommandWithOutput(cmd, 30*time.Second)
+	if err := runService(client, "nginx", "enable"); err != nil {
+		return err
+	}
+	
+	if !siteChanged {
+		return runService(client, "nginx", "start")
+	}
+	if err := checkConfig(client, "nginx"); err != nil {
+		return err
+	}
+	return runService(client, "nginx", "reload-or-restart")
+}
+
+// Where the ACME certificates are installed, a directory per mail host,
+// and the Postfix table serving them by SNI
+const (
+	tlsDir = "/etc/ssl/mailops"
+	sniMap = "/etc/postfix/sni"
+)
+
+// challengeRoot is the web root nginx serves ACME challenges from
+const challengeRoot = "/var/www/acme-challenge"
+
+// tlsFiles returns the certificate and key the services use by default
+func (p *PostfixDovecotProfile) tlsFiles() (string, string) {
+	return p.certFiles(p.serverHost())
+}
+
+// certFiles returns the certificate and key of a mail host
+func (p *PostfixDovecotProfile) certFiles(host string) (string, string) {
+	if p.ACME {
+		return fmt.Sprintf("%s/%s/fullchain.pem", tlsDir, host), fmt.Sprintf("%s/%s/privkey.pem", tlsDir, host)
+	}
+	return "/etc/ssl/certs/ssl-cert-snakeoil.pem", "/etc/ssl/private/ssl-cert-snakeoil.key"
+}
+
+// updateSNIMap adds the certificate of the mail host to the Postfix SNI
+// table. postmap -F copies the certificate into the table's database, so
+// it is rebuilt on every call.
+func (p *PostfixDovecotProfile) updateSNIMap(client *ssh.Client) error {
+	content, err := readFile(client, sniMap)
 	if err != nil {
 		return err
 	}
+	certFile, keyFile := p.certFiles(p.mailHost())
+	entry := fmt.Sprintf("%s %s %s", p.mailHost(), keyFile, certFile)
+	if _, err := ensureFile(client, sniMap, setTableEntry(content, "", p.mailHost(), entry)); err != nil {
+		return err
+	}
+	if _, err := client.ExecuteCommandWithOutput("postmap -F hash:"+sniMap, 30*time.Second); err != nil {
+		return fmt.Errorf("failed to rebuild %s: %v", sniMap, err)
+	}
+	return nil
+}
+
+// mailHost returns the host name of the mail server
+func (p *PostfixDovecotProfile) mailHost() string {
+	return fmt.Sprintf("%s.%s", p.Hostname, p.Domain)
+}
+
+// serverHost returns the host name the server greets with, the mail host of
+// the domain deployed first when several share the server
+func (p *PostfixDovecotProfile) serverHost() string {
+	if p.ServerHost != "" {
+		return p.ServerHost
+	}
+	return p.mailHost()
+}
+
+// ServeHTTPChallenge serves a key authorization with an nginx site for the
+// mail and MTA-STS policy hosts. The site stays for renewals.
+func (p *PostfixDovecotProfile) ServeHTTPChallenge(client *ssh.Client, token, keyAuth string) (func() error, error) {
+	if err := installPackages(client, "nginx"); err != nil {
+		return nil, err
+	}
+	if err := removeLegacySite(client, "acme-challenge", p.mailHost()); err != nil {
+		return nil, err
+	}
+	if err := enableNginxSite(client, "acme-challenge-"+p.mailHost(), acmeChallengeSiteConfig(challengeRoot, p.mailHost(), mtasts.PolicyHost(p.Domain))); err != nil {
+		return nil, err
+	}
 	
-	// Generate DKIM key
-	genKeyCmd := fmt.Sprintf("opendkim-genkey -b %d -r -s %s -d %s -D /etc/opendkim/keys/%s",
-		p.DKIMKeySize,
-		p.DKIMSelector,
-		p.Domain,
-		p.Domain,
-	)
-	_, err = client.ExecuteCommandWithOutput(genKeyCmd, 60*time.Second)
+	stop := func() error {
+		_, err := client.ExecuteCommandWithOutput(fmt.Sprintf("rm -f %s%s/%s", challengeRoot, challengePath, token), 30*time.Second)
+		return err
+	}
+	if err := writeChallenge(client, challengeRoot, p.mailHost(), token, keyAuth); err != nil {
+		stop()
+		return nil, err
+	}
+	return stop, nil
+}
+
+// InstallCertificate installs the certificate of the mail host and reloads
+// Postfix, Dovecot and the nginx serving the MTA-STS policy when it changed
+func (p *PostfixDovecotProfile) InstallCertificate(client *ssh.Client, chain, key []byte) error {
+	certFile, keyFile := p.certFiles(p.mailHost())
+	if _, err := client.ExecuteCommandWithOutput("mkdir -p "+path.Dir(certFile), 30*time.Second); err != nil {
+		return err
+	}
+	changed, err := installCertificate(client, certFile, keyFile, chain, key)
+	if err != nil || !changed {
+		return err
+	}
+	if err := p.updateSNIMap(client); err != nil {
+		return err
+	}
+	
+	for _, service := range []string{"postfix", "dovecot"} {
+		if err := reloadService(client, service); err != nil {
+			return err
+		}
+	}
+	if _, err := client.ExecuteCommandWithOutput("systemctl is-active --quiet nginx", 30*time.Second); err == nil {
+		return reloadService(client, "nginx")
+	}
+	return nil
+}
+
+// Where the virtual mailboxes and their tables live
+const (
+	vmailUser    = "vmail"
+	vmailDir     = "/var/mail/vhosts"
+	dovecotUsers = "/etc/dovecot/users"
+	vdomainsMap  = "/etc/postfix/vdomains"
+	vmailboxMap  = "/etc/postfix/vmailbox"
+	virtualMap   = "/etc/postfix/virtual"
+)
+
+// configureMailboxes creates the vmail user owning the virtual mailboxes and
+// the mailbox, alias and password tables, keeping existing ones, and adds
+// the domain to the virtual domains. It returns the uid and gid of the vmail
+// user.
+func (p *PostfixDovecotProfile) configureMailboxes(client *ssh.Client) (int, int, error) {
+	cmd := fmt.Sprintf("id -u %s >/dev/null 2>&1 || useradd --system --user-group --home-dir %s --no-create-home --shell /usr/sbin/nologin %s",
+		vmailUser, vmailDir, vmailUser)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return 0, 0, fmt.Errorf("failed to create user %s: %v", vmailUser, err)
+	}
+	
+	cmd = fmt.Sprintf("mkdir -p %s/%s && chown %s:%s %s %s/%s && chmod 770 %s",
+		vmailDir, p.Domain, vmailUser, vmailUser, vmailDir, vmailDir, p.Domain, vmailDir)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return 0, 0, err
+	}
+	
+	// The passwords are readable by Dovecot only
+	cmd = fmt.Sprintf("touch %s %s %s && chown root:dovecot %s && chmod 640 %s && postmap %s && postmap %s",
+		vmailboxMap, virtualMap, dovecotUsers, dovecotUsers, dovecotUsers, vmailboxMap, virtualMap)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return 0, 0, err
+	}
+	
+	if err := setMapEntry(client, vdomainsMap, p.Domain, p.Domain+" OK"); err != nil {
+		return 0, 0, err
+	}
+	
+	output, err := client.ExecuteCommandWithOutput(fmt.Sprintf("id -u %s && id -g %s", vmailUser, vmailUser), 30*time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	var uid, gid int
+	if _, err := fmt.Sscan(output, &uid, &gid); err != nil {
+		return 0, 0, fmt.Errorf("failed to look up user %s: %v", vmailUser, err)
+	}
+	return uid, gid, nil
+}
+
+// writeUsers replaces the password table, readable by Dovecot only.
+// Dovecot reads it again when it changes.
+func writeUsers(client *ssh.Client, content string) error {
+	if _, err := ensurePrivateFile(client, dovecotUsers, content); err != nil {
+		return err
+	}
+	_, err := client.ExecuteCommandWithOutput(fmt.Sprintf("chown root:dovecot %s && chmod 640 %s", dovecotUsers, dovecotUsers), 30*time.Second)
+	return err
+}
+
+// writeMap replaces a Postfix lookup table and rebuilds its database, which
+// Postfix picks up without a reload
+func writeMap(client *ssh.Client, path, content string) error {
+	changed, err := ensureFile(client, path, content)
+	if err != nil || !changed {
+		return err
+	}
+	if _, err := client.ExecuteCommandWithOutput("postmap "+path, 30*time.Second); err != nil {
+		return fmt.Errorf("failed to rebuild %s: %v", path, err)
+	}
+	return nil
+}
+
+// setMapEntry sets the entry for key in a Postfix lookup table, keeping the
+// entries of other keys, such as the domains deployed to the server earlier
+func setMapEntry(client *ssh.Client, path, key, entry string) error {
+	content, err := readFile(client, path)
+	if err != nil {
+		return err
+	}
+	return writeMap(client, path, setTableEntry(content, "", key, entry))
+}
+
+// AddMailbox adds a mailbox to the password and mailbox tables. The
+// password is hashed before it is sent to the server.
+func (p *PostfixDovecotProfile) AddMailbox(client *ssh.Client, address, password string) error {
+	passwords, err := readFile(client, dovecotUsers)
+	if err != nil {
+		return err
+	}
+	if hasTableKey(passwords, ":", address) {
+		return fmt.Errorf("mailbox %s already exists", address)
+	}
+	hash, err := users.HashPassword(password)
 	if err != nil {
 		return err
 	}
 	
-	// Set permissions
-	chmodCmd := fmt.Sprintf("chown -R opendkim:opendkim /etc/opendkim && chmod 600 /etc/opendkim/keys/%s/*.private", p.Domain)
-	_, err = client.ExecuteCommandWithOutput(chmodCmd, 30*time.Second)
+	mailboxes, err := readFile(client, vmailboxMap)
 	if err != nil {
 		return err
 	}
+	local, domain, _ := strings.Cut(address, "@")
+	mailboxes = setTableEntry(mailboxes, "", address, fmt.Sprintf("%s %s/%s/Maildir/", address, domain, local))
 	
-	// Enable and start opendkim
-	_, err = client.ExecuteCommandWithOutput("systemctl enable opendkim", 30*time.Second)
+	// Accept mail for the mailbox only once it can log in
+	if err := writeUsers(client, setTableEntry(passwords, ":", address, address+":"+hash)); err != nil {
+		return err
+	}
+	return writeMap(client, vmailboxMap, mailboxes)
+}
+
+// RemoveMailbox removes a mailbox from the password and mailbox tables. Its
+// Maildir under /var/mail/vhosts is kept.
+func (p *PostfixDovecotProfile) RemoveMailbox(client *ssh.Client, address string) error {
+	passwords, err := readFile(client, dovecotUsers)
+	if err != nil {
+		return err
+	}
+	mailboxes, err := readFile(client, vmailboxMap)
 	if err != nil {
 		return err
 	}
+	if !hasTableKey(passwords, ":", address) && !hasTableKey(mailboxes, "", address) {
+		return fmt.Errorf("mailbox %s does not exist", address)
+	}
 	
-	_, err = client.ExecuteCommandWithOutput("systemctl restart opendkim", 30*time.Second)
+	if err := writeMap(client, vmailboxMap, setTableEntry(mailboxes, "", address, "")); err != nil {
+		return err
+	}
+	return writeUsers(client, setTableEntry(passwords, ":", address, ""))
+}
+
+// SetPassword replaces the password hash of a mailbox
+func (p *PostfixDovecotProfile) SetPassword(client *ssh.Client, address, password string) error {
+	passwords, err := readFile(client, dovecotUsers)
+	if err != nil {
+		return err
+	}
+	if !hasTableKey(passwords, ":", address) {
+		return fmt.Errorf("mailbox %s does not exist", address)
+	}
+	hash, err := users.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return writeUsers(client, setTableEntry(passwords, ":", address, address+":"+hash))
+}
+
+// AddAlias adds destinations to the virtual alias table entry of address
+func (p *PostfixDovecotProfile) AddAlias(client *ssh.Client, address string, destinations []string) error {
+	content, err := readFile(client, virtualMap)
+	if err != nil {
+		return err
+	}
+	alias := findAlias(parseAliases(content), address)
+	if alias == nil {
+		alias = &Alias{Address: address}
+	}
+	alias.Destinations = addDestinations(alias.Destinations, destinations)
+	return writeMap(client, virtualMap, setTableEntry(content, "", address, aliasEntry(alias)))
+}
+
+// RemoveAlias removes destinations from the virtual alias table entry of
+// address, or the entry
+func (p *PostfixDovecotProfile) RemoveAlias(client *ssh.Client, address string, destinations []string) error {
+	content, err := readFile(client, virtualMap)
 	if err != nil {
 		return err
 	}
+	alias := findAlias(parseAliases(content), address)
+	if alias == nil {
+		return fmt.Errorf("alias %s does not exist", address)
+	}
+	if len(destinations) == 0 {
+		alias.Destinations = nil
+	} else if alias.Destinations, err = removeDestinations(address, alias.Destinations, destinations); err != nil {
+		return err
+	}
+	return writeMap(client, virtualMap, setTableEntry(content, "", address, aliasEntry(alias)))
+}
+
+// ListUsers returns the mailboxes of the password table and the aliases of
+// the virtual alias table in the domain, leaving out the ones of other
+// domains on the server
+func (p *PostfixDovecotProfile) ListUsers(client *ssh.Client) (*UserList, error) {
+	passwords, err := readFile(client, dovecotUsers)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := readFile(client, virtualMap)
+	if err != nil {
+		return nil, err
+	}
 	
-	return nil
-}
\ No newline at end of file
+	suffix := "@" + p.Domain
+	list := &UserList{Mailboxes: []string{}, Aliases: []Alias{}}
+	for _, mailbox := range tableKeys(passwords, ":") {
+		if strings.HasSuffix(mailbox, suffix) {
+			list.Mailboxes = append(list.Mailboxes, mailbox)
+		}
+	}
+	for _, alias := range parseAliases(aliases) {
+		if strings.HasSuffix(alias.Address, suffix) {
+			list.Aliases = append(list.Aliases, alias)
+		}
+	}
+	return list, nil
+}
+
+// ServerDomains returns the virtual domains of the server
+func (p *PostfixDovecotProfile) ServerDomains(client *ssh.Client) ([]string, error) {
+	domains, err := readFile(client, vdomainsMap)
+	if err != nil {
+		return nil, err
+	}
+	return tableKeys(domains, ""), nil
+}
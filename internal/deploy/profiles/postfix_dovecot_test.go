@@ -0,0 +1,109 @@
+package profiles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetMapEntry(t *testing.T) {
+	// postmap records the tables it rebuilds
+	bin := t.TempDir()
+	log := filepath.Join(t.TempDir(), "postmap.log")
+	writeLocal(t, filepath.Join(bin, "postmap"), "#!/bin/sh\necho \"$1\" >> "+log+"\n")
+	if err := os.Chmod(filepath.Join(bin, "postmap"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	client := testClient(t, bin)
+	path := filepath.Join(t.TempDir(), "vdomains")
+
+	// Rows sharing a server each add their domain to its virtual domains
+	steps := []struct {
+		name    string
+		domain  string
+		want    string
+		rebuilt bool
+	}{
+		{"first domain", "a.example", "a.example OK\n", true},
+		{"second domain keeps the first", "b.example", "a.example OK\nb.example OK\n", true},
+		{"first domain deployed again", "a.example", "a.example OK\nb.example OK\n", false},
+		{"third domain", "c.example", "a.example OK\nb.example OK\nc.example OK\n", true},
+	}
+	rebuilds := ""
+	for _, step := range steps {
+		if err := setMapEntry(client, path, step.domain, step.domain+" OK"); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := readLocal(t, path); got != step.want {
+			t.Errorf("%s: table =\n%q\nwant\n%q", step.name, got, step.want)
+		}
+		if step.rebuilt {
+			rebuilds += path + "\n"
+		}
+		if got := readLocal(t, log); got != rebuilds {
+			t.Errorf("%s: postmap ran for %q, want %q", step.name, got, rebuilds)
+		}
+	}
+}
+
+func TestWriteMapFailure(t *testing.T) {
+	bin := t.TempDir()
+	writeLocal(t, filepath.Join(bin, "postmap"), "#!/bin/sh\necho 'fatal: bad table' >&2\nexit 1\n")
+	if err := os.Chmod(filepath.Join(bin, "postmap"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	client := testClient(t, bin)
+
+	path := filepath.Join(t.TempDir(), "virtual")
+	if err := writeMap(client, path, "a@a.example b@a.example\n"); err == nil {
+		t.Error("writeMap succeeded with postmap failing")
+	}
+}
+
+func TestDKIMTables(t *testing.T) {
+	const keys = "/etc/opendkim/keys"
+	signing, keyTable := "", ""
+	deploy := func(domain, selector string) {
+		signing = setDKIMSigningEntry(signing, domain, selector)
+		keyTable = setDKIMKeyEntry(keyTable, domain, selector, keys+"/"+domain)
+	}
+
+	// Each row sharing the server adds its domain
+	deploy("a.example", "s1")
+	deploy("b.example", "s1")
+	deploy("sub.a.example", "mail")
+	wantSigning := "*@a.example s1._domainkey.a.example\n" +
+		"*@b.example s1._domainkey.b.example\n" +
+		"*@sub.a.example mail._domainkey.sub.a.example\n"
+	wantKeys := "s1._domainkey.a.example a.example:s1:/etc/opendkim/keys/a.example/s1.private\n" +
+		"s1._domainkey.b.example b.example:s1:/etc/opendkim/keys/b.example/s1.private\n" +
+		"mail._domainkey.sub.a.example sub.a.example:mail:/etc/opendkim/keys/sub.a.example/mail.private\n"
+	if signing != wantSigning {
+		t.Errorf("SigningTable =\n%s\nwant\n%s", signing, wantSigning)
+	}
+	if keyTable != wantKeys {
+		t.Errorf("KeyTable =\n%s\nwant\n%s", keyTable, wantKeys)
+	}
+
+	// Deploying a domain again changes nothing
+	deploy("b.example", "s1")
+	if signing != wantSigning || keyTable != wantKeys {
+		t.Errorf("tables changed by deploying b.example again:\n%s\n%s", signing, keyTable)
+	}
+
+	// Switching the selector of a domain replaces its key only, keeping
+	// the keys of other domains, including its subdomains
+	deploy("a.example", "s2")
+	wantSigning = "*@a.example s2._domainkey.a.example\n" +
+		"*@b.example s1._domainkey.b.example\n" +
+		"*@sub.a.example mail._domainkey.sub.a.example\n"
+	wantKeys = "s2._domainkey.a.example a.example:s2:/etc/opendkim/keys/a.example/s2.private\n" +
+		"s1._domainkey.b.example b.example:s1:/etc/opendkim/keys/b.example/s1.private\n" +
+		"mail._domainkey.sub.a.example sub.a.example:mail:/etc/opendkim/keys/sub.a.example/mail.private\n"
+	if signing != wantSigning {
+		t.Errorf("SigningTable after switching a.example to s2 =\n%s\nwant\n%s", signing, wantSigning)
+	}
+	if keyTable != wantKeys {
+		t.Errorf("KeyTable after switching a.example to s2 =\n%s\nwant\n%s", keyTable, wantKeys)
+	}
+}
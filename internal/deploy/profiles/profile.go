@@ -0,0 +1,189 @@
+package profiles
+
+import (
+	"fmt"
+	"mailops/internal/dkim"
+	"mailops/internal/ssh"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Profile deploys and manages one kind of mail stack on a server
+type Profile interface {
+	DKIMManager
+	UserManager
+
+	// Describe returns a human readable name of the stack
+	Describe() string
+
+	// Deploy installs and configures the stack
+	Deploy(client *ssh.Client) (*DeployResult, error)
+
+	// GenerateDKIM installs the key of a selector, signs mail with it and
+	// returns the TXT content publishing it
+	GenerateDKIM(client *ssh.Client, selector string, key *dkim.Key) (string, error)
+
+	// HealthSpec returns what a healthy deployment looks like
+	HealthSpec() HealthSpec
+
+	// Uninstall stops and removes the stack, keeping mail data and keys
+	Uninstall(client *ssh.Client) error
+
+	// MaildirPath returns the Maildir of a mailbox of the domain
+	MaildirPath(user string) string
+
+	// ServeHTTPChallenge serves an ACME HTTP-01 key authorization on port
+	// 80 of the server until stop is called
+	ServeHTTPChallenge(client *ssh.Client, token, keyAuth string) (stop func() error, err error)
+
+	// InstallCertificate installs a PEM certificate chain and its key for
+	// the mail services, reloading them when the certificate changed. The
+	// stack uses it when deployed with Options.ACME.
+	InstallCertificate(client *ssh.Client, chain, key []byte) error
+}
+
+// DKIMManager manages the DKIM keys of a deployed stack
+type DKIMManager interface {
+	// InstallDKIMKey uploads the key of a selector without signing with it
+	InstallDKIMKey(client *ssh.Client, selector string, key *dkim.Key) error
+
+	// ReadDKIMKey returns the TXT content of the key of a selector
+	ReadDKIMKey(client *ssh.Client, selector string) (string, error)
+
+	// SwitchDKIMSelector signs mail with the key of a selector
+	SwitchDKIMSelector(client *ssh.Client, selector string) error
+
+	// RemoveDKIMKey deletes the key of a retired selector
+	RemoveDKIMKey(client *ssh.Client, selector string) error
+}
+
+// MultiDomain is implemented by profiles that deploy the domains of several
+// rows to one server, each row adding its domain to the ones already there
+type MultiDomain interface {
+	// ServerDomains returns the domains deployed on the server
+	ServerDomains(client *ssh.Client) ([]string, error)
+}
+
+// UserManager manages the mailboxes and aliases of a deployed stack.
+// Addresses are lowercase and validated by the caller.
+type UserManager interface {
+	// AddMailbox creates a mailbox that logs in with password
+	AddMailbox(client *ssh.Client, address, password string) error
+
+	// RemoveMailbox removes the login of a mailbox, keeping its mail
+	RemoveMailbox(client *ssh.Client, address string) error
+
+	// SetPassword changes the password of a mailbox
+	SetPassword(client *ssh.Client, address, password string) error
+
+	// AddAlias forwards mail for address to destinations as well
+	AddAlias(client *ssh.Client, address string, destinations []string) error
+
+	// RemoveAlias stops forwarding mail for address to destinations, or
+	// removes the alias when none are given
+	RemoveAlias(client *ssh.Client, address string, destinations []string) error
+
+	// ListUsers returns the mailboxes and aliases
+	ListUsers(client *ssh.Client) (*UserList, error)
+}
+
+// UserList holds the mailboxes and aliases of a stack, sorted by address
+type UserList struct {
+	Mailboxes []string `json:"mailboxes"`
+	Aliases   []Alias  `json:"aliases"`
+}
+
+// Alias forwards mail for an address to other addresses
+type Alias struct {
+	Address      string   `json:"address"`
+	Destinations []string `json:"destinations"`
+}
+
+// HealthSpec lists the ports a deployment listens on and the systemd
+// services it runs
+type HealthSpec struct {
+	Ports    []int
+	Services []string
+}
+
+// Options holds the settings used to construct a profile for one task
+type Options struct {
+	Domain       string
+	Hostname     string
+	RowID        int
+	DKIMSelector string
+	DKIMKey      *dkim.Key // Installed for DKIMSelector by Deploy, if the stack needs it then
+	MTASTSPolicy string    // MTA-STS policy text served at mta-sts.<domain>, empty to skip
+	ServerHost   string    // Host name of a server shared by several rows, empty for Hostname.Domain
+	ACME         bool      // Serve the certificate of InstallCertificate instead of a self-signed one
+}
+
+// Factory constructs a profile from its options
+type Factory func(opts Options) Profile
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a profile available under the given name. Profiles
+// register themselves from an init function.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	name = strings.ToLower(name)
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("profiles: profile %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// New constructs the named profile
+func New(name string, opts Options) (Profile, error) {
+	registryMu.RLock()
+	factory, ok := registry[strings.ToLower(name)]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown deploy profile %q (available: %s)", name, strings.Join(Registered(), ", "))
+	}
+	return factory(opts), nil
+}
+
+// IsRegistered reports whether a profile name is known
+func IsRegistered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	_, ok := registry[strings.ToLower(name)]
+	return ok
+}
+
+// Registered returns the names of all registered profiles
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// generateDKIM installs the key of a selector with m and signs with it
+func generateDKIM(m DKIMManager, client *ssh.Client, selector string, key *dkim.Key) (string, error) {
+	record, err := key.Record()
+	if err != nil {
+		return "", err
+	}
+	if err := m.InstallDKIMKey(client, selector, key); err != nil {
+		return "", fmt.Errorf("failed to install DKIM key: %w", err)
+	}
+	if err := m.SwitchDKIMSelector(client, selector); err != nil {
+		return "", fmt.Errorf("failed to enable DKIM key: %w", err)
+	}
+	return record.String(), nil
+}
@@ -0,0 +1,140 @@
+package profiles
+
+import (
+	"fmt"
+	"mailops/internal/ssh"
+	"strings"
+	"time"
+)
+
+// configChecks holds the commands that validate the configuration of a
+// service without touching the running instance. Their diagnostics go to
+// stderr, which is all that is kept.
+var configChecks = map[string][]string{
+	"postfix":  {"postfix check", "postconf -n"},
+	"dovecot":  {"doveconf -n"},
+	"opendkim": {"opendkim -n -x /etc/opendkim.conf"},
+	"nginx":    {"nginx -t"},
+}
+
+// journalLines is how much of a failed service's journal is kept
+const journalLines = 30
+
+// ServiceError is a service whose configuration failed validation or that
+// failed to start, with the diagnostics to tell why
+type ServiceError struct {
+	Service string
+	Action  string // "check", or the systemctl action that failed
+	Err     error
+	Command string // The failed command
+	Output  string // Its output
+	Journal string // Tail of the service's journal
+}
+
+func (e *ServiceError) Error() string {
+	if e.Action == "check" {
+		return fmt.Sprintf("invalid %s configuration: %v", e.Service, e.Err)
+	}
+	return fmt.Sprintf("failed to %s %s: %v", e.Action, e.Service, e.Err)
+}
+
+func (e *ServiceError) Unwrap() error {
+	return e.Err
+}
+
+// Diagnostics returns the command output and journal tail for a report
+func (e *ServiceError) Diagnostics() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ %s\n%s\n", e.Command, strings.TrimRight(e.Output, "\n"))
+	if e.Journal != "" {
+		fmt.Fprintf(&b, "$ journalctl -u %s -n %d\n%s\n", e.Service, journalLines, strings.TrimRight(e.Journal, "\n"))
+	}
+	return b.String()
+}
+
+// checkConfig runs the config checks of a service
+func checkConfig(client *ssh.Client, service string) error {
+	for _, check := range configChecks[service] {
+		output, err := runDiagnostic(client, check+" 2>&1 >/dev/null")
+		if err != nil {
+			return &ServiceError{
+				Service: service,
+				Action:  "check",
+				Err:     fmt.Errorf("%s: %v", check, err),
+				Command: check,
+				Output:  output,
+				Journal: journal(client, service),
+			}
+		}
+	}
+	return nil
+}
+
+// startService enables a service and starts it, validating its
+// configuration and restarting it when the configuration changed. An
+// unchanged running service is left alone.
+func startService(client *ssh.Client, service string, changed bool) error {
+	if err := runService(client, service, "enable"); err != nil {
+		return err
+	}
+	if !changed {
+		return runService(client, service, "start")
+	}
+	return restartService(client, service)
+}
+
+// restartService validates the configuration of a service and restarts it
+func restartService(client *ssh.Client, service string) error {
+	if err := checkConfig(client, service); err != nil {
+		return err
+	}
+	return runService(client, service, "restart")
+}
+
+// reloadService validates the configuration of a service and reloads it
+func reloadService(client *ssh.Client, service string) error {
+	if err := checkConfig(client, service); err != nil {
+		return err
+	}
+	return runService(client, service, "reload")
+}
+
+// runService runs a systemctl action on a service, keeping its journal
+// when the action fails
+func runService(client *ssh.Client, service, action string) error {
+	cmd := fmt.Sprintf("systemctl %s %s", action, service)
+	output, err := runDiagnostic(client, cmd+" 2>&1")
+	if err != nil {
+		return &ServiceError{
+			Service: service,
+			Action:  action,
+			Err:     err,
+			Command: cmd,
+			Output:  output,
+			Journal: journal(client, service),
+		}
+	}
+	return nil
+}
+
+// runDiagnostic runs a command and returns its output even when it fails
+func runDiagnostic(client *ssh.Client, cmd string) (string, error) {
+	result, err := client.ExecuteCommand(cmd, 60*time.Second)
+	if result == nil {
+		return "", err
+	}
+	if err != nil {
+		return result.Stdout, fmt.Errorf("exit code %d", result.ExitCode)
+	}
+	return result.Stdout, nil
+}
+
+// journal returns the last lines logged by a service, or an empty string
+// when they cannot be read
+func journal(client *ssh.Client, service string) string {
+	output, err := runDiagnostic(client, fmt.Sprintf("journalctl -u %s -n %d --no-pager 2>&1", service, journalLines))
+	if err != nil {
+		return ""
+	}
+	return output
+}
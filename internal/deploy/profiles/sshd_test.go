@@ -0,0 +1,119 @@
+package profiles
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"mailops/internal/ssh"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testClient returns a client of an SSH server running each command with
+// the local shell, so the helpers converging files on a server can be run
+// against a temporary directory. Commands are looked up in bin first, so a
+// test can stand in for tools the machine lacks.
+func testClient(t *testing.T, bin string) *ssh.Client {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &gossh.ServerConfig{
+		PasswordCallback: func(gossh.ConnMetadata, []byte) (*gossh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	env := append(os.Environ(), "PATH="+bin+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveShell(conn, config, env)
+		}
+	}()
+
+	client, err := ssh.NewClient(ssh.Config{
+		Host:     "127.0.0.1",
+		Port:     l.Addr().(*net.TCPAddr).Port,
+		User:     "root",
+		Password: "secret",
+		Timeout:  5 * time.Second,
+		HostKeys: &ssh.HostKeyPolicy{Mode: ssh.HostKeyInsecure},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// serveShell runs the commands of a connection with sh
+func serveShell(conn net.Conn, config *gossh.ServerConfig, env []string) {
+	_, channels, requests, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go gossh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				if err := gossh.Unmarshal(req.Payload, &exec); err != nil {
+					req.Reply(false, nil)
+					return
+				}
+				req.Reply(true, nil)
+				status := runShell(exec.Command, env, channel)
+				channel.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+// runShell runs a command with sh and returns its exit status
+func runShell(command string, env []string, channel gossh.Channel) uint32 {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = env
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return uint32(exitErr.ExitCode())
+	default:
+		return 127
+	}
+}
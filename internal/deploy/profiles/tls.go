@@ -0,0 +1,80 @@
+package profiles
+
+import (
+	"fmt"
+	"mailops/internal/ssh"
+	"strings"
+	"time"
+)
+
+// challengePath is where ACME HTTP-01 key authorizations are served, below
+// a web root
+const challengePath = "/.well-known/acme-challenge"
+
+// writeChallenge writes a key authorization below root and waits until it
+// is served on port 80 of the server for host
+func writeChallenge(client *ssh.Client, root, host, token, keyAuth string) error {
+	dir := root + challengePath
+	cmd := fmt.Sprintf("mkdir -p %s && printf '%%s' '%s' > %s/%s", dir, keyAuth, dir, token)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return fmt.Errorf("failed to write challenge: %v", err)
+	}
+
+	// Tokens and key authorizations are base64url, safe to quote
+	cmd = fmt.Sprintf("for i in $(seq 1 10); do [ \"$(curl -fs -H 'Host: %s' http://127.0.0.1%s/%s)\" = '%s' ] && exit 0; sleep 1; done; exit 1",
+		host, challengePath, token, keyAuth)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 30*time.Second); err != nil {
+		return fmt.Errorf("challenge is not served on port 80 of the server")
+	}
+	return nil
+}
+
+// placeholderCertificate creates a short-lived self-signed certificate for
+// host unless a certificate is already installed, so the services start
+// before the ACME certificate is issued
+func placeholderCertificate(client *ssh.Client, host, certFile, keyFile string) error {
+	cmd := fmt.Sprintf("test -f %s || (umask 077 && openssl req -x509 -newkey rsa:2048 -nodes -days 30 -subj '/CN=%s' -keyout %s -out %s && chmod 644 %s)",
+		certFile, host, keyFile, certFile, certFile)
+	if _, err := client.ExecuteCommandWithOutput(cmd, 60*time.Second); err != nil {
+		return fmt.Errorf("failed to create placeholder certificate: %v", err)
+	}
+	return nil
+}
+
+// installCertificate writes a certificate chain and its key and reports
+// whether either changed
+func installCertificate(client *ssh.Client, certFile, keyFile string, chain, key []byte) (bool, error) {
+	certChanged, err := ensureFile(client, certFile, string(chain))
+	if err != nil {
+		return false, err
+	}
+	keyChanged, err := ensurePrivateFile(client, keyFile, string(key))
+	if err != nil {
+		return false, err
+	}
+	return certChanged || keyChanged, nil
+}
+
+// acmeChallengeSiteConfig returns an nginx site serving ACME HTTP-01
+// challenges for hosts from root
+func acmeChallengeSiteConfig(root string, hosts ...string) string {
+	return fmt.Sprintf(`server {
+    listen 80;
+    listen [::]:80;
+    server_name %s;
+
+    location ^~ %s/ {
+        root %s;
+        default_type text/plain;
+    }
+
+    location / {
+        return 404;
+    }
+}
+`,
+		strings.Join(hosts, " "),
+		challengePath,
+		root,
+	)
+}
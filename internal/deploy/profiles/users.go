@@ -0,0 +1,156 @@
+package profiles
+
+import (
+	"fmt"
+	"mailops/internal/ssh"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readFile returns the content of a file on the server, empty when it does
+// not exist
+func readFile(client *ssh.Client, path string) (string, error) {
+	content, err := client.ExecuteCommandWithOutput(fmt.Sprintf("cat %s 2>/dev/null || true", path), 30*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return content, nil
+}
+
+// tableKey returns the key of a line of a lookup table, the text before sep
+// or before the first space when sep is empty. Blank lines and comments
+// have no key.
+func tableKey(line, sep string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+	if sep == "" {
+		return strings.Fields(line)[0]
+	}
+	key, _, _ := strings.Cut(line, sep)
+	return key
+}
+
+// tableKeys returns the keys of a lookup table, sorted
+func tableKeys(content, sep string) []string {
+	keys := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		if key := tableKey(line, sep); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hasTableKey reports whether a lookup table has an entry for key
+func hasTableKey(content, sep, key string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if tableKey(line, sep) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// setTableEntry returns a lookup table with the entry for key replaced by
+// entry, or entry appended when there is none. An empty entry removes it.
+func setTableEntry(content, sep, key, entry string) string {
+	var lines []string
+	found := false
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		if tableKey(line, sep) != key {
+			if line != "" || len(lines) > 0 {
+				lines = append(lines, line)
+			}
+			continue
+		}
+		if entry != "" && !found {
+			lines = append(lines, entry)
+		}
+		found = true
+	}
+	if entry != "" && !found {
+		lines = append(lines, entry)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// parseAliases reads the aliases of a Postfix virtual alias table, an
+// address and its comma separated destinations per line
+func parseAliases(content string) []Alias {
+	aliases := []Alias{}
+	for _, line := range strings.Split(content, "\n") {
+		address := tableKey(line, "")
+		if address == "" {
+			continue
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), address))
+		alias := Alias{Address: address}
+		for _, destination := range strings.FieldsFunc(rest, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			alias.Destinations = append(alias.Destinations, destination)
+		}
+		aliases = append(aliases, alias)
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Address < aliases[j].Address })
+	return aliases
+}
+
+// findAlias returns the alias of address, or nil
+func findAlias(aliases []Alias, address string) *Alias {
+	for i := range aliases {
+		if aliases[i].Address == address {
+			return &aliases[i]
+		}
+	}
+	return nil
+}
+
+// aliasEntry returns the virtual alias table line of an alias
+func aliasEntry(alias *Alias) string {
+	if len(alias.Destinations) == 0 {
+		return ""
+	}
+	return alias.Address + " " + strings.Join(alias.Destinations, ",")
+}
+
+// addDestinations returns destinations with the ones in add appended,
+// skipping those already present
+func addDestinations(destinations, add []string) []string {
+	for _, destination := range add {
+		found := false
+		for _, existing := range destinations {
+			if existing == destination {
+				found = true
+				break
+			}
+		}
+		if !found {
+			destinations = append(destinations, destination)
+		}
+	}
+	return destinations
+}
+
+// removeDestinations returns destinations without the ones in remove, or
+// an error naming one that is not there
+func removeDestinations(address string, destinations, remove []string) ([]string, error) {
+	for _, destination := range remove {
+		kept := destinations[:0:0]
+		for _, existing := range destinations {
+			if existing != destination {
+				kept = append(kept, existing)
+			}
+		}
+		if len(kept) == len(destinations) {
+			return nil, fmt.Errorf("alias %s does not forward to %s", address, destination)
+		}
+		destinations = kept
+	}
+	return destinations, nil
+}
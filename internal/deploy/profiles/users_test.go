@@ -0,0 +1,31 @@
+package profiles
+
+import "testing"
+
+func TestSetTableEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		sep     string
+		key     string
+		entry   string
+		want    string
+	}{
+		{"empty table", "", "", "a.example", "a.example OK", "a.example OK\n"},
+		{"appended", "a.example OK\n", "", "b.example", "b.example OK", "a.example OK\nb.example OK\n"},
+		{"appended after a last line without newline", "a.example OK", "", "b.example", "b.example OK", "a.example OK\nb.example OK\n"},
+		{"replaced in place", "a@a.example a.example/a/\nb@a.example a.example/b/\n", "", "a@a.example", "a@a.example a.example/new/", "a@a.example a.example/new/\nb@a.example a.example/b/\n"},
+		{"duplicates collapsed", "a.example OK\nb.example OK\na.example REJECT\n", "", "a.example", "a.example OK", "a.example OK\nb.example OK\n"},
+		{"removed", "a.example OK\nb.example OK\n", "", "a.example", "", "b.example OK\n"},
+		{"last entry removed", "a.example OK\n", "", "a.example", "", ""},
+		{"comments kept", "# Virtual domains\na.example OK\n", "", "b.example", "b.example OK", "# Virtual domains\na.example OK\nb.example OK\n"},
+		{"key prefix of another", "sub.a.example OK\n", "", "a.example", "a.example OK", "sub.a.example OK\na.example OK\n"},
+		{"separator", "a@a.example:{BLF-CRYPT}old\nb@a.example:{BLF-CRYPT}b\n", ":", "a@a.example", "a@a.example:{BLF-CRYPT}new", "a@a.example:{BLF-CRYPT}new\nb@a.example:{BLF-CRYPT}b\n"},
+	}
+
+	for _, tt := range tests {
+		if got := setTableEntry(tt.content, tt.sep, tt.key, tt.entry); got != tt.want {
+			t.Errorf("%s: setTableEntry =\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package dkim parses DKIM key records (RFC 6376 section 3.6.1) from the
+// files key generators write and from DNS, renders them as TXT content and
+// tracks selector rotations.
+package dkim
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mailops/internal/dns"
+	"strings"
+)
+
+// DefaultSelector is used when no selector is configured
+const DefaultSelector = "s1"
+
+// Record is a DKIM public key record
+type Record struct {
+	KeyType   string // k=, "rsa" when absent
+	Hash      string // h=, optional list of hash algorithms
+	Flags     string // t=, optional
+	PublicKey string // p=, base64; empty for a revoked key
+}
+
+// ParseKeyFile parses the public key file written by opendkim-genkey or
+// docker-mailserver, a zone file fragment whose TXT value may be split over
+// several quoted strings and lines. A bare record value is accepted as well.
+func ParseKeyFile(content string) (*Record, error) {
+	var value strings.Builder
+	quoted, comment, found := false, false, false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case comment:
+			comment = c != '\n'
+		case quoted && c == '\\' && i+1 < len(content):
+			value.WriteByte(c)
+			value.WriteByte(content[i+1])
+			i++
+		case c == '"':
+			quoted = !quoted
+			found = true
+			value.WriteByte(c)
+		case quoted:
+			value.WriteByte(c)
+		case c == ';':
+			comment = true
+		}
+	}
+
+	if !found {
+		return ParseRecord(content)
+	}
+	return ParseRecord(dns.JoinTXT(value.String()))
+}
+
+// ParseRecord parses a DKIM key record such as "v=DKIM1; k=rsa; p=MIIB...".
+// Quoted character-strings are joined first.
+func ParseRecord(txt string) (*Record, error) {
+	r := &Record{KeyType: "rsa"}
+	hasKey := false
+
+	for _, tag := range strings.Split(dns.JoinTXT(txt), ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" && !ok {
+			continue
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid DKIM tag %q", strings.TrimSpace(tag))
+		}
+		// Folding whitespace is allowed anywhere in a value
+		value = strings.Join(strings.Fields(value), "")
+
+		switch name {
+		case "v":
+			if value != "DKIM1" {
+				return nil, fmt.Errorf("unsupported DKIM record version %q", value)
+			}
+		case "k":
+			r.KeyType = strings.ToLower(value)
+		case "h":
+			r.Hash = value
+		case "t":
+			r.Flags = value
+		case "p":
+			if value != "" {
+				if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+					return nil, fmt.Errorf("invalid DKIM public key: %w", err)
+				}
+			}
+			r.PublicKey = value
+			hasKey = true
+		}
+	}
+
+	if !hasKey {
+		return nil, fmt.Errorf("DKIM record has no public key (p=)")
+	}
+	return r, nil
+}
+
+// String renders the record as TXT content
+func (r *Record) String() string {
+	parts := []string{"v=DKIM1"}
+	if r.Hash != "" {
+		parts = append(parts, "h="+r.Hash)
+	}
+	keyType := r.KeyType
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	parts = append(parts, "k="+keyType)
+	if r.Flags != "" {
+		parts = append(parts, "t="+r.Flags)
+	}
+	parts = append(parts, "p="+r.PublicKey)
+	return strings.Join(parts, "; ")
+}
+
+// Strings returns the record split into the 255-byte character-strings of
+// its TXT RDATA, as 2048-bit keys do not fit in one
+func (r *Record) Strings() []string {
+	return dns.SplitTXT(r.String())
+}
+
+// RecordName returns the name the key of a selector is published at
+func RecordName(selector, domain string) string {
+	return fmt.Sprintf("%s._domainkey.%s", selector, strings.TrimSuffix(domain, "."))
+}
+
+// ValidSelector checks a selector is a single DNS label
+func ValidSelector(selector string) error {
+	if selector == "" || len(selector) > 63 {
+		return fmt.Errorf("invalid DKIM selector %q", selector)
+	}
+	for _, c := range selector {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("invalid DKIM selector %q, only letters, digits and '-' are allowed", selector)
+		}
+	}
+	return nil
+}
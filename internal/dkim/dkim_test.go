@@ -0,0 +1,192 @@
+package dkim
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey is a base64 public key long enough to need several TXT strings
+var testKey = "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA" + strings.Repeat("q83vEjRWeJA", 30) + "IDAQAB"
+
+func TestParseKeyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Record
+		wantErr bool
+	}{
+		{
+			name: "opendkim-genkey",
+			content: "s1._domainkey\tIN\tTXT\t( \"v=DKIM1; h=sha256; k=rsa; \"\n" +
+				"\t  \"p=" + testKey[:200] + "\"\n" +
+				"\t  \"" + testKey[200:] + "\" )  ; ----- DKIM key s1 for example.com\n",
+			want: Record{KeyType: "rsa", Hash: "sha256", PublicKey: testKey},
+		},
+		{
+			name:    "comment before the record",
+			content: "; key for example.com \"quoted\"\nmail._domainkey IN TXT \"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=\"\n",
+			want:    Record{KeyType: "ed25519", PublicKey: "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+		},
+		{
+			name:    "escaped quote",
+			content: `mail._domainkey IN TXT "v=DKIM1; t=s\"; p="`,
+			want:    Record{KeyType: "rsa", Flags: `s"`},
+		},
+		{
+			name:    "bare value",
+			content: "v=DKIM1; k=rsa; p=" + testKey,
+			want:    Record{KeyType: "rsa", PublicKey: testKey},
+		},
+		{
+			name:    "no key",
+			content: `mail._domainkey IN TXT "v=DKIM1; k=rsa"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ParseKeyFile(tt.content)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseKeyFile = %+v, want an error", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *r != tt.want {
+				t.Errorf("ParseKeyFile = %+v, want %+v", *r, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		txt     string
+		want    Record
+		wantErr bool
+	}{
+		{txt: "v=DKIM1; k=rsa; p=" + testKey, want: Record{KeyType: "rsa", PublicKey: testKey}},
+		{txt: "p=" + testKey, want: Record{KeyType: "rsa", PublicKey: testKey}},
+		{txt: `"v=DKIM1; K=RSA; p=` + testKey[:100] + `" "` + testKey[100:] + `"`, want: Record{KeyType: "rsa", PublicKey: testKey}},
+		{txt: "v=DKIM1; p=" + testKey[:50] + " \t " + testKey[50:] + ";", want: Record{KeyType: "rsa", PublicKey: testKey}},
+		{txt: "v=DKIM1; h=sha1:sha256; t=y:s; k=ed25519; p=AAAA", want: Record{KeyType: "ed25519", Hash: "sha1:sha256", Flags: "y:s", PublicKey: "AAAA"}},
+		{txt: "v=DKIM1; k=rsa; p=", want: Record{KeyType: "rsa"}},
+		{txt: "v=DKIM1; n=notes; s=email; p=AAAA", want: Record{KeyType: "rsa", PublicKey: "AAAA"}},
+		{txt: "v=DKIM2; p=AAAA", wantErr: true},
+		{txt: "v=DKIM1; k=rsa", wantErr: true},
+		{txt: "v=DKIM1; k=rsa; p=not base64!", wantErr: true},
+		{txt: "v=DKIM1; garbage; p=AAAA", wantErr: true},
+		{txt: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRecord(tt.txt)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRecord(%q) = %+v, want an error", tt.txt, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRecord(%q) = %v", tt.txt, err)
+			continue
+		}
+		if *r != tt.want {
+			t.Errorf("ParseRecord(%q) = %+v, want %+v", tt.txt, *r, tt.want)
+		}
+	}
+}
+
+func TestRecordStrings(t *testing.T) {
+	r := &Record{Hash: "sha256", PublicKey: testKey}
+	want := "v=DKIM1; h=sha256; k=rsa; p=" + testKey
+	if got := r.String(); got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+
+	parts := r.Strings()
+	if len(parts) < 2 || strings.Join(parts, "") != want {
+		t.Fatalf("Strings = %q, want %q split in several strings", parts, want)
+	}
+	for _, part := range parts {
+		if len(part) > 255 {
+			t.Errorf("string of %d bytes, want at most 255", len(part))
+		}
+	}
+
+	parsed, err := ParseRecord(r.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != want {
+		t.Errorf("round trip = %q, want %q", parsed.String(), want)
+	}
+}
+
+func TestValidSelector(t *testing.T) {
+	tests := map[string]bool{
+		"s1":                    true,
+		"mail-2024":             true,
+		"S20240101b":            true,
+		"":                      false,
+		"a.b":                   false,
+		"under_score":           false,
+		strings.Repeat("a", 63): true,
+		strings.Repeat("a", 64): false,
+	}
+
+	for selector, valid := range tests {
+		if err := ValidSelector(selector); (err == nil) != valid {
+			t.Errorf("ValidSelector(%q) = %v, want valid %v", selector, err, valid)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	now := time.Date(2024, 3, 1, 23, 30, 0, 0, time.FixedZone("", -3*3600))
+	if got := NewSelector("s1", now); got != "s20240302" {
+		t.Errorf("NewSelector = %q, want the UTC date", got)
+	}
+	if got := NewSelector("s20240302", now); got != "s20240302b" {
+		t.Errorf("NewSelector of the same day = %q, want s20240302b", got)
+	}
+
+	r := &Rotation{Domain: "example.com", OldSelector: "s1", NewSelector: "s20240302", Phase: PhasePublished, PublishedAt: now}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Active() != "s1" {
+		t.Errorf("Active while published = %q, want the old selector", r.Active())
+	}
+	if phase, due := r.Next(time.Hour, 2*time.Hour); phase != PhaseSwitched || !due.Equal(now.Add(time.Hour)) {
+		t.Errorf("Next while published = %s at %v", phase, due)
+	}
+
+	r.Phase, r.SwitchedAt = PhaseSwitched, now.Add(time.Hour)
+	if r.Active() != "s20240302" {
+		t.Errorf("Active once switched = %q, want the new selector", r.Active())
+	}
+	if phase, due := r.Next(time.Hour, 2*time.Hour); phase != PhaseRetired || !due.Equal(now.Add(3*time.Hour)) {
+		t.Errorf("Next once switched = %s at %v", phase, due)
+	}
+
+	r.Phase = PhaseRetired
+	if phase, _ := r.Next(time.Hour, 2*time.Hour); phase != "" {
+		t.Errorf("Next once retired = %s, want none", phase)
+	}
+
+	for _, invalid := range []Rotation{
+		{OldSelector: "s1", NewSelector: "s2", Phase: PhasePublished},
+		{Domain: "example.com", OldSelector: "s.1", NewSelector: "s2", Phase: PhasePublished},
+		{Domain: "example.com", OldSelector: "s1", NewSelector: "s2", Phase: "pending"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil, want an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// Key algorithms
+const (
+	KeyRSA     = "rsa"
+	KeyEd25519 = "ed25519" // RFC 8463
+)
+
+// DefaultRSABits is the RSA key size used when none is configured
+const DefaultRSABits = 2048
+
+// Key is a DKIM signing key pair
+type Key struct {
+	Type    string
+	Private crypto.Signer
+}
+
+// CheckKeyParams checks a key algorithm and RSA key size. A zero size
+// selects DefaultRSABits.
+func CheckKeyParams(keyType string, bits int) error {
+	switch strings.ToLower(keyType) {
+	case "", KeyRSA:
+		if bits != 0 && (bits < 1024 || bits > 4096) {
+			return fmt.Errorf("invalid DKIM RSA key size %d, expected 1024 to 4096 bits", bits)
+		}
+	case KeyEd25519:
+	default:
+		return fmt.Errorf("unknown DKIM key type %q (available: %s, %s)", keyType, KeyRSA, KeyEd25519)
+	}
+	return nil
+}
+
+// GenerateKey creates a key pair of the given algorithm. bits only applies
+// to RSA, zero selects DefaultRSABits.
+func GenerateKey(keyType string, bits int) (*Key, error) {
+	if err := CheckKeyParams(keyType, bits); err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(keyType) == KeyEd25519 {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+		}
+		return &Key{Type: KeyEd25519, Private: private}, nil
+	}
+
+	if bits == 0 {
+		bits = DefaultRSABits
+	}
+	private, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+	}
+	return &Key{Type: KeyRSA, Private: private}, nil
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS#8 or PKCS#1 private key
+func ParsePrivateKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA private key: %w", err)
+		}
+		return &Key{Type: KeyRSA, Private: private}, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &Key{Type: KeyRSA, Private: private}, nil
+	case ed25519.PrivateKey:
+		return &Key{Type: KeyEd25519, Private: private}, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", parsed)
+}
+
+// PrivateKeyPEM returns the private key as PEM encoded PKCS#8, which
+// OpenDKIM reads for both algorithms
+func (k *Key) PrivateKeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.Private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Record returns the DNS record publishing the public key. RSA keys are
+// published as SubjectPublicKeyInfo, Ed25519 keys as the raw 32 bytes.
+func (k *Key) Record() (*Record, error) {
+	var public []byte
+	switch key := k.Private.Public().(type) {
+	case ed25519.PublicKey:
+		public = key
+	default:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode public key: %w", err)
+		}
+		public = der
+	}
+
+	record := &Record{KeyType: k.Type, PublicKey: base64.StdEncoding.EncodeToString(public)}
+	if k.Type == KeyRSA {
+		record.Hash = "sha256"
+	}
+	return record, nil
+}
+
+// KeyFile returns the public key in the zone file form opendkim-genkey
+// writes next to the private key
+func KeyFile(selector, domain string, record *Record) string {
+	parts := record.Strings()
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = `"` + part + `"`
+	}
+	return fmt.Sprintf("%s._domainkey\tIN\tTXT\t( %s )  ; ----- DKIM key %s for %s\n", selector, strings.Join(quoted, "\n\t  "), selector, domain)
+}
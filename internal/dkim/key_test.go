@@ -0,0 +1,153 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestCheckKeyParams(t *testing.T) {
+	tests := []struct {
+		keyType string
+		bits    int
+		valid   bool
+	}{
+		{"", 0, true},
+		{"rsa", 1024, true},
+		{"RSA", 4096, true},
+		{"rsa", 512, false},
+		{"rsa", 8192, false},
+		{"ed25519", 0, true},
+		{"ed25519", 512, true}, // Size only applies to RSA
+		{"ecdsa", 0, false},
+	}
+
+	for _, tt := range tests {
+		if err := CheckKeyParams(tt.keyType, tt.bits); (err == nil) != tt.valid {
+			t.Errorf("CheckKeyParams(%q, %d) = %v, want valid %v", tt.keyType, tt.bits, err, tt.valid)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	tests := []struct {
+		keyType  string
+		bits     int
+		wantType string
+		wantHash string
+		keyBytes int // Length of the decoded public key, 0 to skip
+	}{
+		{keyType: "rsa", bits: 1024, wantType: KeyRSA, wantHash: "sha256"},
+		{keyType: "Ed25519", wantType: KeyEd25519, keyBytes: ed25519.PublicKeySize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantType, func(t *testing.T) {
+			key, err := GenerateKey(tt.keyType, tt.bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Type != tt.wantType {
+				t.Errorf("Type = %q, want %q", key.Type, tt.wantType)
+			}
+
+			record, err := key.Record()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record.KeyType != tt.wantType || record.Hash != tt.wantHash {
+				t.Errorf("Record = %+v, want k=%s h=%s", record, tt.wantType, tt.wantHash)
+			}
+			public, err := base64.StdEncoding.DecodeString(record.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.keyBytes != 0 && len(public) != tt.keyBytes {
+				t.Errorf("public key of %d bytes, want %d", len(public), tt.keyBytes)
+			}
+			if tt.wantType == KeyRSA {
+				if _, err := x509.ParsePKIXPublicKey(public); err != nil {
+					t.Errorf("public key is not SubjectPublicKeyInfo: %v", err)
+				}
+			}
+
+			data, err := key.PrivateKeyPEM()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParsePrivateKey(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reparsed, err := parsed.Record()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *reparsed != *record {
+				t.Errorf("record after a PEM round trip = %+v, want %+v", reparsed, record)
+			}
+		})
+	}
+
+	if _, err := GenerateKey("rsa", 100); err == nil {
+		t.Error("GenerateKey with 100 bits succeeded")
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantType string // Empty when parsing fails
+	}{
+		{"pkcs1", pkcs1, KeyRSA},
+		{"corrupt pkcs1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte("garbage")}), ""},
+		{"corrupt pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}), ""},
+		{"not pem", []byte("-----BEGIN nothing"), ""},
+	}
+
+	for _, tt := range tests {
+		key, err := ParsePrivateKey(tt.data)
+		if tt.wantType == "" {
+			if err == nil {
+				t.Errorf("%s: ParsePrivateKey succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParsePrivateKey = %v", tt.name, err)
+			continue
+		}
+		if key.Type != tt.wantType {
+			t.Errorf("%s: Type = %q, want %q", tt.name, key.Type, tt.wantType)
+		}
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	record := &Record{KeyType: KeyRSA, Hash: "sha256", PublicKey: testKey}
+
+	content := KeyFile("s1", "example.com", record)
+	if !strings.HasPrefix(content, "s1._domainkey\tIN\tTXT\t( \"") || !strings.HasSuffix(content, "; ----- DKIM key s1 for example.com\n") {
+		t.Errorf("KeyFile = %q, not in the opendkim-genkey form", content)
+	}
+
+	parsed, err := ParseKeyFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *record {
+		t.Errorf("ParseKeyFile(KeyFile) = %+v, want %+v", parsed, record)
+	}
+}
@@ -0,0 +1,82 @@
+package dkim
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rotation phases. A rotation publishes the key of a new selector next to
+// the old one, waits for it to propagate, switches the signer to it, then
+// keeps the old key published until mail signed with it has been delivered
+// before retiring it.
+const (
+	PhasePublished = "published" // New key in DNS, old key still signing
+	PhaseSwitched  = "switched"  // New key signing, old key still in DNS
+	PhaseRetired   = "retired"   // Old key removed, rotation complete
+)
+
+// Default waits between rotation phases
+const (
+	DefaultPublishWait = 48 * time.Hour
+	DefaultRetireWait  = 7 * 24 * time.Hour
+)
+
+// Rotation is the state of a selector rotation for one domain
+type Rotation struct {
+	Domain      string    `json:"domain"`
+	OldSelector string    `json:"old_selector"`
+	NewSelector string    `json:"new_selector"`
+	Phase       string    `json:"phase"`
+	Record      string    `json:"record"` // TXT content published for the new selector
+	PublishedAt time.Time `json:"published_at"`
+	SwitchedAt  time.Time `json:"switched_at,omitempty"`
+	RetiredAt   time.Time `json:"retired_at,omitempty"`
+}
+
+// NewSelector returns a date based selector for a rotation started at now,
+// different from the current one
+func NewSelector(current string, now time.Time) string {
+	selector := "s" + now.UTC().Format("20060102")
+	if selector == current {
+		selector += "b"
+	}
+	return selector
+}
+
+// Active returns the selector mail is signed with
+func (r *Rotation) Active() string {
+	if r.Phase == PhasePublished {
+		return r.OldSelector
+	}
+	return r.NewSelector
+}
+
+// Next returns the phase the rotation moves to next and when that becomes
+// due, or an empty phase when the rotation is complete
+func (r *Rotation) Next(publishWait, retireWait time.Duration) (string, time.Time) {
+	switch r.Phase {
+	case PhasePublished:
+		return PhaseSwitched, r.PublishedAt.Add(publishWait)
+	case PhaseSwitched:
+		return PhaseRetired, r.SwitchedAt.Add(retireWait)
+	}
+	return "", time.Time{}
+}
+
+// Validate checks a loaded rotation is consistent
+func (r *Rotation) Validate() error {
+	if r.Domain == "" {
+		return fmt.Errorf("rotation has no domain")
+	}
+	if err := ValidSelector(r.OldSelector); err != nil {
+		return err
+	}
+	if err := ValidSelector(r.NewSelector); err != nil {
+		return err
+	}
+	switch r.Phase {
+	case PhasePublished, PhaseSwitched, PhaseRetired:
+		return nil
+	}
+	return fmt.Errorf("unknown rotation phase %q", r.Phase)
+}
@@ -0,0 +1,274 @@
+package dmarc
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxReportSize bounds a decompressed report, so a malicious attachment
+// cannot exhaust memory
+const maxReportSize = 64 << 20
+
+// Report is a DMARC aggregate report (RFC 7489 appendix C)
+type Report struct {
+	Metadata Metadata `xml:"report_metadata" json:"metadata"`
+	Policy   Policy   `xml:"policy_published" json:"policy"`
+	Records  []Record `xml:"record" json:"records"`
+}
+
+// Metadata identifies a report and the period it covers
+type Metadata struct {
+	OrgName  string `xml:"org_name" json:"org_name"`
+	Email    string `xml:"email" json:"email"`
+	ReportID string `xml:"report_id" json:"report_id"`
+	Begin    int64  `xml:"date_range>begin" json:"begin"` // Unix time
+	End      int64  `xml:"date_range>end" json:"end"`
+}
+
+// Policy is the DMARC record of the domain as seen by the reporter
+type Policy struct {
+	Domain string `xml:"domain" json:"domain"`
+	ADKIM  string `xml:"adkim" json:"adkim,omitempty"`
+	ASPF   string `xml:"aspf" json:"aspf,omitempty"`
+	P      string `xml:"p" json:"p"`
+	SP     string `xml:"sp" json:"sp,omitempty"`
+	Pct    int    `xml:"pct" json:"pct,omitempty"`
+}
+
+// Record holds the results of the messages from one source IP
+type Record struct {
+	SourceIP    string `xml:"row>source_ip" json:"source_ip"`
+	Count       int    `xml:"row>count" json:"count"`
+	Disposition string `xml:"row>policy_evaluated>disposition" json:"disposition"`
+	DKIM        string `xml:"row>policy_evaluated>dkim" json:"dkim"` // Aligned DKIM result
+	SPF         string `xml:"row>policy_evaluated>spf" json:"spf"`   // Aligned SPF result
+	HeaderFrom  string `xml:"identifiers>header_from" json:"header_from"`
+}
+
+// Pass reports whether the messages passed DMARC, which takes an aligned
+// DKIM or SPF pass
+func (r Record) Pass() bool {
+	return strings.EqualFold(r.DKIM, "pass") || strings.EqualFold(r.SPF, "pass")
+}
+
+// Parse parses the XML of an aggregate report
+func Parse(r io.Reader) (*Report, error) {
+	var report Report
+	if err := xml.NewDecoder(r).Decode(&report); err != nil {
+		return nil, fmt.Errorf("invalid aggregate report: %w", err)
+	}
+	if report.Policy.Domain == "" {
+		return nil, fmt.Errorf("aggregate report %q has no policy domain", report.Metadata.ReportID)
+	}
+	return &report, nil
+}
+
+// ReadFile returns the reports in a file as receivers send them: plain XML,
+// gzip or zip compressed, or attached to a mail message such as a file of
+// a Maildir
+func ReadFile(data []byte) ([]*Report, error) {
+	return readFile(data, 0)
+}
+
+// ReadDir returns the reports in the files under dir. A file that holds no
+// report is passed to skip and otherwise ignored.
+func ReadDir(dir string, skip func(path string, err error)) ([]*Report, error) {
+	var reports []*Report
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		found, err := ReadFile(data)
+		if err != nil {
+			skip(path, err)
+			return nil
+		}
+		reports = append(reports, found...)
+		return nil
+	})
+	return reports, err
+}
+
+func readFile(data []byte, depth int) ([]*Report, error) {
+	if depth > 4 {
+		return nil, fmt.Errorf("report nested too deeply")
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip report: %w", err)
+		}
+		defer zr.Close()
+		inner, err := readLimited(zr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip report: %w", err)
+		}
+		return readFile(inner, depth+1)
+
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zip report: %w", err)
+		}
+		var reports []*Report
+		for _, file := range zr.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				return nil, fmt.Errorf("invalid zip report: %w", err)
+			}
+			inner, err := readLimited(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("invalid zip report %s: %w", file.Name, err)
+			}
+			found, err := readFile(inner, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			reports = append(reports, found...)
+		}
+		return reports, nil
+
+	case isXML(data):
+		report, err := Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return []*Report{report}, nil
+	}
+
+	return readMessage(data, depth)
+}
+
+// readMessage returns the reports attached to a mail message
+func readMessage(data []byte, depth int) ([]*Report, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not a report or mail message: %w", err)
+	}
+
+	var reports []*Report
+	err = walkParts(msg.Header, msg.Body, func(body []byte) error {
+		found, err := readFile(body, depth+1)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, found...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(reports) == 0 {
+		return nil, fmt.Errorf("mail message has no report attached")
+	}
+	return reports, nil
+}
+
+// walkParts calls fn with the decoded body of every part of a message that
+// may hold a report
+func walkParts(header map[string][]string, body io.Reader, fn func([]byte) error) error {
+	get := func(key string) string {
+		if values := header[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	mediaType, params, err := mime.ParseMediaType(get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid multipart message: %w", err)
+			}
+			if err := walkParts(part.Header, part, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !isReportPart(mediaType, params["name"], get("Content-Disposition")) {
+		return nil
+	}
+
+	switch strings.ToLower(get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := readLimited(body)
+	if err != nil {
+		return fmt.Errorf("invalid attachment: %w", err)
+	}
+	return fn(data)
+}
+
+// isReportPart reports whether a message part is an XML, gzip or zip
+// attachment. Receivers disagree on media types, so the file name counts
+// as much as the type.
+func isReportPart(mediaType, name, disposition string) bool {
+	switch mediaType {
+	case "text/xml", "application/xml", "application/gzip", "application/x-gzip",
+		"application/zip", "application/x-zip-compressed", "application/x-zip":
+		return true
+	}
+
+	if _, params, err := mime.ParseMediaType(disposition); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".xml") || strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".zip")
+}
+
+func isXML(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("<"))
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxReportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxReportSize {
+		return nil, fmt.Errorf("report exceeds %d bytes", maxReportSize)
+	}
+	return data, nil
+}
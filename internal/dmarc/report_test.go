@@ -0,0 +1,218 @@
+package dmarc
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testReport returns the XML of an aggregate report for domain
+func testReport(org, id, domain string) string {
+	return `<?xml version="1.0" encoding="UTF-8" ?>
+<feedback>
+  <report_metadata>
+    <org_name>` + org + `</org_name>
+    <email>noreply-dmarc-support@` + org + `</email>
+    <report_id>` + id + `</report_id>
+    <date_range><begin>1704067200</begin><end>1704153599</end></date_range>
+  </report_metadata>
+  <policy_published>
+    <domain>` + domain + `</domain>
+    <adkim>r</adkim><aspf>r</aspf><p>quarantine</p><sp>none</sp><pct>100</pct>
+  </policy_published>
+  <record>
+    <row>
+      <source_ip>192.0.2.1</source_ip>
+      <count>12</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>` + domain + `</header_from></identifiers>
+  </record>
+  <record>
+    <row>
+      <source_ip>198.51.100.7</source_ip>
+      <count>3</count>
+      <policy_evaluated><disposition>quarantine</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>` + domain + `</header_from></identifiers>
+  </record>
+</feedback>
+`
+}
+
+func gzipData(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(data))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipData(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// mailMessage returns a multipart message with a text part and attachment
+func mailMessage(contentType, encoding, body string) []byte {
+	return []byte("From: noreply-dmarc-support@google.com\r\n" +
+		"To: dmarc@example.com\r\n" +
+		"Subject: Report domain: example.com\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is an aggregate report.\r\n" +
+		"--b1\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Transfer-Encoding: " + encoding + "\r\n" +
+		"\r\n" +
+		body + "\r\n" +
+		"--b1--\r\n")
+}
+
+func TestReadFile(t *testing.T) {
+	xml := testReport("google.com", "1001", "example.com")
+	encoded := base64.StdEncoding.EncodeToString(gzipData(t, xml))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string // Report IDs
+		wantErr string
+	}{
+		{name: "xml", data: []byte(xml), want: []string{"1001"}},
+		{name: "xml with a byte order mark", data: []byte("\xef\xbb\xbf" + xml), want: []string{"1001"}},
+		{name: "gzip", data: gzipData(t, xml), want: []string{"1001"}},
+		{
+			name: "zip with two reports",
+			data: zipData(t, map[string]string{"a.xml": xml, "b.xml": testReport("yahoo.com", "2002", "example.com")}),
+			want: []string{"1001", "2002"},
+		},
+		{name: "mail with a gzip attachment", data: mailMessage("application/gzip; name=\"r.xml.gz\"", "base64", encoded), want: []string{"1001"}},
+		{
+			name: "mail with an attachment named by disposition",
+			data: mailMessage("application/octet-stream\r\nContent-Disposition: attachment; filename=\"google.com!example.com!1704067200!1704153599.zip\"", "base64",
+				base64.StdEncoding.EncodeToString(zipData(t, map[string]string{"r.xml": xml}))),
+			want: []string{"1001"},
+		},
+		{name: "mail with a quoted-printable xml attachment", data: mailMessage("text/xml", "quoted-printable", strings.ReplaceAll(xml, "=", "=3D")), want: []string{"1001"}},
+		{name: "mail without a report", data: mailMessage("text/html", "7bit", "<p>hello</p>"), wantErr: "no report attached"},
+		{name: "report without a domain", data: []byte(strings.Replace(xml, "<domain>example.com</domain>", "", 1)), wantErr: "no policy domain"},
+		{name: "invalid xml", data: []byte("<feedback><report_metadata>"), wantErr: "invalid aggregate report"},
+		{name: "invalid gzip", data: append([]byte{0x1f, 0x8b}, "garbage"...), wantErr: "invalid gzip report"},
+		{name: "not a report", data: []byte("hello"), wantErr: "not a report or mail message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reports, err := ReadFile(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ReadFile = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, report := range reports {
+				ids = append(ids, report.Metadata.ReportID)
+			}
+			sort.Strings(ids)
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("report ids = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	report, err := Parse(strings.NewReader(testReport("google.com", "1001", "example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantMetadata := Metadata{OrgName: "google.com", Email: "noreply-dmarc-support@google.com", ReportID: "1001", Begin: 1704067200, End: 1704153599}
+	if report.Metadata != wantMetadata {
+		t.Errorf("Metadata = %+v, want %+v", report.Metadata, wantMetadata)
+	}
+	wantPolicy := Policy{Domain: "example.com", ADKIM: "r", ASPF: "r", P: "quarantine", SP: "none", Pct: 100}
+	if report.Policy != wantPolicy {
+		t.Errorf("Policy = %+v, want %+v", report.Policy, wantPolicy)
+	}
+	wantRecords := []Record{
+		{SourceIP: "192.0.2.1", Count: 12, Disposition: "none", DKIM: "pass", SPF: "fail", HeaderFrom: "example.com"},
+		{SourceIP: "198.51.100.7", Count: 3, Disposition: "quarantine", DKIM: "fail", SPF: "fail", HeaderFrom: "example.com"},
+	}
+	if len(report.Records) != len(wantRecords) {
+		t.Fatalf("Records = %+v, want %+v", report.Records, wantRecords)
+	}
+	for i, record := range report.Records {
+		if record != wantRecords[i] {
+			t.Errorf("Records[%d] = %+v, want %+v", i, record, wantRecords[i])
+		}
+		if pass := i == 0; record.Pass() != pass {
+			t.Errorf("Records[%d].Pass() = %v, want %v", i, record.Pass(), pass)
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"new/1.eml":   mailMessage("application/gzip; name=\"r.xml.gz\"", "base64", base64.StdEncoding.EncodeToString(gzipData(t, testReport("google.com", "1001", "example.com")))),
+		"cur/2.xml":   []byte(testReport("yahoo.com", "2002", "example.org")),
+		"cur/3.eml":   mailMessage("text/html", "7bit", "<p>hello</p>"),
+		"tmp/ignored": {},
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var skipped []string
+	reports, err := ReadDir(dir, func(path string, err error) {
+		rel, _ := filepath.Rel(dir, path)
+		skipped = append(skipped, rel)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Errorf("ReadDir found %d reports, want 2", len(reports))
+	}
+	if strings.Join(skipped, ",") != filepath.Join("cur", "3.eml")+","+filepath.Join("tmp", "ignored") {
+		t.Errorf("skipped %v, want cur/3.eml and tmp/ignored", skipped)
+	}
+}
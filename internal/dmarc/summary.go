@@ -0,0 +1,165 @@
+package dmarc
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Server is a server deployed for a domain, as recorded in a run report
+type Server struct {
+	Domain string `json:"domain"`
+	IP     string `json:"ip"`
+	RunID  string `json:"run_id"`
+	RowID  int    `json:"row_id"`
+}
+
+// DomainSummary sums up the reports received for a domain
+type DomainSummary struct {
+	Domain    string           `json:"domain"`
+	Reports   int              `json:"reports"`
+	Reporters []string         `json:"reporters,omitempty"`
+	Begin     time.Time        `json:"begin"`
+	End       time.Time        `json:"end"`
+	Messages  int              `json:"messages"`
+	Pass      int              `json:"pass"`
+	Fail      int              `json:"fail"`
+	Sources   []*SourceSummary `json:"sources,omitempty"` // Most messages first
+	Servers   []Server         `json:"servers,omitempty"` // Servers we deployed for the domain
+}
+
+// SourceSummary sums up the messages of a domain sent from one IP
+type SourceSummary struct {
+	SourceIP    string  `json:"source_ip"`
+	Messages    int     `json:"messages"`
+	Pass        int     `json:"pass"`
+	Fail        int     `json:"fail"`
+	DKIMPass    int     `json:"dkim_pass"`
+	SPFPass     int     `json:"spf_pass"`
+	Quarantined int     `json:"quarantined,omitempty"`
+	Rejected    int     `json:"rejected,omitempty"`
+	Server      *Server `json:"server,omitempty"` // Our server sending from this IP
+}
+
+// Summarize sums up reports by domain and source IP. A report delivered
+// more than once counts once. Sources are matched against the servers we
+// deployed, and domains with deployed servers but no reports are listed
+// with no sources.
+func Summarize(reports []*Report, servers []Server) []*DomainSummary {
+	domains := make(map[string]*DomainSummary)
+	domain := func(name string) *DomainSummary {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		summary, ok := domains[name]
+		if !ok {
+			summary = &DomainSummary{Domain: name}
+			domains[name] = summary
+		}
+		return summary
+	}
+
+	for _, server := range servers {
+		summary := domain(server.Domain)
+		summary.Servers = append(summary.Servers, server)
+	}
+
+	seen := make(map[string]bool)
+	sources := make(map[string]map[string]*SourceSummary)
+	for _, report := range reports {
+		key := report.Metadata.OrgName + "\x00" + report.Metadata.ReportID
+		if report.Metadata.ReportID != "" && seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		summary := domain(report.Policy.Domain)
+		summary.Reports++
+		summary.Reporters = appendUnique(summary.Reporters, report.Metadata.OrgName)
+		begin, end := time.Unix(report.Metadata.Begin, 0).UTC(), time.Unix(report.Metadata.End, 0).UTC()
+		if summary.Begin.IsZero() || begin.Before(summary.Begin) {
+			summary.Begin = begin
+		}
+		if end.After(summary.End) {
+			summary.End = end
+		}
+
+		if sources[summary.Domain] == nil {
+			sources[summary.Domain] = make(map[string]*SourceSummary)
+		}
+		for _, record := range report.Records {
+			ip := normalizeIP(record.SourceIP)
+			source, ok := sources[summary.Domain][ip]
+			if !ok {
+				source = &SourceSummary{SourceIP: ip, Server: findServer(summary.Servers, ip)}
+				sources[summary.Domain][ip] = source
+				summary.Sources = append(summary.Sources, source)
+			}
+
+			source.Messages += record.Count
+			summary.Messages += record.Count
+			if record.Pass() {
+				source.Pass += record.Count
+				summary.Pass += record.Count
+			} else {
+				source.Fail += record.Count
+				summary.Fail += record.Count
+			}
+			if strings.EqualFold(record.DKIM, "pass") {
+				source.DKIMPass += record.Count
+			}
+			if strings.EqualFold(record.SPF, "pass") {
+				source.SPFPass += record.Count
+			}
+			switch strings.ToLower(record.Disposition) {
+			case "quarantine":
+				source.Quarantined += record.Count
+			case "reject":
+				source.Rejected += record.Count
+			}
+		}
+	}
+
+	result := make([]*DomainSummary, 0, len(domains))
+	for _, summary := range domains {
+		sort.Slice(summary.Sources, func(i, j int) bool {
+			a, b := summary.Sources[i], summary.Sources[j]
+			if a.Messages != b.Messages {
+				return a.Messages > b.Messages
+			}
+			return a.SourceIP < b.SourceIP
+		})
+		sort.Strings(summary.Reporters)
+		result = append(result, summary)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Domain < result[j].Domain })
+	return result
+}
+
+func findServer(servers []Server, ip string) *Server {
+	for i := range servers {
+		if normalizeIP(servers[i].IP) == ip {
+			return &servers[i]
+		}
+	}
+	return nil
+}
+
+func normalizeIP(ip string) string {
+	ip = strings.TrimSpace(ip)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+func appendUnique(list []string, value string) []string {
+	if value == "" {
+		return list
+	}
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
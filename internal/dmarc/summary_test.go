@@ -0,0 +1,81 @@
+package dmarc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	report := func(org, id, domain string, begin int64, records ...Record) *Report {
+		return &Report{
+			Metadata: Metadata{OrgName: org, ReportID: id, Begin: begin, End: begin + 86399},
+			Policy:   Policy{Domain: domain, P: "none"},
+			Records:  records,
+		}
+	}
+	reports := []*Report{
+		report("google.com", "1", "Example.com.", 1704067200,
+			Record{SourceIP: "192.0.2.1", Count: 10, DKIM: "pass", SPF: "pass", Disposition: "none"},
+			Record{SourceIP: "2001:db8:0::1", Count: 2, DKIM: "fail", SPF: "fail", Disposition: "reject"},
+		),
+		// Delivered twice
+		report("google.com", "1", "example.com", 1704067200,
+			Record{SourceIP: "192.0.2.1", Count: 10, DKIM: "pass", SPF: "pass"},
+		),
+		report("yahoo.com", "7", "example.com", 1703980800,
+			Record{SourceIP: "192.0.2.1", Count: 1, DKIM: "fail", SPF: "PASS"},
+			Record{SourceIP: "2001:db8::1", Count: 3, DKIM: "fail", SPF: "fail", Disposition: "quarantine"},
+			Record{SourceIP: "198.51.100.9", Count: 5, DKIM: "pass", SPF: "fail"},
+		),
+	}
+	servers := []Server{
+		{Domain: "example.com", IP: "192.0.2.1", RunID: "run-1", RowID: 1},
+		{Domain: "example.org", IP: "192.0.2.2", RunID: "run-1", RowID: 2},
+	}
+
+	summaries := Summarize(reports, servers)
+	if len(summaries) != 2 || summaries[0].Domain != "example.com" || summaries[1].Domain != "example.org" {
+		t.Fatalf("Summarize = %+v, want example.com and example.org", summaries)
+	}
+
+	com := summaries[0]
+	if com.Reports != 2 || com.Messages != 21 || com.Pass != 16 || com.Fail != 5 {
+		t.Errorf("example.com: %d reports, %d messages, %d pass, %d fail, want 2, 21, 16, 5", com.Reports, com.Messages, com.Pass, com.Fail)
+	}
+	if len(com.Reporters) != 2 || com.Reporters[0] != "google.com" || com.Reporters[1] != "yahoo.com" {
+		t.Errorf("example.com reporters = %v", com.Reporters)
+	}
+	if want := time.Unix(1703980800, 0).UTC(); !com.Begin.Equal(want) {
+		t.Errorf("example.com begins %v, want %v", com.Begin, want)
+	}
+	if want := time.Unix(1704067200+86399, 0).UTC(); !com.End.Equal(want) {
+		t.Errorf("example.com ends %v, want %v", com.End, want)
+	}
+
+	want := []SourceSummary{
+		{SourceIP: "192.0.2.1", Messages: 11, Pass: 11, DKIMPass: 10, SPFPass: 11},
+		{SourceIP: "198.51.100.9", Messages: 5, Pass: 5, DKIMPass: 5},
+		{SourceIP: "2001:db8::1", Messages: 5, Fail: 5, Quarantined: 3, Rejected: 2},
+	}
+	if len(com.Sources) != len(want) {
+		t.Fatalf("example.com sources = %+v", com.Sources)
+	}
+	for i, source := range com.Sources {
+		got := *source
+		got.Server = nil
+		if got != want[i] {
+			t.Errorf("source %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if server := com.Sources[0].Server; server == nil || server.RowID != 1 {
+		t.Errorf("source 192.0.2.1 server = %+v, want row 1", server)
+	}
+	if com.Sources[1].Server != nil {
+		t.Errorf("source 198.51.100.9 server = %+v, want none", com.Sources[1].Server)
+	}
+
+	org := summaries[1]
+	if org.Reports != 0 || len(org.Sources) != 0 || len(org.Servers) != 1 {
+		t.Errorf("example.org = %+v, want a deployed domain without reports", org)
+	}
+}
@@ -0,0 +1,94 @@
+package cloudflare
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every provider in the process, as
+// Cloudflare enforces its limits per account rather than per task
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens per second, zero for unlimited
+	tokens float64
+	last   time.Time
+	paused time.Time // No requests before this time, after a 429
+}
+
+var limiter = &rateLimiter{}
+
+// setRate changes the request rate. The burst equals one second of requests.
+func (l *rateLimiter) setRate(rps float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rps == l.rate {
+		return
+	}
+	l.rate = rps
+	l.tokens = l.burst()
+	l.last = time.Now()
+}
+
+// wait blocks until a request may be sent, or returns the context's error
+// when it is cancelled first
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve takes a token if one is available, or returns how long to wait
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(l.paused) {
+		return l.paused.Sub(now)
+	}
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if burst := l.burst(); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// pause holds back every request for d, after Cloudflare asked to back off
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(l.paused) {
+		l.paused = until
+	}
+}
+
+func (l *rateLimiter) burst() float64 {
+	if l.rate < 1 {
+		return 1
+	}
+	return l.rate
+}
@@ -2,33 +2,97 @@ package cloudflare
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"strings"
+	"mailops/internal/dns"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	defaultAPIURL = "https://api.cloudflare.com/client/v4"
+	pageSize      = 100
+)
+
+// zoneIDs caches zone IDs by API token and zone name across all providers,
+// so tasks sharing a zone look it up once per run
+var zoneIDs sync.Map
+
 // Provider implements Cloudflare DNS provider
 type Provider struct {
 	apiToken string
+	apiURL   string
+	zone     string
 	dryRun   bool
 	client   *http.Client
+	ctx      context.Context // Cancels requests, including the wait for the rate limiter
+}
+
+func init() {
+	dns.Register("cloudflare", newFromConfig)
+}
+
+// newFromConfig builds a provider from the row settings. Options:
+//
+//	api_timeout_ms  timeout per API request
+//	rate_limit_rps  requests per second shared by all tasks
+//	api_url         API base URL
+func newFromConfig(cfg dns.Config) (dns.Provider, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("%w: Cloudflare API token is required", dns.ErrMissingConfig)
+	}
+	
+	p := NewProvider(cfg.Token, cfg.Zone, cfg.DryRun)
+	if cfg.Context != nil {
+		p.ctx = cfg.Context
+	}
+	p.apiURL = strings.TrimSuffix(cfg.Option("api_url", defaultAPIURL), "/")
+	
+	if v := cfg.Option("api_timeout_ms", ""); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("invalid Cloudflare api_timeout_ms: %s", v)
+		}
+		p.client.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	
+	if v := cfg.Option("rate_limit_rps", ""); v != "" {
+		rps, err := strconv.ParseFloat(v, 64)
+		if err != nil || rps < 0 {
+			return nil, fmt.Errorf("invalid Cloudflare rate_limit_rps: %s", v)
+		}
+		limiter.setRate(rps)
+	}
+	
+	return p, nil
 }
 
-// NewProvider creates a new Cloudflare DNS provider
-func NewProvider(apiToken string, dryRun bool) *Provider {
+// NewProvider creates a new Cloudflare DNS provider. Relative record names
+// are qualified with zone; an empty zone is discovered from the account.
+func NewProvider(apiToken, zone string, dryRun bool) *Provider {
 	return &Provider{
 		apiToken: apiToken,
+		apiURL:   defaultAPIURL,
+		zone:     strings.TrimSuffix(zone, "."),
 		dryRun:   dryRun,
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		ctx: context.Background(),
 	}
 }
 
+// Name returns the registry name of the provider
+func (p *Provider) Name() string {
+	return "cloudflare"
+}
+
 // Zone represents a Cloudflare zone
 type Zone struct {
 	ID     string `json:"id"`
@@ -38,397 +102,489 @@ type Zone struct {
 
 // DNSRecord represents a DNS record
 type DNSRecord struct {
-	ID      string `json:"id,omitempty"`
-	Type    string `json:"type"`
-	Name    string `json:"name"`
-	Content string `json:"content"`
-	TTL     int    `json:"ttl"`
-	Proxied bool   `json:"proxied"`
-	Priority int   `json:"priority,omitempty"`
+	ID       string          `json:"id,omitempty"`
+	Type     string          `json:"type"`
+	Name     string          `json:"name"`
+	Content  string          `json:"content"`
+	TTL      int             `json:"ttl"`
+	Proxied  bool            `json:"proxied"`
+	Priority int             `json:"priority,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"` // Structured fields of CAA and SRV records
 }
 
-// APIResponse represents Cloudflare API response
-type APIResponse struct {
-	Success bool `json:"success"`
-	Errors  []struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
-	} `json:"errors"`
-	Messages []struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
-	} `json:"messages"`
-	Result interface{} `json:"result"`
+// caaData is the data object of a CAA record
+type caaData struct {
+	Flags int    `json:"flags"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+// srvData is the data object of an SRV record
+type srvData struct {
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
+}
+
+// APIError is an error entry of a Cloudflare API response
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
-// DNSListResponse represents list records response
-type DNSListResponse struct {
-	Success bool        `json:"success"`
-	Result  []DNSRecord `json:"result"`
-	Errors  []struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
-	} `json:"errors"`
+// APIResponse represents Cloudflare API response
+type APIResponse struct {
+	Success    bool            `json:"success"`
+	Errors     []APIError      `json:"errors"`
+	Messages   []APIError      `json:"messages"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo *struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
 }
 
 // GetZoneID gets zone ID by zone name
 func (p *Provider) GetZoneID(zoneName string) (string, error) {
-	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones?name=%s", zoneName)
+	zoneName = strings.ToLower(strings.TrimSuffix(zoneName, "."))
+	cacheKey := p.apiToken + "|" + zoneName
+	if id, ok := zoneIDs.Load(cacheKey); ok {
+		return id.(string), nil
+	}
 	
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
+	var zones []Zone
+	if err := p.get("/zones?name="+url.QueryEscape(zoneName), &zones); err != nil {
 		return "", err
 	}
 	
-	req.Header.Set("Authorization", "Bearer "+p.apiToken)
-	req.Header.Set("Content-Type", "application/json")
+	if len(zones) == 0 {
+		return "", &dns.APIError{Kind: dns.ErrNotFound, Message: fmt.Sprintf("zone not found: %s", zoneName)}
+	}
 	
-	resp, err := p.client.Do(req)
-	if err != nil {
-		return "", err
+	zoneIDs.Store(cacheKey, zones[0].ID)
+	return zones[0].ID, nil
+}
+
+// ListZones lists the names of the zones the API token can access
+func (p *Provider) ListZones() ([]string, error) {
+	var zones []Zone
+	if err := p.getAll("/zones", &zones); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 	
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	names := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		zoneIDs.Store(p.apiToken+"|"+strings.ToLower(zone.Name), zone.ID)
+		names = append(names, zone.Name)
 	}
 	
-	var apiResp struct {
-		Success bool   `json:"success"`
-		Result  []Zone `json:"result"`
+	return names, nil
+}
+
+// FindZone returns the zone that contains the given name. Without a
+// configured zone, the most specific zone of the account is used and kept.
+func (p *Provider) FindZone(name string) (string, error) {
+	if p.zone != "" {
+		if err := dns.CheckZone(name, p.zone); err != nil {
+			return "", err
+		}
+		return p.zone, nil
 	}
 	
-	if err := json.Unmarshal(body, &apiResp); err != nil {
+	zones, err := p.ListZones()
+	if err != nil {
 		return "", err
 	}
 	
-	if !apiResp.Success || len(apiResp.Result) == 0 {
-		return "", fmt.Errorf("zone not found: %s", zoneName)
+	zone, err := dns.MatchZone(name, zones)
+	if err != nil {
+		return "", err
 	}
 	
-	return apiResp.Result[0].ID, nil
+	// Later lookups for this task resolve against the discovered zone
+	p.zone = zone
+	return zone, nil
 }
 
 // FindRecord finds a DNS record by type and name
-func (p *Provider) FindRecord(recordType, name string) (*DNSRecord, error) {
-	if p.dryRun {
-		return nil, nil // In dry-run mode, pretend record doesn't exist
-	}
-	
-	zoneName := extractZoneName(name)
-	zoneID, err := p.GetZoneID(zoneName)
+// Lookups are read-only and therefore also performed in dry-run mode.
+func (p *Provider) FindRecord(recordType, name string) (*dns.Record, error) {
+	records, err := p.ListRecords(recordType, name)
 	if err != nil {
 		return nil, err
 	}
 	
-	// Build query parameters
-	queryParams := url.Values{}
-	queryParams.Set("type", recordType)
-	queryParams.Set("name", name)
-	queryParams.Set("per_page", "100")
-	
-	apiURL := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records?%s", zoneID, queryParams.Encode())
-	
-	req, err := http.NewRequest("GET", apiURL, nil)
-	if err != nil {
-		return nil, err
+	// Return first matching record
+	if len(records) > 0 {
+		return &records[0], nil
 	}
 	
-	req.Header.Set("Authorization", "Bearer "+p.apiToken)
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := p.client.Do(req)
+	return nil, nil // Not found
+}
+
+// ListRecords lists DNS records by type and name
+func (p *Provider) ListRecords(recordType, name string) ([]dns.Record, error) {
+	name = p.qualify(name)
+	zoneID, err := p.zoneIDFor(name)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	// Build query parameters
+	queryParams := url.Values{}
+	queryParams.Set("type", recordType)
+	queryParams.Set("name", name)
 	
-	var listResp DNSListResponse
-	if err := json.Unmarshal(body, &listResp); err != nil {
+	var apiRecords []DNSRecord
+	if err := p.getAll(fmt.Sprintf("/zones/%s/dns_records?%s", zoneID, queryParams.Encode()), &apiRecords); err != nil {
 		return nil, err
 	}
 	
-	if !listResp.Success {
-		if len(listResp.Errors) > 0 {
-			return nil, fmt.Errorf("API error: %s", listResp.Errors[0].Message)
+	records := make([]dns.Record, 0, len(apiRecords))
+	for _, r := range apiRecords {
+		record := dns.Record{
+			ID:       r.ID,
+			Type:     r.Type,
+			Name:     r.Name,
+			Content:  r.Content,
+			TTL:      r.TTL,
+			Priority: r.Priority,
 		}
-		return nil, fmt.Errorf("failed to list records")
-	}
-	
-	// Return first matching record
-	if len(listResp.Result) > 0 {
-		return &listResp.Result[0], nil
+		decodeData(&record, r.Data)
+		if strings.EqualFold(record.Type, "TXT") {
+			record.Content = dns.JoinTXT(record.Content)
+		}
+		records = append(records, record)
 	}
 	
-	return nil, nil // Not found
+	return records, nil
 }
 
-// UpsertRecord creates or updates a DNS record
-func (p *Provider) UpsertRecord(recordType, name, content string, priority *int) error {
+// UpsertRecord creates or updates a DNS record. A record with an ID
+// replaces that record, otherwise the first record of the same type and
+// name is replaced, or a new record is created.
+func (p *Provider) UpsertRecord(record dns.Record) error {
 	if p.dryRun {
 		// In dry-run mode, just return without doing anything
 		// The caller will log what would happen
 		return nil
 	}
 	
-	// Try to find existing record
-	existing, err := p.FindRecord(recordType, name)
-	if err != nil {
-		return fmt.Errorf("failed to check existing record: %w", err)
+	name := p.qualify(record.Name)
+	
+	recordID := record.ID
+	if recordID == "" {
+		existing, err := p.FindRecord(record.Type, name)
+		if err != nil {
+			return fmt.Errorf("failed to check existing record: %w", err)
+		}
+		if existing != nil {
+			recordID = existing.ID
+		}
 	}
 	
-	zoneName := extractZoneName(name)
-	zoneID, err := p.GetZoneID(zoneName)
+	zoneID, err := p.zoneIDFor(name)
 	if err != nil {
 		return err
 	}
 	
-	record := DNSRecord{
-		Type:    recordType,
-		Name:    name,
-		Content: content,
-		TTL:     3600,
-		Proxied: false,
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = 3600
 	}
 	
-	if priority != nil {
-		record.Priority = *priority
+	apiRecord := DNSRecord{
+		Type:     record.Type,
+		Name:     name,
+		Content:  encodeContent(record),
+		TTL:      ttl,
+		Proxied:  false,
+		Priority: record.Priority,
+	}
+	if apiRecord.Data, err = encodeData(record); err != nil {
+		return err
 	}
 	
-	if existing != nil {
+	if recordID != "" {
 		// Update existing record
-		return p.updateRecord(zoneID, existing.ID, record)
-	} else {
-		// Create new record
-		return p.createRecord(zoneID, record)
+		return p.do("PUT", fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, recordID), apiRecord, nil)
 	}
+	// Create new record
+	return p.do("POST", fmt.Sprintf("/zones/%s/dns_records", zoneID), apiRecord, nil)
 }
 
-// CreateARecord creates an A record
-func (p *Provider) CreateARecord(zone, name, ip string) error {
+// CreateRecord adds a DNS record, leaving existing records of the same type
+// and name in place
+func (p *Provider) CreateRecord(record dns.Record) error {
 	if p.dryRun {
-		// In dry-run mode, just return without doing anything
 		return nil
 	}
 	
-	zoneID, err := p.GetZoneID(zone)
+	name := p.qualify(record.Name)
+	zoneID, err := p.zoneIDFor(name)
 	if err != nil {
 		return err
 	}
 	
-	fullName := fmt.Sprintf("%s.%s", name, zone)
-	
-	record := DNSRecord{
-		Type:    "A",
-		Name:    fullName,
-		Content: ip,
-		TTL:     3600,
-		Proxied: false,
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = 3600
 	}
 	
-	return p.createRecord(zoneID, record)
-}
-
-// CreateMXRecord creates an MX record
-func (p *Provider) CreateMXRecord(zone, mailServer string, priority int) error {
-	if p.dryRun {
-		// In dry-run mode, just return without doing anything
-		return nil
+	apiRecord := DNSRecord{
+		Type:     record.Type,
+		Name:     name,
+		Content:  encodeContent(record),
+		TTL:      ttl,
+		Proxied:  false,
+		Priority: record.Priority,
 	}
-	
-	zoneID, err := p.GetZoneID(zone)
-	if err != nil {
+	if apiRecord.Data, err = encodeData(record); err != nil {
 		return err
 	}
 	
-	record := DNSRecord{
-		Type:     "MX",
-		Name:     zone,
-		Content:  fmt.Sprintf("%s.%s", mailServer, zone),
-		TTL:      3600,
-		Priority: priority,
-	}
-	
-	return p.createRecord(zoneID, record)
+	return p.do("POST", fmt.Sprintf("/zones/%s/dns_records", zoneID), apiRecord, nil)
 }
 
-// CreateTXTRecord creates a TXT record
-func (p *Provider) CreateTXTRecord(zone, name, content string) error {
-	if p.dryRun {
-		// In dry-run mode, just return without doing anything
-		return nil
-	}
-	
-	zoneID, err := p.GetZoneID(zone)
-	if err != nil {
-		return err
+// encodeContent returns the content sent for a record. TXT values longer
+// than a single character-string are sent as quoted 255-byte strings.
+func encodeContent(record dns.Record) string {
+	if strings.EqualFold(record.Type, "TXT") && len(record.Content) > 255 {
+		return dns.FormatTXT(record.Content)
 	}
-	
-	var fullName string
-	if name == "@" {
-		fullName = zone
-	} else {
-		fullName = fmt.Sprintf("%s.%s", name, zone)
+	return record.Content
+}
+
+// encodeData builds the data object Cloudflare expects for CAA and SRV
+// records in place of the content
+func encodeData(record dns.Record) (json.RawMessage, error) {
+	switch strings.ToUpper(record.Type) {
+	case "CAA":
+		flags, tag, value, err := dns.ParseCAA(record.Content)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(caaData{Flags: flags, Tag: tag, Value: value})
+	case "SRV":
+		weight, port, target, err := dns.ParseSRV(record.Content)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(srvData{Priority: record.Priority, Weight: weight, Port: port, Target: target})
 	}
-	
-	record := DNSRecord{
-		Type:    "TXT",
-		Name:    fullName,
-		Content: content,
-		TTL:     3600,
+	return nil, nil
+}
+
+// decodeData sets the content of CAA and SRV records from their data
+// object, so it has the same form whatever content Cloudflare returns
+func decodeData(record *dns.Record, data json.RawMessage) {
+	if len(data) == 0 {
+		return
+	}
+	switch strings.ToUpper(record.Type) {
+	case "CAA":
+		var caa caaData
+		if json.Unmarshal(data, &caa) == nil && caa.Tag != "" {
+			record.Content = dns.FormatCAA(caa.Flags, caa.Tag, caa.Value)
+		}
+	case "SRV":
+		var srv srvData
+		if json.Unmarshal(data, &srv) == nil && srv.Target != "" {
+			record.Content = dns.FormatSRV(srv.Weight, srv.Port, srv.Target)
+			record.Priority = srv.Priority
+		}
 	}
-	
-	return p.createRecord(zoneID, record)
 }
 
-// createRecord creates a DNS record
-func (p *Provider) createRecord(zoneID string, record DNSRecord) error {
+// DeleteRecord deletes a DNS record by ID
+func (p *Provider) DeleteRecord(record dns.Record) error {
 	if p.dryRun {
-		// In dry-run mode, just return without doing anything
 		return nil
 	}
 	
-	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records", zoneID)
-	
-	data, err := json.Marshal(record)
-	if err != nil {
-		return err
+	if record.ID == "" {
+		return fmt.Errorf("record ID is required to delete %s %s", record.Type, record.Name)
 	}
 	
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	zoneID, err := p.zoneIDFor(p.qualify(record.Name))
 	if err != nil {
 		return err
 	}
 	
-	req.Header.Set("Authorization", "Bearer "+p.apiToken)
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := p.client.Do(req)
+	return p.do("DELETE", fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, record.ID), nil, nil)
+}
+
+// zoneIDFor looks up the ID of the zone containing a record name
+func (p *Provider) zoneIDFor(name string) (string, error) {
+	zoneName, err := p.FindZone(name)
 	if err != nil {
-		return err
+		return "", err
+	}
+	return p.GetZoneID(zoneName)
+}
+
+// qualify expands a zone-relative record name ("@", "mail") to a full name
+func (p *Provider) qualify(name string) string {
+	return dns.Qualify(name, p.zone)
+}
+
+// get fetches a single page of results
+func (p *Provider) get(path string, result interface{}) error {
+	return p.do("GET", path, nil, result)
+}
+
+// getAll fetches every page of a list endpoint into result, a pointer to a slice
+func (p *Provider) getAll(path string, result interface{}) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	
+	var all []json.RawMessage
+	for page := 1; ; page++ {
+		resp, err := p.request("GET", fmt.Sprintf("%s%sper_page=%d&page=%d", path, sep, pageSize, page), nil)
+		if err != nil {
+			return err
+		}
+		
+		var items []json.RawMessage
+		if err := json.Unmarshal(resp.Result, &items); err != nil {
+			return fmt.Errorf("failed to decode Cloudflare response: %w", err)
+		}
+		all = append(all, items...)
+		
+		if resp.ResultInfo == nil || page >= resp.ResultInfo.TotalPages || len(items) == 0 {
+			break
+		}
 	}
-	defer resp.Body.Close()
 	
-	body, err := io.ReadAll(resp.Body)
+	data, err := json.Marshal(all)
 	if err != nil {
 		return err
 	}
-	
-	var apiResp APIResponse
-	if err := json.Unmarshal(body, &apiResp); err != nil {
+	return json.Unmarshal(data, result)
+}
+
+// do sends a request and decodes its result into result, if not nil
+func (p *Provider) do(method, path string, body, result interface{}) error {
+	resp, err := p.request(method, path, body)
+	if err != nil {
 		return err
 	}
 	
-	if !apiResp.Success {
-		if len(apiResp.Errors) > 0 {
-			return fmt.Errorf("API error: %s", apiResp.Errors[0].Message)
+	if result != nil && len(resp.Result) > 0 {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("failed to decode Cloudflare response: %w", err)
 		}
-		return fmt.Errorf("failed to create record")
 	}
-	
 	return nil
 }
 
-// updateRecord updates an existing DNS record
-func (p *Provider) updateRecord(zoneID, recordID string, record DNSRecord) error {
-	if p.dryRun {
-		// In dry-run mode, just return without doing anything
-		return nil
-	}
-	
-	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records/%s", zoneID, recordID)
-	
-	data, err := json.Marshal(record)
-	if err != nil {
-		return err
+// request sends a rate limited API request and classifies failures
+func (p *Provider) request(method, path string, body interface{}) (*APIResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
 	}
 	
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(p.ctx, method, p.apiURL+path, reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	
 	req.Header.Set("Authorization", "Bearer "+p.apiToken)
 	req.Header.Set("Content-Type", "application/json")
 	
+	if err := limiter.wait(p.ctx); err != nil {
+		return nil, err
+	}
+	
 	resp, err := p.client.Do(req)
 	if err != nil {
-		return err
+		if p.ctx.Err() != nil {
+			return nil, p.ctx.Err()
+		}
+		return nil, &dns.APIError{Kind: dns.ErrUnavailable, Message: err.Error()}
 	}
 	defer resp.Body.Close()
 	
-	body, err := io.ReadAll(resp.Body)
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, &dns.APIError{Kind: dns.ErrUnavailable, Message: err.Error()}
 	}
 	
 	var apiResp APIResponse
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		return err
+	if err := json.Unmarshal(data, &apiResp); err != nil && resp.StatusCode < 400 {
+		return nil, fmt.Errorf("failed to decode Cloudflare response: %w", err)
 	}
 	
-	if !apiResp.Success {
-		if len(apiResp.Errors) > 0 {
-			return fmt.Errorf("API error: %s", apiResp.Errors[0].Message)
+	if resp.StatusCode >= 400 || !apiResp.Success {
+		apiErr := classify(resp, apiResp.Errors)
+		if apiErr.RetryAfter > 0 {
+			limiter.pause(apiErr.RetryAfter)
 		}
-		return fmt.Errorf("failed to update record")
+		return nil, apiErr
 	}
 	
-	return nil
+	return &apiResp, nil
 }
 
-// ApplyDNSRecords applies all DNS records for a mail server
-func (p *Provider) ApplyDNSRecords(zone, host, domain, ip, dkimPublicKey, spfTemplate, dmarcTemplate, dkimSelector string) error {
-	// A record
-	if err := p.CreateARecord(zone, host, ip); err != nil {
-		return fmt.Errorf("failed to create A record: %v", err)
+// classify maps a failed response onto the DNS error classes
+func classify(resp *http.Response, errs []APIError) *dns.APIError {
+	apiErr := &dns.APIError{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	if len(errs) > 0 {
+		messages := make([]string, len(errs))
+		for i, e := range errs {
+			messages[i] = fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+		}
+		apiErr.Message = strings.Join(messages, "; ")
 	}
 	
-	// MX record
-	if err := p.CreateMXRecord(zone, host, 10); err != nil {
-		return fmt.Errorf("failed to create MX record: %v", err)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || hasCode(errs, 971, 10429):
+		apiErr.Kind = dns.ErrRateLimited
+		apiErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || hasCode(errs, 9103, 9109, 10000):
+		apiErr.Kind = dns.ErrAuth
+	case resp.StatusCode == http.StatusNotFound || hasCode(errs, 7003, 81044):
+		apiErr.Kind = dns.ErrNotFound
+	case resp.StatusCode >= 500:
+		apiErr.Kind = dns.ErrUnavailable
+	default:
+		apiErr.Kind = dns.ErrValidation
 	}
 	
-	// SPF record
-	spfRecord := spfTemplate
-	if spfRecord == "" {
-		spfRecord = fmt.Sprintf("v=spf1 mx -all")
-	}
-	if err := p.CreateTXTRecord(zone, "@", spfRecord); err != nil {
-		return fmt.Errorf("failed to create SPF record: %v", err)
+	return apiErr
+}
+
+func hasCode(errs []APIError, codes ...int) bool {
+	for _, e := range errs {
+		for _, code := range codes {
+			if e.Code == code {
+				return true
+			}
+		}
 	}
-	
-	// DMARC record
-	dmarcRecord := dmarcTemplate
-	if dmarcRecord == "" {
-		dmarcRecord = fmt.Sprintf("v=DMARC1; p=none; rua=mailto:dmarc@%s", zone)
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
 	}
-	if err := p.CreateTXTRecord(zone, "_dmarc", dmarcRecord); err != nil {
-		return fmt.Errorf("failed to create DMARC record: %v", err)
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
 	}
-	
-	// DKIM record
-	if dkimPublicKey != "" {
-		dkimRecordName := fmt.Sprintf("%s._domainkey", dkimSelector)
-		if err := p.CreateTXTRecord(zone, dkimRecordName, dkimPublicKey); err != nil {
-			return fmt.Errorf("failed to create DKIM record: %v", err)
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
 		}
 	}
-	
-	return nil
+	return 0
 }
-
-// extractZoneName extracts zone name from full domain name
-func extractZoneName(fullName string) string {
-	parts := strings.Split(fullName, ".")
-	if len(parts) >= 2 {
-		return strings.Join(parts[len(parts)-2:], ".")
-	}
-	return fullName
-}
\ No newline at end of file
@@ -0,0 +1,520 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailops/internal/dns"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubFailure is a response the stub API returns instead of handling the
+// next request
+type stubFailure struct {
+	status     int
+	errors     []APIError
+	retryAfter string
+}
+
+// stubAPI serves the zones and DNS records endpoints of the Cloudflare API
+// for one account, paginating lists like the real API
+type stubAPI struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	zones    []Zone
+	records  map[string][]DNSRecord // By zone ID
+	next     int
+	requests []string // Method and URL of every request
+	failures []stubFailure
+}
+
+func newStubAPI(t *testing.T, zones ...string) *stubAPI {
+	t.Helper()
+	api := &stubAPI{records: map[string][]DNSRecord{}}
+	for i, name := range zones {
+		api.zones = append(api.zones, Zone{ID: fmt.Sprintf("zone-%d", i+1), Name: name, Status: "active"})
+	}
+	api.srv = httptest.NewServer(http.HandlerFunc(api.serve))
+	t.Cleanup(api.srv.Close)
+
+	// Each test starts with an idle, unlimited bucket
+	limiter = &rateLimiter{}
+	return api
+}
+
+// provider returns a provider of the stub account. Tokens are unique per
+// test, so zone IDs cached by other tests do not apply.
+func (api *stubAPI) provider(t *testing.T, zone string) *Provider {
+	t.Helper()
+	p, err := newFromConfig(dns.Config{
+		Token:   "token-" + t.Name(),
+		Zone:    zone,
+		Options: map[string]string{"api_url": api.srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*Provider)
+}
+
+func (api *stubAPI) fail(failures ...stubFailure) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.failures = append(api.failures, failures...)
+}
+
+// count returns the number of requests whose method and URL contain substr
+func (api *stubAPI) count(substr string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	n := 0
+	for _, request := range api.requests {
+		if strings.Contains(request, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func (api *stubAPI) serve(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.requests = append(api.requests, r.Method+" "+r.URL.String())
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer token-") {
+		api.reply(w, http.StatusUnauthorized, nil, nil, APIError{Code: 10000, Message: "Authentication error"})
+		return
+	}
+	if len(api.failures) > 0 {
+		failure := api.failures[0]
+		api.failures = api.failures[1:]
+		if failure.retryAfter != "" {
+			w.Header().Set("Retry-After", failure.retryAfter)
+		}
+		api.reply(w, failure.status, nil, nil, failure.errors...)
+		return
+	}
+
+	query := r.URL.Query()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "zones":
+		var zones []Zone
+		for _, zone := range api.zones {
+			if name := query.Get("name"); name == "" || name == zone.Name {
+				zones = append(zones, zone)
+			}
+		}
+		api.page(w, query, zones)
+
+	case len(parts) >= 3 && parts[0] == "zones" && parts[2] == "dns_records":
+		zoneID := parts[1]
+		switch r.Method {
+		case http.MethodGet:
+			var records []DNSRecord
+			for _, record := range api.records[zoneID] {
+				if record.Type == query.Get("type") && record.Name == query.Get("name") {
+					records = append(records, record)
+				}
+			}
+			api.page(w, query, records)
+		case http.MethodPost, http.MethodPut:
+			var record DNSRecord
+			if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+				api.reply(w, http.StatusBadRequest, nil, nil, APIError{Code: 9207, Message: err.Error()})
+				return
+			}
+			if r.Method == http.MethodPut {
+				record.ID = parts[3]
+				api.remove(zoneID, record.ID)
+			} else {
+				api.next++
+				record.ID = fmt.Sprintf("rec-%d", api.next)
+			}
+			api.records[zoneID] = append(api.records[zoneID], record)
+			api.reply(w, http.StatusOK, record, nil)
+		case http.MethodDelete:
+			if !api.remove(zoneID, parts[3]) {
+				api.reply(w, http.StatusNotFound, nil, nil, APIError{Code: 81044, Message: "Record does not exist."})
+				return
+			}
+			api.reply(w, http.StatusOK, map[string]string{"id": parts[3]}, nil)
+		}
+
+	default:
+		api.reply(w, http.StatusNotFound, nil, nil, APIError{Code: 7003, Message: "Could not route to " + r.URL.Path})
+	}
+}
+
+func (api *stubAPI) remove(zoneID, id string) bool {
+	records := api.records[zoneID]
+	for i, record := range records {
+		if record.ID == id {
+			api.records[zoneID] = append(records[:i], records[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// paginate returns the page of items selected by the page and per_page
+// parameters, and its result_info
+func paginate[T any](items []T, query map[string][]string) ([]T, map[string]int) {
+	get := func(key string, def int) int {
+		if v, ok := query[key]; ok {
+			if n, err := strconv.Atoi(v[0]); err == nil {
+				return n
+			}
+		}
+		return def
+	}
+	number, size := get("page", 1), get("per_page", 20)
+	total := (len(items) + size - 1) / size
+	start, end := (number-1)*size, number*size
+	if start > len(items) {
+		start = len(items)
+	}
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end], map[string]int{"page": number, "total_pages": total}
+}
+
+// page replies with a page of zones or records
+func (api *stubAPI) page(w http.ResponseWriter, query map[string][]string, items any) {
+	switch items := items.(type) {
+	case []Zone:
+		result, info := paginate(items, query)
+		api.reply(w, http.StatusOK, result, info)
+	case []DNSRecord:
+		result, info := paginate(items, query)
+		api.reply(w, http.StatusOK, result, info)
+	}
+}
+
+func (api *stubAPI) reply(w http.ResponseWriter, status int, result any, info map[string]int, errs ...APIError) {
+	if errs == nil {
+		errs = []APIError{}
+	}
+	body := map[string]any{"success": status < 400 && len(errs) == 0, "errors": errs, "messages": []APIError{}, "result": result}
+	if info != nil {
+		body["result_info"] = info
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestListRecordsPages(t *testing.T) {
+	api := newStubAPI(t, "example.com")
+	for i := 0; i < 2*pageSize+30; i++ {
+		api.records["zone-1"] = append(api.records["zone-1"], DNSRecord{ID: fmt.Sprintf("txt-%d", i), Type: "TXT", Name: "example.com", Content: fmt.Sprintf("value %d", i)})
+	}
+	api.records["zone-1"] = append(api.records["zone-1"],
+		DNSRecord{ID: "dkim", Type: "TXT", Name: "s1._domainkey.example.com", Content: `"v=DKIM1; k=rsa; " "p=MIIB"`},
+		DNSRecord{ID: "caa", Type: "CAA", Name: "example.com", Content: `0 issue letsencrypt.org`, Data: json.RawMessage(`{"flags":0,"tag":"issue","value":"letsencrypt.org"}`)},
+	)
+	p := api.provider(t, "example.com")
+
+	records, err := p.ListRecords("TXT", "@")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2*pageSize+30 || records[len(records)-1].Content != fmt.Sprintf("value %d", 2*pageSize+29) {
+		t.Errorf("ListRecords returned %d records, want %d in order", len(records), 2*pageSize+30)
+	}
+	if n := api.count("dns_records"); n != 3 {
+		t.Errorf("%d record list requests, want one per page", n)
+	}
+
+	dkim, err := p.FindRecord("TXT", "s1._domainkey")
+	if err != nil || dkim == nil || dkim.Content != "v=DKIM1; k=rsa; p=MIIB" {
+		t.Errorf("FindRecord of a split TXT = %+v, %v", dkim, err)
+	}
+	caa, err := p.FindRecord("CAA", "example.com")
+	if err != nil || caa == nil || caa.Content != `0 issue "letsencrypt.org"` {
+		t.Errorf("FindRecord of a CAA record = %+v, %v", caa, err)
+	}
+}
+
+func TestFindZone(t *testing.T) {
+	// The account's zones span two pages, the zone of the name is on the second
+	var zones []string
+	for i := 0; i < pageSize+20; i++ {
+		zones = append(zones, fmt.Sprintf("zone%d.test", i))
+	}
+	api := newStubAPI(t, append(zones, "example.com", "mail.example.com.test")...)
+	p := api.provider(t, "")
+
+	zone, err := p.FindZone("mail.example.com")
+	if err != nil || zone != "example.com" {
+		t.Fatalf("FindZone = %q, %v, want example.com", zone, err)
+	}
+	if n := api.count("GET /zones?per_page"); n != 2 {
+		t.Errorf("%d zone list requests, want 2", n)
+	}
+
+	// Listing cached the zone IDs, and the zone is kept for later lookups
+	if _, err := p.ListRecords("MX", "@"); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.count("/zones?name="); n != 0 {
+		t.Errorf("zone looked up by name %d times after listing the zones", n)
+	}
+	if !strings.Contains(api.requests[len(api.requests)-1], "/zones/zone-121/dns_records?name=example.com") {
+		t.Errorf("last request %s, want the records of example.com", api.requests[len(api.requests)-1])
+	}
+}
+
+func TestZoneIDCache(t *testing.T) {
+	api := newStubAPI(t, "example.com")
+
+	for i := 0; i < 3; i++ {
+		if _, err := api.provider(t, "example.com").FindRecord("A", "mail"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := api.count("/zones?name=example.com"); n != 1 {
+		t.Errorf("zone ID requested %d times by providers sharing a token, want 1", n)
+	}
+
+	other, err := newFromConfig(dns.Config{Token: "token-other-" + t.Name(), Zone: "example.com", Options: map[string]string{"api_url": api.srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.FindRecord("A", "mail"); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.count("/zones?name=example.com"); n != 2 {
+		t.Errorf("zone ID requested %d times after a second token, want 2", n)
+	}
+
+	if _, err := api.provider(t, "example.org").FindRecord("A", "mail.example.org"); !errors.Is(err, dns.ErrNotFound) {
+		t.Errorf("record of an unknown zone: %v, want ErrNotFound", err)
+	}
+}
+
+func TestWriteRecords(t *testing.T) {
+	api := newStubAPI(t, "example.com")
+	p := api.provider(t, "example.com")
+	long := strings.Repeat("a", 300)
+
+	for _, record := range []dns.Record{
+		{Type: "A", Name: "mail", Content: "192.0.2.1"},
+		{Type: "A", Name: "mail", Content: "192.0.2.2"}, // Replaces the first
+		{Type: "CAA", Name: "@", Content: `0 issue "letsencrypt.org"`},
+	} {
+		if err := p.UpsertRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.CreateRecord(dns.Record{Type: "TXT", Name: "@", Content: long}); err != nil {
+		t.Fatal(err)
+	}
+
+	records := api.records["zone-1"]
+	if len(records) != 3 {
+		t.Fatalf("zone holds %+v, want 3 records", records)
+	}
+	if records[0].Name != "mail.example.com" || records[0].Content != "192.0.2.2" || records[0].TTL != 3600 {
+		t.Errorf("A record = %+v", records[0])
+	}
+	if string(records[1].Data) != `{"flags":0,"tag":"issue","value":"letsencrypt.org"}` {
+		t.Errorf("CAA data = %s", records[1].Data)
+	}
+	if records[2].Content != dns.FormatTXT(long) {
+		t.Errorf("long TXT content = %q, want split strings", records[2].Content)
+	}
+
+	if err := p.DeleteRecord(dns.Record{ID: records[0].ID, Type: "A", Name: "mail"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteRecord(dns.Record{ID: "missing", Type: "A", Name: "mail"}); !errors.Is(err, dns.ErrNotFound) {
+		t.Errorf("deleting a missing record: %v, want ErrNotFound", err)
+	}
+
+	// Dry-run providers only read
+	dry := api.provider(t, "example.com")
+	dry.dryRun = true
+	before := len(api.requests)
+	dry.UpsertRecord(dns.Record{Type: "A", Name: "mail", Content: "192.0.2.3"})
+	dry.DeleteRecord(dns.Record{ID: records[1].ID, Type: "CAA", Name: "@"})
+	if len(api.requests) != before {
+		t.Errorf("dry-run provider sent %v", api.requests[before:])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		failure    stubFailure
+		kind       error
+		retryAfter time.Duration
+		message    string
+	}{
+		{name: "unauthorized", failure: stubFailure{status: 401}, kind: dns.ErrAuth, message: "Unauthorized"},
+		{name: "forbidden", failure: stubFailure{status: 403, errors: []APIError{{Code: 9109, Message: "Invalid access token"}}}, kind: dns.ErrAuth, message: "Invalid access token (code 9109)"},
+		{name: "auth error code", failure: stubFailure{status: 400, errors: []APIError{{Code: 10000, Message: "Authentication error"}}}, kind: dns.ErrAuth},
+		{name: "throttled", failure: stubFailure{status: 429, retryAfter: "2"}, kind: dns.ErrRateLimited, retryAfter: 2 * time.Second},
+		{name: "throttled without Retry-After", failure: stubFailure{status: 429}, kind: dns.ErrRateLimited},
+		{name: "rate limit code", failure: stubFailure{status: 400, errors: []APIError{{Code: 971, Message: "Please wait and consider throttling your request speed"}}}, kind: dns.ErrRateLimited},
+		{name: "server error", failure: stubFailure{status: 502}, kind: dns.ErrUnavailable, message: "Bad Gateway"},
+		{name: "unavailable", failure: stubFailure{status: 503}, kind: dns.ErrUnavailable},
+		{name: "not found", failure: stubFailure{status: 404}, kind: dns.ErrNotFound},
+		{name: "not found code", failure: stubFailure{status: 400, errors: []APIError{{Code: 81044, Message: "Record does not exist."}}}, kind: dns.ErrNotFound},
+		{
+			name:    "invalid record",
+			failure: stubFailure{status: 400, errors: []APIError{{Code: 9005, Message: "Content for A record is invalid."}, {Code: 1004, Message: "DNS Validation Error"}}},
+			kind:    dns.ErrValidation,
+			message: "Content for A record is invalid. (code 9005); DNS Validation Error (code 1004)",
+		},
+		{name: "unsuccessful 200", failure: stubFailure{status: 200, errors: []APIError{{Code: 1004, Message: "DNS Validation Error"}}}, kind: dns.ErrValidation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newStubAPI(t, "example.com")
+			p := api.provider(t, "example.com")
+			api.fail(tt.failure)
+
+			_, err := p.ListRecords("A", "mail")
+			var apiErr *dns.APIError
+			if !errors.As(err, &apiErr) || !errors.Is(err, tt.kind) {
+				t.Fatalf("error %v, want %v", err, tt.kind)
+			}
+			if apiErr.Status != tt.failure.status || apiErr.RetryAfter != tt.retryAfter {
+				t.Errorf("error status %d, retry after %v, want %d and %v", apiErr.Status, apiErr.RetryAfter, tt.failure.status, tt.retryAfter)
+			}
+			if tt.message != "" && apiErr.Message != tt.message {
+				t.Errorf("error message %q, want %q", apiErr.Message, tt.message)
+			}
+			if dns.IsTemporary(err) != (tt.kind == dns.ErrRateLimited || tt.kind == dns.ErrUnavailable) {
+				t.Errorf("IsTemporary(%v) = %v", err, dns.IsTemporary(err))
+			}
+		})
+	}
+}
+
+func TestRetryAfterPausesRequests(t *testing.T) {
+	api := newStubAPI(t, "example.com")
+	p := api.provider(t, "example.com")
+	if _, err := p.GetZoneID("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	api.fail(stubFailure{status: 429, retryAfter: "1"})
+
+	if _, err := p.ListRecords("A", "mail"); !errors.Is(err, dns.ErrRateLimited) {
+		t.Fatalf("throttled request: %v", err)
+	}
+
+	// Every provider of the process waits out the pause
+	start := time.Now()
+	if _, err := api.provider(t, "example.com").ListRecords("A", "mail"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("request after Retry-After: 1 sent after %v", elapsed)
+	}
+}
+
+func TestRequestCancelled(t *testing.T) {
+	api := newStubAPI(t, "example.com")
+	limiter.pause(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := newFromConfig(dns.Config{
+		Token:   "token-" + t.Name(),
+		Zone:    "example.com",
+		Options: map[string]string{"api_url": api.srv.URL},
+		Context: ctx,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := p.FindRecord("A", "mail"); !errors.Is(err, context.Canceled) {
+		t.Errorf("request of a cancelled task: %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled request returned after %v", elapsed)
+	}
+	if n := api.count(""); n != 0 {
+		t.Errorf("cancelled request reached the API %d times", n)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{}
+	if d := l.reserve(); d != 0 {
+		t.Errorf("unlimited bucket waits %v", d)
+	}
+
+	// The burst is one second of requests
+	l.setRate(5)
+	for i := 0; i < 5; i++ {
+		if d := l.reserve(); d != 0 {
+			t.Fatalf("request %d of the burst waits %v", i+1, d)
+		}
+	}
+	if d := l.reserve(); d < 150*time.Millisecond || d > 200*time.Millisecond {
+		t.Errorf("request after the burst waits %v, want about 200ms", d)
+	}
+
+	slow := &rateLimiter{}
+	slow.setRate(0.5)
+	slow.reserve()
+	if d := slow.reserve(); d < 1900*time.Millisecond || d > 2*time.Second {
+		t.Errorf("second request at 0.5 rps waits %v, want about 2s", d)
+	}
+
+	paused := &rateLimiter{}
+	paused.pause(50 * time.Millisecond)
+	paused.pause(time.Millisecond) // A shorter pause does not shorten it
+	start := time.Now()
+	if err := paused.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Errorf("paused bucket waited %v, want 50ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	paused.pause(time.Minute)
+	if err := paused.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait with a cancelled context = %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", 0, 0},
+		{"30", 30 * time.Second, 30 * time.Second},
+		{" 5 ", 5 * time.Second, 5 * time.Second},
+		{"0", 0, 0},
+		{"-3", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v to %v", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package dns
+
+import (
+	"errors"
+	"time"
+)
+
+// Error classes returned by providers. Provider errors wrap one of these, so
+// callers can tell them apart with errors.Is.
+var (
+	// ErrAuth means the credentials were rejected or lack permission
+	ErrAuth = errors.New("DNS provider authentication failed")
+	// ErrRateLimited means the provider throttled the request
+	ErrRateLimited = errors.New("DNS provider rate limit exceeded")
+	// ErrUnavailable means the provider failed on its side and may recover
+	ErrUnavailable = errors.New("DNS provider unavailable")
+	// ErrNotFound means the zone or record does not exist
+	ErrNotFound = errors.New("DNS zone or record not found")
+	// ErrValidation means the provider rejected the request content
+	ErrValidation = errors.New("DNS request rejected")
+)
+
+// APIError is a classified error returned by a provider API
+type APIError struct {
+	Kind       error         // One of the error classes above
+	Status     int           // HTTP status or protocol response code, if any
+	Message    string        // Message reported by the provider
+	RetryAfter time.Duration // How long the provider asked to wait, if it did
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Kind
+}
+
+// RetryAfter returns the wait requested by the provider for a throttled
+// request, or zero when it did not ask for one
+func RetryAfter(err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.RetryAfter
+	}
+	return 0
+}
+
+// IsTemporary reports whether a request may succeed when retried later
+func IsTemporary(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrUnavailable)
+}
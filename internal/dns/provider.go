@@ -0,0 +1,116 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrMissingConfig is returned by provider factories when a required setting
+// (credentials, zone, server address) is missing
+var ErrMissingConfig = errors.New("missing required DNS provider setting")
+
+// Record represents a DNS record managed by a provider
+type Record struct {
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Content  string `json:"content"`
+	TTL      int    `json:"ttl,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// Provider manages records in a DNS zone
+type Provider interface {
+	// Name returns the registry name of the provider
+	Name() string
+
+	// FindZone returns the zone that contains the given name
+	FindZone(name string) (string, error)
+
+	// FindRecord returns the first record of the given type and name, or nil
+	FindRecord(recordType, name string) (*Record, error)
+
+	// ListRecords returns every record of the given type and name
+	ListRecords(recordType, name string) ([]Record, error)
+
+	// UpsertRecord creates or replaces a record. A record with an ID
+	// replaces that record, otherwise the first record of the same type and
+	// name is replaced, or a new record is created.
+	UpsertRecord(record Record) error
+
+	// CreateRecord adds a record next to the existing records of the same
+	// type and name, for types such as TXT where several values coexist
+	CreateRecord(record Record) error
+
+	// DeleteRecord removes an existing record
+	DeleteRecord(record Record) error
+}
+
+// HandOffProvider is implemented by providers that do not change DNS
+// themselves but collect the records for someone else to publish. Their
+// changes are made even in dry-run mode, and HandOff delivers them.
+type HandOffProvider interface {
+	Provider
+
+	// HandOff delivers the collected records and returns where they went
+	HandOff() (string, error)
+}
+
+// ParseOptions parses provider options in "key=value;key=value" form, as used
+// by the dns_options CSV column
+func ParseOptions(s string) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid DNS option %q, expected key=value", part)
+		}
+		options[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return options, nil
+}
+
+// Qualify expands a zone-relative record name ("@", "mail", "_dmarc") to a
+// fully qualified name without the trailing dot. Names already inside the
+// zone are returned unchanged.
+func Qualify(name, zone string) string {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	zone = strings.TrimSuffix(zone, ".")
+	if zone == "" {
+		return name
+	}
+	if name == "@" || name == "" {
+		return zone
+	}
+	if InZone(name, zone) {
+		return name
+	}
+	return name + "." + zone
+}
+
+// InZone reports whether name is the zone apex or a name below it
+func InZone(name, zone string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// SplitTXT splits TXT content into character-strings of at most 255 bytes,
+// the maximum length of a single string in TXT RDATA
+func SplitTXT(content string) []string {
+	if content == "" {
+		return []string{""}
+	}
+
+	parts := make([]string, 0, len(content)/255+1)
+	for len(content) > 255 {
+		parts = append(parts, content[:255])
+		content = content[255:]
+	}
+	return append(parts, content)
+}
@@ -0,0 +1,113 @@
+// Package psl answers public suffix questions from an embedded copy of the
+// Public Suffix List, so zone discovery never treats a registry suffix such
+// as co.uk as a customer zone. To update it, replace public_suffix_list.dat
+// with https://publicsuffix.org/list/public_suffix_list.dat.
+package psl
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+)
+
+//go:embed public_suffix_list.dat
+var listData string
+
+// ruleSet holds the rules by kind, keyed by domain without "*." or "!"
+type ruleSet struct {
+	normal    map[string]bool
+	wildcard  map[string]bool
+	exception map[string]bool
+}
+
+var rules = parseRules(listData)
+
+func parseRules(data string) ruleSet {
+	set := ruleSet{
+		normal:    make(map[string]bool),
+		wildcard:  make(map[string]bool),
+		exception: make(map[string]bool),
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		// Only the first word of a line is the rule
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ToLower(line)
+
+		kind := set.normal
+		switch {
+		case strings.HasPrefix(line, "!"):
+			kind, line = set.exception, line[1:]
+		case strings.HasPrefix(line, "*."):
+			kind, line = set.wildcard, line[2:]
+		}
+		kind[line] = true
+		// Internationalized rules are listed in Unicode, names usually
+		// arrive in their ASCII form
+		kind[toASCII(line)] = true
+	}
+	return set
+}
+
+// PublicSuffix returns the public suffix of a domain, following the list's
+// algorithm: the longest matching rule wins, exceptions beat wildcards, and
+// an unlisted TLD is a public suffix by itself.
+func PublicSuffix(domain string) string {
+	domain = normalize(domain)
+	labels := strings.Split(domain, ".")
+
+	// Walk from the longest candidate to the TLD, so the first match is the
+	// longest rule
+	for i := 0; i < len(labels); i++ {
+		candidate := strings.Join(labels[i:], ".")
+
+		if rules.exception[candidate] {
+			// The suffix is the exception rule without its leftmost label
+			return strings.Join(labels[i+1:], ".")
+		}
+		if rules.normal[candidate] {
+			return candidate
+		}
+		if i+1 < len(labels) && rules.wildcard[strings.Join(labels[i+1:], ".")] {
+			return candidate
+		}
+	}
+
+	return labels[len(labels)-1]
+}
+
+// IsPublicSuffix reports whether a domain is itself a public suffix
+func IsPublicSuffix(domain string) bool {
+	domain = normalize(domain)
+	return domain != "" && PublicSuffix(domain) == domain
+}
+
+// RegistrableDomain returns the public suffix plus one label, the highest
+// level a customer can own (example.co.uk for mail.example.co.uk)
+func RegistrableDomain(domain string) (string, error) {
+	domain = normalize(domain)
+	if domain == "" {
+		return "", fmt.Errorf("empty domain")
+	}
+
+	suffix := PublicSuffix(domain)
+	if suffix == domain {
+		return "", fmt.Errorf("%s is a public suffix", domain)
+	}
+
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	if i := strings.LastIndex(rest, "."); i >= 0 {
+		rest = rest[i+1:]
+	}
+	return rest + "." + suffix, nil
+}
+
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
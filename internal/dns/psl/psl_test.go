@@ -0,0 +1,114 @@
+package psl
+
+import "testing"
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string // Empty when domain is a public suffix
+	}{
+		{"example.com", "example.com"},
+		{"mail.example.com", "example.com"},
+		{"MAIL.Example.COM.", "example.com"},
+		{"mail.example.co.uk", "example.co.uk"},
+		{"mail.example.com.tr", "example.com.tr"},
+		{"mail.example.com.ar", "example.com.ar"},
+		{"mail.example.co.il", "example.co.il"},
+		{"mail.example.co.th", "example.co.th"},
+		{"mail.example.com.my", "example.com.my"},
+		{"a.b.example.com.au", "example.com.au"},
+		{"mail.example.unlisted", "example.unlisted"},
+		// Wildcard and exception rules: *.ck and !www.ck
+		{"mail.example.foo.ck", "example.foo.ck"},
+		{"www.ck", "www.ck"},
+		{"mail.www.ck", "www.ck"},
+		// Internationalized rules, in Unicode and ASCII form
+		{"mail.example.公司.cn", "example.公司.cn"},
+		{"mail.example.xn--55qx5d.cn", "example.xn--55qx5d.cn"},
+		// Private section
+		{"site.example.github.io", "example.github.io"},
+		{"com", ""},
+		{"co.uk", ""},
+		{"com.tr", ""},
+		{"foo.ck", ""},
+		{"xn--55qx5d.cn", ""},
+		{"unlisted", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := RegistrableDomain(tt.domain)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("RegistrableDomain(%q) = %q, want an error", tt.domain, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("RegistrableDomain(%q) = %q, %v, want %q", tt.domain, got, err, tt.want)
+		}
+	}
+}
+
+func TestPublicSuffix(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com", "com"},
+		{"example.co.uk", "co.uk"},
+		{"example.com.tr", "com.tr"},
+		{"example.foo.ck", "foo.ck"},
+		{"www.ck", "ck"},
+		{"example.kawasaki.jp", "example.kawasaki.jp"},
+		{"city.kawasaki.jp", "kawasaki.jp"},
+		{"example.unlisted", "unlisted"},
+	}
+
+	for _, tt := range tests {
+		if got := PublicSuffix(tt.domain); got != tt.want {
+			t.Errorf("PublicSuffix(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestIsPublicSuffix(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"com", true},
+		{"co.uk", true},
+		{"com.tr", true},
+		{"github.io", true},
+		{"example.com", false},
+		{"example.co.uk", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsPublicSuffix(tt.domain); got != tt.want {
+			t.Errorf("IsPublicSuffix(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com", "example.com"},
+		{"公司.cn", "xn--55qx5d.cn"},
+		{"рф", "xn--p1ai"},
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"ελ", "xn--qxam"},
+		{"香港", "xn--j6w193g"},
+	}
+
+	for _, tt := range tests {
+		if got := toASCII(tt.domain); got != tt.want {
+			t.Errorf("toASCII(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
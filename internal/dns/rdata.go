@@ -0,0 +1,116 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Record content of the structured types is kept in presentation form:
+// CAA as `flags tag "value"` and SRV as "weight port target", with the SRV
+// priority in Record.Priority as for MX. These helpers convert between that
+// form and the fields providers send on the wire.
+
+// ParseCAA splits CAA content such as `0 issue "letsencrypt.org"`
+func ParseCAA(content string) (flags int, tag, value string, err error) {
+	fields := strings.SplitN(strings.TrimSpace(content), " ", 3)
+	if len(fields) != 3 {
+		return 0, "", "", fmt.Errorf("invalid CAA record %q, expected: flags tag \"value\"", content)
+	}
+
+	flags, err = strconv.Atoi(fields[0])
+	if err != nil || flags < 0 || flags > 255 {
+		return 0, "", "", fmt.Errorf("invalid CAA flags in %q", content)
+	}
+
+	tag = strings.ToLower(fields[1])
+	if tag == "" {
+		return 0, "", "", fmt.Errorf("invalid CAA tag in %q", content)
+	}
+
+	value = strings.TrimSpace(fields[2])
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
+	}
+	return flags, tag, value, nil
+}
+
+// FormatCAA returns CAA content in presentation form
+func FormatCAA(flags int, tag, value string) string {
+	return fmt.Sprintf("%d %s \"%s\"", flags, tag, value)
+}
+
+// ParseSRV splits SRV content such as "1 587 mail.example.com"
+func ParseSRV(content string) (weight, port int, target string, err error) {
+	fields := strings.Fields(content)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid SRV record %q, expected: weight port target", content)
+	}
+
+	weight, err = strconv.Atoi(fields[0])
+	if err != nil || weight < 0 || weight > 0xffff {
+		return 0, 0, "", fmt.Errorf("invalid SRV weight in %q", content)
+	}
+	port, err = strconv.Atoi(fields[1])
+	if err != nil || port < 0 || port > 0xffff {
+		return 0, 0, "", fmt.Errorf("invalid SRV port in %q", content)
+	}
+	return weight, port, strings.TrimSuffix(fields[2], "."), nil
+}
+
+// FormatSRV returns SRV content in presentation form
+func FormatSRV(weight, port int, target string) string {
+	return fmt.Sprintf("%d %d %s", weight, port, strings.TrimSuffix(target, "."))
+}
+
+// FormatTXT returns TXT content as quoted character-strings of at most 255
+// bytes, for providers that take long values in presentation form
+func FormatTXT(content string) string {
+	parts := SplitTXT(content)
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(part) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// JoinTXT returns the value of TXT content given as one or more quoted
+// character-strings, such as `"v=DKIM1; k=rsa; " "p=MIIB..."`. Unquoted
+// content is returned unchanged.
+func JoinTXT(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, `"`) {
+		return content
+	}
+
+	var sb strings.Builder
+	quoted := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case !quoted:
+			// Whitespace between strings
+		case c == '\\' && i+3 < len(content) && isDigits(content[i+1:i+4]):
+			n, _ := strconv.Atoi(content[i+1 : i+4])
+			sb.WriteByte(byte(n))
+			i += 3
+		case c == '\\' && i+1 < len(content):
+			i++
+			sb.WriteByte(content[i])
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
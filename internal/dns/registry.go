@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultProvider is used when a row does not name a DNS provider
+const DefaultProvider = "cloudflare"
+
+// Config holds the settings used to construct a provider for one task
+type Config struct {
+	Token   string
+	Zone    string
+	DryRun  bool
+	Options map[string]string
+
+	// RunID and RowID identify the task, for providers that write files
+	RunID string
+	RowID int
+
+	// Context cancels the provider's requests with the task, nil for none
+	Context context.Context
+}
+
+// Option returns a provider option, or def when it is not set
+func (c Config) Option(key, def string) string {
+	if v, ok := c.Options[key]; ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Factory constructs a provider from its configuration
+type Factory func(cfg Config) (Provider, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a provider available under the given name. Providers
+// register themselves from an init function.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	name = strings.ToLower(name)
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("dns: provider %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// New constructs the named provider. An empty name selects DefaultProvider.
+func New(name string, cfg Config) (Provider, error) {
+	if name == "" {
+		name = DefaultProvider
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[strings.ToLower(name)]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown DNS provider: %s", name)
+	}
+	return factory(cfg)
+}
+
+// IsRegistered reports whether a provider name is known. An empty name
+// refers to DefaultProvider.
+func IsRegistered(name string) bool {
+	if name == "" {
+		name = DefaultProvider
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	_, ok := registry[strings.ToLower(name)]
+	return ok
+}
+
+// Registered returns the names of all registered providers
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
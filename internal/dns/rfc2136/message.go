@@ -0,0 +1,394 @@
+package rfc2136
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mailops/internal/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DNS opcodes, classes, types and response codes used by this package
+const (
+	opcodeQuery  = 0
+	opcodeUpdate = 5
+
+	classIN   = 1
+	classNONE = 254
+	classANY  = 255
+
+	typeA     = 1
+	typeCNAME = 5
+	typeSOA   = 6
+	typeMX    = 15
+	typeTXT   = 16
+	typeAAAA  = 28
+	typeSRV   = 33
+	typeTSIG  = 250
+	typeCAA   = 257
+
+	rcodeNoError  = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+	rcodeYXDomain = 6
+	rcodeYXRRSet  = 7
+	rcodeNXRRSet  = 8
+	rcodeNotAuth  = 9
+	rcodeNotZone  = 10
+)
+
+var errTruncated = errors.New("truncated DNS message")
+
+var typeCodes = map[string]uint16{
+	"A":     typeA,
+	"AAAA":  typeAAAA,
+	"CAA":   typeCAA,
+	"CNAME": typeCNAME,
+	"MX":    typeMX,
+	"SOA":   typeSOA,
+	"SRV":   typeSRV,
+	"TXT":   typeTXT,
+}
+
+var rcodeNames = map[int]string{
+	rcodeFormErr:  "FORMERR",
+	rcodeServFail: "SERVFAIL",
+	rcodeNXDomain: "NXDOMAIN",
+	rcodeNotImp:   "NOTIMP",
+	rcodeRefused:  "REFUSED",
+	rcodeYXDomain: "YXDOMAIN",
+	rcodeYXRRSet:  "YXRRSET",
+	rcodeNXRRSet:  "NXRRSET",
+	rcodeNotAuth:  "NOTAUTH",
+	rcodeNotZone:  "NOTZONE",
+}
+
+func rcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+func typeCode(recordType string) (uint16, error) {
+	code, ok := typeCodes[strings.ToUpper(recordType)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported record type: %s", recordType)
+	}
+	return code, nil
+}
+
+// resourceRecord is a decoded or to-be-encoded resource record
+type resourceRecord struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	rdata []byte
+}
+
+// message is a decoded DNS message
+type message struct {
+	id       uint16
+	flags    uint16
+	question []resourceRecord
+	answer   []resourceRecord
+	ns       []resourceRecord
+	extra    []resourceRecord
+
+	raw        []byte
+	tsigOffset int // Offset of the TSIG record in raw, or 0
+}
+
+func (m *message) rcode() int {
+	return int(m.flags & 0x000f)
+}
+
+// builder encodes a DNS message. Names are written uncompressed.
+type builder struct {
+	buf    []byte
+	counts [4]uint16
+}
+
+func newBuilder(id uint16, opcode int, recursionDesired bool) *builder {
+	b := &builder{buf: make([]byte, 12, 512)}
+	binary.BigEndian.PutUint16(b.buf[0:], id)
+	flags := uint16(opcode&0xf) << 11
+	if recursionDesired {
+		flags |= 1 << 8
+	}
+	binary.BigEndian.PutUint16(b.buf[2:], flags)
+	return b
+}
+
+// add appends a record to a section (0 question/zone, 1 answer/prerequisite,
+// 2 authority/update, 3 additional). Questions carry no TTL or RDATA.
+func (b *builder) add(section int, rr resourceRecord) error {
+	var err error
+	b.buf, err = appendName(b.buf, rr.name)
+	if err != nil {
+		return err
+	}
+	b.buf = binary.BigEndian.AppendUint16(b.buf, rr.rtype)
+	b.buf = binary.BigEndian.AppendUint16(b.buf, rr.class)
+	if section > 0 {
+		if len(rr.rdata) > 0xffff {
+			return fmt.Errorf("record data too long for %s", rr.name)
+		}
+		b.buf = binary.BigEndian.AppendUint32(b.buf, rr.ttl)
+		b.buf = binary.BigEndian.AppendUint16(b.buf, uint16(len(rr.rdata)))
+		b.buf = append(b.buf, rr.rdata...)
+	}
+	b.counts[section]++
+	return nil
+}
+
+func (b *builder) bytes() []byte {
+	for i, count := range b.counts {
+		binary.BigEndian.PutUint16(b.buf[4+2*i:], count)
+	}
+	return b.buf
+}
+
+// appendName appends a domain name in uncompressed wire format
+func appendName(buf []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name: %s", name)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0), nil
+}
+
+// encodeRData encodes record content in presentation form into RDATA
+func encodeRData(rtype uint16, content string, priority int) ([]byte, error) {
+	switch rtype {
+	case typeA:
+		ip := net.ParseIP(content).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address: %s", content)
+		}
+		return ip, nil
+	case typeAAAA:
+		ip := net.ParseIP(content)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address: %s", content)
+		}
+		return ip.To16(), nil
+	case typeCNAME:
+		return appendName(nil, content)
+	case typeMX:
+		if priority < 0 || priority > 0xffff {
+			return nil, fmt.Errorf("invalid MX priority: %d", priority)
+		}
+		return appendName(binary.BigEndian.AppendUint16(nil, uint16(priority)), content)
+	case typeTXT:
+		var rdata []byte
+		for _, part := range dns.SplitTXT(content) {
+			rdata = append(rdata, byte(len(part)))
+			rdata = append(rdata, part...)
+		}
+		return rdata, nil
+	case typeSRV:
+		if priority < 0 || priority > 0xffff {
+			return nil, fmt.Errorf("invalid SRV priority: %d", priority)
+		}
+		weight, port, target, err := dns.ParseSRV(content)
+		if err != nil {
+			return nil, err
+		}
+		rdata := binary.BigEndian.AppendUint16(nil, uint16(priority))
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(weight))
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(port))
+		return appendName(rdata, target)
+	case typeCAA:
+		flags, tag, value, err := dns.ParseCAA(content)
+		if err != nil {
+			return nil, err
+		}
+		if len(tag) > 255 {
+			return nil, fmt.Errorf("CAA tag too long: %s", tag)
+		}
+		rdata := []byte{byte(flags), byte(len(tag))}
+		rdata = append(rdata, tag...)
+		return append(rdata, value...), nil
+	default:
+		return nil, fmt.Errorf("unsupported record type %d", rtype)
+	}
+}
+
+// decodeRData decodes RDATA at off in msg into presentation form, returning
+// the content and MX or SRV priority
+func decodeRData(msg []byte, rr resourceRecord, off int) (string, int, error) {
+	switch rr.rtype {
+	case typeA, typeAAAA:
+		return net.IP(rr.rdata).String(), 0, nil
+	case typeCNAME:
+		name, _, err := readName(msg, off)
+		return name, 0, err
+	case typeMX:
+		if len(rr.rdata) < 3 {
+			return "", 0, errTruncated
+		}
+		name, _, err := readName(msg, off+2)
+		return name, int(binary.BigEndian.Uint16(rr.rdata)), err
+	case typeTXT:
+		var sb strings.Builder
+		data := rr.rdata
+		for len(data) > 0 {
+			n := int(data[0])
+			if 1+n > len(data) {
+				return "", 0, errTruncated
+			}
+			sb.Write(data[1 : 1+n])
+			data = data[1+n:]
+		}
+		return sb.String(), 0, nil
+	case typeSRV:
+		if len(rr.rdata) < 7 {
+			return "", 0, errTruncated
+		}
+		target, _, err := readName(msg, off+6)
+		weight := int(binary.BigEndian.Uint16(rr.rdata[2:]))
+		port := int(binary.BigEndian.Uint16(rr.rdata[4:]))
+		return dns.FormatSRV(weight, port, target), int(binary.BigEndian.Uint16(rr.rdata)), err
+	case typeCAA:
+		if len(rr.rdata) < 2 || 2+int(rr.rdata[1]) > len(rr.rdata) {
+			return "", 0, errTruncated
+		}
+		end := 2 + int(rr.rdata[1])
+		return dns.FormatCAA(int(rr.rdata[0]), string(rr.rdata[2:end]), string(rr.rdata[end:])), 0, nil
+	default:
+		return "", 0, fmt.Errorf("unsupported record type %d", rr.rtype)
+	}
+}
+
+// canonicalRData returns the RDATA of a decoded record without name
+// compression, so it can be sent back to the server. Other RDATA is kept as
+// is.
+func canonicalRData(rr resourceRecord, content string, priority int) ([]byte, error) {
+	switch rr.rtype {
+	case typeCNAME, typeMX, typeSRV:
+		return encodeRData(rr.rtype, content, priority)
+	}
+	return append([]byte(nil), rr.rdata...), nil
+}
+
+// parseMessage decodes a DNS message. RDATA offsets are kept so compressed
+// names inside RDATA can be decoded later.
+func parseMessage(raw []byte) (*message, []int, error) {
+	if len(raw) < 12 {
+		return nil, nil, errTruncated
+	}
+
+	m := &message{
+		id:    binary.BigEndian.Uint16(raw[0:]),
+		flags: binary.BigEndian.Uint16(raw[2:]),
+		raw:   raw,
+	}
+
+	var counts [4]int
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(raw[4+2*i:]))
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(raw, off)
+		if err != nil {
+			return nil, nil, err
+		}
+		if next+4 > len(raw) {
+			return nil, nil, errTruncated
+		}
+		m.question = append(m.question, resourceRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(raw[next:]),
+			class: binary.BigEndian.Uint16(raw[next+2:]),
+		})
+		off = next + 4
+	}
+
+	// RDATA offsets of answer records, in order
+	var answerOffsets []int
+	sections := []*[]resourceRecord{&m.answer, &m.ns, &m.extra}
+	for s, section := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			start := off
+			name, next, err := readName(raw, off)
+			if err != nil {
+				return nil, nil, err
+			}
+			if next+10 > len(raw) {
+				return nil, nil, errTruncated
+			}
+			rr := resourceRecord{
+				name:  name,
+				rtype: binary.BigEndian.Uint16(raw[next:]),
+				class: binary.BigEndian.Uint16(raw[next+2:]),
+				ttl:   binary.BigEndian.Uint32(raw[next+4:]),
+			}
+			rdlen := int(binary.BigEndian.Uint16(raw[next+8:]))
+			rdoff := next + 10
+			if rdoff+rdlen > len(raw) {
+				return nil, nil, errTruncated
+			}
+			rr.rdata = raw[rdoff : rdoff+rdlen]
+			off = rdoff + rdlen
+
+			if s == 0 {
+				answerOffsets = append(answerOffsets, rdoff)
+			}
+			if s == 2 && rr.rtype == typeTSIG {
+				m.tsigOffset = start
+			}
+			*section = append(*section, rr)
+		}
+	}
+
+	return m, answerOffsets, nil
+}
+
+// readName reads a possibly compressed domain name at off, returning the
+// name without trailing dot and the offset following it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errTruncated
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errTruncated
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errTruncated
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,502 @@
+// Package rfc2136 implements a DNS provider that applies changes with
+// RFC 2136 dynamic UPDATE messages signed with TSIG, for zones hosted on
+// BIND, Knot or any other authoritative server that accepts updates.
+package rfc2136
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mailops/internal/dns"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTTL     = 3600
+	defaultTimeout = 10 * time.Second
+)
+
+func init() {
+	dns.Register("rfc2136", newFromConfig)
+}
+
+// Provider applies records to a primary server with dynamic updates. All
+// messages go over TCP, as DKIM keys do not fit a plain UDP message.
+type Provider struct {
+	server  string
+	zone    string
+	ttl     int
+	timeout time.Duration
+	key     *tsigKey
+	dryRun  bool
+}
+
+// newFromConfig builds a provider from the row settings. Options:
+//
+//	server          primary server, host or host:port (required)
+//	tsig_key        TSIG key name
+//	tsig_secret     base64 TSIG secret, defaults to the row's API token
+//	tsig_algorithm  hmac-sha256 (default), hmac-sha512, hmac-sha1 or hmac-md5
+//	ttl             TTL of written records in seconds
+//	timeout_ms      network timeout per message
+func newFromConfig(cfg dns.Config) (dns.Provider, error) {
+	server := cfg.Option("server", "")
+	if server == "" {
+		return nil, fmt.Errorf("%w: rfc2136 requires the server option", dns.ErrMissingConfig)
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	p := &Provider{
+		server:  server,
+		zone:    strings.ToLower(strings.TrimSuffix(cfg.Zone, ".")),
+		ttl:     defaultTTL,
+		timeout: defaultTimeout,
+		dryRun:  cfg.DryRun,
+	}
+
+	if v := cfg.Option("ttl", ""); v != "" {
+		ttl, err := strconv.Atoi(v)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid rfc2136 ttl: %s", v)
+		}
+		p.ttl = ttl
+	}
+
+	if v := cfg.Option("timeout_ms", ""); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("invalid rfc2136 timeout_ms: %s", v)
+		}
+		p.timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	if keyName := cfg.Option("tsig_key", ""); keyName != "" {
+		secret := cfg.Option("tsig_secret", cfg.Token)
+		if secret == "" {
+			return nil, fmt.Errorf("%w: TSIG key %s has no secret", dns.ErrMissingConfig, keyName)
+		}
+		key, err := newTSIGKey(keyName, cfg.Option("tsig_algorithm", ""), secret)
+		if err != nil {
+			return nil, err
+		}
+		p.key = key
+	}
+
+	return p, nil
+}
+
+// Name returns the registry name of the provider
+func (p *Provider) Name() string {
+	return "rfc2136"
+}
+
+// FindZone returns the configured zone, or discovers the zone by walking up
+// the labels of name, up to its registrable domain, until the server
+// answers with an SOA record
+func (p *Provider) FindZone(name string) (string, error) {
+	if p.zone != "" {
+		if err := dns.CheckZone(name, p.zone); err != nil {
+			return "", err
+		}
+		return p.zone, nil
+	}
+
+	candidates, err := dns.ZoneCandidates(name)
+	if err != nil {
+		return "", err
+	}
+
+	for _, candidate := range candidates {
+		m, _, err := p.query(candidate, typeSOA)
+		if err != nil {
+			return "", err
+		}
+		for _, rr := range m.answer {
+			if rr.rtype == typeSOA && strings.EqualFold(rr.name, candidate) {
+				return candidate, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no zone on %s contains %s", p.server, name)
+}
+
+// FindRecord returns the first record of the given type and name, or nil
+func (p *Provider) FindRecord(recordType, name string) (*dns.Record, error) {
+	records, err := p.ListRecords(recordType, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return &records[0], nil
+}
+
+// ListRecords queries the server for every record of the given type and name
+func (p *Provider) ListRecords(recordType, name string) ([]dns.Record, error) {
+	rtype, err := typeCode(recordType)
+	if err != nil {
+		return nil, err
+	}
+	name = dns.Qualify(name, p.zone)
+
+	m, offsets, err := p.query(name, rtype)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]dns.Record, 0, len(m.answer))
+	for i, rr := range m.answer {
+		if rr.rtype != rtype || !strings.EqualFold(rr.name, name) {
+			continue
+		}
+		content, priority, err := decodeRData(m.raw, rr, offsets[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s record %s: %w", recordType, name, err)
+		}
+		rdata, err := canonicalRData(rr, content, priority)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s record %s: %w", recordType, name, err)
+		}
+		records = append(records, dns.Record{
+			ID:       recordID(rdata),
+			Type:     strings.ToUpper(recordType),
+			Name:     name,
+			Content:  content,
+			TTL:      int(rr.ttl),
+			Priority: priority,
+		})
+	}
+
+	return records, nil
+}
+
+// UpsertRecord replaces the record identified by its ID, or the first record
+// of the same type and name, or creates the record. Every update carries a
+// prerequisite on the whole RRset it was computed from, so a concurrent
+// change on the server makes the update fail instead of being overwritten.
+func (p *Provider) UpsertRecord(record dns.Record) error {
+	if p.dryRun {
+		return nil
+	}
+
+	rtype, err := typeCode(record.Type)
+	if err != nil {
+		return err
+	}
+	name := dns.Qualify(record.Name, p.zone)
+
+	rdata, err := encodeRData(rtype, record.Content, record.Priority)
+	if err != nil {
+		return err
+	}
+
+	currentID := record.ID
+	if currentID == "" {
+		existing, err := p.FindRecord(record.Type, name)
+		if err != nil {
+			return fmt.Errorf("failed to check existing record: %w", err)
+		}
+		if existing != nil {
+			currentID = existing.ID
+		}
+	}
+
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = p.ttl
+	}
+
+	b, err := p.newUpdate(name)
+	if err != nil {
+		return err
+	}
+
+	if currentID == "" {
+		// RRset does not exist
+		if err := b.add(1, resourceRecord{name: name, rtype: rtype, class: classNONE}); err != nil {
+			return err
+		}
+	} else {
+		current, err := p.requireRRset(b, name, rtype, currentID)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, rdata) {
+			if err := b.add(2, resourceRecord{name: name, rtype: rtype, class: classNONE, rdata: current}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := b.add(2, resourceRecord{name: name, rtype: rtype, class: classIN, ttl: uint32(ttl), rdata: rdata}); err != nil {
+		return err
+	}
+
+	return p.update(b)
+}
+
+// CreateRecord adds a record to its RRset, leaving the other records of the
+// same type and name in place. Adding a record that already exists is a
+// no-op on the server.
+func (p *Provider) CreateRecord(record dns.Record) error {
+	if p.dryRun {
+		return nil
+	}
+
+	rtype, err := typeCode(record.Type)
+	if err != nil {
+		return err
+	}
+	name := dns.Qualify(record.Name, p.zone)
+
+	rdata, err := encodeRData(rtype, record.Content, record.Priority)
+	if err != nil {
+		return err
+	}
+
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = p.ttl
+	}
+
+	b, err := p.newUpdate(name)
+	if err != nil {
+		return err
+	}
+	if err := b.add(2, resourceRecord{name: name, rtype: rtype, class: classIN, ttl: uint32(ttl), rdata: rdata}); err != nil {
+		return err
+	}
+
+	return p.update(b)
+}
+
+// DeleteRecord removes the record identified by its ID
+func (p *Provider) DeleteRecord(record dns.Record) error {
+	if p.dryRun {
+		return nil
+	}
+
+	if record.ID == "" {
+		return fmt.Errorf("record ID is required to delete %s %s", record.Type, record.Name)
+	}
+
+	rtype, err := typeCode(record.Type)
+	if err != nil {
+		return err
+	}
+	name := dns.Qualify(record.Name, p.zone)
+
+	b, err := p.newUpdate(name)
+	if err != nil {
+		return err
+	}
+	current, err := p.requireRRset(b, name, rtype, record.ID)
+	if err != nil {
+		return err
+	}
+	if err := b.add(2, resourceRecord{name: name, rtype: rtype, class: classNONE, rdata: current}); err != nil {
+		return err
+	}
+
+	return p.update(b)
+}
+
+// requireRRset adds the RRset of name and type as it is on the server to
+// the prerequisites of an update, and returns the RDATA of the record with
+// the given ID. RFC 2136 compares a value dependent prerequisite with the
+// whole RRset, so every record of the set is listed, in the wire form the
+// server returned.
+func (p *Provider) requireRRset(b *builder, name string, rtype uint16, id string) ([]byte, error) {
+	current, err := rdataFromID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	m, offsets, err := p.query(name, rtype)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check existing record: %w", err)
+	}
+
+	var rrset [][]byte
+	found := false
+	for i, rr := range m.answer {
+		if rr.rtype != rtype || !strings.EqualFold(rr.name, name) {
+			continue
+		}
+		content, priority, err := decodeRData(m.raw, rr, offsets[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode record %s: %w", name, err)
+		}
+		rdata, err := canonicalRData(rr, content, priority)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode record %s: %w", name, err)
+		}
+		if bytes.Equal(rdata, current) {
+			found = true
+		}
+		rrset = append(rrset, rdata)
+	}
+	if !found {
+		return nil, &dns.APIError{Kind: dns.ErrValidation, Status: rcodeNXRRSet, Message: fmt.Sprintf("record %s changed on the server", name)}
+	}
+
+	for _, rdata := range rrset {
+		if err := b.add(1, resourceRecord{name: name, rtype: rtype, class: classIN, rdata: rdata}); err != nil {
+			return nil, err
+		}
+	}
+	return current, nil
+}
+
+// newUpdate starts an UPDATE message for the zone containing name
+func (p *Provider) newUpdate(name string) (*builder, error) {
+	zone, err := p.FindZone(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBuilder(newID(), opcodeUpdate, false)
+	if err := b.add(0, resourceRecord{name: zone, rtype: typeSOA, class: classIN}); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// update sends an UPDATE message and checks the response code
+func (p *Provider) update(b *builder) error {
+	m, _, err := p.exchange(b.bytes())
+	if err != nil {
+		return err
+	}
+
+	switch rcode := m.rcode(); rcode {
+	case rcodeNoError:
+		return nil
+	case rcodeNXRRSet, rcodeYXRRSet, rcodeNXDomain, rcodeYXDomain:
+		return &dns.APIError{Kind: dns.ErrValidation, Status: rcode, Message: fmt.Sprintf("update prerequisite failed, the record changed on the server (%s)", rcodeName(rcode))}
+	case rcodeNotAuth:
+		return &dns.APIError{Kind: dns.ErrAuth, Status: rcode, Message: "server is not authoritative for the zone or rejected the key (NOTAUTH)"}
+	case rcodeRefused:
+		return &dns.APIError{Kind: dns.ErrAuth, Status: rcode, Message: "server refused the update, check the update policy for the key (REFUSED)"}
+	case rcodeServFail:
+		return &dns.APIError{Kind: dns.ErrUnavailable, Status: rcode, Message: "update failed: SERVFAIL"}
+	default:
+		return &dns.APIError{Kind: dns.ErrValidation, Status: rcode, Message: fmt.Sprintf("update failed: %s", rcodeName(rcode))}
+	}
+}
+
+// query sends a standard query. A missing name is not an error.
+func (p *Provider) query(name string, rtype uint16) (*message, []int, error) {
+	b := newBuilder(newID(), opcodeQuery, false)
+	if err := b.add(0, resourceRecord{name: name, rtype: rtype, class: classIN}); err != nil {
+		return nil, nil, err
+	}
+
+	m, offsets, err := p.exchange(b.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch rcode := m.rcode(); rcode {
+	case rcodeNoError, rcodeNXDomain:
+	case rcodeRefused, rcodeNotAuth:
+		return nil, nil, &dns.APIError{Kind: dns.ErrAuth, Status: rcode, Message: fmt.Sprintf("query for %s failed: %s", name, rcodeName(rcode))}
+	case rcodeServFail:
+		return nil, nil, &dns.APIError{Kind: dns.ErrUnavailable, Status: rcode, Message: fmt.Sprintf("query for %s failed: %s", name, rcodeName(rcode))}
+	default:
+		return nil, nil, fmt.Errorf("query for %s failed: %s", name, rcodeName(rcode))
+	}
+	return m, offsets, nil
+}
+
+// exchange signs a message, sends it over TCP and verifies the response
+func (p *Provider) exchange(msg []byte) (*message, []int, error) {
+	var requestMAC []byte
+	if p.key != nil {
+		var err error
+		msg, requestMAC, err = p.key.sign(msg, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to sign message: %w", err)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", p.server, p.timeout)
+	if err != nil {
+		return nil, nil, &dns.APIError{Kind: dns.ErrUnavailable, Message: fmt.Sprintf("failed to connect to %s: %v", p.server, err)}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.timeout))
+
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, len(msg)+2), uint16(len(msg)))
+	if _, err := conn.Write(append(frame, msg...)); err != nil {
+		return nil, nil, &dns.APIError{Kind: dns.ErrUnavailable, Message: fmt.Sprintf("failed to send to %s: %v", p.server, err)}
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, nil, &dns.APIError{Kind: dns.ErrUnavailable, Message: fmt.Sprintf("failed to read from %s: %v", p.server, err)}
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		return nil, nil, &dns.APIError{Kind: dns.ErrUnavailable, Message: fmt.Sprintf("failed to read from %s: %v", p.server, err)}
+	}
+
+	m, offsets, err := parseMessage(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid response from %s: %w", p.server, err)
+	}
+	if m.id != binary.BigEndian.Uint16(msg) {
+		return nil, nil, fmt.Errorf("response ID mismatch from %s", p.server)
+	}
+
+	if p.key != nil {
+		if m.tsigOffset == 0 && m.rcode() != rcodeNoError {
+			// Servers answer unsigned when they cannot verify the request
+			return m, offsets, nil
+		}
+		if err := p.key.verify(m, requestMAC); err != nil {
+			return nil, nil, &dns.APIError{Kind: dns.ErrAuth, Message: err.Error()}
+		}
+	}
+
+	return m, offsets, nil
+}
+
+// recordIDPrefix marks record IDs holding the RDATA of the record
+const recordIDPrefix = "rdata:"
+
+// recordID identifies a record by its RDATA, as RFC 2136 has no record IDs.
+// The RDATA is kept as the server returned it, as TXT strings split at other
+// boundaries than ours are another value to the server.
+func recordID(rdata []byte) string {
+	return recordIDPrefix + base64.RawURLEncoding.EncodeToString(rdata)
+}
+
+// rdataFromID returns the RDATA a record ID was built from
+func rdataFromID(id string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(id, recordIDPrefix)
+	if !ok {
+		return nil, fmt.Errorf("invalid record ID: %s", id)
+	}
+	rdata, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid record ID: %s", id)
+	}
+	return rdata, nil
+}
+
+func newID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
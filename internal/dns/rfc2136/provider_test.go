@@ -0,0 +1,538 @@
+package rfc2136
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mailops/internal/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testZone    = "example.com"
+	testKeyName = "mailops-key"
+)
+
+var testSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+// stubRR is a record held by the stub server, with its RDATA in wire form
+type stubRR struct {
+	ttl   uint32
+	rdata []byte
+}
+
+// stubServer is an authoritative server for testZone answering queries and
+// dynamic updates over TCP, checking prerequisites as RFC 2136 §3.2 does
+type stubServer struct {
+	t    *testing.T
+	addr string
+	key  *tsigKey // Nil to accept unsigned messages
+
+	mu      sync.Mutex
+	records map[string][]stubRR // By lower-case "name/type"
+	updates int                 // Updates applied
+}
+
+func newStubServer(t *testing.T, key *tsigKey) *stubServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &stubServer{t: t, addr: l.Addr().String(), key: key, records: map[string][]stubRR{}}
+	s.set(testZone, typeSOA, []byte{0})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func rrKey(name string, rtype uint16) string {
+	return fmt.Sprintf("%s/%d", strings.ToLower(strings.TrimSuffix(name, ".")), rtype)
+}
+
+// set replaces an RRset on the server
+func (s *stubServer) set(name string, rtype uint16, rdatas ...[]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rrs []stubRR
+	for _, rdata := range rdatas {
+		rrs = append(rrs, stubRR{ttl: 300, rdata: rdata})
+	}
+	s.records[rrKey(name, rtype)] = rrs
+}
+
+// get returns the RDATA of an RRset on the server
+func (s *stubServer) get(name string, rtype uint16) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rdatas [][]byte
+	for _, rr := range s.records[rrKey(name, rtype)] {
+		rdatas = append(rdatas, rr.rdata)
+	}
+	return rdatas
+}
+
+func (s *stubServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		return
+	}
+
+	response := s.handle(raw)
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(response)))
+	conn.Write(append(frame, response...))
+}
+
+// handle answers a message, signing the response when the request was
+// signed with the server's key
+func (s *stubServer) handle(raw []byte) []byte {
+	m, _, err := parseMessage(raw)
+	if err != nil {
+		s.t.Errorf("stub server: invalid request: %v", err)
+		return reply(raw, rcodeFormErr, nil)
+	}
+
+	var requestMAC []byte
+	if s.key != nil {
+		if err := s.key.verify(m, nil); err != nil {
+			return reply(raw, rcodeNotAuth, nil)
+		}
+		requestMAC = requestTSIGMAC(m)
+	}
+
+	var rcode int
+	var answer []resourceRecord
+	switch opcode := int(m.flags>>11) & 0xf; opcode {
+	case opcodeQuery:
+		rcode, answer = s.query(m)
+	case opcodeUpdate:
+		rcode = s.update(m)
+	default:
+		rcode = rcodeNotImp
+	}
+
+	response := reply(raw, rcode, answer)
+	if s.key != nil {
+		response, _, err = s.key.sign(response, requestMAC)
+		if err != nil {
+			s.t.Errorf("stub server: failed to sign: %v", err)
+		}
+	}
+	return response
+}
+
+func (s *stubServer) query(m *message) (int, []resourceRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := m.question[0]
+	var answer []resourceRecord
+	for _, rr := range s.records[rrKey(q.name, q.rtype)] {
+		answer = append(answer, resourceRecord{name: q.name, rtype: q.rtype, class: classIN, ttl: rr.ttl, rdata: rr.rdata})
+	}
+	return rcodeNoError, answer
+}
+
+// update checks the prerequisites of an update and applies it
+func (s *stubServer) update(m *message) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(m.question) != 1 || !strings.EqualFold(m.question[0].name, testZone) {
+		return rcodeNotAuth
+	}
+
+	// Value dependent prerequisites are compared per RRset
+	required := map[string][][]byte{}
+	for _, rr := range m.answer {
+		key := rrKey(rr.name, rr.rtype)
+		switch rr.class {
+		case classANY:
+			if len(s.records[key]) == 0 {
+				return rcodeNXRRSet
+			}
+		case classNONE:
+			if len(s.records[key]) > 0 {
+				return rcodeYXRRSet
+			}
+		case classIN:
+			required[key] = append(required[key], rr.rdata)
+		default:
+			return rcodeFormErr
+		}
+	}
+	for key, rdatas := range required {
+		if !sameRRset(s.records[key], rdatas) {
+			return rcodeNXRRSet
+		}
+	}
+
+	for _, rr := range m.ns {
+		key := rrKey(rr.name, rr.rtype)
+		rrs := s.records[key]
+		switch rr.class {
+		case classIN:
+			if !containsRData(rrs, rr.rdata) {
+				rrs = append(rrs, stubRR{ttl: rr.ttl, rdata: append([]byte(nil), rr.rdata...)})
+			}
+		case classANY:
+			rrs = nil
+		case classNONE:
+			var kept []stubRR
+			for _, existing := range rrs {
+				if !bytes.Equal(existing.rdata, rr.rdata) {
+					kept = append(kept, existing)
+				}
+			}
+			rrs = kept
+		}
+		s.records[key] = rrs
+	}
+	s.updates++
+	return rcodeNoError
+}
+
+func containsRData(rrs []stubRR, rdata []byte) bool {
+	for _, rr := range rrs {
+		if bytes.Equal(rr.rdata, rdata) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameRRset(rrs []stubRR, rdatas [][]byte) bool {
+	if len(rrs) != len(rdatas) {
+		return false
+	}
+	for _, rdata := range rdatas {
+		if !containsRData(rrs, rdata) {
+			return false
+		}
+	}
+	return true
+}
+
+// reply builds a response echoing the question of a request
+func reply(request []byte, rcode int, answer []resourceRecord) []byte {
+	m, _, _ := parseMessage(request)
+	b := newBuilder(m.id, int(m.flags>>11)&0xf, false)
+	for _, q := range m.question {
+		b.add(0, q)
+	}
+	for _, rr := range answer {
+		b.add(1, rr)
+	}
+	msg := b.bytes()
+	flags := binary.BigEndian.Uint16(msg[2:])
+	binary.BigEndian.PutUint16(msg[2:], flags|1<<15|uint16(rcode))
+	return msg
+}
+
+// requestTSIGMAC returns the MAC of the TSIG record of a request
+func requestTSIGMAC(m *message) []byte {
+	tsig := m.extra[len(m.extra)-1]
+	_, off, _ := readName(tsig.rdata, 0)
+	size := int(binary.BigEndian.Uint16(tsig.rdata[off+8:]))
+	return tsig.rdata[off+10 : off+10+size]
+}
+
+func newTestProvider(t *testing.T, server *stubServer, options map[string]string) *Provider {
+	t.Helper()
+	opts := map[string]string{"server": server.addr, "timeout_ms": "2000"}
+	for k, v := range options {
+		opts[k] = v
+	}
+	p, err := newFromConfig(dns.Config{Options: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*Provider)
+}
+
+func txtRData(t *testing.T, parts ...string) []byte {
+	t.Helper()
+	var rdata []byte
+	for _, part := range parts {
+		rdata = append(rdata, byte(len(part)))
+		rdata = append(rdata, part...)
+	}
+	return rdata
+}
+
+func TestFindZone(t *testing.T) {
+	server := newStubServer(t, nil)
+	p := newTestProvider(t, server, nil)
+
+	zone, err := p.FindZone("mail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone != testZone {
+		t.Errorf("FindZone = %q, want %q", zone, testZone)
+	}
+}
+
+func TestListRecords(t *testing.T) {
+	server := newStubServer(t, nil)
+	server.set("example.com", typeTXT, txtRData(t, "v=spf1 -all"), txtRData(t, "google-site-verification=abc"))
+	mx, _ := encodeRData(typeMX, "mail.example.com", 10)
+	server.set("example.com", typeMX, mx)
+	p := newTestProvider(t, server, nil)
+
+	records, err := p.ListRecords("TXT", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Content != "v=spf1 -all" || records[1].Content != "google-site-verification=abc" {
+		t.Errorf("ListRecords(TXT) = %+v", records)
+	}
+
+	record, err := p.FindRecord("MX", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.Content != "mail.example.com" || record.Priority != 10 {
+		t.Errorf("FindRecord(MX) = %+v", record)
+	}
+
+	record, err = p.FindRecord("A", "missing.example.com")
+	if err != nil || record != nil {
+		t.Errorf("FindRecord(missing) = %+v, %v", record, err)
+	}
+}
+
+func TestUpsertRecord(t *testing.T) {
+	long := strings.Repeat("a", 300)
+
+	tests := []struct {
+		name     string
+		existing [][]byte // TXT RRset at the apex before the update
+		record   dns.Record
+		byID     bool // Replace the record listed with the existing content
+		want     [][]byte
+	}{
+		{
+			name:   "create",
+			record: dns.Record{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"},
+			want:   [][]byte{txtRData(t, "v=spf1 mx -all")},
+		},
+		{
+			name:     "replace first record",
+			existing: [][]byte{txtRData(t, "v=spf1 -all")},
+			record:   dns.Record{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"},
+			want:     [][]byte{txtRData(t, "v=spf1 mx -all")},
+		},
+		{
+			name:     "replace one record of an RRset",
+			existing: [][]byte{txtRData(t, "v=spf1 -all"), txtRData(t, "google-site-verification=abc")},
+			record:   dns.Record{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"},
+			byID:     true,
+			want:     [][]byte{txtRData(t, "google-site-verification=abc"), txtRData(t, "v=spf1 mx -all")},
+		},
+		{
+			name:     "replace TXT stored with other string boundaries",
+			existing: [][]byte{txtRData(t, long[:100], long[100:])},
+			record:   dns.Record{Type: "TXT", Name: "example.com", Content: "short"},
+			byID:     true,
+			want:     [][]byte{txtRData(t, "short")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newStubServer(t, nil)
+			if tt.existing != nil {
+				server.set("example.com", typeTXT, tt.existing...)
+			}
+			p := newTestProvider(t, server, nil)
+
+			record := tt.record
+			if tt.byID {
+				records, err := p.ListRecords("TXT", "example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				record.ID = records[0].ID
+			}
+			if err := p.UpsertRecord(record); err != nil {
+				t.Fatal(err)
+			}
+
+			got := server.get("example.com", typeTXT)
+			if len(got) != len(tt.want) {
+				t.Fatalf("RRset = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], tt.want[i]) {
+					t.Errorf("RRset = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpsertRecordPrerequisiteFails(t *testing.T) {
+	server := newStubServer(t, nil)
+	server.set("example.com", typeTXT, txtRData(t, "v=spf1 -all"), txtRData(t, "other"))
+	p := newTestProvider(t, server, nil)
+
+	records, err := p.ListRecords("TXT", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changed on the server after it was listed
+	server.set("example.com", typeTXT, txtRData(t, "v=spf1 a -all"), txtRData(t, "other"))
+	err = p.UpsertRecord(dns.Record{ID: records[0].ID, Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"})
+	if !errors.Is(err, dns.ErrValidation) {
+		t.Fatalf("UpsertRecord = %v, want %v", err, dns.ErrValidation)
+	}
+
+	// Created on the server after it was found missing
+	server.set("mail.example.com", typeA, []byte{192, 0, 2, 1})
+	b, err := p.newUpdate("mail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.add(1, resourceRecord{name: "mail.example.com", rtype: typeA, class: classNONE})
+	b.add(2, resourceRecord{name: "mail.example.com", rtype: typeA, class: classIN, ttl: 300, rdata: []byte{192, 0, 2, 2}})
+	if err := p.update(b); !errors.Is(err, dns.ErrValidation) {
+		t.Fatalf("update = %v, want %v", err, dns.ErrValidation)
+	}
+	if server.updates != 0 {
+		t.Errorf("server applied %d updates, want 0", server.updates)
+	}
+}
+
+func TestCreateAndDeleteRecord(t *testing.T) {
+	server := newStubServer(t, nil)
+	server.set("example.com", typeTXT, txtRData(t, "v=spf1 -all"))
+	p := newTestProvider(t, server, nil)
+
+	if err := p.CreateRecord(dns.Record{Type: "TXT", Name: "example.com", Content: "verification"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.get("example.com", typeTXT); len(got) != 2 {
+		t.Fatalf("RRset after create = %q", got)
+	}
+
+	records, err := p.ListRecords("TXT", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteRecord(records[0]); err != nil {
+		t.Fatal(err)
+	}
+	got := server.get("example.com", typeTXT)
+	if len(got) != 1 || !bytes.Equal(got[0], txtRData(t, "verification")) {
+		t.Errorf("RRset after delete = %q", got)
+	}
+
+	if err := p.DeleteRecord(records[0]); !errors.Is(err, dns.ErrValidation) {
+		t.Errorf("DeleteRecord of a deleted record = %v, want %v", err, dns.ErrValidation)
+	}
+}
+
+func TestTSIG(t *testing.T) {
+	key, err := newTSIGKey(testKeyName, "hmac-sha256", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newStubServer(t, key)
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		wantErr error
+	}{
+		{"signed", map[string]string{"tsig_key": testKeyName, "tsig_secret": testSecret}, nil},
+		{"sha512 key", map[string]string{"tsig_key": testKeyName, "tsig_secret": testSecret, "tsig_algorithm": "hmac-sha512"}, dns.ErrAuth},
+		{"wrong secret", map[string]string{"tsig_key": testKeyName, "tsig_secret": base64.StdEncoding.EncodeToString([]byte("wrong"))}, dns.ErrAuth},
+		{"unsigned", nil, dns.ErrAuth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, server, tt.options)
+			err := p.CreateRecord(dns.Record{Type: "A", Name: "mail.example.com", Content: "192.0.2.1"})
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("CreateRecord = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateRecord = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTSIGResponseVerification(t *testing.T) {
+	key, err := newTSIGKey(testKeyName, "", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := newBuilder(1, opcodeQuery, false).bytes()
+	_, requestMAC, err := key.sign(request, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _, err := key.sign(reply(request, rcodeNoError, nil), requestMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, _, err := parseMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.verify(m, requestMAC); err != nil {
+		t.Errorf("verify = %v", err)
+	}
+	if err := key.verify(m, []byte("another request")); err == nil {
+		t.Error("verify accepted a response to another request")
+	}
+
+	tampered := append([]byte(nil), response...)
+	tampered[3] ^= 0x01
+	m, _, _ = parseMessage(tampered)
+	if err := key.verify(m, requestMAC); err == nil {
+		t.Error("verify accepted a tampered response")
+	}
+}
+
+func TestRecordID(t *testing.T) {
+	want := txtRData(t, "a", "b")
+	rdata, err := rdataFromID(recordID(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rdata, want) {
+		t.Errorf("rdataFromID = %x, want %x", rdata, want)
+	}
+
+	for _, id := range []string{"v=spf1 -all", "10 mail.example.com", recordIDPrefix + "not base64!", ""} {
+		if _, err := rdataFromID(id); err == nil {
+			t.Errorf("rdataFromID accepted %q", id)
+		}
+	}
+}
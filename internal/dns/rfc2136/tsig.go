@@ -0,0 +1,226 @@
+package rfc2136
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// tsigFudge is the permitted clock skew in seconds (RFC 8945 recommends 300)
+const tsigFudge = 300
+
+// TSIG error codes carried in the TSIG record
+const (
+	tsigBadSig  = 16
+	tsigBadKey  = 17
+	tsigBadTime = 18
+)
+
+var tsigAlgorithms = map[string]struct {
+	name string
+	hash func() hash.Hash
+}{
+	"hmac-md5":    {"hmac-md5.sig-alg.reg.int", md5.New},
+	"hmac-sha1":   {"hmac-sha1", sha1.New},
+	"hmac-sha256": {"hmac-sha256", sha256.New},
+	"hmac-sha512": {"hmac-sha512", sha512.New},
+}
+
+// tsigKey signs and verifies messages with a shared secret (RFC 8945)
+type tsigKey struct {
+	name      string
+	algorithm string // Algorithm domain name
+	hash      func() hash.Hash
+	secret    []byte
+	now       func() time.Time
+}
+
+// newTSIGKey creates a key from its name, algorithm and base64 secret
+func newTSIGKey(name, algorithm, secret string) (*tsigKey, error) {
+	algorithm = strings.ToLower(strings.TrimSuffix(algorithm, "."))
+	if algorithm == "" {
+		algorithm = "hmac-sha256"
+	}
+	if algorithm == "hmac-md5.sig-alg.reg.int" {
+		algorithm = "hmac-md5"
+	}
+
+	alg, ok := tsigAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm: %s", algorithm)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret, expected base64: %w", err)
+	}
+
+	return &tsigKey{
+		name:      strings.ToLower(strings.TrimSuffix(name, ".")),
+		algorithm: alg.name,
+		hash:      alg.hash,
+		secret:    decoded,
+		now:       time.Now,
+	}, nil
+}
+
+// sign appends a TSIG record to an encoded message and returns the signed
+// message and its MAC, which is needed to verify the response. A response
+// is signed with the MAC of its request.
+func (k *tsigKey) sign(msg, requestMAC []byte) ([]byte, []byte, error) {
+	timeSigned := uint64(k.now().Unix())
+
+	mac, err := k.mac(requestMAC, msg, timeSigned, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rdata, err := appendName(nil, k.algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	rdata = appendUint48(rdata, timeSigned)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, msg[0:2]...) // Original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	signed := append([]byte(nil), msg...)
+	signed, err = appendName(signed, k.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed = binary.BigEndian.AppendUint16(signed, typeTSIG)
+	signed = binary.BigEndian.AppendUint16(signed, classANY)
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+
+	arcount := binary.BigEndian.Uint16(signed[10:])
+	binary.BigEndian.PutUint16(signed[10:], arcount+1)
+
+	return signed, mac, nil
+}
+
+// verify checks the TSIG record of a response to a request signed with
+// requestMAC
+func (k *tsigKey) verify(m *message, requestMAC []byte) error {
+	if m.tsigOffset == 0 {
+		return fmt.Errorf("response is not signed")
+	}
+
+	tsig := m.extra[len(m.extra)-1]
+	if tsig.rtype != typeTSIG {
+		return fmt.Errorf("TSIG record is not the last additional record")
+	}
+	if !strings.EqualFold(tsig.name, k.name) {
+		return fmt.Errorf("response signed with unexpected key %s", tsig.name)
+	}
+
+	algorithm, off, err := readName(tsig.rdata, 0)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(algorithm, k.algorithm) {
+		return fmt.Errorf("response signed with unexpected algorithm %s", algorithm)
+	}
+	if off+10 > len(tsig.rdata) {
+		return errTruncated
+	}
+
+	timeSigned := readUint48(tsig.rdata[off:])
+	fudge := binary.BigEndian.Uint16(tsig.rdata[off+6:])
+	macSize := int(binary.BigEndian.Uint16(tsig.rdata[off+8:]))
+	off += 10
+	if off+macSize+6 > len(tsig.rdata) {
+		return errTruncated
+	}
+	mac := tsig.rdata[off : off+macSize]
+	off += macSize
+	originalID := tsig.rdata[off : off+2]
+	tsigError := binary.BigEndian.Uint16(tsig.rdata[off+2:])
+
+	switch tsigError {
+	case 0:
+	case tsigBadSig:
+		return fmt.Errorf("server rejected TSIG signature (BADSIG)")
+	case tsigBadKey:
+		return fmt.Errorf("server does not know TSIG key %s (BADKEY)", k.name)
+	case tsigBadTime:
+		return fmt.Errorf("TSIG time check failed, check the clock (BADTIME)")
+	default:
+		return fmt.Errorf("TSIG error %d", tsigError)
+	}
+
+	// The MAC covers the message as it was before the TSIG record was added
+	unsigned := append([]byte(nil), m.raw[:m.tsigOffset]...)
+	copy(unsigned[0:2], originalID)
+	arcount := binary.BigEndian.Uint16(unsigned[10:])
+	binary.BigEndian.PutUint16(unsigned[10:], arcount-1)
+
+	expected, err := k.mac(requestMAC, unsigned, timeSigned, fudge)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, expected) {
+		return fmt.Errorf("response TSIG signature does not verify")
+	}
+
+	now := uint64(k.now().Unix())
+	if now+uint64(fudge) < timeSigned || timeSigned+uint64(fudge) < now {
+		return fmt.Errorf("response TSIG time is outside the allowed skew")
+	}
+
+	return nil
+}
+
+// mac computes the TSIG MAC over an optional request MAC, the message and
+// the TSIG variables
+func (k *tsigKey) mac(requestMAC, msg []byte, timeSigned uint64, fudge uint16) ([]byte, error) {
+	if fudge == 0 {
+		fudge = tsigFudge
+	}
+
+	h := hmac.New(k.hash, k.secret)
+	if requestMAC != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		h.Write(requestMAC)
+	}
+	h.Write(msg)
+
+	vars, err := appendName(nil, k.name)
+	if err != nil {
+		return nil, err
+	}
+	vars = binary.BigEndian.AppendUint16(vars, classANY)
+	vars = binary.BigEndian.AppendUint32(vars, 0)
+	vars, err = appendName(vars, k.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	vars = appendUint48(vars, timeSigned)
+	vars = binary.BigEndian.AppendUint16(vars, fudge)
+	vars = binary.BigEndian.AppendUint16(vars, 0) // Error
+	vars = binary.BigEndian.AppendUint16(vars, 0) // Other len
+	h.Write(vars)
+
+	return h.Sum(nil), nil
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func readUint48(b []byte) uint64 {
+	return uint64(b[0])<<40 | uint64(b[1])<<32 | uint64(b[2])<<24 | uint64(b[3])<<16 | uint64(b[4])<<8 | uint64(b[5])
+}
@@ -0,0 +1,288 @@
+// Package verify checks that published DNS records are visible on the zone's
+// authoritative nameservers, and optionally on public resolvers.
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout      = 2 * time.Minute
+	defaultInterval     = 5 * time.Second
+	defaultQueryTimeout = 5 * time.Second
+)
+
+// Options configure a Verifier. Nameservers replace the zone's NS lookup,
+// which is how a local stub server is used in tests.
+type Options struct {
+	Nameservers  []string      // host:port of authoritative servers, discovered from NS records when empty
+	Resolvers    []string      // host:port of additional resolvers that must also see the records
+	Timeout      time.Duration // Deadline for all records to match
+	Interval     time.Duration // Wait between polls
+	QueryTimeout time.Duration // Timeout per query
+}
+
+// Expectation is a record that should be visible
+type Expectation struct {
+	Type     string
+	Name     string
+	Content  string
+	Priority int
+}
+
+// ServerResult is what one server answered for a record on the last poll
+type ServerResult struct {
+	Server   string   `json:"server"`
+	Matched  bool     `json:"matched"`
+	Observed []string `json:"observed,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Result is the verification outcome of one record
+type Result struct {
+	Type     string         `json:"type"`
+	Name     string         `json:"name"`
+	Expected string         `json:"expected"`
+	Verified bool           `json:"verified"`
+	Attempts int            `json:"attempts"`
+	Servers  []ServerResult `json:"servers"`
+}
+
+// Verifier polls nameservers until expected records are visible
+type Verifier struct {
+	opts Options
+}
+
+// New creates a verifier, filling in default timings
+func New(opts Options) *Verifier {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.QueryTimeout <= 0 {
+		opts.QueryTimeout = defaultQueryTimeout
+	}
+	return &Verifier{opts: opts}
+}
+
+// Nameservers returns the servers records are checked against: the
+// authoritative servers of zone, followed by the configured resolvers
+func (v *Verifier) Nameservers(ctx context.Context, zone string) ([]string, error) {
+	servers := append([]string(nil), v.opts.Nameservers...)
+
+	if len(servers) == 0 {
+		nsRecords, err := net.DefaultResolver.LookupNS(ctx, strings.TrimSuffix(zone, ".")+".")
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up nameservers of %s: %w", zone, err)
+		}
+		for _, ns := range nsRecords {
+			addr, err := lookupAddress(ctx, ns.Host)
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers, net.JoinHostPort(addr, "53"))
+		}
+		sort.Strings(servers)
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no nameservers found for %s", zone)
+	}
+
+	return append(servers, v.opts.Resolvers...), nil
+}
+
+// Verify polls every server until all records match or the deadline
+// passes, and returns the outcome of the last poll for each record
+func (v *Verifier) Verify(ctx context.Context, zone string, records []Expectation) ([]Result, error) {
+	servers, err := v.Nameservers(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.opts.Timeout)
+	defer cancel()
+
+	results := make([]Result, len(records))
+	for i, record := range records {
+		results[i] = Result{
+			Type:     strings.ToUpper(record.Type),
+			Name:     record.Name,
+			Expected: expected(record),
+		}
+	}
+
+	for {
+		pending := 0
+		for i, record := range records {
+			if results[i].Verified {
+				continue
+			}
+			results[i].Attempts++
+			results[i].Servers = v.check(ctx, servers, record)
+			results[i].Verified = true
+			for _, server := range results[i].Servers {
+				if !server.Matched {
+					results[i].Verified = false
+				}
+			}
+			if !results[i].Verified {
+				pending++
+			}
+		}
+
+		if pending == 0 {
+			return results, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return results, nil
+		case <-time.After(v.opts.Interval):
+		}
+	}
+}
+
+// check queries every server for one record
+func (v *Verifier) check(ctx context.Context, servers []string, record Expectation) []ServerResult {
+	results := make([]ServerResult, 0, len(servers))
+	for _, server := range servers {
+		result := ServerResult{Server: server}
+
+		qctx, cancel := context.WithTimeout(ctx, v.opts.QueryTimeout)
+		observed, err := query(qctx, resolverFor(server), record)
+		cancel()
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Observed = observed
+		for _, value := range observed {
+			if value == expected(record) {
+				result.Matched = true
+			}
+		}
+
+		results = append(results, result)
+	}
+	return results
+}
+
+// query looks up a record and returns the values in comparable form
+func query(ctx context.Context, r *net.Resolver, record Expectation) ([]string, error) {
+	name := strings.TrimSuffix(record.Name, ".") + "."
+
+	var values []string
+	var err error
+
+	switch strings.ToUpper(record.Type) {
+	case "A", "AAAA":
+		network := "ip4"
+		if strings.EqualFold(record.Type, "AAAA") {
+			network = "ip6"
+		}
+		var ips []net.IP
+		ips, err = r.LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			values = append(values, ip.String())
+		}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = r.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			values = append(values, fmt.Sprintf("%d %s", mx.Pref, normalizeName(mx.Host)))
+		}
+	case "TXT":
+		values, err = r.LookupTXT(ctx, name)
+	case "CNAME":
+		var cname string
+		cname, err = r.LookupCNAME(ctx, name)
+		if err == nil {
+			values = append(values, normalizeName(cname))
+		}
+	case "SRV":
+		var srvs []*net.SRV
+		_, srvs, err = r.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			values = append(values, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, normalizeName(srv.Target)))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported record type: %s", record.Type)
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	return values, err
+}
+
+// Supported reports whether records of a type can be verified
+func Supported(recordType string) bool {
+	switch strings.ToUpper(recordType) {
+	case "A", "AAAA", "MX", "TXT", "CNAME", "SRV":
+		return true
+	}
+	return false
+}
+
+// expected returns the value a record is compared by
+func expected(record Expectation) string {
+	switch strings.ToUpper(record.Type) {
+	case "MX":
+		return fmt.Sprintf("%d %s", record.Priority, normalizeName(record.Content))
+	case "CNAME":
+		return normalizeName(record.Content)
+	case "SRV":
+		fields := strings.Fields(record.Content)
+		if len(fields) == 3 {
+			return fmt.Sprintf("%d %s %s %s", record.Priority, fields[0], fields[1], normalizeName(fields[2]))
+		}
+	case "A", "AAAA":
+		if ip := net.ParseIP(record.Content); ip != nil {
+			return ip.String()
+		}
+	}
+	return record.Content
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// resolverFor returns a resolver that sends every query to server
+func resolverFor(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo:     true,
+		StrictErrors: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// lookupAddress resolves a nameserver host, preferring IPv4
+func lookupAddress(ctx context.Context, host string) (string, error) {
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve nameserver %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if addr.To4() != nil {
+			return addr.String(), nil
+		}
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("nameserver %s has no address", host)
+	}
+	return addrs[0].String(), nil
+}
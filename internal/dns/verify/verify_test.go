@@ -0,0 +1,325 @@
+package verify
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DNS types answered by the stub server
+const (
+	typeA     = 1
+	typeCNAME = 5
+	typeMX    = 15
+	typeTXT   = 16
+	typeAAAA  = 28
+	typeSRV   = 33
+)
+
+// stubRecord is a record served by the stub server once it answered after
+// queries for its name and type
+type stubRecord struct {
+	rtype uint16
+	rdata []byte
+	after int
+}
+
+// stubServer is an authoritative nameserver answering over UDP
+type stubServer struct {
+	addr string
+
+	mu      sync.Mutex
+	records map[string][]stubRecord // By lower-case name without trailing dot
+	queries map[string]int          // By "name/type"
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &stubServer{addr: conn.LocalAddr().String(), records: map[string][]stubRecord{}, queries: map[string]int{}}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := s.answer(buf[:n]); response != nil {
+				conn.WriteTo(response, from)
+			}
+		}
+	}()
+	return s
+}
+
+// add serves a record from the first query on
+func (s *stubServer) add(name string, rtype uint16, rdata []byte) {
+	s.addAfter(name, rtype, rdata, 0)
+}
+
+// addAfter serves a record once after queries for it were answered
+func (s *stubServer) addAfter(name string, rtype uint16, rdata []byte, after int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.records[name] = append(s.records[name], stubRecord{rtype: rtype, rdata: rdata, after: after})
+}
+
+// answer builds the response to a query, with the records of the queried
+// type and any CNAME at the name
+func (s *stubServer) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	name, end, ok := readQueryName(query, 12)
+	if !ok || end+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end:])
+
+	s.mu.Lock()
+	key := fmt.Sprintf("%s/%d", name, qtype)
+	answered := s.queries[key]
+	s.queries[key]++
+	var answers []stubRecord
+	for _, record := range s.records[name] {
+		if (record.rtype == qtype || record.rtype == typeCNAME) && answered >= record.after {
+			answers = append(answers, record)
+		}
+	}
+	s.mu.Unlock()
+
+	response := append([]byte(nil), query[:2]...)
+	flags := 0x8000 | 0x0400 | 0x0080 | binary.BigEndian.Uint16(query[2:])&0x0100 // QR, AA, RA, RD
+	response = binary.BigEndian.AppendUint16(response, flags)
+	response = binary.BigEndian.AppendUint16(response, 1)
+	response = binary.BigEndian.AppendUint16(response, uint16(len(answers)))
+	response = binary.BigEndian.AppendUint32(response, 0)
+	response = append(response, query[12:end+4]...)
+	for _, record := range answers {
+		response = append(response, 0xc0, 12) // Name of the question
+		response = binary.BigEndian.AppendUint16(response, record.rtype)
+		response = binary.BigEndian.AppendUint16(response, 1)
+		response = binary.BigEndian.AppendUint32(response, 60)
+		response = binary.BigEndian.AppendUint16(response, uint16(len(record.rdata)))
+		response = append(response, record.rdata...)
+	}
+	return response
+}
+
+func readQueryName(msg []byte, off int) (string, int, bool) {
+	var labels []string
+	for off < len(msg) {
+		n := int(msg[off])
+		if n == 0 {
+			return strings.ToLower(strings.Join(labels, ".")), off + 1, true
+		}
+		if n&0xc0 != 0 || off+1+n > len(msg) {
+			return "", 0, false
+		}
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += 1 + n
+	}
+	return "", 0, false
+}
+
+func wireName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func rdataA(ip string) []byte {
+	return net.ParseIP(ip).To4()
+}
+
+func rdataAAAA(ip string) []byte {
+	return net.ParseIP(ip).To16()
+}
+
+func rdataMX(pref uint16, host string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, pref), wireName(host)...)
+}
+
+func rdataTXT(parts ...string) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, byte(len(part)))
+		b = append(b, part...)
+	}
+	return b
+}
+
+func rdataSRV(priority, weight, port uint16, target string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, priority)
+	b = binary.BigEndian.AppendUint16(b, weight)
+	b = binary.BigEndian.AppendUint16(b, port)
+	return append(b, wireName(target)...)
+}
+
+func testVerifier(servers ...*stubServer) *Verifier {
+	var nameservers []string
+	for _, server := range servers {
+		nameservers = append(nameservers, server.addr)
+	}
+	return New(Options{
+		Nameservers:  nameservers,
+		Timeout:      time.Second,
+		Interval:     10 * time.Millisecond,
+		QueryTimeout: time.Second,
+	})
+}
+
+func TestVerify(t *testing.T) {
+	server := newStubServer(t)
+	server.add("mail.example.com", typeA, rdataA("192.0.2.1"))
+	server.add("mail.example.com", typeAAAA, rdataAAAA("2001:db8::1"))
+	server.add("example.com", typeMX, rdataMX(10, "Mail.Example.com"))
+	server.add("example.com", typeTXT, rdataTXT("v=spf1 mx -all"))
+	server.add("example.com", typeTXT, rdataTXT("google-site-verification=abc"))
+	server.add("s1._domainkey.example.com", typeTXT, rdataTXT("v=DKIM1; k=rsa; p="+strings.Repeat("A", 230), strings.Repeat("B", 100)))
+	server.add("_submission._tcp.example.com", typeSRV, rdataSRV(0, 1, 587, "mail.example.com"))
+	server.add("autoconfig.example.com", typeCNAME, wireName("mail.example.com"))
+
+	records := []Expectation{
+		{Type: "A", Name: "mail.example.com", Content: "192.0.2.1"},
+		{Type: "AAAA", Name: "mail.example.com.", Content: "2001:0db8:0000::1"},
+		{Type: "MX", Name: "example.com", Content: "mail.example.com.", Priority: 10},
+		{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"},
+		{Type: "TXT", Name: "s1._domainkey.example.com", Content: "v=DKIM1; k=rsa; p=" + strings.Repeat("A", 230) + strings.Repeat("B", 100)},
+		{Type: "SRV", Name: "_submission._tcp.example.com", Content: "1 587 mail.example.com", Priority: 0},
+		{Type: "CNAME", Name: "autoconfig.example.com", Content: "MAIL.example.com"},
+	}
+
+	results, err := testVerifier(server).Verify(context.Background(), "example.com", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if !result.Verified || result.Attempts != 1 {
+			t.Errorf("%s %s: verified %v after %d attempts, servers %+v", result.Type, result.Name, result.Verified, result.Attempts, result.Servers)
+		}
+	}
+}
+
+func TestVerifyWaitsForPropagation(t *testing.T) {
+	server := newStubServer(t)
+	server.add("example.com", typeTXT, rdataTXT("v=spf1 -all"))
+	server.addAfter("example.com", typeTXT, rdataTXT("v=spf1 mx -all"), 2)
+
+	results, err := testVerifier(server).Verify(context.Background(), "example.com", []Expectation{
+		{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !results[0].Verified || results[0].Attempts != 3 {
+		t.Errorf("verified %v after %d attempts, want 3", results[0].Verified, results[0].Attempts)
+	}
+}
+
+func TestVerifyReportsMismatch(t *testing.T) {
+	updated := newStubServer(t)
+	updated.add("mail.example.com", typeA, rdataA("192.0.2.1"))
+	stale := newStubServer(t)
+	stale.add("mail.example.com", typeA, rdataA("192.0.2.99"))
+	empty := newStubServer(t)
+
+	verifier := testVerifier(updated, stale, empty)
+	verifier.opts.Timeout = 100 * time.Millisecond
+
+	results, err := verifier.Verify(context.Background(), "example.com", []Expectation{
+		{Type: "A", Name: "mail.example.com", Content: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := results[0]
+	if result.Verified || result.Attempts < 2 {
+		t.Fatalf("verified %v after %d attempts, want unverified after several", result.Verified, result.Attempts)
+	}
+	want := []struct {
+		server   string
+		matched  bool
+		observed string
+	}{
+		{updated.addr, true, "192.0.2.1"},
+		{stale.addr, false, "192.0.2.99"},
+		{empty.addr, false, ""},
+	}
+	for i, server := range result.Servers {
+		if server.Server != want[i].server || server.Matched != want[i].matched || strings.Join(server.Observed, ",") != want[i].observed || server.Error != "" {
+			t.Errorf("server %d = %+v, want %+v", i, server, want[i])
+		}
+	}
+}
+
+func TestVerifyCancelled(t *testing.T) {
+	server := newStubServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := testVerifier(server).Verify(ctx, "example.com", []Expectation{
+		{Type: "A", Name: "mail.example.com", Content: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Verified || results[0].Attempts != 1 {
+		t.Errorf("verified %v after %d attempts, want one failed attempt", results[0].Verified, results[0].Attempts)
+	}
+}
+
+func TestNameservers(t *testing.T) {
+	verifier := New(Options{Nameservers: []string{"192.0.2.53:53"}, Resolvers: []string{"198.51.100.53:53"}})
+
+	servers, err := verifier.Nameservers(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(servers, ",") != "192.0.2.53:53,198.51.100.53:53" {
+		t.Errorf("Nameservers = %v", servers)
+	}
+}
+
+func TestExpected(t *testing.T) {
+	tests := []struct {
+		record Expectation
+		want   string
+	}{
+		{Expectation{Type: "A", Content: "192.0.2.1"}, "192.0.2.1"},
+		{Expectation{Type: "AAAA", Content: "2001:DB8:0::1"}, "2001:db8::1"},
+		{Expectation{Type: "mx", Content: "Mail.Example.com.", Priority: 10}, "10 mail.example.com"},
+		{Expectation{Type: "CNAME", Content: "Mail.Example.com."}, "mail.example.com"},
+		{Expectation{Type: "SRV", Content: "1 587 Mail.Example.com.", Priority: 5}, "5 1 587 mail.example.com"},
+		{Expectation{Type: "TXT", Content: "v=spf1 -all"}, "v=spf1 -all"},
+	}
+
+	for _, tt := range tests {
+		if got := expected(tt.record); got != tt.want {
+			t.Errorf("expected(%+v) = %q, want %q", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestSupported(t *testing.T) {
+	for recordType, want := range map[string]bool{"A": true, "aaaa": true, "MX": true, "TXT": true, "CNAME": true, "SRV": true, "CAA": false, "PTR": false} {
+		if got := Supported(recordType); got != want {
+			t.Errorf("Supported(%q) = %v, want %v", recordType, got, want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"fmt"
+	"mailops/internal/dns/psl"
+	"strings"
+)
+
+// ZoneCandidates returns the names that could be the zone apex for name,
+// from name itself up to its registrable domain. Public suffixes are never
+// candidates, so discovery cannot settle on a registry zone such as co.uk.
+func ZoneCandidates(name string) ([]string, error) {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+
+	registrable, err := psl.RegistrableDomain(name)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []string{name}
+	for candidate := name; candidate != registrable; {
+		candidate = candidate[strings.Index(candidate, ".")+1:]
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// MatchZone returns the most specific zone in zones that contains name
+func MatchZone(name string, zones []string) (string, error) {
+	candidates, err := ZoneCandidates(name)
+	if err != nil {
+		return "", err
+	}
+
+	known := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		known[strings.ToLower(strings.TrimSuffix(zone, "."))] = true
+	}
+
+	for _, candidate := range candidates {
+		if known[candidate] {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no zone available for %s", ErrNotFound, name)
+}
+
+// CheckZone verifies that a configured zone can hold records for name
+func CheckZone(name, zone string) error {
+	if psl.IsPublicSuffix(zone) {
+		return fmt.Errorf("%w: zone %s is a public suffix", ErrValidation, zone)
+	}
+	if !InZone(name, zone) {
+		return fmt.Errorf("%w: %s is not in zone %s", ErrValidation, name, zone)
+	}
+	return nil
+}
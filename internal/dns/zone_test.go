@@ -0,0 +1,87 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestZoneCandidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string // Comma separated, empty for an error
+		wantErr bool
+	}{
+		{name: "mail.example.com", want: "mail.example.com,example.com"},
+		{name: "Mail.Example.com.", want: "mail.example.com,example.com"},
+		{name: "a.b.example.co.uk", want: "a.b.example.co.uk,b.example.co.uk,example.co.uk"},
+		{name: "mail.example.com.tr", want: "mail.example.com.tr,example.com.tr"},
+		{name: "example.com", want: "example.com"},
+		{name: "co.uk", wantErr: true},
+		{name: "com.tr", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ZoneCandidates(tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ZoneCandidates(%q) = %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || strings.Join(got, ",") != tt.want {
+			t.Errorf("ZoneCandidates(%q) = %v, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestMatchZone(t *testing.T) {
+	zones := []string{"example.com", "sub.example.com.", "com.tr", "example.com.tr"}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"mail.example.com", "example.com"},
+		{"mail.sub.example.com", "sub.example.com"},
+		{"mail.example.com.tr", "example.com.tr"},
+		{"mail.other.com.tr", ""},
+		{"mail.example.org", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := MatchZone(tt.name, zones)
+		if tt.want == "" {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("MatchZone(%q) = %q, %v, want %v", tt.name, got, err, ErrNotFound)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("MatchZone(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckZone(t *testing.T) {
+	tests := []struct {
+		name, zone string
+		valid      bool
+	}{
+		{"mail.example.com", "example.com", true},
+		{"mail.example.com.tr", "example.com.tr", true},
+		{"mail.example.com.tr", "com.tr", false},
+		{"mail.example.co.uk", "co.uk", false},
+		{"mail.example.org", "example.com", false},
+	}
+
+	for _, tt := range tests {
+		err := CheckZone(tt.name, tt.zone)
+		if (err == nil) != tt.valid {
+			t.Errorf("CheckZone(%q, %q) = %v, want valid %v", tt.name, tt.zone, err, tt.valid)
+		}
+		if err != nil && !errors.Is(err, ErrValidation) {
+			t.Errorf("CheckZone(%q, %q) = %v, want %v", tt.name, tt.zone, err, ErrValidation)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Package zonefile implements a DNS provider that changes nothing itself and
+// instead exports the records as an RFC 1035 zone-file fragment, for domains
+// whose DNS is managed by the customer.
+package zonefile
+
+import (
+	"fmt"
+	"mailops/internal/dns"
+	"mailops/internal/dns/psl"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTTL = 3600
+
+func init() {
+	dns.Register("zonefile", newFromConfig)
+}
+
+// Provider collects records and writes them to a zone file on hand-off
+type Provider struct {
+	zone  string
+	ttl   int
+	path  string
+	runID string
+	rowID int
+
+	mu      sync.Mutex
+	records []dns.Record
+}
+
+// newFromConfig builds a provider from the row settings. Options:
+//
+//	dir  directory for the zone file, defaults to output/reports/<run_id>
+//	ttl  TTL of exported records in seconds
+func newFromConfig(cfg dns.Config) (dns.Provider, error) {
+	dir := cfg.Option("dir", filepath.Join("output/reports", cfg.RunID))
+
+	p := &Provider{
+		zone:  strings.ToLower(strings.TrimSuffix(cfg.Zone, ".")),
+		ttl:   defaultTTL,
+		path:  filepath.Join(dir, fmt.Sprintf("%d.zone", cfg.RowID)),
+		runID: cfg.RunID,
+		rowID: cfg.RowID,
+	}
+
+	if v := cfg.Option("ttl", ""); v != "" {
+		ttl, err := strconv.Atoi(v)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid zonefile ttl: %s", v)
+		}
+		p.ttl = ttl
+	}
+
+	return p, nil
+}
+
+// Name returns the registry name of the provider
+func (p *Provider) Name() string {
+	return "zonefile"
+}
+
+// FindZone returns the configured zone. Without one, the registrable domain
+// of the first name becomes the zone of the export.
+func (p *Provider) FindZone(name string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.zone == "" {
+		zone, err := psl.RegistrableDomain(name)
+		if err != nil {
+			return "", err
+		}
+		p.zone = zone
+	}
+
+	if err := dns.CheckZone(name, p.zone); err != nil {
+		return "", err
+	}
+	return p.zone, nil
+}
+
+// FindRecord always reports no record, as the current zone is unknown
+func (p *Provider) FindRecord(recordType, name string) (*dns.Record, error) {
+	return nil, nil
+}
+
+// ListRecords always reports no records, as the current zone is unknown
+func (p *Provider) ListRecords(recordType, name string) ([]dns.Record, error) {
+	return nil, nil
+}
+
+// UpsertRecord adds a record to the export, replacing a collected record of
+// the same type and name
+func (p *Provider) UpsertRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	record.Type = strings.ToUpper(record.Type)
+	record.Name = dns.Qualify(record.Name, p.zone)
+	if record.TTL == 0 {
+		record.TTL = p.ttl
+	}
+
+	for i, existing := range p.records {
+		if existing.Type == record.Type && strings.EqualFold(existing.Name, record.Name) {
+			p.records[i] = record
+			return nil
+		}
+	}
+	p.records = append(p.records, record)
+	return nil
+}
+
+// CreateRecord adds a record to the export next to the collected records of
+// the same type and name, unless the same value was already collected
+func (p *Provider) CreateRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	record.Type = strings.ToUpper(record.Type)
+	record.Name = dns.Qualify(record.Name, p.zone)
+	if record.TTL == 0 {
+		record.TTL = p.ttl
+	}
+
+	for _, existing := range p.records {
+		if existing.Type == record.Type && strings.EqualFold(existing.Name, record.Name) &&
+			existing.Content == record.Content && existing.Priority == record.Priority {
+			return nil
+		}
+	}
+	p.records = append(p.records, record)
+	return nil
+}
+
+// DeleteRecord drops a collected record. Records already published by the
+// customer are out of reach and have to be removed by hand.
+func (p *Provider) DeleteRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := dns.Qualify(record.Name, p.zone)
+	for i, existing := range p.records {
+		if strings.EqualFold(existing.Type, record.Type) && strings.EqualFold(existing.Name, name) {
+			p.records = append(p.records[:i], p.records[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// HandOff writes the collected records to the zone file and returns its path
+func (p *Provider) HandOff() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(p.path, []byte(p.render()), 0644); err != nil {
+		return "", fmt.Errorf("failed to write zone file: %w", err)
+	}
+	return p.path, nil
+}
+
+// render formats the records as a zone-file fragment relative to the zone
+func (p *Provider) render() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "; Records for %s generated by mailops\n", p.zone)
+	fmt.Fprintf(&sb, "; Run %s, row %d, %s\n", p.runID, p.rowID, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&sb, "$ORIGIN %s.\n", p.zone)
+	fmt.Fprintf(&sb, "$TTL %d\n\n", p.ttl)
+
+	for _, r := range p.records {
+		fmt.Fprintf(&sb, "%-24s %-6d IN %-5s %s\n", p.relative(r.Name), r.TTL, r.Type, p.rdata(r))
+	}
+
+	return sb.String()
+}
+
+// rdata formats record content in presentation form
+func (p *Provider) rdata(r dns.Record) string {
+	switch r.Type {
+	case "MX":
+		return fmt.Sprintf("%d %s", r.Priority, p.absolute(r.Content))
+	case "CNAME", "NS":
+		return p.absolute(r.Content)
+	case "SRV":
+		weight, port, target, err := dns.ParseSRV(r.Content)
+		if err != nil {
+			return r.Content
+		}
+		return fmt.Sprintf("%d %d %d %s", r.Priority, weight, port, p.absolute(target))
+	case "TXT":
+		parts := dns.SplitTXT(r.Content)
+		quoted := make([]string, len(parts))
+		for i, part := range parts {
+			quoted[i] = quoteTXT(part)
+		}
+		if len(quoted) == 1 {
+			return quoted[0]
+		}
+		return "( " + strings.Join(quoted, "\n"+strings.Repeat(" ", 43)) + " )"
+	default:
+		return r.Content
+	}
+}
+
+// relative returns an owner name relative to the origin
+func (p *Provider) relative(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if strings.EqualFold(name, p.zone) {
+		return "@"
+	}
+	if dns.InZone(name, p.zone) {
+		return name[:len(name)-len(p.zone)-1]
+	}
+	return name + "."
+}
+
+// absolute returns a target name as an absolute domain name, keeping names
+// that already end in a dot
+func (p *Provider) absolute(name string) string {
+	if name = strings.TrimSpace(name); strings.HasSuffix(name, ".") {
+		return name
+	}
+	return dns.Qualify(name, p.zone) + "."
+}
+
+// quoteTXT quotes a TXT character-string, escaping quotes, backslashes and
+// non-printable bytes
+func quoteTXT(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,38 @@
+package zonefile
+
+import (
+	"mailops/internal/dns"
+	"testing"
+)
+
+func TestFindZone(t *testing.T) {
+	tests := []struct {
+		zone string // Configured zone
+		name string
+		want string // Empty for an error
+	}{
+		{"", "mail.example.com", "example.com"},
+		{"", "mail.example.com.tr", "example.com.tr"},
+		{"", "mail.example.co.il", "example.co.il"},
+		{"", "com.tr", ""},
+		{"example.com.tr", "mail.example.com.tr", "example.com.tr"},
+		{"com.tr", "mail.example.com.tr", ""},
+	}
+
+	for _, tt := range tests {
+		p, err := newFromConfig(dns.Config{Zone: tt.zone, Options: map[string]string{"dir": t.TempDir()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.FindZone(tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("FindZone(%q) with zone %q = %q, want an error", tt.name, tt.zone, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("FindZone(%q) with zone %q = %q, %v, want %q", tt.name, tt.zone, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package zonefile
+
+import (
+	"fmt"
+	"mailops/internal/dkim"
+	"mailops/internal/dns"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// zoneRR is a resource record read back from a zone file
+type zoneRR struct {
+	owner string // Absolute, with the trailing dot
+	ttl   int
+	typ   string
+	rdata []string // Fields, quoted strings unescaped
+}
+
+// parseZone reads a zone file as RFC 1035 §5.1 defines its syntax: $ORIGIN
+// and $TTL directives, ";" comments, parentheses continuing an entry across
+// lines, and quoted strings with \X and \DDD escapes. It fails on anything
+// else, so what it accepts is valid zone-file syntax.
+func parseZone(t *testing.T, text string) []zoneRR {
+	t.Helper()
+	var (
+		records []zoneRR
+		origin  string
+		ttl     int
+		fields  []string
+		quoted  []bool
+		depth   int
+	)
+
+	// entry interprets the fields of one complete entry
+	entry := func() {
+		defer func() { fields, quoted = nil, nil }()
+		if len(fields) == 0 {
+			return
+		}
+		switch fields[0] {
+		case "$ORIGIN":
+			origin = fields[1]
+			if !strings.HasSuffix(origin, ".") {
+				t.Fatalf("$ORIGIN %s is not absolute", origin)
+			}
+			return
+		case "$TTL":
+			var err error
+			if ttl, err = strconv.Atoi(fields[1]); err != nil {
+				t.Fatalf("invalid $TTL %s", fields[1])
+			}
+			return
+		}
+		if len(fields) < 5 || quoted[0] {
+			t.Fatalf("incomplete entry %q", fields)
+		}
+
+		rr := zoneRR{owner: fields[0], ttl: ttl}
+		switch {
+		case rr.owner == "@":
+			rr.owner = origin
+		case !strings.HasSuffix(rr.owner, "."):
+			rr.owner += "." + origin
+		}
+		var err error
+		if rr.ttl, err = strconv.Atoi(fields[1]); err != nil {
+			t.Fatalf("invalid TTL in %q", fields)
+		}
+		if fields[2] != "IN" {
+			t.Fatalf("class %s in %q, want IN", fields[2], fields)
+		}
+		rr.typ = fields[3]
+		rr.rdata = fields[4:]
+		for i, field := range rr.rdata {
+			if quoted[4+i] && len(field) > 255 {
+				t.Errorf("%s %s: character-string of %d bytes", rr.owner, rr.typ, len(field))
+			}
+			if !quoted[4+i] && rr.typ == "TXT" {
+				t.Errorf("%s TXT: unquoted string %q", rr.owner, field)
+			}
+		}
+		records = append(records, rr)
+	}
+
+	for n, line := range strings.Split(text, "\n") {
+		for i := 0; i < len(line); i++ {
+			switch c := line[i]; {
+			case c == ';':
+				i = len(line)
+			case c == ' ' || c == '\t':
+			case c == '(':
+				depth++
+			case c == ')':
+				if depth--; depth < 0 {
+					t.Fatalf("line %d: unbalanced )", n+1)
+				}
+			case c == '"':
+				var sb strings.Builder
+				for i++; ; i++ {
+					if i >= len(line) {
+						t.Fatalf("line %d: unterminated string", n+1)
+					}
+					c := line[i]
+					if c == '"' {
+						break
+					}
+					if c == '\\' {
+						if i+3 < len(line) && strings.Trim(line[i+1:i+4], "0123456789") == "" {
+							b, _ := strconv.Atoi(line[i+1 : i+4])
+							if b > 255 {
+								t.Fatalf("line %d: invalid escape \\%s", n+1, line[i+1:i+4])
+							}
+							sb.WriteByte(byte(b))
+							i += 3
+							continue
+						}
+						i++
+						if i >= len(line) {
+							t.Fatalf("line %d: escape at the end of the line", n+1)
+						}
+						c = line[i]
+					}
+					sb.WriteByte(c)
+				}
+				fields = append(fields, sb.String())
+				quoted = append(quoted, true)
+			default:
+				end := strings.IndexAny(line[i:], " \t;()\"")
+				if end < 0 {
+					end = len(line) - i
+				}
+				fields = append(fields, line[i:i+end])
+				quoted = append(quoted, false)
+				i += end - 1
+			}
+		}
+		if depth == 0 {
+			entry()
+		}
+	}
+	if depth != 0 {
+		t.Fatal("unterminated (")
+	}
+	return records
+}
+
+func TestQuoteTXT(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"v=spf1 mx -all", `"v=spf1 mx -all"`},
+		{"", `""`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\mail`, `"C:\\mail"`},
+		{"tab\there", `"tab\009here"`},
+		{"caf\xc3\xa9", `"caf\195\169"`},
+		{"semi;colon (paren)", `"semi;colon (paren)"`},
+	}
+
+	for _, tt := range tests {
+		if got := quoteTXT(tt.in); got != tt.want {
+			t.Errorf("quoteTXT(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRdata(t *testing.T) {
+	p := &Provider{zone: "example.com"}
+	long := strings.Repeat("a", 255) + strings.Repeat("b", 45)
+
+	tests := []struct {
+		record dns.Record
+		want   string
+	}{
+		{dns.Record{Type: "A", Content: "192.0.2.1"}, "192.0.2.1"},
+		{dns.Record{Type: "MX", Content: "mail.example.com", Priority: 10}, "10 mail.example.com."},
+		{dns.Record{Type: "MX", Content: "mx1", Priority: 0}, "0 mx1.example.com."},
+		{dns.Record{Type: "MX", Content: "mx.provider.net.", Priority: 20}, "20 mx.provider.net."},
+		{dns.Record{Type: "CNAME", Content: "mail"}, "mail.example.com."},
+		{dns.Record{Type: "SRV", Content: "1 993 mail.example.com", Priority: 0}, "0 1 993 mail.example.com."},
+		{dns.Record{Type: "CAA", Content: `0 issue "letsencrypt.org"`}, `0 issue "letsencrypt.org"`},
+		{dns.Record{Type: "TXT", Content: "v=DMARC1; p=none"}, `"v=DMARC1; p=none"`},
+		{dns.Record{Type: "TXT", Content: `a "quoted" \ value`}, `"a \"quoted\" \\ value"`},
+		{dns.Record{Type: "TXT", Content: long}, `( "` + strings.Repeat("a", 255) + `"` + "\n" + strings.Repeat(" ", 43) + `"` + strings.Repeat("b", 45) + `" )`},
+	}
+
+	for _, tt := range tests {
+		if got := p.rdata(tt.record); got != tt.want {
+			t.Errorf("rdata(%s %q) = %s, want %s", tt.record.Type, tt.record.Content, got, tt.want)
+		}
+	}
+}
+
+func TestRelative(t *testing.T) {
+	p := &Provider{zone: "example.com"}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "@"},
+		{"Example.COM.", "@"},
+		{"mail.example.com", "mail"},
+		{"s1._domainkey.example.com.", "s1._domainkey"},
+		{"example.org", "example.org."},
+		{"badexample.com", "badexample.com."},
+	}
+
+	for _, tt := range tests {
+		if got := p.relative(tt.name); got != tt.want {
+			t.Errorf("relative(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	key, err := dkim.GenerateKey("rsa", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := key.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkimValue := record.String()
+	if len(dkimValue) <= 255 {
+		t.Fatalf("2048-bit DKIM record of %d bytes fits one string", len(dkimValue))
+	}
+
+	dir := t.TempDir()
+	provider, err := newFromConfig(dns.Config{Zone: "example.com.", RunID: "run-1", RowID: 7, Options: map[string]string{"dir": dir, "ttl": "300"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := provider.(*Provider)
+
+	changes := []struct {
+		create bool
+		record dns.Record
+	}{
+		{false, dns.Record{Type: "a", Name: "mail", Content: "192.0.2.1"}},
+		{false, dns.Record{Type: "A", Name: "mail.example.com", Content: "192.0.2.2"}}, // Replaces the first
+		{false, dns.Record{Type: "MX", Name: "@", Content: "mail.example.com", Priority: 10}},
+		{true, dns.Record{Type: "MX", Name: "example.com", Content: "backup.example.net.", Priority: 20, TTL: 86400}},
+		{true, dns.Record{Type: "MX", Name: "example.com", Content: "backup.example.net.", Priority: 20}}, // Already collected
+		{false, dns.Record{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"}},
+		{false, dns.Record{Type: "TXT", Name: "_dmarc", Content: `v=DMARC1; p=none; rua=mailto:"dmarc"@example.com`}},
+		{false, dns.Record{Type: "TXT", Name: "default._domainkey.example.com", Content: dkimValue}},
+		{false, dns.Record{Type: "CNAME", Name: "autoconfig", Content: "mail"}},
+		{false, dns.Record{Type: "TXT", Name: "obsolete", Content: "x"}},
+	}
+	for _, change := range changes {
+		if change.create {
+			err = p.CreateRecord(change.record)
+		} else {
+			err = p.UpsertRecord(change.record)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.DeleteRecord(dns.Record{Type: "txt", Name: "obsolete.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := p.HandOff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := dir + "/7.zone"; path != want {
+		t.Errorf("HandOff wrote %s, want %s", path, want)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	if !strings.HasPrefix(text, "; Records for example.com generated by mailops\n; Run run-1, row 7, ") {
+		t.Errorf("zone file header:\n%s", text)
+	}
+
+	want := []string{
+		"mail.example.com. 300 A 192.0.2.2",
+		"example.com. 300 MX 10 mail.example.com.",
+		"example.com. 86400 MX 20 backup.example.net.",
+		"example.com. 300 TXT v=spf1 mx -all",
+		`_dmarc.example.com. 300 TXT v=DMARC1; p=none; rua=mailto:"dmarc"@example.com`,
+		"default._domainkey.example.com. 300 TXT " + dkimValue,
+		"autoconfig.example.com. 300 CNAME mail.example.com.",
+	}
+	records := parseZone(t, text)
+	if len(records) != len(want) {
+		t.Fatalf("zone file holds %d records, want %d:\n%s", len(records), len(want), text)
+	}
+	for i, rr := range records {
+		// Character-strings of a TXT record make up one value
+		rdata := strings.Join(rr.rdata, " ")
+		if rr.typ == "TXT" {
+			rdata = strings.Join(rr.rdata, "")
+		}
+		if got := fmt.Sprintf("%s %d %s %s", rr.owner, rr.ttl, rr.typ, rdata); got != want[i] {
+			t.Errorf("record %d = %s, want %s", i, got, want[i])
+		}
+	}
+	if dkimRR := records[5]; len(dkimRR.rdata) < 2 {
+		t.Errorf("2048-bit DKIM record in %d string, want it split", len(dkimRR.rdata))
+	}
+	if strings.Contains(text, "192.0.2.1\n") {
+		t.Error("zone file holds the replaced A record")
+	}
+}
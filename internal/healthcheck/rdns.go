@@ -0,0 +1,112 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ReverseDNSResult is the outcome of a forward-confirmed reverse DNS check
+// of a mail server address
+type ReverseDNSResult struct {
+	IP               string   `json:"ip"`
+	Expected         string   `json:"expected"` // Host name the mail server announces
+	PTR              []string `json:"ptr,omitempty"`
+	MatchesHostname  bool     `json:"matches_hostname"`
+	ForwardConfirmed bool     `json:"forward_confirmed"` // A PTR name resolves back to IP
+	Passed           bool     `json:"passed"`
+	Problem          string   `json:"problem,omitempty"`
+	Action           string   `json:"action,omitempty"` // What to ask for, e.g. in a hosting provider ticket
+}
+
+// CheckReverseDNS resolves the PTR records of ip, checks that one of them
+// forward-resolves back to ip and that it is the host name the mail server
+// was configured with. A nil resolver uses the system resolver.
+func CheckReverseDNS(ctx context.Context, r *net.Resolver, ip, hostname string) ReverseDNSResult {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	hostname = normalizeHost(hostname)
+	result := ReverseDNSResult{IP: ip, Expected: hostname}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		result.Problem = fmt.Sprintf("%s is not an IP address", ip)
+		return result
+	}
+
+	names, err := r.LookupAddr(ctx, ip)
+	if err != nil && !isNotFound(err) {
+		result.Problem = fmt.Sprintf("PTR lookup of %s failed: %v", ip, err)
+		return result
+	}
+	for _, name := range names {
+		result.PTR = append(result.PTR, normalizeHost(name))
+	}
+
+	if len(result.PTR) == 0 {
+		result.Problem = fmt.Sprintf("%s has no PTR record", ip)
+		result.Action = ptrTicket(ip, hostname)
+		return result
+	}
+
+	for _, name := range result.PTR {
+		if name == hostname {
+			result.MatchesHostname = true
+		}
+		if resolvesTo(ctx, r, name, addr) {
+			result.ForwardConfirmed = true
+		}
+	}
+
+	switch {
+	case !result.MatchesHostname:
+		result.Problem = fmt.Sprintf("PTR of %s is %s, but the mail server announces itself as %s", ip, strings.Join(result.PTR, ", "), hostname)
+		result.Action = ptrTicket(ip, hostname)
+	case !result.ForwardConfirmed:
+		result.Problem = fmt.Sprintf("PTR of %s is %s, but %s does not resolve back to %s", ip, hostname, hostname, ip)
+		result.Action = fmt.Sprintf("Publish an A/AAAA record for %s pointing to %s, or wait for the record applied by this run to propagate.", hostname, ip)
+	case len(result.PTR) > 1:
+		result.Problem = fmt.Sprintf("%s has %d PTR records (%s); some receivers only check the first", ip, len(result.PTR), strings.Join(result.PTR, ", "))
+		result.Action = fmt.Sprintf("Please remove every reverse DNS (PTR) record of %s except %s.", ip, hostname)
+	default:
+		result.Passed = true
+	}
+
+	return result
+}
+
+// ptrTicket returns the request to send to the provider of an address
+func ptrTicket(ip, hostname string) string {
+	return fmt.Sprintf("Please set the reverse DNS (PTR) record of %s to %s. The mail server on this address identifies itself as %s, which resolves to %s, so receiving servers require a matching PTR record.", ip, hostname, hostname, ip)
+}
+
+// resolvesTo reports whether name has an address record equal to addr
+func resolvesTo(ctx context.Context, r *net.Resolver, name string, addr net.IP) bool {
+	network := "ip4"
+	if addr.To4() == nil {
+		network = "ip6"
+	}
+
+	ips, err := r.LookupIP(ctx, network, name)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHost(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
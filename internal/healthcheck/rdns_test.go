@@ -0,0 +1,233 @@
+package healthcheck
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// DNS types answered by the stub nameserver
+const (
+	typeA   = 1
+	typePTR = 12
+)
+
+// stubRecords holds the rdata served by a stub nameserver by lower-case
+// name without the trailing dot, and type
+type stubRecords map[string]map[uint16][][]byte
+
+func (records stubRecords) add(name string, rtype uint16, rdata []byte) {
+	if records[name] == nil {
+		records[name] = map[uint16][][]byte{}
+	}
+	records[name][rtype] = append(records[name][rtype], rdata)
+}
+
+// stubResolver returns a resolver whose queries are answered from records.
+// Names without records are answered NXDOMAIN, and every query SERVFAIL
+// when servfail is set.
+func stubResolver(t *testing.T, records stubRecords, servfail bool) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := stubAnswer(buf[:n], records, servfail); response != nil {
+				conn.WriteTo(response, from)
+			}
+		}
+	}()
+
+	addr := conn.LocalAddr().String()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}
+}
+
+// stubAnswer builds the response to a query
+func stubAnswer(query []byte, records stubRecords, servfail bool) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	var labels []string
+	off := 12
+	for off < len(query) && query[off] != 0 {
+		n := int(query[off])
+		if off+1+n > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[off+1:off+1+n]))
+		off += 1 + n
+	}
+	end := off + 1
+	if end+4 > len(query) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, "."))
+	qtype := binary.BigEndian.Uint16(query[end:])
+
+	var rcode uint16
+	answers := records[name][qtype]
+	switch {
+	case servfail:
+		rcode, answers = 2, nil // SERVFAIL
+	case records[name] == nil:
+		rcode = 3 // NXDOMAIN
+	}
+
+	response := append([]byte(nil), query[:2]...)
+	flags := 0x8000 | 0x0400 | 0x0080 | binary.BigEndian.Uint16(query[2:])&0x0100 | rcode // QR, AA, RA, RD
+	response = binary.BigEndian.AppendUint16(response, flags)
+	response = binary.BigEndian.AppendUint16(response, 1)
+	response = binary.BigEndian.AppendUint16(response, uint16(len(answers)))
+	response = binary.BigEndian.AppendUint32(response, 0)
+	response = append(response, query[12:end+4]...)
+	for _, rdata := range answers {
+		response = append(response, 0xc0, 12) // Name of the question
+		response = binary.BigEndian.AppendUint16(response, qtype)
+		response = binary.BigEndian.AppendUint16(response, 1)
+		response = binary.BigEndian.AppendUint32(response, 60)
+		response = binary.BigEndian.AppendUint16(response, uint16(len(rdata)))
+		response = append(response, rdata...)
+	}
+	return response
+}
+
+func wireName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// zone returns the records of a stub nameserver: the PTR records of
+// 192.0.2.1 and the A records of host names
+func zone(ptr []string, a map[string]string) stubRecords {
+	records := stubRecords{}
+	for _, name := range ptr {
+		records.add("1.2.0.192.in-addr.arpa", typePTR, wireName(name))
+	}
+	for name, ip := range a {
+		records.add(name, typeA, net.ParseIP(ip).To4())
+	}
+	return records
+}
+
+func TestCheckReverseDNS(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		ptr      []string
+		a        map[string]string
+		servfail bool
+
+		wantPTR   []string
+		matches   bool
+		confirmed bool
+		passed    bool
+		problem   string // Part of the problem, empty when passed
+		action    string // Part of the action, empty for none
+	}{
+		{
+			name:    "no PTR",
+			ip:      "192.0.2.1",
+			a:       map[string]string{"mail.example.com": "192.0.2.1"},
+			problem: "192.0.2.1 has no PTR record",
+			action:  "set the reverse DNS (PTR) record of 192.0.2.1 to mail.example.com",
+		},
+		{
+			name:      "PTR names another host",
+			ip:        "192.0.2.1",
+			ptr:       []string{"host-1.provider.net"},
+			a:         map[string]string{"host-1.provider.net": "192.0.2.1", "mail.example.com": "192.0.2.1"},
+			wantPTR:   []string{"host-1.provider.net"},
+			confirmed: true,
+			problem:   "PTR of 192.0.2.1 is host-1.provider.net, but the mail server announces itself as mail.example.com",
+			action:    "set the reverse DNS (PTR) record of 192.0.2.1 to mail.example.com",
+		},
+		{
+			name:    "not forward-confirmed",
+			ip:      "192.0.2.1",
+			ptr:     []string{"mail.example.com"},
+			a:       map[string]string{"mail.example.com": "192.0.2.99"},
+			wantPTR: []string{"mail.example.com"},
+			matches: true,
+			problem: "mail.example.com does not resolve back to 192.0.2.1",
+			action:  "Publish an A/AAAA record for mail.example.com pointing to 192.0.2.1",
+		},
+		{
+			name:      "multiple PTRs",
+			ip:        "192.0.2.1",
+			ptr:       []string{"mail.example.com", "host-1.provider.net"},
+			a:         map[string]string{"host-1.provider.net": "192.0.2.1", "mail.example.com": "192.0.2.1"},
+			wantPTR:   []string{"mail.example.com", "host-1.provider.net"},
+			matches:   true,
+			confirmed: true,
+			problem:   "192.0.2.1 has 2 PTR records",
+			action:    "remove every reverse DNS (PTR) record of 192.0.2.1 except mail.example.com",
+		},
+		{
+			name:      "passed",
+			ip:        "192.0.2.1",
+			ptr:       []string{"Mail.Example.COM."},
+			a:         map[string]string{"mail.example.com": "192.0.2.1"},
+			wantPTR:   []string{"mail.example.com"},
+			matches:   true,
+			confirmed: true,
+			passed:    true,
+		},
+		{
+			name:     "lookup failure",
+			ip:       "192.0.2.1",
+			servfail: true,
+			problem:  "PTR lookup of 192.0.2.1 failed",
+		},
+		{
+			name:    "not an address",
+			ip:      "mail.example.com",
+			problem: "mail.example.com is not an IP address",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := stubResolver(t, zone(tt.ptr, tt.a), tt.servfail)
+			result := CheckReverseDNS(context.Background(), r, tt.ip, "Mail.example.com.")
+
+			if result.IP != tt.ip || result.Expected != "mail.example.com" {
+				t.Errorf("checked %s for %s, want %s for mail.example.com", result.IP, result.Expected, tt.ip)
+			}
+			if !reflect.DeepEqual(result.PTR, tt.wantPTR) {
+				t.Errorf("PTR = %q, want %q", result.PTR, tt.wantPTR)
+			}
+			if result.MatchesHostname != tt.matches || result.ForwardConfirmed != tt.confirmed || result.Passed != tt.passed {
+				t.Errorf("matches %v, forward-confirmed %v, passed %v, want %v, %v, %v",
+					result.MatchesHostname, result.ForwardConfirmed, result.Passed, tt.matches, tt.confirmed, tt.passed)
+			}
+			if (result.Problem == "") != (tt.problem == "") || !strings.Contains(result.Problem, tt.problem) {
+				t.Errorf("problem = %q, want it to contain %q", result.Problem, tt.problem)
+			}
+			if (result.Action == "") != (tt.action == "") || !strings.Contains(result.Action, tt.action) {
+				t.Errorf("action = %q, want it to contain %q", result.Action, tt.action)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Package mtasts builds MTA-STS policies (RFC 8461) and the DNS records that
+// announce them, together with the TLS reporting record (RFC 8460).
+package mtasts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Policy modes
+const (
+	ModeEnforce = "enforce"
+	ModeTesting = "testing"
+	ModeNone    = "none"
+)
+
+const (
+	// DefaultMaxAge is how long senders cache the policy, one week
+	DefaultMaxAge = 604800
+	// MaxMaxAge is the longest max_age allowed by RFC 8461, about a year
+	MaxMaxAge = 31557600
+
+	// PolicyPath is where the policy is served on the policy host
+	PolicyPath = "/.well-known/mta-sts.txt"
+)
+
+// Policy is an MTA-STS policy
+type Policy struct {
+	Mode   string
+	MX     []string // Host names or *.domain patterns, sorted and lower case
+	MaxAge int      // Seconds
+}
+
+// NewPolicy validates and normalises a policy. An empty mode means testing
+// and a zero max age means DefaultMaxAge.
+func NewPolicy(mode string, mx []string, maxAge int) (*Policy, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		mode = ModeTesting
+	case ModeEnforce, ModeTesting, ModeNone:
+	default:
+		return nil, fmt.Errorf("invalid MTA-STS mode %q, expected enforce, testing or none", mode)
+	}
+
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	if maxAge < 0 || maxAge > MaxMaxAge {
+		return nil, fmt.Errorf("invalid MTA-STS max_age %d, expected 1 to %d seconds", maxAge, MaxMaxAge)
+	}
+
+	seen := make(map[string]bool, len(mx))
+	hosts := make([]string, 0, len(mx))
+	for _, host := range mx {
+		host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 && mode != ModeNone {
+		return nil, fmt.Errorf("MTA-STS policy in %s mode needs at least one MX host", mode)
+	}
+	sort.Strings(hosts)
+
+	return &Policy{Mode: mode, MX: hosts, MaxAge: maxAge}, nil
+}
+
+// Text renders the policy file served at PolicyPath
+func (p *Policy) Text() string {
+	var b strings.Builder
+	b.WriteString("version: STSv1\r\n")
+	fmt.Fprintf(&b, "mode: %s\r\n", p.Mode)
+	for _, host := range p.MX {
+		fmt.Fprintf(&b, "mx: %s\r\n", host)
+	}
+	fmt.Fprintf(&b, "max_age: %d\r\n", p.MaxAge)
+	return b.String()
+}
+
+// ID returns the policy id announced in DNS. It is derived from the policy
+// text, so it changes whenever the MX set, mode or max age does, which is
+// what tells senders to fetch the policy again.
+func (p *Policy) ID() string {
+	sum := sha256.Sum256([]byte(p.Text()))
+	return hex.EncodeToString(sum[:10])
+}
+
+// Record returns the TXT record announcing the policy
+func (p *Policy) Record() string {
+	return fmt.Sprintf("v=STSv1; id=%s", p.ID())
+}
+
+// RecordName returns the name of the policy TXT record of domain
+func RecordName(domain string) string {
+	return "_mta-sts." + strings.TrimSuffix(domain, ".")
+}
+
+// PolicyHost returns the host that serves the policy of domain over HTTPS
+func PolicyHost(domain string) string {
+	return "mta-sts." + strings.TrimSuffix(domain, ".")
+}
+
+// TLSRPTName returns the name of the TLS reporting TXT record of domain
+func TLSRPTName(domain string) string {
+	return "_smtp._tls." + strings.TrimSuffix(domain, ".")
+}
+
+// TLSRPTRecord returns the TLS reporting record sending aggregate reports to
+// rua, a comma separated list of mailto: or https: URIs
+func TLSRPTRecord(rua string) string {
+	return fmt.Sprintf("v=TLSRPTv1; rua=%s", rua)
+}
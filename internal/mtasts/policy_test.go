@@ -0,0 +1,112 @@
+package mtasts
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPolicyText(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		mx     []string
+		maxAge int
+		want   string
+	}{
+		{
+			name:   "enforce",
+			mode:   "Enforce",
+			mx:     []string{"mx2.example.com.", "MX1.example.com", "mx2.example.com"},
+			maxAge: 86400,
+			want:   "version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: mx2.example.com\r\nmax_age: 86400\r\n",
+		},
+		{
+			name: "defaults",
+			mx:   []string{"*.example.net"},
+			want: "version: STSv1\r\nmode: testing\r\nmx: *.example.net\r\nmax_age: 604800\r\n",
+		},
+		{
+			name:   "none without MX",
+			mode:   "none",
+			maxAge: MaxMaxAge,
+			want:   "version: STSv1\r\nmode: none\r\nmax_age: 31557600\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		policy, err := NewPolicy(tt.mode, tt.mx, tt.maxAge)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		text := policy.Text()
+		if text != tt.want {
+			t.Errorf("%s: Text =\n%q\nwant\n%q", tt.name, text, tt.want)
+		}
+		if strings.Count(text, "\n") != strings.Count(text, "\r\n") {
+			t.Errorf("%s: Text has lines not ended by CRLF: %q", tt.name, text)
+		}
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		mx     []string
+		maxAge int
+	}{
+		{"unknown mode", "strict", []string{"mx.example.com"}, 0},
+		{"enforce without MX", "enforce", nil, 0},
+		{"testing with blank MX", "testing", []string{" ", "."}, 0},
+		{"negative max_age", "enforce", []string{"mx.example.com"}, -1},
+		{"max_age over a year", "enforce", []string{"mx.example.com"}, MaxMaxAge + 1},
+	}
+
+	for _, tt := range tests {
+		if policy, err := NewPolicy(tt.mode, tt.mx, tt.maxAge); err == nil {
+			t.Errorf("%s: NewPolicy = %+v, want an error", tt.name, policy)
+		}
+	}
+}
+
+func TestPolicyID(t *testing.T) {
+	newPolicy := func(mode string, mx []string, maxAge int) *Policy {
+		t.Helper()
+		policy, err := NewPolicy(mode, mx, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return policy
+	}
+	base := newPolicy("enforce", []string{"mx1.example.com", "mx2.example.com"}, 86400)
+	id := base.ID()
+
+	// RFC 8461 §3.1: 1 to 32 alphanumeric characters
+	if !regexp.MustCompile(`^[a-zA-Z0-9]{1,32}$`).MatchString(id) {
+		t.Errorf("ID %q is not 1 to 32 alphanumeric characters", id)
+	}
+	if want := "v=STSv1; id=" + id; base.Record() != want {
+		t.Errorf("Record = %q, want %q", base.Record(), want)
+	}
+
+	tests := []struct {
+		name    string
+		policy  *Policy
+		changed bool
+	}{
+		{"same policy", newPolicy("enforce", []string{"mx1.example.com", "mx2.example.com"}, 86400), false},
+		{"MX in another order and case", newPolicy("ENFORCE", []string{"MX2.example.com.", "mx1.example.com"}, 86400), false},
+		{"mode", newPolicy("testing", []string{"mx1.example.com", "mx2.example.com"}, 86400), true},
+		{"MX added", newPolicy("enforce", []string{"mx1.example.com", "mx2.example.com", "mx3.example.com"}, 86400), true},
+		{"MX removed", newPolicy("enforce", []string{"mx1.example.com"}, 86400), true},
+		{"MX replaced", newPolicy("enforce", []string{"mx1.example.com", "mx9.example.com"}, 86400), true},
+		{"max_age", newPolicy("enforce", []string{"mx1.example.com", "mx2.example.com"}, 604800), true},
+	}
+
+	for _, tt := range tests {
+		if changed := tt.policy.ID() != id; changed != tt.changed {
+			t.Errorf("%s: ID changed %v, want %v", tt.name, changed, tt.changed)
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sync"
 )
 
-// Encoder writes NDJSON events to stdout
+// Encoder writes NDJSON events to stdout. It is safe for concurrent use.
 type Encoder struct {
+	mu     sync.Mutex
 	writer *bufio.Writer
 }
 
@@ -27,6 +29,9 @@ func (e *Encoder) Encode(eventType EventType, runID, rowID string, data any) err
 		return fmt.Errorf("failed to marshal envelope: %w", err)
 	}
 
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	_, err = e.writer.Write(dataBytes)
 	if err != nil {
 		return fmt.Errorf("failed to write event: %w", err)
@@ -37,11 +37,16 @@ const (
 	RemoteCmdTransient   ErrorCode = "REMOTE_CMD_TRANSIENT"
 	SSHConn              ErrorCode = "SSH_CONN"
 	SSHTimeout           ErrorCode = "SSH_TIMEOUT"
+	SSHHostKeyMismatch   ErrorCode = "SSH_HOST_KEY_MISMATCH" // Never retried
 	InvalidConfig        ErrorCode = "INVALID_CONFIG"
 	AuthFailed           ErrorCode = "AUTH_FAILED"
 	DeployFailed         ErrorCode = "DEPLOY_FAILED"
 	DNSRateLimit         ErrorCode = "DNS_RATE_LIMIT"
 	DNSAuthFailed        ErrorCode = "DNS_AUTH_FAILED"
+	DNSProviderFailed    ErrorCode = "DNS_PROVIDER_FAILED"
+	DNSVerifyFailed      ErrorCode = "DNS_VERIFY_FAILED"
+	CertIssueFailed      ErrorCode = "CERT_ISSUE_FAILED"
+	ServerLocked         ErrorCode = "SERVER_LOCKED"
 )
 
 // Task states
@@ -94,6 +99,8 @@ var retryableErrors = map[ErrorCode]bool{
 	SSHTimeout:        true,
 	DeployFailed:      true,
 	DNSRateLimit:      true,
+	DNSProviderFailed: true,
+	ServerLocked:      true,
 }
 
 // IsRetryable checks if an error code is retryable
@@ -190,6 +197,7 @@ type StartRunCommand struct {
 	Concurrency int    `json:"concurrency"`
 	DNSDryRun   bool   `json:"dns_dry_run,omitempty"`
 	DryRun      bool   `json:"dry_run,omitempty"`
+	DNSOnly     bool   `json:"dns_only,omitempty"`
 }
 
 type CancelRunCommand struct {
@@ -0,0 +1,313 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailops/internal/acme"
+	"mailops/internal/deploy/profiles"
+	"mailops/internal/dns"
+	"mailops/internal/dns/verify"
+	"mailops/internal/mtasts"
+	"mailops/internal/protocol"
+	"mailops/internal/ssh"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CertificateInfo is the certificate of the mail host recorded in a report
+type CertificateInfo struct {
+	Domains   []string `json:"domains"`
+	Issuer    string   `json:"issuer"`
+	NotBefore string   `json:"not_before"`
+	NotAfter  string   `json:"not_after"`
+	Issued    bool     `json:"issued"` // Issued by this run rather than taken from the archive
+}
+
+// validateACME checks the certificate settings for a task
+func (s *Scheduler) validateACME(task *Task) error {
+	if !s.appConfig.ACME {
+		return nil
+	}
+	opts := s.appConfig.ACMEOptions
+	if err := opts.Check(); err != nil {
+		return err
+	}
+	if opts.ChallengeType() == acme.ChallengeDNS01 {
+		provider, err := s.newDNSProvider(task)
+		if err != nil {
+			return err
+		}
+		if _, ok := provider.(dns.HandOffProvider); ok {
+			return fmt.Errorf("the %s challenge needs a DNS provider that publishes records, %s hands them off", acme.ChallengeDNS01, provider.Name())
+		}
+	}
+	return nil
+}
+
+// certificateDomains returns the names the certificate of a task covers:
+// the mail host, and the MTA-STS policy host that is served with the same
+// certificate
+func (s *Scheduler) certificateDomains(task *Task) []string {
+	domains := []string{task.Server.MailHostname()}
+	if s.appConfig.MTASTS {
+		domains = append(domains, mtasts.PolicyHost(task.Server.Domain))
+	}
+	return domains
+}
+
+// stepIssueCertificate installs the certificate of the mail host, obtained
+// from the ACME CA unless the archived one is still good
+func (s *Scheduler) stepIssueCertificate(task *Task) *TaskError {
+	// The CA resolves the names in live DNS
+	if task.Report.DNSStatus != "applied" {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Skipping certificate issuance, DNS records were not applied (%s). Run cert-renew once they are published.", task.Report.DNSStatus))
+		return nil
+	}
+
+	profile, err := s.newProfile(task)
+	if err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
+
+	client, err := s.sshClient(task)
+	if err != nil {
+		return sshError("Failed to create SSH client", err)
+	}
+
+	cert, issued, err := s.certificate(task, profile, client, false)
+	if err != nil {
+		return &TaskError{Code: protocol.CertIssueFailed, Message: fmt.Sprintf("Failed to obtain certificate: %v", err)}
+	}
+	if err := profile.InstallCertificate(client, cert.Chain, cert.Key); err != nil {
+		return profileError("Certificate installation failed", err)
+	}
+
+	task.Report.Certificate = &CertificateInfo{
+		Domains:   cert.Domains,
+		Issuer:    cert.Issuer,
+		NotBefore: cert.NotBefore.Format(time.RFC3339),
+		NotAfter:  cert.NotAfter.Format(time.RFC3339),
+		Issued:    issued,
+	}
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Certificate for %s from %s installed, valid until %s", strings.Join(cert.Domains, ", "), cert.Issuer, cert.NotAfter.Format(time.RFC3339)))
+	return nil
+}
+
+// RenewCertificates renews the certificate of every server that expires
+// within the renewal window, or of all servers when force is set, and
+// installs it. It is meant to run periodically.
+func (s *Scheduler) RenewCertificates(servers []ServerConfig, force bool) error {
+	var errs []error
+	for _, server := range servers {
+		task := &Task{RowID: server.RowID, Server: server, Ctx: context.Background()}
+		if err := s.renewCertificate(task, force); err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("Certificate renewal of %s failed: %v", server.MailHostname(), err))
+			errs = append(errs, fmt.Errorf("row %d: %w", server.RowID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Scheduler) renewCertificate(task *Task, force bool) error {
+	if !force {
+		cert, err := s.archivedCertificate(task)
+		if err != nil {
+			return err
+		}
+		if cert != nil {
+			due := cert.NotAfter.Add(-s.appConfig.ACMEOptions.RenewWindow())
+			s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Certificate of %s is valid until %s, renewal is due at %s", task.Server.MailHostname(), cert.NotAfter.Format(time.RFC3339), due.Format(time.RFC3339)))
+			return nil
+		}
+	}
+
+	profile, err := s.newProfile(task)
+	if err != nil {
+		return err
+	}
+	_, err = s.withSSH(task, func(client *ssh.Client) (string, error) {
+		cert, _, err := s.certificate(task, profile, client, true)
+		if err != nil {
+			return "", err
+		}
+		if err := profile.InstallCertificate(client, cert.Chain, cert.Key); err != nil {
+			return "", fmt.Errorf("failed to install certificate: %w", err)
+		}
+		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Renewed certificate of %s, valid until %s", task.Server.MailHostname(), cert.NotAfter.Format(time.RFC3339)))
+		return "", nil
+	})
+	return err
+}
+
+// certificate returns the archived certificate of a task's mail host, or
+// obtains and archives a new one when the archived one is missing, misses
+// a name, is due for renewal or force is set. issued reports a new one.
+func (s *Scheduler) certificate(task *Task, profile profiles.Profile, client *ssh.Client, force bool) (cert *acme.Certificate, issued bool, err error) {
+	if !force {
+		if cert, err = s.archivedCertificate(task); err != nil || cert != nil {
+			return cert, false, err
+		}
+	}
+
+	opts := s.appConfig.ACMEOptions
+	domains := s.certificateDomains(task)
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Requesting a certificate for %s from %s with the %s challenge...", strings.Join(domains, ", "), opts.Directory(), opts.ChallengeType()))
+
+	accountKey, err := acme.AccountKey(acmeAccountKeyPath(opts.Directory()))
+	if err != nil {
+		return nil, false, err
+	}
+	var solver acme.Solver = &httpChallengeSolver{s: s, task: task, profile: profile, client: client, stops: make(map[string]func() error)}
+	if opts.ChallengeType() == acme.ChallengeDNS01 {
+		provider, err := s.newDNSProvider(task)
+		if err != nil {
+			return nil, false, err
+		}
+		solver = &dnsChallengeSolver{s: s, task: task, provider: provider}
+	}
+
+	cert, err = acme.Obtain(task.Ctx, opts, accountKey, domains, solver)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := writeCertificate(domains[0], cert); err != nil {
+		return nil, false, err
+	}
+	return cert, true, nil
+}
+
+// archivedCertificate returns the archived certificate of a task's mail
+// host, or nil when there is none or it is due for renewal
+func (s *Scheduler) archivedCertificate(task *Task) (*acme.Certificate, error) {
+	domains := s.certificateDomains(task)
+	dir := certificateDir(domains[0])
+
+	chain, err := os.ReadFile(filepath.Join(dir, "fullchain.pem"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archived certificate: %w", err)
+	}
+	key, err := os.ReadFile(filepath.Join(dir, "privkey.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archived certificate key: %w", err)
+	}
+	cert, err := acme.Parse(chain, key)
+	if err != nil {
+		return nil, fmt.Errorf("archived certificate %s: %w", dir, err)
+	}
+
+	if cert.NeedsRenewal(domains, s.appConfig.ACMEOptions.RenewWindow(), time.Now()) {
+		return nil, nil
+	}
+	return cert, nil
+}
+
+// writeCertificate archives a certificate under output/certs/<host>, the
+// key readable by the owner only
+func writeCertificate(host string, cert *acme.Certificate) error {
+	dir := certificateDir(host)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "privkey.pem"), cert.Key, 0600); err != nil {
+		return fmt.Errorf("failed to archive certificate key: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fullchain.pem"), cert.Chain, 0644); err != nil {
+		return fmt.Errorf("failed to archive certificate: %w", err)
+	}
+	return nil
+}
+
+func certificateDir(host string) string {
+	return filepath.Join("output/certs", strings.ToLower(strings.TrimSuffix(host, ".")))
+}
+
+// acmeAccountKeyPath returns where the account key for a CA is kept. Each
+// directory gets its own account, so test and production CAs do not mix.
+func acmeAccountKeyPath(directory string) string {
+	name := directory
+	if u, err := url.Parse(directory); err == nil && u.Host != "" {
+		name = u.Host
+	}
+	return filepath.Join("output/acme", strings.ReplaceAll(name, ":", "_"), "account.key")
+}
+
+// httpChallengeSolver serves HTTP-01 challenges from the deployed server
+type httpChallengeSolver struct {
+	s       *Scheduler
+	task    *Task
+	profile profiles.Profile
+	client  *ssh.Client
+	stops   map[string]func() error
+}
+
+func (h *httpChallengeSolver) Present(ctx context.Context, ch acme.Challenge) error {
+	h.s.logger.Log(h.s.runID, h.task.RowID, protocol.Info, fmt.Sprintf("Serving the %s challenge for %s...", ch.Type, ch.Domain))
+	stop, err := h.profile.ServeHTTPChallenge(h.client, ch.Token, ch.KeyAuth)
+	if err != nil {
+		return err
+	}
+	h.stops[ch.Token] = stop
+	return nil
+}
+
+func (h *httpChallengeSolver) CleanUp(ctx context.Context, ch acme.Challenge) error {
+	stop, ok := h.stops[ch.Token]
+	if !ok {
+		return nil
+	}
+	delete(h.stops, ch.Token)
+	return stop()
+}
+
+// dnsChallengeSolver publishes DNS-01 challenges through the row's DNS
+// provider and waits until the authoritative nameservers serve them
+type dnsChallengeSolver struct {
+	s        *Scheduler
+	task     *Task
+	provider dns.Provider
+}
+
+func (d *dnsChallengeSolver) Present(ctx context.Context, ch acme.Challenge) error {
+	zone, err := d.provider.FindZone(ch.Record)
+	if err != nil {
+		return fmt.Errorf("failed to find zone for %s: %w", ch.Record, err)
+	}
+	if err := d.provider.CreateRecord(dns.Record{Type: "TXT", Name: ch.Record, Content: ch.Value}); err != nil {
+		return fmt.Errorf("failed to create TXT %s: %w", ch.Record, err)
+	}
+
+	d.s.logger.Log(d.s.runID, d.task.RowID, protocol.Info, fmt.Sprintf("Published TXT %s, waiting for the nameservers of %s...", ch.Record, zone))
+	results, err := verify.New(d.s.appConfig.DNSVerify).Verify(ctx, zone, []verify.Expectation{{Type: "TXT", Name: ch.Record, Content: ch.Value}})
+	if err != nil {
+		return fmt.Errorf("failed to verify TXT %s: %w", ch.Record, err)
+	}
+	for _, result := range results {
+		if !result.Verified {
+			return fmt.Errorf("TXT %s is not visible on all nameservers after %d attempts", ch.Record, result.Attempts)
+		}
+	}
+	return nil
+}
+
+func (d *dnsChallengeSolver) CleanUp(ctx context.Context, ch acme.Challenge) error {
+	records, err := d.provider.ListRecords("TXT", ch.Record)
+	if err != nil {
+		return fmt.Errorf("failed to look up TXT %s: %w", ch.Record, err)
+	}
+	for _, record := range records {
+		if strings.Trim(record.Content, `"`) != ch.Value {
+			continue
+		}
+		if err := d.provider.DeleteRecord(record); err != nil {
+			return fmt.Errorf("failed to delete TXT %s: %w", ch.Record, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"mailops/internal/dkim"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dkimKey returns the key of a domain's selector from the local archive,
+// generating and archiving it on first use. Keys are generated here rather
+// than on the server, so every step and retry installs the same key and the
+// key material survives a rebuilt server.
+func (s *Scheduler) dkimKey(task *Task, selector string) (*dkim.Key, error) {
+	path := dkimKeyPath(task.Server.Domain, selector)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := dkim.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("archived DKIM key %s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read archived DKIM key: %w", err)
+	}
+
+	key, err := dkim.GenerateKey(s.appConfig.DKIMKeyType, s.appConfig.DKIMKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	err = writeDKIMKey(task.Server.Domain, selector, key)
+	if errors.Is(err, os.ErrExist) {
+		return s.dkimKey(task, selector) // Archived by a concurrent task
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// dkimRecord returns the TXT content publishing the archived key of a
+// selector, or an empty string when the key is not archived
+func dkimRecord(domain, selector string) string {
+	data, err := os.ReadFile(dkimKeyPath(domain, selector))
+	if err != nil {
+		return ""
+	}
+	key, err := dkim.ParsePrivateKey(data)
+	if err != nil {
+		return ""
+	}
+	record, err := key.Record()
+	if err != nil {
+		return ""
+	}
+	return record.String()
+}
+
+// writeDKIMKey archives a key pair under output/dkim/<domain>, readable by
+// the owner only
+func writeDKIMKey(domain, selector string, key *dkim.Key) error {
+	path := dkimKeyPath(domain, selector)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	private, err := key.PrivateKeyPEM()
+	if err != nil {
+		return err
+	}
+	record, err := key.Record()
+	if err != nil {
+		return err
+	}
+
+	// O_EXCL keeps the key of a concurrent task for the same domain
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to archive DKIM key: %w", err)
+	}
+	if _, err := file.Write(private); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to archive DKIM key: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	publicPath := strings.TrimSuffix(path, ".private") + ".txt"
+	return os.WriteFile(publicPath, []byte(dkim.KeyFile(selector, domain, record)), 0644)
+}
+
+func dkimKeyPath(domain, selector string) string {
+	return filepath.Join("output/dkim", strings.ToLower(strings.TrimSuffix(domain, ".")), selector+".private")
+}
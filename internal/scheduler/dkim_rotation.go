@@ -0,0 +1,283 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailops/internal/dkim"
+	"mailops/internal/dns"
+	"mailops/internal/dns/verify"
+	"mailops/internal/protocol"
+	"mailops/internal/ssh"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dkimSelector returns the selector a task signs with: the active selector
+// of a rotation of its domain, otherwise the configured selector
+func (s *Scheduler) dkimSelector(task *Task) string {
+	if rotation, err := LoadDKIMRotation(task.Server.Domain); err == nil && rotation != nil {
+		return rotation.Active()
+	}
+	if s.appConfig.DKIMSelector != "" {
+		return s.appConfig.DKIMSelector
+	}
+	return dkim.DefaultSelector
+}
+
+// RotateDKIM advances the DKIM selector rotation of every server by at most
+// one phase. It is meant to run periodically: a phase whose wait has not
+// elapsed is left for a later run. A new rotation starts when start is set
+// or the configured rotation interval has passed since the last one.
+func (s *Scheduler) RotateDKIM(servers []ServerConfig, start bool) error {
+	var errs []error
+	for _, server := range servers {
+		task := &Task{RowID: server.RowID, Server: server, Ctx: context.Background()}
+		if err := s.rotateDKIM(task, start); err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("DKIM rotation of %s failed: %v", server.Domain, err))
+			errs = append(errs, fmt.Errorf("row %d: %w", server.RowID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Scheduler) rotateDKIM(task *Task, start bool) error {
+	rotation, err := LoadDKIMRotation(task.Server.Domain)
+	if err != nil {
+		return err
+	}
+
+	if rotation == nil || rotation.Phase == dkim.PhaseRetired {
+		due := start
+		if !due && rotation != nil && s.appConfig.DKIMRotateInterval > 0 {
+			due = !time.Now().Before(rotation.PublishedAt.Add(s.appConfig.DKIMRotateInterval))
+		}
+		if !due {
+			s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("No DKIM rotation due for %s, signing with selector %s", task.Server.Domain, s.dkimSelector(task)))
+			return nil
+		}
+		return s.startDKIMRotation(task)
+	}
+
+	next, due := rotation.Next(s.dkimPublishWait(), s.dkimRetireWait())
+	if time.Now().Before(due) {
+		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("DKIM rotation of %s from %s to %s is %s, %s is due at %s", task.Server.Domain, rotation.OldSelector, rotation.NewSelector, rotation.Phase, next, due.Format(time.RFC3339)))
+		return nil
+	}
+
+	switch next {
+	case dkim.PhaseSwitched:
+		return s.switchDKIMSelector(task, rotation)
+	case dkim.PhaseRetired:
+		return s.retireDKIMSelector(task, rotation)
+	}
+	return nil
+}
+
+// startDKIMRotation generates the key of a new selector and publishes it
+// next to the key mail is currently signed with
+func (s *Scheduler) startDKIMRotation(task *Task) error {
+	oldSelector := s.dkimSelector(task)
+	newSelector := dkim.NewSelector(oldSelector, time.Now())
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Starting DKIM rotation of %s from selector %s to %s...", task.Server.Domain, oldSelector, newSelector))
+
+	profile, err := s.newProfile(task)
+	if err != nil {
+		return err
+	}
+	key, err := s.dkimKey(task, newSelector)
+	if err != nil {
+		return err
+	}
+	record, err := key.Record()
+	if err != nil {
+		return err
+	}
+	content := record.String()
+
+	if _, err := s.withSSH(task, func(client *ssh.Client) (string, error) {
+		return "", profile.InstallDKIMKey(client, newSelector, key)
+	}); err != nil {
+		return err
+	}
+
+	provider, err := s.newDNSProvider(task)
+	if err != nil {
+		return err
+	}
+	name := dkim.RecordName(newSelector, task.Server.Domain)
+	if err := provider.UpsertRecord(dns.Record{Type: "TXT", Name: name, Content: content}); err != nil {
+		return fmt.Errorf("failed to publish TXT %s: %w", name, err)
+	}
+	s.handOffDNS(task, provider)
+
+	rotation := &dkim.Rotation{
+		Domain:      strings.TrimSuffix(task.Server.Domain, "."),
+		OldSelector: oldSelector,
+		NewSelector: newSelector,
+		Phase:       dkim.PhasePublished,
+		Record:      content,
+		PublishedAt: time.Now(),
+	}
+	if err := writeDKIMRotation(rotation); err != nil {
+		return err
+	}
+
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Published DKIM key %s, mail is still signed with %s until the key has propagated", name, oldSelector))
+	return nil
+}
+
+// switchDKIMSelector signs with the new key once it is visible on every
+// authoritative nameserver
+func (s *Scheduler) switchDKIMSelector(task *Task, rotation *dkim.Rotation) error {
+	profile, err := s.newProfile(task)
+	if err != nil {
+		return err
+	}
+	provider, err := s.newDNSProvider(task)
+	if err != nil {
+		return err
+	}
+	zone, err := provider.FindZone(task.Server.Domain)
+	if err != nil {
+		return fmt.Errorf("failed to find zone for %s: %w", task.Server.Domain, err)
+	}
+
+	name := dkim.RecordName(rotation.NewSelector, rotation.Domain)
+	results, err := verify.New(s.appConfig.DNSVerify).Verify(task.Ctx, zone, []verify.Expectation{{Type: "TXT", Name: name, Content: rotation.Record}})
+	if err != nil {
+		return fmt.Errorf("failed to verify TXT %s: %w", name, err)
+	}
+	for _, result := range results {
+		if !result.Verified {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("DKIM key %s is not visible on all nameservers yet, keeping selector %s", name, rotation.OldSelector))
+			return nil
+		}
+	}
+
+	if _, err := s.withSSH(task, func(client *ssh.Client) (string, error) {
+		return "", profile.SwitchDKIMSelector(client, rotation.NewSelector)
+	}); err != nil {
+		return err
+	}
+
+	rotation.Phase = dkim.PhaseSwitched
+	rotation.SwitchedAt = time.Now()
+	if err := writeDKIMRotation(rotation); err != nil {
+		return err
+	}
+
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Mail of %s is now signed with selector %s", rotation.Domain, rotation.NewSelector))
+	return nil
+}
+
+// retireDKIMSelector removes the old key from DNS and the server once mail
+// signed with it has had time to be delivered and verified
+func (s *Scheduler) retireDKIMSelector(task *Task, rotation *dkim.Rotation) error {
+	profile, err := s.newProfile(task)
+	if err != nil {
+		return err
+	}
+	provider, err := s.newDNSProvider(task)
+	if err != nil {
+		return err
+	}
+
+	name := dkim.RecordName(rotation.OldSelector, rotation.Domain)
+	records, err := provider.ListRecords("TXT", name)
+	if err != nil {
+		return fmt.Errorf("failed to look up TXT %s: %w", name, err)
+	}
+	for _, record := range records {
+		if err := provider.DeleteRecord(record); err != nil {
+			return fmt.Errorf("failed to delete TXT %s: %w", name, err)
+		}
+	}
+	if _, ok := provider.(dns.HandOffProvider); ok {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Remove the TXT record %s by hand", name))
+	}
+
+	if _, err := s.withSSH(task, func(client *ssh.Client) (string, error) {
+		return "", profile.RemoveDKIMKey(client, rotation.OldSelector)
+	}); err != nil {
+		return err
+	}
+
+	rotation.Phase = dkim.PhaseRetired
+	rotation.RetiredAt = time.Now()
+	if err := writeDKIMRotation(rotation); err != nil {
+		return err
+	}
+
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Retired DKIM selector %s of %s", rotation.OldSelector, rotation.Domain))
+	return nil
+}
+
+// handOffDNS delivers the records collected by a hand-off provider
+func (s *Scheduler) handOffDNS(task *Task, provider dns.Provider) {
+	handOff, ok := provider.(dns.HandOffProvider)
+	if !ok {
+		return
+	}
+	path, err := handOff.HandOff()
+	if err != nil {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to hand off DNS records: %v", err))
+		return
+	}
+	s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Publish the records in %s by hand", path))
+}
+
+func (s *Scheduler) dkimPublishWait() time.Duration {
+	if s.appConfig.DKIMPublishWait > 0 {
+		return s.appConfig.DKIMPublishWait
+	}
+	return dkim.DefaultPublishWait
+}
+
+func (s *Scheduler) dkimRetireWait() time.Duration {
+	if s.appConfig.DKIMRetireWait > 0 {
+		return s.appConfig.DKIMRetireWait
+	}
+	return dkim.DefaultRetireWait
+}
+
+// LoadDKIMRotation loads the rotation state of a domain, or nil when the
+// domain has never been rotated
+func LoadDKIMRotation(domain string) (*dkim.Rotation, error) {
+	data, err := os.ReadFile(dkimRotationPath(domain))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM rotation: %w", err)
+	}
+
+	var rotation dkim.Rotation
+	if err := json.Unmarshal(data, &rotation); err != nil {
+		return nil, fmt.Errorf("failed to parse DKIM rotation of %s: %w", domain, err)
+	}
+	if err := rotation.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid DKIM rotation of %s: %w", domain, err)
+	}
+	return &rotation, nil
+}
+
+// writeDKIMRotation persists the rotation state of a domain
+func writeDKIMRotation(rotation *dkim.Rotation) error {
+	if err := os.MkdirAll(filepath.Dir(dkimRotationPath(rotation.Domain)), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(rotation, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal DKIM rotation: %w", err)
+	}
+	return os.WriteFile(dkimRotationPath(rotation.Domain), data, 0644)
+}
+
+func dkimRotationPath(domain string) string {
+	return filepath.Join("output/dkim", strings.ToLower(strings.TrimSuffix(domain, "."))+".rotation.json")
+}
@@ -0,0 +1,192 @@
+package scheduler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mailops/internal/dmarc"
+	"mailops/internal/protocol"
+	"mailops/internal/ssh"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dmarcRecord renders the DMARC record of a task
+func (s *Scheduler) dmarcRecord(task *Task) string {
+	record := renderTemplate(s.appConfig.DMARCTemplate, templateVariables(task))
+	if record == "" {
+		record = fmt.Sprintf("v=DMARC1; p=none; rua=mailto:dmarc@%s", task.Server.Domain)
+	}
+	return record
+}
+
+// dmarcMailbox returns the local part of the rua address of a task's DMARC
+// record that is delivered to the task's own server, or an empty string
+// when aggregate reports go elsewhere
+func (s *Scheduler) dmarcMailbox(task *Task) string {
+	domain := strings.TrimSuffix(task.Server.Domain, ".")
+	for _, tag := range strings.Split(s.dmarcRecord(task), ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(tag), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "rua") {
+			continue
+		}
+		for _, uri := range strings.Split(value, ",") {
+			uri = strings.TrimSpace(uri)
+			if len(uri) < len("mailto:") || !strings.EqualFold(uri[:len("mailto:")], "mailto:") {
+				continue
+			}
+			address, _, _ := strings.Cut(uri[len("mailto:"):], "!") // Drop the size limit
+			local, host, ok := strings.Cut(address, "@")
+			if ok && local != "" && strings.EqualFold(host, domain) {
+				return local
+			}
+		}
+	}
+	return ""
+}
+
+// FetchDMARCReports downloads the Maildir of each server's DMARC report
+// mailbox and returns the aggregate reports in it. mailbox overrides the
+// mailbox taken from the rua address of the DMARC record. Messages that
+// hold no report are skipped with a warning.
+func (s *Scheduler) FetchDMARCReports(servers []ServerConfig, mailbox string) ([]*dmarc.Report, error) {
+	var reports []*dmarc.Report
+	var errs []error
+	for _, server := range servers {
+		task := &Task{RowID: server.RowID, Server: server}
+		found, err := s.fetchDMARCReports(task, mailbox)
+		if err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("Failed to fetch DMARC reports of %s: %v", server.Domain, err))
+			errs = append(errs, fmt.Errorf("row %d: %w", server.RowID, err))
+			continue
+		}
+		reports = append(reports, found...)
+	}
+	return reports, errors.Join(errs...)
+}
+
+func (s *Scheduler) fetchDMARCReports(task *Task, mailbox string) ([]*dmarc.Report, error) {
+	user := mailbox
+	if user == "" {
+		user = s.dmarcMailbox(task)
+	}
+	if user == "" {
+		return nil, fmt.Errorf("the DMARC rua address is not a mailbox of %s, set the mailbox explicitly", task.Server.Domain)
+	}
+
+	profile, err := s.newProfile(task)
+	if err != nil {
+		return nil, err
+	}
+	dir := profile.MaildirPath(user)
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Fetching DMARC reports from %s...", dir))
+	archive, err := s.withSSH(task, func(client *ssh.Client) (string, error) {
+		cmd := fmt.Sprintf("if [ -d %s ]; then tar czf - -C %s cur new; fi", dir, dir)
+		return client.ExecuteCommandWithOutput(cmd, time.Duration(s.appConfig.CmdTimeoutMs)*time.Millisecond)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if archive == "" {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Mailbox %s does not exist yet", dir))
+		return nil, nil
+	}
+
+	zr, err := gzip.NewReader(strings.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Maildir archive: %w", err)
+	}
+	defer zr.Close()
+
+	var reports []*dmarc.Report
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid Maildir archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Maildir archive: %w", err)
+		}
+		found, err := dmarc.ReadFile(data)
+		if err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Skipping %s: %v", header.Name, err))
+			continue
+		}
+		reports = append(reports, found...)
+	}
+
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Found %d DMARC reports in %s", len(reports), dir))
+	return reports, nil
+}
+
+// LoadDeployedServers returns the servers of successful runs from the
+// reports in output/reports, the latest run of each domain and address
+func LoadDeployedServers() ([]dmarc.Server, error) {
+	paths, err := filepath.Glob(filepath.Join("output/reports", "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	type deployment struct {
+		server dmarc.Server
+		end    string
+	}
+	latest := make(map[string]deployment)
+	for _, path := range paths {
+		// Task reports are named by row ID, plans and snapshots share the directory
+		if _, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".json")); err != nil {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read report: %w", err)
+		}
+		var report TaskReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, fmt.Errorf("failed to parse report %s: %w", path, err)
+		}
+		if report.Status != "SUCCESS" || report.Domain == "" || report.ServerIP == "" {
+			continue
+		}
+
+		domain := strings.ToLower(strings.TrimSuffix(report.Domain, "."))
+		key := domain + "|" + report.ServerIP
+		// RFC 3339 times in one zone order as strings
+		if current, ok := latest[key]; ok && current.end >= report.EndTime {
+			continue
+		}
+		latest[key] = deployment{
+			server: dmarc.Server{Domain: domain, IP: report.ServerIP, RunID: filepath.Base(filepath.Dir(path)), RowID: report.RowID},
+			end:    report.EndTime,
+		}
+	}
+
+	servers := make([]dmarc.Server, 0, len(latest))
+	for _, d := range latest {
+		servers = append(servers, d.server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Domain != servers[j].Domain {
+			return servers[i].Domain < servers[j].Domain
+		}
+		return servers[i].IP < servers[j].IP
+	})
+	return servers, nil
+}
@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"fmt"
+	"mailops/internal/dns"
+	"strings"
+)
+
+// Optional record sets published in addition to the mail records
+const (
+	ExtraCAA        = "caa"        // CAA restricting certificate issuance to our ACME CA
+	ExtraBIMI       = "bimi"       // BIMI default._bimi record
+	ExtraAutoconfig = "autoconfig" // Submission/IMAPS SRV records and autoconfig/autodiscover names
+)
+
+// ParseDNSExtras parses a comma separated list of extras. "none" returns an
+// empty list, which disables the extras a profile or default would enable.
+func ParseDNSExtras(s string) ([]string, error) {
+	extras := make([]string, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "", "none":
+		case ExtraCAA, ExtraBIMI, ExtraAutoconfig:
+			extras = append(extras, name)
+		default:
+			return nil, fmt.Errorf("unknown DNS extra %q (available: %s, %s, %s)", name, ExtraCAA, ExtraBIMI, ExtraAutoconfig)
+		}
+	}
+	return extras, nil
+}
+
+// dnsExtras returns the extras enabled for a task: the row's own list when
+// it has one, otherwise its deploy profile's, otherwise the default
+func (s *Scheduler) dnsExtras(task *Task) []string {
+	if task.Server.DNSExtras != nil {
+		return task.Server.DNSExtras
+	}
+	if extras, ok := s.appConfig.DNSExtrasByProfile[task.Server.DeployProfile]; ok {
+		return extras
+	}
+	return s.appConfig.DNSExtras
+}
+
+// validateDNSExtras checks the extras of a task can be rendered
+func (s *Scheduler) validateDNSExtras(task *Task) error {
+	for _, extra := range s.dnsExtras(task) {
+		switch extra {
+		case ExtraCAA:
+			record, err := s.caaRecord(task)
+			if err != nil {
+				return err
+			}
+			if _, _, _, err := dns.ParseCAA(record); err != nil {
+				return fmt.Errorf("invalid caa_template: %w", err)
+			}
+		case ExtraBIMI:
+			if s.appConfig.BIMITemplate == "" {
+				return fmt.Errorf("the bimi DNS extra needs a bimi_template with the logo URL")
+			}
+		case ExtraAutoconfig:
+		default:
+			return fmt.Errorf("unknown DNS extra %q", extra)
+		}
+	}
+	return nil
+}
+
+// extraDNSRecords builds the records of the extras enabled for a task.
+// Failing to publish them only warns.
+func (s *Scheduler) extraDNSRecords(task *Task) []PlannedRecord {
+	domain := strings.TrimSuffix(task.Server.Domain, ".")
+	hostname := task.Server.MailHostname()
+
+	var records []PlannedRecord
+	for _, extra := range s.dnsExtras(task) {
+		switch extra {
+		case ExtraCAA:
+			if record, err := s.caaRecord(task); err == nil {
+				records = append(records, PlannedRecord{Type: "CAA", Name: domain, Content: record})
+			}
+		case ExtraBIMI:
+			records = append(records, PlannedRecord{
+				Type:    "TXT",
+				Name:    "default._bimi." + domain,
+				Content: renderTemplate(s.appConfig.BIMITemplate, templateVariables(task)),
+			})
+		case ExtraAutoconfig:
+			// RFC 6186 service records, and the names Thunderbird and
+			// Outlook probe for their configuration
+			records = append(records,
+				PlannedRecord{Type: "SRV", Name: "_submission._tcp." + domain, Content: dns.FormatSRV(1, 587, hostname)},
+				PlannedRecord{Type: "SRV", Name: "_imaps._tcp." + domain, Content: dns.FormatSRV(1, 993, hostname)},
+				PlannedRecord{Type: "CNAME", Name: "autoconfig." + domain, Content: hostname},
+				PlannedRecord{Type: "CNAME", Name: "autodiscover." + domain, Content: hostname},
+			)
+		}
+	}
+
+	for i := range records {
+		records[i].Optional = true
+	}
+	return records
+}
+
+// caaRecord renders the CAA record of a task. Without a caa_template it
+// allows the configured ACME CA, which has to be one whose issuer domain is
+// known.
+func (s *Scheduler) caaRecord(task *Task) (string, error) {
+	template := s.appConfig.CAATemplate
+	if template == "" {
+		issuer := s.appConfig.ACMEOptions.CAAIssuer()
+		if issuer == "" {
+			return "", fmt.Errorf("the caa DNS extra needs a caa_template naming the CA of %s", s.appConfig.ACMEOptions.Directory())
+		}
+		template = fmt.Sprintf(`0 issue "%s"`, issuer)
+	}
+	return renderTemplate(template, templateVariables(task)), nil
+}
+
+// templateVariables returns the values available to record templates
+func templateVariables(task *Task) map[string]string {
+	return map[string]string{
+		"server_ip": task.Server.ServerIP,
+		"domain":    task.Server.Domain,
+		"host":      task.Server.Host,
+	}
+}
@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"mailops/internal/acme"
+	"testing"
+)
+
+func TestCAARecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		directory string
+		template  string
+		want      string // Empty when validation fails
+	}{
+		{name: "default CA", want: `0 issue "letsencrypt.org"`},
+		{name: "staging", directory: "https://acme-staging-v02.api.letsencrypt.org/directory", want: `0 issue "letsencrypt.org"`},
+		{name: "zerossl", directory: "https://acme.zerossl.com/v2/DV90", want: `0 issue "sectigo.com"`},
+		{name: "unknown CA", directory: "https://ca.internal.example/acme/directory"},
+		{name: "unknown CA with template", directory: "https://ca.internal.example/acme/directory", template: `0 issue "ca.{domain}"`, want: `0 issue "ca.example.com"`},
+		{name: "invalid template", template: `0 issue`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Scheduler{appConfig: &Config{
+				DNSExtras:   []string{ExtraCAA},
+				CAATemplate: tt.template,
+				ACMEOptions: acme.Options{DirectoryURL: tt.directory},
+			}}
+			task := &Task{Server: ServerConfig{Host: "mail", Domain: "example.com"}}
+
+			err := s.validateDNSExtras(task)
+			if (err == nil) != (tt.want != "") {
+				t.Fatalf("validateDNSExtras = %v, want valid %v", err, tt.want != "")
+			}
+			records := s.extraDNSRecords(task)
+			if tt.want == "" {
+				return
+			}
+			if len(records) != 1 || records[0].Type != "CAA" || records[0].Name != "example.com" || records[0].Content != tt.want {
+				t.Errorf("records = %+v, want CAA %s", records, tt.want)
+			}
+		})
+	}
+}
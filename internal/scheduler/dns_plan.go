@@ -0,0 +1,411 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailops/internal/dns"
+	"mailops/internal/protocol"
+	"mailops/internal/spf"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNS plan actions
+const (
+	PlanCreate = "create"
+	PlanUpdate = "update"
+	PlanDelete = "delete"
+	PlanNoop   = "noop"
+	PlanSkip   = "skip" // Left unpublished, Note says why
+)
+
+// DNSPlan is the set of DNS changes computed for one task against the
+// current zone. It is persisted with the run so it can be reviewed and
+// confirmed before it is applied.
+type DNSPlan struct {
+	RunID     string          `json:"run_id"`
+	RowID     int             `json:"row_id"`
+	Provider  string          `json:"provider"`
+	Zone      string          `json:"zone"`
+	Domain    string          `json:"domain"`
+	CreatedAt string          `json:"created_at"`
+	Records   []PlannedRecord `json:"records"`
+}
+
+// PlannedRecord is a single record change within a DNS plan
+type PlannedRecord struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Content  string `json:"content"`
+	Priority int    `json:"priority,omitempty"`
+	Action   string `json:"action"`
+	RecordID string `json:"record_id,omitempty"`
+	Current  string `json:"current,omitempty"`
+	Optional bool   `json:"optional,omitempty"` // Failure to apply only warns
+	Note     string `json:"note,omitempty"`
+}
+
+// desiredDNSRecords builds the record set a task should publish
+func (s *Scheduler) desiredDNSRecords(task *Task, dkimSelector, dkimPublicKey string) []PlannedRecord {
+	// Every name is fully qualified, so records land in the same place
+	// whatever zone the provider resolves them to
+	domain := strings.TrimSuffix(task.Server.Domain, ".")
+	hostname := task.Server.MailHostname()
+
+	records := []PlannedRecord{
+		{Type: "A", Name: hostname, Content: task.Server.ServerIP},
+		{Type: "MX", Name: domain, Content: hostname, Priority: 10},
+		{Type: "TXT", Name: domain, Content: s.spfRecord(task), Optional: true},
+		{Type: "TXT", Name: "_dmarc." + domain, Content: s.dmarcRecord(task), Optional: true},
+	}
+
+	if dkimPublicKey != "" {
+		records = append(records, PlannedRecord{
+			Type:     "TXT",
+			Name:     fmt.Sprintf("%s._domainkey.%s", dkimSelector, domain),
+			Content:  dkimPublicKey,
+			Optional: true,
+		})
+	}
+
+	// The policy settings were checked by validate_input
+	if policy, err := s.mtaSTSPolicy(task); err == nil && policy != nil {
+		records = append(records, s.mtaSTSRecords(task, policy)...)
+	}
+
+	records = append(records, s.extraDNSRecords(task)...)
+
+	return records
+}
+
+// planDNS compares the desired records with the current zone and decides
+// what has to change for each of them
+func (s *Scheduler) planDNS(provider dns.Provider, task *Task, desired []PlannedRecord) (*DNSPlan, error) {
+	zone, err := provider.FindZone(task.Server.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find zone for %s: %w", task.Server.Domain, err)
+	}
+
+	plan := &DNSPlan{
+		RunID:     s.runID,
+		RowID:     task.RowID,
+		Provider:  provider.Name(),
+		Zone:      zone,
+		Domain:    task.Server.Domain,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Records:   make([]PlannedRecord, 0, len(desired)),
+	}
+
+	for _, record := range desired {
+		// An A record cannot coexist with a CNAME of the same name
+		if record.Type == "A" {
+			cname, err := provider.FindRecord("CNAME", record.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up CNAME %s: %w", record.Name, err)
+			}
+			if cname != nil {
+				plan.Records = append(plan.Records, PlannedRecord{
+					Type:     "CNAME",
+					Name:     record.Name,
+					Action:   PlanDelete,
+					RecordID: cname.ID,
+					Current:  cname.Content,
+				})
+			}
+		}
+
+		// TXT names hold unrelated records next to ours; SPF is merged with
+		// the published record, others replace the record of their kind
+		if record.Type == "TXT" && spf.IsSPF(record.Content) {
+			record, err = s.planSPF(provider, task, record)
+			if err != nil {
+				return nil, err
+			}
+			plan.Records = append(plan.Records, record)
+			continue
+		}
+
+		var existing *dns.Record
+		if record.Type == "TXT" {
+			existing, err = findTXT(provider, record)
+		} else {
+			existing, err = provider.FindRecord(record.Type, record.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up %s %s: %w", record.Type, record.Name, err)
+		}
+
+		switch {
+		case existing == nil:
+			record.Action = PlanCreate
+		case recordMatches(record, existing):
+			record.Action = PlanNoop
+			record.RecordID = existing.ID
+			record.Current = existing.Content
+		default:
+			record.Action = PlanUpdate
+			record.RecordID = existing.ID
+			record.Current = existing.Content
+		}
+
+		plan.Records = append(plan.Records, record)
+	}
+
+	return plan, nil
+}
+
+// applyDNSPlan applies every change of a plan and records it in the report.
+// With a snapshot, the value each change replaces is looked up first and the
+// snapshot is persisted after every change, so it can be rolled back.
+func (s *Scheduler) applyDNSPlan(provider dns.Provider, task *Task, plan *DNSPlan, snapshot *DNSSnapshot) *TaskError {
+	for _, record := range plan.Records {
+		if record.Action == PlanNoop {
+			s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("%s record %s is up to date", record.Type, record.Name))
+			task.Report.DNSChanges = append(task.Report.DNSChanges, plannedChange(record))
+			continue
+		}
+		if record.Action == PlanSkip {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Not publishing %s record %s: %s", record.Type, record.Name, record.Note))
+			continue
+		}
+
+		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Applying %s of %s record %s...", record.Action, record.Type, record.Name))
+
+		// The records of the set before the run, taken before its first change
+		var previous []dns.Record
+		if snapshot != nil && snapshot.find(record.Type, record.Name) == nil {
+			var err error
+			previous, err = provider.ListRecords(record.Type, record.Name)
+			if err != nil {
+				return dnsTaskError(fmt.Sprintf("Failed to snapshot %s records %s: %v", record.Type, record.Name, err), err)
+			}
+		}
+
+		var err error
+		switch record.Action {
+		case PlanCreate:
+			err = provider.CreateRecord(dns.Record{
+				Type:     record.Type,
+				Name:     record.Name,
+				Content:  record.Content,
+				Priority: record.Priority,
+			})
+		case PlanUpdate:
+			err = provider.UpsertRecord(dns.Record{
+				ID:       record.RecordID,
+				Type:     record.Type,
+				Name:     record.Name,
+				Content:  record.Content,
+				Priority: record.Priority,
+			})
+		case PlanDelete:
+			err = provider.DeleteRecord(dns.Record{ID: record.RecordID, Type: record.Type, Name: record.Name})
+		default:
+			err = fmt.Errorf("unknown plan action: %s", record.Action)
+		}
+
+		if err != nil {
+			if record.Optional {
+				s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to %s %s record %s: %v", record.Action, record.Type, record.Name, err))
+				continue
+			}
+			return dnsTaskError(fmt.Sprintf("Failed to %s %s record %s: %v", record.Action, record.Type, record.Name, err), err)
+		}
+
+		if snapshot != nil {
+			s.snapshotChange(provider, task, snapshot, record, previous)
+		}
+
+		task.Report.DNSChanges = append(task.Report.DNSChanges, plannedChange(record))
+	}
+
+	return nil
+}
+
+// snapshotChange adds an applied change to the snapshot and persists it.
+// previous is the set before the run, nil when an earlier change took it.
+func (s *Scheduler) snapshotChange(provider dns.Provider, task *Task, snapshot *DNSSnapshot, record PlannedRecord, previous []dns.Record) {
+	before := previous
+	if existing := snapshot.find(record.Type, record.Name); existing != nil {
+		before = existing.Applied
+	}
+
+	// Read the set back, so rollback knows the IDs of the written records
+	applied, err := provider.ListRecords(record.Type, record.Name)
+	if err != nil {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to look up applied %s records %s: %v", record.Type, record.Name, err))
+		applied = appliedRRset(before, record)
+	}
+
+	snapshot.record(SnapshotRecord{
+		Type:     record.Type,
+		Name:     record.Name,
+		Action:   record.Action,
+		Previous: previous,
+		Applied:  applied,
+	})
+	if err := s.writeDNSSnapshot(snapshot); err != nil {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to write DNS snapshot: %v", err))
+	}
+}
+
+// newDNSProvider constructs the DNS provider selected by a task's row
+func (s *Scheduler) newDNSProvider(task *Task) (dns.Provider, error) {
+	options := make(map[string]string)
+	for k, v := range s.appConfig.DNSProviderDefaults[dnsProviderName(task.Server.DNSProvider)] {
+		options[k] = v
+	}
+	for k, v := range task.Server.DNSOptions {
+		options[k] = v
+	}
+
+	return dns.New(task.Server.DNSProvider, dns.Config{
+		Token:   task.Server.DNSToken,
+		Zone:    task.Server.DNSZone,
+		DryRun:  s.dnsDryRun,
+		Options: options,
+		RunID:   s.runID,
+		RowID:   task.RowID,
+		Context: task.Ctx,
+	})
+}
+
+// dnsConfigError converts a provider construction error into a task error
+func dnsConfigError(err error) *TaskError {
+	if errors.Is(err, dns.ErrMissingConfig) {
+		return &TaskError{Code: protocol.MissingRequiredField, Message: err.Error()}
+	}
+	return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+}
+
+// dnsTaskError maps a provider error onto a task error, so throttling and
+// provider outages are retried and honour the provider's Retry-After. Only
+// rejected credentials are reported as an authentication failure; errors the
+// provider did not classify, such as network failures, are retried.
+func dnsTaskError(message string, err error) *TaskError {
+	switch {
+	case errors.Is(err, dns.ErrAuth):
+		return &TaskError{Code: protocol.DNSAuthFailed, Message: message}
+	case dns.IsTemporary(err):
+		return &TaskError{Code: protocol.DNSRateLimit, Message: message, RetryAfter: dns.RetryAfter(err)}
+	case errors.Is(err, dns.ErrNotFound), errors.Is(err, dns.ErrValidation):
+		return &TaskError{Code: protocol.InvalidConfig, Message: message}
+	default:
+		return &TaskError{Code: protocol.DNSProviderFailed, Message: message}
+	}
+}
+
+// dnsProviderName returns the provider name used for a row
+func dnsProviderName(name string) string {
+	if name == "" {
+		return dns.DefaultProvider
+	}
+	return strings.ToLower(name)
+}
+
+// logDNSPlan logs a human readable summary of a plan
+func (s *Scheduler) logDNSPlan(task *Task, plan *DNSPlan) {
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("DNS plan for %s in zone %s (%d records):", plan.Domain, plan.Zone, len(plan.Records)))
+	for _, record := range plan.Records {
+		line := fmt.Sprintf("  [%s] %s %s -> %s", strings.ToUpper(record.Action), record.Type, record.Name, record.Content)
+		if record.Type == "MX" {
+			line += fmt.Sprintf(" (priority %d)", record.Priority)
+		}
+		if record.Action == PlanUpdate {
+			line += fmt.Sprintf(" (was %s)", record.Current)
+		}
+		if record.Note != "" {
+			line += fmt.Sprintf(" (%s)", record.Note)
+		}
+		s.logger.Log(s.runID, task.RowID, protocol.Info, line)
+	}
+}
+
+// writeDNSPlan persists a plan next to the task report
+func (s *Scheduler) writeDNSPlan(plan *DNSPlan) error {
+	reportDir := filepath.Join("output/reports", s.runID)
+	if err := os.MkdirAll(reportDir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal DNS plan: %w", err)
+	}
+
+	return os.WriteFile(dnsPlanPath(s.runID, plan.RowID), data, 0644)
+}
+
+// LoadDNSPlans loads every DNS plan persisted for a run, ordered by row ID
+func LoadDNSPlans(runID string) ([]*DNSPlan, error) {
+	paths, err := filepath.Glob(filepath.Join("output/reports", runID, "*.dns-plan.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	plans := make([]*DNSPlan, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DNS plan: %w", err)
+		}
+
+		var plan DNSPlan
+		if err := json.Unmarshal(data, &plan); err != nil {
+			return nil, fmt.Errorf("failed to parse DNS plan %s: %w", path, err)
+		}
+		plans = append(plans, &plan)
+	}
+
+	sort.Slice(plans, func(i, j int) bool { return plans[i].RowID < plans[j].RowID })
+	return plans, nil
+}
+
+// PlanDigest returns a stable digest of the changes in a set of plans. A
+// confirm token is bound to this digest so any edit to a plan invalidates it.
+func PlanDigest(plans []*DNSPlan) string {
+	h := sha256.New()
+	for _, plan := range plans {
+		fmt.Fprintf(h, "%s|%d|%s|%s\n", plan.RunID, plan.RowID, plan.Provider, plan.Zone)
+		for _, r := range plan.Records {
+			fmt.Fprintf(h, "%s|%s|%s|%d|%s|%s\n", r.Action, r.Type, r.Name, r.Priority, r.RecordID, r.Content)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func dnsPlanPath(runID string, rowID int) string {
+	return filepath.Join("output/reports", runID, fmt.Sprintf("%d.dns-plan.json", rowID))
+}
+
+func plannedChange(record PlannedRecord) DNSChange {
+	return DNSChange{
+		Type:     record.Type,
+		Name:     record.Name,
+		Content:  record.Content,
+		Priority: record.Priority,
+		Action:   record.Action,
+	}
+}
+
+// recordMatches reports whether an existing record already has the desired value
+func recordMatches(record PlannedRecord, existing *dns.Record) bool {
+	if (record.Type == "MX" || record.Type == "SRV") && existing.Priority != record.Priority {
+		return false
+	}
+	normalize := func(v string) string {
+		v = strings.TrimSpace(v)
+		v = strings.Trim(v, `"`)
+		return strings.ToLower(strings.TrimSuffix(v, "."))
+	}
+	if record.Type == "TXT" {
+		return dns.JoinTXT(existing.Content) == dns.JoinTXT(record.Content)
+	}
+	return normalize(existing.Content) == normalize(record.Content)
+}
@@ -0,0 +1,232 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailops/internal/dns"
+	"mailops/internal/protocol"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSTaskError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		code       protocol.ErrorCode
+		retryAfter time.Duration
+	}{
+		{"rejected token", &dns.APIError{Kind: dns.ErrAuth, Status: 403}, protocol.DNSAuthFailed, 0},
+		{"wrapped auth error", fmt.Errorf("zone lookup: %w", dns.ErrAuth), protocol.DNSAuthFailed, 0},
+		{"throttled", &dns.APIError{Kind: dns.ErrRateLimited, Status: 429, RetryAfter: 30 * time.Second}, protocol.DNSRateLimit, 30 * time.Second},
+		{"provider outage", &dns.APIError{Kind: dns.ErrUnavailable, Status: 503}, protocol.DNSRateLimit, 0},
+		{"unknown zone", fmt.Errorf("find zone: %w", dns.ErrNotFound), protocol.InvalidConfig, 0},
+		{"rejected content", &dns.APIError{Kind: dns.ErrValidation, Status: 400}, protocol.InvalidConfig, 0},
+		{"network failure", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, protocol.DNSProviderFailed, 0},
+		{"unclassified", errors.New("unexpected response"), protocol.DNSProviderFailed, 0},
+		{"cancelled", context.Canceled, protocol.DNSProviderFailed, 0},
+	}
+
+	for _, tt := range tests {
+		taskErr := dnsTaskError("message", tt.err)
+		if taskErr.Code != tt.code || taskErr.RetryAfter != tt.retryAfter || taskErr.Message != "message" {
+			t.Errorf("%s: dnsTaskError = %+v, want code %s and Retry-After %v", tt.name, taskErr, tt.code, tt.retryAfter)
+		}
+	}
+}
+
+func TestPlanDNS(t *testing.T) {
+	s := newDNSTestScheduler(t,
+		dns.Record{Type: "A", Name: "mail.example.com", Content: "192.0.2.10"},
+		dns.Record{Type: "MX", Name: "example.com", Content: "old.example.net", Priority: 10},
+		dns.Record{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"},
+		dns.Record{Type: "TXT", Name: "_dmarc.example.com", Content: "v=DMARC1; p=reject"},
+		dns.Record{Type: "TXT", Name: "_dmarc.example.com", Content: "unrelated"},
+		dns.Record{Type: "CNAME", Name: "mx.example.com", Content: "mail.example.net"},
+	)
+	task := fakeTask()
+	task.Ctx = context.Background()
+
+	desired := []PlannedRecord{
+		{Type: "A", Name: "mail.example.com", Content: "192.0.2.10"},
+		{Type: "MX", Name: "example.com", Content: "mail.example.com", Priority: 10},
+		{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all", Optional: true},
+		{Type: "TXT", Name: "_dmarc.example.com", Content: "v=DMARC1; p=none", Optional: true},
+		{Type: "TXT", Name: "default._domainkey.example.com", Content: "v=DKIM1; k=rsa; p=MIGf", Optional: true},
+		{Type: "A", Name: "mx.example.com", Content: "192.0.2.10"},
+	}
+	plan, err := s.planDNS(fakeZone, task, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.RunID != "run-1" || plan.RowID != 1 || plan.Provider != "fake" || plan.Zone != "example.com" || plan.Domain != "example.com" {
+		t.Errorf("plan = %+v", plan)
+	}
+
+	// Action, record and the ID of the record it replaces
+	want := []string{
+		"noop A mail.example.com 1",
+		"update MX example.com 2",
+		"noop TXT example.com 3",
+		"update TXT _dmarc.example.com 4",
+		"create TXT default._domainkey.example.com ",
+		"delete CNAME mx.example.com 6",
+		"create A mx.example.com ",
+	}
+	var got []string
+	for _, record := range plan.Records {
+		got = append(got, fmt.Sprintf("%s %s %s %s", record.Action, record.Type, record.Name, record.RecordID))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("plan records =\n%q\nwant\n%q", got, want)
+	}
+	if update := plan.Records[1]; update.Current != "old.example.net" || update.Content != "mail.example.com" {
+		t.Errorf("MX update = %+v", update)
+	}
+
+	if _, err := s.planDNS(fakeZone, &Task{RowID: 2, Server: ServerConfig{Domain: "example.org"}}, desired); !errors.Is(err, dns.ErrNotFound) {
+		t.Errorf("planDNS outside the zone = %v, want %v", err, dns.ErrNotFound)
+	}
+}
+
+func TestApplyDNSPlan(t *testing.T) {
+	s := newDNSTestScheduler(t,
+		dns.Record{Type: "MX", Name: "example.com", Content: "old.example.net", Priority: 10},
+		dns.Record{Type: "TXT", Name: "_dmarc.example.com", Content: "unrelated"},
+		dns.Record{Type: "CNAME", Name: "mx.example.com", Content: "mail.example.net"},
+	)
+	plan := &DNSPlan{RunID: "run-1", RowID: 1, Provider: "fake", Zone: "example.com", Domain: "example.com", Records: []PlannedRecord{
+		{Type: "MX", Name: "example.com", Content: "mail.example.com", Priority: 10, Action: PlanUpdate, RecordID: "1"},
+		{Type: "TXT", Name: "_dmarc.example.com", Content: "v=DMARC1; p=none", Action: PlanCreate, Optional: true},
+		{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all", Action: PlanSkip, Note: "2 SPF records are published"},
+		{Type: "CNAME", Name: "mx.example.com", Action: PlanDelete, RecordID: "3"},
+		{Type: "A", Name: "mx.example.com", Content: "192.0.2.10", Action: PlanCreate},
+		{Type: "A", Name: "mail.example.com", Content: "192.0.2.10", Action: PlanNoop, RecordID: "9"},
+	}}
+
+	task := fakeTask()
+	if taskErr := s.applyDNSPlan(fakeZone, task, plan, nil); taskErr != nil {
+		t.Fatal(taskErr)
+	}
+	want := []string{
+		"A mx.example.com 0 192.0.2.10",
+		"MX example.com 10 mail.example.com",
+		"TXT _dmarc.example.com 0 unrelated",
+		"TXT _dmarc.example.com 0 v=DMARC1; p=none",
+	}
+	if got := fakeZone.dump(); !reflect.DeepEqual(got, want) {
+		t.Errorf("zone =\n%q\nwant\n%q", got, want)
+	}
+
+	// Skipped records are not reported as changes
+	var changes []string
+	for _, change := range task.Report.DNSChanges {
+		changes = append(changes, change.Action+" "+change.Type+" "+change.Name)
+	}
+	wantChanges := []string{"update MX example.com", "create TXT _dmarc.example.com", "delete CNAME mx.example.com", "create A mx.example.com", "noop A mail.example.com"}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("report changes = %q, want %q", changes, wantChanges)
+	}
+}
+
+func TestApplyDNSPlanErrors(t *testing.T) {
+	plan := &DNSPlan{RunID: "run-1", RowID: 1, Provider: "fake", Zone: "example.com", Records: []PlannedRecord{
+		{Type: "TXT", Name: "_dmarc.example.com", Content: "v=DMARC1; p=none", Action: PlanCreate, Optional: true},
+		{Type: "A", Name: "mail.example.com", Content: "192.0.2.10", Action: PlanCreate},
+		{Type: "MX", Name: "example.com", Content: "mail.example.com", Priority: 10, Action: PlanCreate},
+	}}
+
+	tests := []struct {
+		name string
+		fail map[string]error
+		code protocol.ErrorCode // Empty when the plan applies
+		want []string
+	}{
+		{
+			name: "optional record fails",
+			fail: map[string]error{"TXT _dmarc.example.com": &dns.APIError{Kind: dns.ErrValidation}},
+			want: []string{"A mail.example.com 0 192.0.2.10", "MX example.com 10 mail.example.com"},
+		},
+		{
+			name: "required record rejected",
+			fail: map[string]error{"A mail.example.com": &dns.APIError{Kind: dns.ErrAuth, Status: 403}},
+			code: protocol.DNSAuthFailed,
+			want: []string{"TXT _dmarc.example.com 0 v=DMARC1; p=none"},
+		},
+		{
+			name: "provider unreachable",
+			fail: map[string]error{"MX example.com": errors.New("connection reset")},
+			code: protocol.DNSProviderFailed,
+			want: []string{"A mail.example.com 0 192.0.2.10", "TXT _dmarc.example.com 0 v=DMARC1; p=none"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDNSTestScheduler(t)
+			fakeZone.fail = tt.fail
+
+			taskErr := s.applyDNSPlan(fakeZone, fakeTask(), plan, nil)
+			var code protocol.ErrorCode
+			if taskErr != nil {
+				code = taskErr.Code
+			}
+			if code != tt.code {
+				t.Errorf("applyDNSPlan = %+v, want code %q", taskErr, tt.code)
+			}
+			if got := fakeZone.dump(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("zone = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanDigest(t *testing.T) {
+	newPlans := func() []*DNSPlan {
+		return []*DNSPlan{
+			{RunID: "run-1", RowID: 1, Provider: "fake", Zone: "example.com", CreatedAt: "2026-02-01T12:00:00Z", Records: []PlannedRecord{
+				{Type: "MX", Name: "example.com", Content: "mail.example.com", Priority: 10, Action: PlanUpdate, RecordID: "1", Current: "old.example.net"},
+				{Type: "TXT", Name: "_dmarc.example.com", Content: "v=DMARC1; p=none", Action: PlanCreate},
+			}},
+			{RunID: "run-1", RowID: 2, Provider: "fake", Zone: "example.org", Records: []PlannedRecord{
+				{Type: "A", Name: "mail.example.org", Content: "192.0.2.20", Action: PlanCreate},
+			}},
+		}
+	}
+	digest := PlanDigest(newPlans())
+	if digest != PlanDigest(newPlans()) {
+		t.Fatal("PlanDigest differs for the same plans")
+	}
+
+	tests := []struct {
+		name    string
+		edit    func(plans []*DNSPlan)
+		changed bool
+	}{
+		{"content", func(plans []*DNSPlan) { plans[0].Records[1].Content = "v=DMARC1; p=reject" }, true},
+		{"action", func(plans []*DNSPlan) { plans[0].Records[0].Action = PlanCreate }, true},
+		{"record ID", func(plans []*DNSPlan) { plans[0].Records[0].RecordID = "2" }, true},
+		{"priority", func(plans []*DNSPlan) { plans[0].Records[0].Priority = 20 }, true},
+		{"name", func(plans []*DNSPlan) { plans[1].Records[0].Name = "mx.example.org" }, true},
+		{"zone", func(plans []*DNSPlan) { plans[1].Zone = "mail.example.org" }, true},
+		{"provider", func(plans []*DNSPlan) { plans[1].Provider = "cloudflare" }, true},
+		{"run", func(plans []*DNSPlan) { plans[1].RunID = "run-2" }, true},
+		{"record added", func(plans []*DNSPlan) {
+			plans[1].Records = append(plans[1].Records, PlannedRecord{Type: "TXT", Name: "example.org", Content: "v=spf1 mx -all", Action: PlanCreate})
+		}, true},
+		{"plan removed", func(plans []*DNSPlan) { plans[1].Records = nil }, true},
+		{"creation time", func(plans []*DNSPlan) { plans[0].CreatedAt = "2026-02-01T13:00:00Z" }, false},
+		{"previous value shown for review", func(plans []*DNSPlan) { plans[0].Records[0].Current = "other.example.net" }, false},
+	}
+
+	for _, tt := range tests {
+		plans := newPlans()
+		tt.edit(plans)
+		if changed := PlanDigest(plans) != digest; changed != tt.changed {
+			t.Errorf("%s: digest changed %v, want %v", tt.name, changed, tt.changed)
+		}
+	}
+}
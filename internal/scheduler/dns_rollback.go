@@ -0,0 +1,298 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailops/internal/dns"
+	"mailops/internal/protocol"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DNSSnapshot records the state of every record set a task changed, so the
+// changes can be undone after a failure, a cancellation or on request. It is
+// persisted next to the task report and updated after every change.
+type DNSSnapshot struct {
+	RunID    string           `json:"run_id"`
+	RowID    int              `json:"row_id"`
+	Provider string           `json:"provider"`
+	Zone     string           `json:"zone"`
+	Domain   string           `json:"domain"`
+	Records  []SnapshotRecord `json:"records"`
+}
+
+// SnapshotRecord is one changed record set, all records of a type and name.
+// Previous holds the set before the run's first change to it and Applied the
+// set the run left; either is empty when the set did not exist.
+type SnapshotRecord struct {
+	Type       string       `json:"type"`
+	Name       string       `json:"name"`
+	Action     string       `json:"action"` // First change the run made to the set
+	Previous   []dns.Record `json:"previous,omitempty"`
+	Applied    []dns.Record `json:"applied,omitempty"`
+	RolledBack bool         `json:"rolled_back,omitempty"`
+}
+
+// find returns the entry of a record set, or nil when the run has not
+// changed it
+func (snapshot *DNSSnapshot) find(recordType, name string) *SnapshotRecord {
+	for i := range snapshot.Records {
+		existing := &snapshot.Records[i]
+		if existing.Type == recordType && strings.EqualFold(existing.Name, name) {
+			return existing
+		}
+	}
+	return nil
+}
+
+// record adds a change to the snapshot. A set changed again, by a later
+// record of the plan or by a retry, keeps the records it had before the run,
+// so rollback never restores a value written by the run itself.
+func (snapshot *DNSSnapshot) record(change SnapshotRecord) {
+	if existing := snapshot.find(change.Type, change.Name); existing != nil {
+		existing.Applied = change.Applied
+		existing.RolledBack = false
+		return
+	}
+	snapshot.Records = append(snapshot.Records, change)
+}
+
+// appliedRRset returns a record set as a planned change leaves it
+func appliedRRset(rrset []dns.Record, record PlannedRecord) []dns.Record {
+	applied := make([]dns.Record, 0, len(rrset)+1)
+	for _, existing := range rrset {
+		// Updates and deletes replace their record, or the whole set when
+		// they name none
+		if record.Action != PlanCreate && (record.RecordID == "" || existing.ID == record.RecordID) {
+			continue
+		}
+		applied = append(applied, existing)
+	}
+	if record.Action != PlanDelete {
+		applied = append(applied, dns.Record{Type: record.Type, Name: record.Name, Content: record.Content, Priority: record.Priority})
+	}
+	return applied
+}
+
+// diffRRset compares two record sets by value. It returns the records of
+// current that want lacks and the records of want that current lacks.
+func diffRRset(current, want []dns.Record) (stale, missing []dns.Record) {
+	matched := make([]bool, len(current))
+	for _, record := range want {
+		found := false
+		for i := range current {
+			if !matched[i] && recordMatches(PlannedRecord{Type: record.Type, Content: record.Content, Priority: record.Priority}, &current[i]) {
+				matched[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, record)
+		}
+	}
+	for i, ok := range matched {
+		if !ok {
+			stale = append(stale, current[i])
+		}
+	}
+	return stale, missing
+}
+
+// changed reports whether the snapshot holds any change left to roll back
+func (snapshot *DNSSnapshot) changed() bool {
+	if snapshot == nil {
+		return false
+	}
+	for _, record := range snapshot.Records {
+		if !record.RolledBack {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackDNS restores every record set in a snapshot, newest change first,
+// to the records it held before the run: records the run wrote get their
+// previous value back or are deleted, and records it deleted are recreated.
+// Sets changed by someone else since the run are left alone. The snapshot is
+// persisted after each set, so an interrupted rollback can be run again.
+func (s *Scheduler) rollbackDNS(provider dns.Provider, snapshot *DNSSnapshot) error {
+	var errs []error
+
+	for i := len(snapshot.Records) - 1; i >= 0; i-- {
+		record := &snapshot.Records[i]
+		if record.RolledBack {
+			continue
+		}
+
+		err := rollbackRecord(provider, record)
+		if err != nil {
+			s.logger.Log(s.runID, snapshot.RowID, protocol.Error, fmt.Sprintf("Failed to roll back %s records %s: %v", record.Type, record.Name, err))
+			errs = append(errs, fmt.Errorf("%s %s: %w", record.Type, record.Name, err))
+			continue
+		}
+
+		record.RolledBack = true
+		s.logger.Log(s.runID, snapshot.RowID, protocol.Info, fmt.Sprintf("Rolled back %s of %s records %s", record.Action, record.Type, record.Name))
+
+		if err := s.writeDNSSnapshot(snapshot); err != nil {
+			s.logger.Log(s.runID, snapshot.RowID, protocol.Warn, fmt.Sprintf("Failed to write DNS snapshot: %v", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// rollbackRecord restores a single record set
+func rollbackRecord(provider dns.Provider, record *SnapshotRecord) error {
+	current, err := provider.ListRecords(record.Type, record.Name)
+	if err != nil {
+		return err
+	}
+
+	stale, missing := diffRRset(current, record.Previous)
+	if len(stale) == 0 && len(missing) == 0 {
+		return nil // Already restored
+	}
+	if added, removed := diffRRset(current, record.Applied); len(added) > 0 || len(removed) > 0 {
+		return fmt.Errorf("the records were changed since the run, leaving them unchanged")
+	}
+
+	// Records written by the run take back the values they replaced, and
+	// the rest of them are deleted
+	for i, previous := range missing {
+		previous.ID = ""
+		if i < len(stale) {
+			previous.ID = stale[i].ID
+			err = provider.UpsertRecord(previous)
+		} else {
+			err = provider.CreateRecord(previous)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(missing); i < len(stale); i++ {
+		if err := provider.DeleteRecord(stale[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackTaskDNS undoes the DNS changes of a task after it failed or was
+// cancelled, and records the outcome in the report
+func (s *Scheduler) rollbackTaskDNS(task *Task, reason string) {
+	if !task.DNSSnapshot.changed() {
+		return
+	}
+
+	s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Task %s, rolling back DNS changes...", reason))
+
+	provider, err := s.newDNSProvider(task)
+	if err == nil {
+		err = s.rollbackDNS(provider, task.DNSSnapshot)
+	}
+	if err != nil {
+		task.Report.DNSStatus = "rollback_failed"
+		s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("DNS rollback incomplete, run the rollback command for run %s: %v", s.runID, err))
+		return
+	}
+
+	task.Report.DNSStatus = "rolled_back"
+	s.logger.Log(s.runID, task.RowID, protocol.Info, "DNS changes rolled back")
+}
+
+// RollbackRun undoes the DNS changes persisted for a past run. The scheduler
+// must have been created with that run's ID; servers supply the credentials
+// of each row, and only rows present in servers are rolled back.
+func (s *Scheduler) RollbackRun(servers []ServerConfig) error {
+	snapshots, err := LoadDNSSnapshots(s.runID)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("no DNS snapshots found for run %s", s.runID)
+	}
+
+	byRow := make(map[int]ServerConfig, len(servers))
+	for _, server := range servers {
+		byRow[server.RowID] = server
+	}
+
+	var errs []error
+	for _, snapshot := range snapshots {
+		server, ok := byRow[snapshot.RowID]
+		if !ok {
+			continue
+		}
+		if !snapshot.changed() {
+			s.logger.Log(s.runID, snapshot.RowID, protocol.Info, "Nothing to roll back")
+			continue
+		}
+		if name := dnsProviderName(server.DNSProvider); name != snapshot.Provider {
+			errs = append(errs, fmt.Errorf("row %d: changes were made with provider %s, not %s", snapshot.RowID, snapshot.Provider, name))
+			continue
+		}
+
+		provider, err := s.newDNSProvider(&Task{RowID: snapshot.RowID, Server: server})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("row %d: %w", snapshot.RowID, err))
+			continue
+		}
+
+		s.logger.Log(s.runID, snapshot.RowID, protocol.Info, fmt.Sprintf("Rolling back %d DNS changes in zone %s...", len(snapshot.Records), snapshot.Zone))
+		if err := s.rollbackDNS(provider, snapshot); err != nil {
+			errs = append(errs, fmt.Errorf("row %d: %w", snapshot.RowID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// writeDNSSnapshot persists a snapshot next to the task report
+func (s *Scheduler) writeDNSSnapshot(snapshot *DNSSnapshot) error {
+	if err := os.MkdirAll(filepath.Join("output/reports", snapshot.RunID), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal DNS snapshot: %w", err)
+	}
+
+	return os.WriteFile(dnsSnapshotPath(snapshot.RunID, snapshot.RowID), data, 0644)
+}
+
+// LoadDNSSnapshots loads every DNS snapshot persisted for a run, ordered by
+// row ID
+func LoadDNSSnapshots(runID string) ([]*DNSSnapshot, error) {
+	paths, err := filepath.Glob(filepath.Join("output/reports", runID, "*.dns-snapshot.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*DNSSnapshot, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DNS snapshot: %w", err)
+		}
+
+		var snapshot DNSSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to parse DNS snapshot %s: %w", path, err)
+		}
+		snapshots = append(snapshots, &snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].RowID < snapshots[j].RowID })
+	return snapshots, nil
+}
+
+func dnsSnapshotPath(runID string, rowID int) string {
+	return filepath.Join("output/reports", runID, fmt.Sprintf("%d.dns-snapshot.json", rowID))
+}
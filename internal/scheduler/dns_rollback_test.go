@@ -0,0 +1,461 @@
+package scheduler
+
+import (
+	"fmt"
+	"mailops/internal/dns"
+	"mailops/internal/protocol"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func init() {
+	dns.Register("fake", func(cfg dns.Config) (dns.Provider, error) {
+		return fakeZone, nil
+	})
+}
+
+// fakeZone is the zone of the "fake" DNS provider
+var fakeZone = &fakeProvider{}
+
+// fakeProvider keeps the records of example.com in memory
+type fakeProvider struct {
+	mu      sync.Mutex
+	next    int
+	records []dns.Record
+	fail    map[string]error // Write errors by "TYPE name"
+}
+
+// reset replaces the zone with records, numbering their IDs from 1
+func (p *fakeProvider) reset(records ...dns.Record) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next = 0
+	p.records = nil
+	p.fail = nil
+	for _, record := range records {
+		p.next++
+		record.ID = strconv.Itoa(p.next)
+		p.records = append(p.records, record)
+	}
+}
+
+// dump returns the records of the zone, see dumpRecords
+func (p *fakeProvider) dump() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return dumpRecords(p.records)
+}
+
+// dumpRecords returns records as sorted "TYPE name priority content" lines,
+// IDs left out
+func dumpRecords(records []dns.Record) []string {
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		lines = append(lines, fmt.Sprintf("%s %s %d %s", record.Type, record.Name, record.Priority, record.Content))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+
+func (p *fakeProvider) FindZone(name string) (string, error) {
+	if !dns.InZone(name, "example.com") {
+		return "", dns.ErrNotFound
+	}
+	return "example.com", nil
+}
+
+func (p *fakeProvider) FindRecord(recordType, name string) (*dns.Record, error) {
+	records, _ := p.ListRecords(recordType, name)
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return &records[0], nil
+}
+
+func (p *fakeProvider) ListRecords(recordType, name string) ([]dns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var records []dns.Record
+	for _, record := range p.records {
+		if record.Type == recordType && strings.EqualFold(record.Name, name) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (p *fakeProvider) UpsertRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.fail[record.Type+" "+record.Name]; err != nil {
+		return err
+	}
+	for i, existing := range p.records {
+		if (record.ID != "" && existing.ID == record.ID) || (record.ID == "" && existing.Type == record.Type && strings.EqualFold(existing.Name, record.Name)) {
+			record.ID = existing.ID
+			p.records[i] = record
+			return nil
+		}
+	}
+	if record.ID != "" {
+		return dns.ErrNotFound
+	}
+	p.next++
+	record.ID = strconv.Itoa(p.next)
+	p.records = append(p.records, record)
+	return nil
+}
+
+func (p *fakeProvider) CreateRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.fail[record.Type+" "+record.Name]; err != nil {
+		return err
+	}
+	p.next++
+	record.ID = strconv.Itoa(p.next)
+	p.records = append(p.records, record)
+	return nil
+}
+
+func (p *fakeProvider) DeleteRecord(record dns.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, existing := range p.records {
+		if existing.ID == record.ID {
+			p.records = append(p.records[:i], p.records[i+1:]...)
+			return nil
+		}
+	}
+	return dns.ErrNotFound
+}
+
+// testLogger logs task messages to the test log
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Log(runID string, rowID int, level protocol.LogLevel, msg string) {
+	l.t.Logf("%s/%d %s: %s", runID, rowID, level, msg)
+}
+
+// newDNSTestScheduler returns a scheduler for run-1 working in a temporary
+// directory, with the fake zone holding records
+func newDNSTestScheduler(t *testing.T, records ...dns.Record) *Scheduler {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	fakeZone.reset(records...)
+	return &Scheduler{runID: "run-1", logger: testLogger{t}, appConfig: &Config{}}
+}
+
+// fakeTask returns a task for row 1, whose DNS is hosted by the fake provider
+func fakeTask() *Task {
+	return &Task{RowID: 1, Server: ServerConfig{RowID: 1, Domain: "example.com", ServerIP: "192.0.2.10", DNSProvider: "fake"}, Report: &TaskReport{}}
+}
+
+// zoneBefore holds the fake zone before the run
+var zoneBefore = []dns.Record{
+	{Type: "TXT", Name: "example.com", Content: "v=spf1 -all"},
+	{Type: "TXT", Name: "example.com", Content: "google-site-verification=abc"},
+	{Type: "MX", Name: "example.com", Content: "mx1.example.net", Priority: 10},
+	{Type: "MX", Name: "example.com", Content: "mx2.example.net", Priority: 20},
+	{Type: "CNAME", Name: "mail.example.com", Content: "mail.example.net"},
+}
+
+// runPlan changes every record set of zoneBefore and creates one more
+var runPlan = &DNSPlan{RunID: "run-1", RowID: 1, Provider: "fake", Zone: "example.com", Domain: "example.com", Records: []PlannedRecord{
+	{Type: "CNAME", Name: "mail.example.com", Action: PlanDelete, RecordID: "5"},
+	{Type: "A", Name: "mail.example.com", Content: "192.0.2.10", Action: PlanCreate},
+	{Type: "MX", Name: "example.com", Content: "mail.example.com", Priority: 10, Action: PlanUpdate, RecordID: "3"},
+	{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all", Action: PlanUpdate, RecordID: "1"},
+	{Type: "TXT", Name: "_dmarc.example.com", Content: "v=DMARC1; p=none", Action: PlanNoop},
+}}
+
+func TestDiffRRset(t *testing.T) {
+	spf := dns.Record{ID: "1", Type: "TXT", Name: "example.com", Content: "v=spf1 -all"}
+	other := dns.Record{ID: "2", Type: "TXT", Name: "example.com", Content: "other"}
+	mx10 := dns.Record{ID: "3", Type: "MX", Name: "example.com", Content: "mx.example.net", Priority: 10}
+	mx20 := dns.Record{Type: "MX", Name: "example.com", Content: "mx.example.net.", Priority: 20}
+
+	tests := []struct {
+		name           string
+		current, want  []dns.Record
+		stale, missing []dns.Record
+	}{
+		{"empty", nil, nil, nil, nil},
+		{"same set in another order, IDs ignored", []dns.Record{spf, other}, []dns.Record{{Type: "TXT", Content: `"other"`}, {Type: "TXT", Content: "v=spf1 -all"}}, nil, nil},
+		{"record added", []dns.Record{spf, other}, []dns.Record{spf}, []dns.Record{other}, nil},
+		{"record removed", []dns.Record{spf}, []dns.Record{spf, other}, nil, []dns.Record{other}},
+		{"priority differs", []dns.Record{mx10}, []dns.Record{mx20}, []dns.Record{mx10}, []dns.Record{mx20}},
+		{"duplicates count", []dns.Record{spf}, []dns.Record{spf, spf}, nil, []dns.Record{spf}},
+	}
+
+	for _, tt := range tests {
+		stale, missing := diffRRset(tt.current, tt.want)
+		if !reflect.DeepEqual(stale, tt.stale) || !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("%s: diffRRset = %v, %v, want %v, %v", tt.name, stale, missing, tt.stale, tt.missing)
+		}
+	}
+}
+
+func TestAppliedRRset(t *testing.T) {
+	rrset := []dns.Record{
+		{ID: "1", Type: "TXT", Name: "example.com", Content: "v=spf1 -all"},
+		{ID: "2", Type: "TXT", Name: "example.com", Content: "other"},
+	}
+	tests := []struct {
+		record PlannedRecord
+		want   []string
+	}{
+		{PlannedRecord{Type: "TXT", Name: "example.com", Content: "new", Action: PlanCreate}, []string{"v=spf1 -all", "other", "new"}},
+		{PlannedRecord{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all", Action: PlanUpdate, RecordID: "1"}, []string{"other", "v=spf1 mx -all"}},
+		{PlannedRecord{Type: "TXT", Name: "example.com", Content: "only", Action: PlanUpdate}, []string{"only"}},
+		{PlannedRecord{Type: "TXT", Name: "example.com", Action: PlanDelete, RecordID: "2"}, []string{"v=spf1 -all"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, record := range appliedRRset(rrset, tt.record) {
+			got = append(got, record.Content)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("appliedRRset after %s %s = %q, want %q", tt.record.Action, tt.record.Content, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotCapture(t *testing.T) {
+	s := newDNSTestScheduler(t, zoneBefore...)
+	task := fakeTask()
+	task.DNSSnapshot = &DNSSnapshot{RunID: "run-1", RowID: 1, Provider: "fake", Zone: "example.com", Domain: "example.com"}
+
+	if taskErr := s.applyDNSPlan(fakeZone, task, runPlan, task.DNSSnapshot); taskErr != nil {
+		t.Fatal(taskErr)
+	}
+
+	// Every changed set is captured whole, untouched records included
+	type entry struct {
+		key, action       string
+		previous, applied []string
+	}
+	contents := func(records []dns.Record) []string {
+		var values []string
+		for _, record := range records {
+			values = append(values, fmt.Sprintf("%s#%s", record.Content, record.ID))
+		}
+		sort.Strings(values)
+		return values
+	}
+	want := []entry{
+		{"CNAME mail.example.com", PlanDelete, []string{"mail.example.net#5"}, nil},
+		{"A mail.example.com", PlanCreate, nil, []string{"192.0.2.10#6"}},
+		{"MX example.com", PlanUpdate, []string{"mx1.example.net#3", "mx2.example.net#4"}, []string{"mail.example.com#3", "mx2.example.net#4"}},
+		{"TXT example.com", PlanUpdate, []string{"google-site-verification=abc#2", "v=spf1 -all#1"}, []string{"google-site-verification=abc#2", "v=spf1 mx -all#1"}},
+	}
+	check := func(snapshot *DNSSnapshot) {
+		t.Helper()
+		var got []entry
+		for _, record := range snapshot.Records {
+			got = append(got, entry{record.Type + " " + record.Name, record.Action, contents(record.Previous), contents(record.Applied)})
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("snapshot =\n%+v\nwant\n%+v", got, want)
+		}
+	}
+	check(task.DNSSnapshot)
+
+	snapshots, err := LoadDNSSnapshots("run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("loaded %d snapshots, want 1", len(snapshots))
+	}
+	check(snapshots[0])
+
+	// A retry changing a set again keeps the records from before the run
+	retry := &DNSPlan{RunID: "run-1", RowID: 1, Provider: "fake", Zone: "example.com", Records: []PlannedRecord{
+		{Type: "TXT", Name: "example.com", Content: "v=spf1 a mx -all", Action: PlanUpdate, RecordID: "1"},
+	}}
+	if taskErr := s.applyDNSPlan(fakeZone, task, retry, task.DNSSnapshot); taskErr != nil {
+		t.Fatal(taskErr)
+	}
+	want[3].applied = []string{"google-site-verification=abc#2", "v=spf1 a mx -all#1"}
+	check(task.DNSSnapshot)
+}
+
+func TestRollbackRecord(t *testing.T) {
+	spf := dns.Record{Type: "TXT", Name: "example.com", Content: "v=spf1 -all"}
+	spfNew := dns.Record{Type: "TXT", Name: "example.com", Content: "v=spf1 mx -all"}
+	verification := dns.Record{Type: "TXT", Name: "example.com", Content: "google-site-verification=abc"}
+	a := dns.Record{Type: "A", Name: "mail.example.com", Content: "192.0.2.10"}
+	mx1 := dns.Record{Type: "MX", Name: "example.com", Content: "mx1.example.net", Priority: 10}
+	mx2 := dns.Record{Type: "MX", Name: "example.com", Content: "mx2.example.net", Priority: 20}
+	mail := dns.Record{Type: "MX", Name: "example.com", Content: "mail.example.com", Priority: 10}
+
+	tests := []struct {
+		name    string
+		zone    []dns.Record
+		record  SnapshotRecord
+		want    []dns.Record
+		wantErr bool
+	}{
+		{
+			name:   "created set is deleted",
+			zone:   []dns.Record{a, spf},
+			record: SnapshotRecord{Type: "A", Name: "mail.example.com", Action: PlanCreate, Applied: []dns.Record{a}},
+			want:   []dns.Record{spf},
+		},
+		{
+			name:   "updated record gets its value back, the rest of the set stays",
+			zone:   []dns.Record{verification, spfNew},
+			record: SnapshotRecord{Type: "TXT", Name: "example.com", Action: PlanUpdate, Previous: []dns.Record{spf, verification}, Applied: []dns.Record{spfNew, verification}},
+			want:   []dns.Record{spf, verification},
+		},
+		{
+			name:   "whole set is restored",
+			zone:   []dns.Record{mail},
+			record: SnapshotRecord{Type: "MX", Name: "example.com", Action: PlanUpdate, Previous: []dns.Record{mx1, mx2}, Applied: []dns.Record{mail}},
+			want:   []dns.Record{mx1, mx2},
+		},
+		{
+			name:   "record added to a set is deleted",
+			zone:   []dns.Record{verification, spf},
+			record: SnapshotRecord{Type: "TXT", Name: "example.com", Action: PlanCreate, Previous: []dns.Record{verification}, Applied: []dns.Record{verification, spf}},
+			want:   []dns.Record{verification},
+		},
+		{
+			name:   "deleted set is recreated",
+			record: SnapshotRecord{Type: "MX", Name: "example.com", Action: PlanDelete, Previous: []dns.Record{mx1, mx2}},
+			want:   []dns.Record{mx1, mx2},
+		},
+		{
+			name:   "already restored",
+			zone:   []dns.Record{spf},
+			record: SnapshotRecord{Type: "TXT", Name: "example.com", Action: PlanUpdate, Previous: []dns.Record{spf}, Applied: []dns.Record{spfNew}},
+			want:   []dns.Record{spf},
+		},
+		{
+			name:    "record changed since the run",
+			zone:    []dns.Record{verification, {Type: "TXT", Name: "example.com", Content: "v=spf1 include:other -all"}},
+			record:  SnapshotRecord{Type: "TXT", Name: "example.com", Action: PlanUpdate, Previous: []dns.Record{spf, verification}, Applied: []dns.Record{spfNew, verification}},
+			want:    []dns.Record{verification, {Type: "TXT", Name: "example.com", Content: "v=spf1 include:other -all"}},
+			wantErr: true,
+		},
+		{
+			name:    "record added to the set since the run",
+			zone:    []dns.Record{spfNew, verification},
+			record:  SnapshotRecord{Type: "TXT", Name: "example.com", Action: PlanUpdate, Previous: []dns.Record{spf}, Applied: []dns.Record{spfNew}},
+			want:    []dns.Record{spfNew, verification},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newDNSTestScheduler(t, tt.zone...)
+			want := dumpRecords(tt.want)
+
+			err := rollbackRecord(fakeZone, &tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rollbackRecord = %v, want error %v", err, tt.wantErr)
+			}
+			if got := fakeZone.dump(); !reflect.DeepEqual(got, want) {
+				t.Errorf("zone = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// A record the run deleted is not recreated once another record has taken
+// its name
+func TestRollbackLeavesRecordCreatedSinceRun(t *testing.T) {
+	newDNSTestScheduler(t, zoneBefore...)
+	cname := SnapshotRecord{Type: "CNAME", Name: "mail.example.com", Action: PlanDelete, Previous: []dns.Record{{ID: "5", Type: "CNAME", Name: "mail.example.com", Content: "mail.example.net"}}}
+
+	// The run deleted the CNAME, then someone else pointed it elsewhere
+	if err := fakeZone.DeleteRecord(dns.Record{ID: "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fakeZone.CreateRecord(dns.Record{Type: "CNAME", Name: "mail.example.com", Content: "mail.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := rollbackRecord(fakeZone, &cname)
+	if err == nil || !strings.Contains(err.Error(), "changed since the run") {
+		t.Errorf("rollbackRecord = %v, want the set left alone", err)
+	}
+	records, _ := fakeZone.ListRecords("CNAME", "mail.example.com")
+	if len(records) != 1 || records[0].Content != "mail.example.org" {
+		t.Errorf("CNAME records = %+v, want only the one created since the run", records)
+	}
+}
+
+func TestRollbackRun(t *testing.T) {
+	s := newDNSTestScheduler(t, zoneBefore...)
+	before := fakeZone.dump()
+
+	task := fakeTask()
+	task.DNSSnapshot = &DNSSnapshot{RunID: "run-1", RowID: 1, Provider: "fake", Zone: "example.com", Domain: "example.com"}
+	if taskErr := s.applyDNSPlan(fakeZone, task, runPlan, task.DNSSnapshot); taskErr != nil {
+		t.Fatal(taskErr)
+	}
+	if reflect.DeepEqual(fakeZone.dump(), before) {
+		t.Fatal("the plan left the zone unchanged")
+	}
+
+	servers := []ServerConfig{fakeTask().Server}
+	otherProvider := []ServerConfig{{RowID: 1, Domain: "example.com", DNSProvider: "cloudflare"}}
+
+	// Rows missing from servers, and rows configured with another
+	// provider, are not touched
+	if err := s.RollbackRun([]ServerConfig{{RowID: 2, DNSProvider: "fake"}}); err != nil {
+		t.Errorf("RollbackRun without row 1 = %v", err)
+	}
+	if err := s.RollbackRun(otherProvider); err == nil || !strings.Contains(err.Error(), "provider fake, not cloudflare") {
+		t.Errorf("RollbackRun with another provider = %v", err)
+	}
+	if reflect.DeepEqual(fakeZone.dump(), before) {
+		t.Fatal("zone rolled back for a row that was not selected")
+	}
+
+	// A new scheduler for the run reads the snapshot from disk
+	rollback := &Scheduler{runID: "run-1", logger: testLogger{t}, appConfig: &Config{}}
+	if err := rollback.RollbackRun(servers); err != nil {
+		t.Fatal(err)
+	}
+	if got := fakeZone.dump(); !reflect.DeepEqual(got, before) {
+		t.Errorf("zone after rollback = %q, want %q", got, before)
+	}
+
+	snapshots, err := LoadDNSSnapshots("run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshots[0].changed() {
+		t.Errorf("persisted snapshot still holds changes: %+v", snapshots[0].Records)
+	}
+	if err := rollback.RollbackRun(servers); err != nil {
+		t.Errorf("second RollbackRun = %v", err)
+	}
+	if got := fakeZone.dump(); !reflect.DeepEqual(got, before) {
+		t.Errorf("zone after a second rollback = %q, want %q", got, before)
+	}
+
+	none := &Scheduler{runID: "run-2", logger: testLogger{t}, appConfig: &Config{}}
+	if err := none.RollbackRun(servers); err == nil || !strings.Contains(err.Error(), "no DNS snapshots found for run run-2") {
+		t.Errorf("RollbackRun of a run without snapshots = %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"mailops/internal/dns"
+	"mailops/internal/protocol"
+	"mailops/internal/spf"
+	"net"
+	"strings"
+	"time"
+)
+
+// spfRecord renders the SPF record of a task
+func (s *Scheduler) spfRecord(task *Task) string {
+	record := renderTemplate(s.appConfig.SPFTemplate, templateVariables(task))
+	if record == "" {
+		record = "v=spf1 mx -all"
+	}
+	return record
+}
+
+// planSPF merges the desired SPF record into the SPF record already
+// published at its name. A name with several SPF records, or a merged record
+// that exceeds the DNS lookup limit, is skipped rather than published, as
+// receivers would reject mail with a permanent error either way.
+func (s *Scheduler) planSPF(provider dns.Provider, task *Task, record PlannedRecord) (PlannedRecord, error) {
+	ours, err := spf.Parse(record.Content)
+	if err != nil {
+		return record, fmt.Errorf("%w: invalid spf_template: %v", dns.ErrValidation, err)
+	}
+
+	txts, err := provider.ListRecords("TXT", record.Name)
+	if err != nil {
+		return record, fmt.Errorf("failed to look up TXT %s: %w", record.Name, err)
+	}
+	var existing []dns.Record
+	for _, txt := range txts {
+		if spf.IsSPF(txt.Content) {
+			existing = append(existing, txt)
+		}
+	}
+
+	merged := ours
+	switch len(existing) {
+	case 0:
+		record.Action = PlanCreate
+	case 1:
+		current, err := spf.Parse(existing[0].Content)
+		if err != nil {
+			return skipRecord(record, fmt.Sprintf("the published SPF record cannot be merged: %v", err)), nil
+		}
+		merged = spf.Merge(current, ours)
+		record.RecordID = existing[0].ID
+		record.Current = existing[0].Content
+		record.Action = PlanUpdate
+		if spf.Equal(current, merged) {
+			record.Action = PlanNoop
+			record.Content = dns.JoinTXT(existing[0].Content)
+			return record, nil
+		}
+	default:
+		return skipRecord(record, fmt.Sprintf("%d SPF records are published at %s, merge them into one by hand", len(existing), record.Name)), nil
+	}
+	record.Content = merged.String()
+
+	ctx, cancel := context.WithTimeout(task.Ctx, 30*time.Second)
+	defer cancel()
+	lookups, err := spf.CountLookups(ctx, net.DefaultResolver, merged)
+	if err != nil {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("SPF lookup count for %s may be incomplete: %v", record.Name, err))
+	}
+	if lookups > spf.MaxLookups {
+		return skipRecord(record, fmt.Sprintf("the SPF record needs more than %d DNS lookups, flatten some includes by hand", spf.MaxLookups)), nil
+	}
+
+	return record, nil
+}
+
+// findTXT returns the TXT record at the desired record's name that it
+// replaces: the one with the same version tag (v=DMARC1, v=DKIM1, ...), or
+// one with the same content. Other TXT records at the name are left alone.
+func findTXT(provider dns.Provider, record PlannedRecord) (*dns.Record, error) {
+	txts, err := provider.ListRecords("TXT", record.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := txtVersion(record.Content)
+	for i := range txts {
+		if recordMatches(record, &txts[i]) {
+			return &txts[i], nil
+		}
+	}
+	for i := range txts {
+		if tag != "" && txtVersion(txts[i].Content) == tag {
+			return &txts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// txtVersion returns the lower case version tag a TXT record starts with,
+// such as "v=dmarc1", or an empty string
+func txtVersion(content string) string {
+	content = strings.ToLower(dns.JoinTXT(content))
+	if !strings.HasPrefix(content, "v=") {
+		return ""
+	}
+	end := strings.IndexAny(content, "; \t")
+	if end < 0 {
+		end = len(content)
+	}
+	return content[:end]
+}
+
+// skipRecord marks a record as not to be published and why
+func skipRecord(record PlannedRecord, note string) PlannedRecord {
+	record.Action = PlanSkip
+	record.Note = note
+	return record
+}
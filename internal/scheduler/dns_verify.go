@@ -0,0 +1,83 @@
+package scheduler
+
+import (
+	"fmt"
+	"mailops/internal/dns/verify"
+	"mailops/internal/protocol"
+	"strings"
+)
+
+// stepDNSVerify checks that the applied records are visible on the zone's
+// authoritative nameservers
+func (s *Scheduler) stepDNSVerify(task *Task) *TaskError {
+	if task.Report.DNSStatus != "applied" {
+		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Skipping DNS verification, records were not applied (%s)", task.Report.DNSStatus))
+		return nil
+	}
+
+	expectations := make([]verify.Expectation, 0, len(task.Report.DNSChanges))
+	for _, change := range task.Report.DNSChanges {
+		if !verify.Supported(change.Type) {
+			s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Not verifying %s record %s, the type cannot be queried", change.Type, change.Name))
+			continue
+		}
+		switch change.Action {
+		case PlanCreate, PlanUpdate, PlanNoop:
+			expectations = append(expectations, verify.Expectation{
+				Type:     change.Type,
+				Name:     change.Name,
+				Content:  change.Content,
+				Priority: change.Priority,
+			})
+		}
+	}
+
+	if len(expectations) == 0 {
+		s.logger.Log(s.runID, task.RowID, protocol.Info, "No DNS records to verify")
+		return nil
+	}
+
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Verifying %d DNS records on the nameservers of %s...", len(expectations), task.Report.DNSZone))
+
+	results, err := verify.New(s.appConfig.DNSVerify).Verify(task.Ctx, task.Report.DNSZone, expectations)
+	if err != nil {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("DNS verification failed: %v", err))
+		if s.appConfig.DNSVerifyRequired {
+			return &TaskError{Code: protocol.DNSVerifyFailed, Message: fmt.Sprintf("DNS verification failed: %v", err)}
+		}
+		return nil
+	}
+	task.Report.DNSVerification = results
+
+	var unverified []string
+	for _, result := range results {
+		if result.Verified {
+			s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("%s record %s is visible on all nameservers", result.Type, result.Name))
+			continue
+		}
+
+		unverified = append(unverified, fmt.Sprintf("%s %s", result.Type, result.Name))
+		for _, server := range result.Servers {
+			if server.Matched {
+				continue
+			}
+			observed := strings.Join(server.Observed, ", ")
+			if server.Error != "" {
+				observed = server.Error
+			}
+			if observed == "" {
+				observed = "no record"
+			}
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("%s record %s not visible on %s after %d attempts: %s", result.Type, result.Name, server.Server, result.Attempts, observed))
+		}
+	}
+
+	if len(unverified) > 0 && s.appConfig.DNSVerifyRequired {
+		return &TaskError{Code: protocol.DNSVerifyFailed, Message: fmt.Sprintf("DNS records not visible before the deadline: %s", strings.Join(unverified, "; "))}
+	}
+
+	if len(unverified) == 0 {
+		s.logger.Log(s.runID, task.RowID, protocol.Info, "All DNS records verified")
+	}
+	return nil
+}
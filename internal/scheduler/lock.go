@@ -0,0 +1,193 @@
+package scheduler
+
+import (
+	"fmt"
+	"mailops/internal/protocol"
+	"mailops/internal/ssh"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Where the lock of a server is kept. /var/lock is cleared on boot, so a
+// reboot releases a lock its holder could not.
+const (
+	lockFile  = "/var/lock/mailops.lock"
+	lockGuard = "/var/lock/mailops.lock.guard" // flock'ed while the lock file is checked or changed
+)
+
+// Timing of server locks
+const (
+	lockRefresh    = time.Minute      // How often the holder touches the lock file
+	lockStaleAfter = 5 * time.Minute  // Age of an untouched lock file that is taken over
+	lockPoll       = 15 * time.Second // How often a waiting task tries again
+	lockWait       = 30 * time.Minute // How long a task waits before failing
+)
+
+// serverLock is the lock file a task holds on its server, refreshed until
+// it is released
+type serverLock struct {
+	token string        // First field of the lock file, naming the holder
+	stop  chan struct{} // Closed to stop refreshing
+	done  chan struct{} // Closed when refreshing stopped
+	lost  chan struct{} // Closed when another run took the lock over
+}
+
+var unsafeOwnerChars = regexp.MustCompile(`[^A-Za-z0-9._/=:+-]`)
+
+// lockServer takes the lock file of a task's server, so other runs, and
+// other processes of this one, leave the server alone until unlockServer.
+// It waits while the lock is held by someone else and takes over a lock
+// not refreshed for lockStaleAfter. A task cancelled while waiting fails
+// with ServerLocked.
+func (s *Scheduler) lockServer(task *Task) *TaskError {
+	key := serverKey(task.Server)
+	token := fmt.Sprintf("%s/%d", s.runID, task.RowID)
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s controller=%s pid=%d since=%s", token, hostname, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	script := lockScript(token, unsafeOwnerChars.ReplaceAllString(owner, "_"))
+
+	deadline := time.Now().Add(lockWait)
+	waitingFor := ""
+	for {
+		output, err := s.runSSH(task, func(client *ssh.Client) (string, error) {
+			return client.ExecuteCommandWithOutput(script, time.Minute)
+		})
+		if err != nil {
+			return sshError(fmt.Sprintf("Failed to lock server %s", key), err)
+		}
+
+		acquired, stale, holder := parseLockOutput(output)
+		if stale != "" {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Taking over the stale lock of server %s held by %s", key, stale))
+		}
+		if acquired {
+			lock := &serverLock{token: token, stop: make(chan struct{}), done: make(chan struct{}), lost: make(chan struct{})}
+			task.serverLock = lock
+			go s.refreshServerLock(task, lock)
+			return nil
+		}
+		if holder == "" {
+			return &TaskError{Code: protocol.RemoteCmdTransient, Message: fmt.Sprintf("Failed to lock server %s: unexpected output %q", key, output)}
+		}
+
+		if time.Now().After(deadline) {
+			return &TaskError{Code: protocol.ServerLocked, Message: fmt.Sprintf("Server %s is still locked by %s after %v", key, holder, lockWait)}
+		}
+		if holder != waitingFor {
+			s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Server %s is locked by %s, waiting...", key, holder))
+			waitingFor = holder
+		}
+		select {
+		case <-task.Ctx.Done():
+			return &TaskError{Code: protocol.ServerLocked, Message: fmt.Sprintf("Cancelled while waiting for the lock of server %s held by %s", key, holder)}
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+// refreshServerLock touches the lock file of a task's server until the lock
+// is released or taken over. A lock taken over is marked lost, which fails
+// the task's next step.
+func (s *Scheduler) refreshServerLock(task *Task, lock *serverLock) {
+	defer close(lock.done)
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+		}
+
+		output, err := s.runSSH(task, func(client *ssh.Client) (string, error) {
+			return client.ExecuteCommandWithOutput(lockHolderScript(lock.token, "touch "+lockFile), time.Minute)
+		})
+		if err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to refresh the lock of server %s: %v", serverKey(task.Server), err))
+			continue
+		}
+		if strings.TrimSpace(output) != "ok" {
+			s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("Lost the lock of server %s to another run", serverKey(task.Server)))
+			close(lock.lost)
+			return
+		}
+	}
+}
+
+// checkServerLock fails when the lock a task holds on its server was taken
+// over by another run, so the task stops working on the server
+func checkServerLock(task *Task) *TaskError {
+	lock := task.serverLock
+	if lock == nil {
+		return nil
+	}
+	select {
+	case <-lock.lost:
+		return &TaskError{Code: protocol.ServerLocked, Message: fmt.Sprintf("Lost the lock of server %s to another run", serverKey(task.Server))}
+	default:
+		return nil
+	}
+}
+
+// unlockServer releases the lock a task holds on its server, if any
+func (s *Scheduler) unlockServer(task *Task) {
+	lock := task.serverLock
+	if lock == nil {
+		return
+	}
+	task.serverLock = nil
+	close(lock.stop)
+	<-lock.done
+
+	_, err := s.runSSH(task, func(client *ssh.Client) (string, error) {
+		return client.ExecuteCommandWithOutput(lockHolderScript(lock.token, "rm -f "+lockFile), time.Minute)
+	})
+	if err != nil {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to release the lock of server %s, it is taken over after %v: %v", serverKey(task.Server), lockStaleAfter, err))
+	}
+}
+
+// lockScript returns the shell command taking the lock file for owner,
+// whose first field is token. It prints "acquired", preceded by "stale
+// <holder>" when it took over a stale lock, or "held <holder>".
+func lockScript(token, owner string) string {
+	return fmt.Sprintf(`exec 9>%[1]s && flock -w 30 9 || { echo 'held (lock busy)'; exit 0; }
+if [ -f %[2]s ]; then
+  holder=$(head -n 1 %[2]s)
+  age=$(( $(date +%%s) - $(stat -c %%Y %[2]s) ))
+  if [ "${holder%%%% *}" != '%[3]s' ]; then
+    if [ "$age" -lt %[4]d ]; then echo "held $holder"; exit 0; fi
+    echo "stale $holder"
+  fi
+fi
+echo '%[5]s' > %[2]s && echo acquired`,
+		lockGuard, lockFile, token, int(lockStaleAfter.Seconds()), owner)
+}
+
+// parseLockOutput reads the output of lockScript: whether the lock was
+// acquired, the holder of a stale lock taken over and the holder of a lock
+// that is not
+func parseLockOutput(output string) (acquired bool, stale, holder string) {
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "acquired":
+			acquired = true
+		case strings.HasPrefix(line, "stale "):
+			stale = strings.TrimPrefix(line, "stale ")
+		case strings.HasPrefix(line, "held "):
+			holder = strings.TrimPrefix(line, "held ")
+		}
+	}
+	return acquired, stale, holder
+}
+
+// lockHolderScript returns the shell command running cmd when the lock file
+// is still held by token. It prints "ok" when it ran cmd.
+func lockHolderScript(token, cmd string) string {
+	return fmt.Sprintf(`exec 9>%s && flock -w 30 9; if [ "$(head -n 1 %s | cut -d ' ' -f 1)" = '%s' ]; then %s && echo ok; else echo lost; fi`,
+		lockGuard, lockFile, token, cmd)
+}
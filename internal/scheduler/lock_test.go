@@ -0,0 +1,116 @@
+package scheduler
+
+import (
+	"context"
+	"io"
+	"mailops/internal/protocol"
+	"mailops/internal/ssh"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLockOutput(t *testing.T) {
+	tests := []struct {
+		output   string
+		acquired bool
+		stale    string
+		holder   string
+	}{
+		{"acquired\n", true, "", ""},
+		{"stale run-1/2 controller=a pid=1\nacquired\n", true, "run-1/2 controller=a pid=1", ""},
+		{"held run-1/2 controller=a pid=1\n", false, "", "run-1/2 controller=a pid=1"},
+		{"held (lock busy)\n", false, "", "(lock busy)"},
+		{"\r\nacquired\r\n", true, "", ""},
+		{"flock: not found\n", false, "", ""},
+		{"", false, "", ""},
+	}
+
+	for _, tt := range tests {
+		acquired, stale, holder := parseLockOutput(tt.output)
+		if acquired != tt.acquired || stale != tt.stale || holder != tt.holder {
+			t.Errorf("parseLockOutput(%q) = %v, %q, %q, want %v, %q, %q", tt.output, acquired, stale, holder, tt.acquired, tt.stale, tt.holder)
+		}
+	}
+}
+
+// runLockScript runs a lock script against a lock file in dir instead of
+// the server's
+func runLockScript(t *testing.T, dir, script string) string {
+	t.Helper()
+	script = strings.ReplaceAll(script, lockFile, filepath.Join(dir, "mailops.lock"))
+	output, err := exec.Command("sh", "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v: %s", script, err, output)
+	}
+	return string(output)
+}
+
+func TestLockScript(t *testing.T) {
+	if _, err := exec.LookPath("flock"); err != nil {
+		t.Skip("flock is not installed")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mailops.lock")
+
+	steps := []struct {
+		name     string
+		script   string
+		acquired bool
+		stale    string
+		holder   string
+	}{
+		{"free", lockScript("run-1/1", "run-1/1 pid=1"), true, "", ""},
+		{"held by the same task", lockScript("run-1/1", "run-1/1 pid=1"), true, "", ""},
+		{"held by another run", lockScript("run-2/1", "run-2/1 pid=2"), false, "", "run-1/1 pid=1"},
+		{"stale", lockScript("run-2/1", "run-2/1 pid=2"), true, "run-1/1 pid=1", ""},
+	}
+
+	for _, step := range steps {
+		if step.stale != "" {
+			old := time.Now().Add(-lockStaleAfter - time.Minute)
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		acquired, stale, holder := parseLockOutput(runLockScript(t, dir, step.script))
+		if acquired != step.acquired || stale != step.stale || holder != step.holder {
+			t.Errorf("%s: got %v, %q, %q, want %v, %q, %q", step.name, acquired, stale, holder, step.acquired, step.stale, step.holder)
+		}
+	}
+
+	if output := runLockScript(t, dir, lockHolderScript("run-1/1", "true")); strings.TrimSpace(output) != "lost" {
+		t.Errorf("refresh by the previous holder printed %q, want lost", output)
+	}
+	if output := runLockScript(t, dir, lockHolderScript("run-2/1", "rm -f "+lockFile)); strings.TrimSpace(output) != "ok" {
+		t.Errorf("release by the holder printed %q, want ok", output)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file left after release: %v", err)
+	}
+}
+
+func TestLostServerLock(t *testing.T) {
+	s := &Scheduler{runID: "run-1", encoder: protocol.NewEncoder(io.Discard), logger: testLogger{t}, appConfig: &Config{}}
+	task := &Task{RowID: 1, Server: ServerConfig{Host: "mail.example.com"}, Ctx: context.Background(), Report: &TaskReport{}}
+	task.serverLock = &serverLock{token: "run-1/1", lost: make(chan struct{})}
+
+	if err := checkServerLock(task); err != nil {
+		t.Fatalf("checkServerLock with the lock held = %+v", err)
+	}
+
+	close(task.serverLock.lost)
+	if err := checkServerLock(task); err == nil || err.Code != protocol.ServerLocked {
+		t.Errorf("checkServerLock after losing the lock = %+v, want %s", err, protocol.ServerLocked)
+	}
+	if err := s.executeStep(task, "unknown_step"); err == nil || err.Code != protocol.ServerLocked {
+		t.Errorf("executeStep after losing the lock = %+v, want %s", err, protocol.ServerLocked)
+	}
+	ran := false
+	if _, err := s.withSSH(task, func(client *ssh.Client) (string, error) { ran = true; return "", nil }); err == nil || ran {
+		t.Errorf("withSSH after losing the lock = %v, ran %v, want an error without running", err, ran)
+	}
+}
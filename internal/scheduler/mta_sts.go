@@ -0,0 +1,54 @@
+package scheduler
+
+import (
+	"fmt"
+	"mailops/internal/mtasts"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mtaSTSPolicy builds the MTA-STS policy of a task from its mail host, or
+// returns nil when MTA-STS is disabled. Without ACME the policy host only has
+// a self-signed certificate and senders cannot fetch the policy, so an
+// enforce policy is published in testing mode, where TLS reports show the
+// failures.
+func (s *Scheduler) mtaSTSPolicy(task *Task) (*mtasts.Policy, error) {
+	if !s.appConfig.MTASTS {
+		return nil, nil
+	}
+	policy, err := mtasts.NewPolicy(s.appConfig.MTASTSMode, []string{task.Server.MailHostname()}, s.appConfig.MTASTSMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Mode == mtasts.ModeEnforce && !s.appConfig.ACME {
+		policy.Mode = mtasts.ModeTesting
+	}
+	return policy, nil
+}
+
+// mtaSTSRecords returns the records announcing a policy: the policy TXT
+// record, the TLS reporting record and the address of the policy host
+func (s *Scheduler) mtaSTSRecords(task *Task, policy *mtasts.Policy) []PlannedRecord {
+	domain := strings.TrimSuffix(task.Server.Domain, ".")
+
+	rua := renderTemplate(s.appConfig.TLSRPTRua, map[string]string{"domain": domain})
+	if rua == "" {
+		rua = "mailto:tlsrpt@" + domain
+	}
+
+	return []PlannedRecord{
+		{Type: "A", Name: mtasts.PolicyHost(domain), Content: task.Server.ServerIP, Optional: true},
+		{Type: "TXT", Name: mtasts.RecordName(domain), Content: policy.Record(), Optional: true},
+		{Type: "TXT", Name: mtasts.TLSRPTName(domain), Content: mtasts.TLSRPTRecord(rua), Optional: true},
+	}
+}
+
+// writeMTASTSPolicy saves the policy text next to the task report
+func (s *Scheduler) writeMTASTSPolicy(task *Task, policy *mtasts.Policy) error {
+	reportDir := filepath.Join("output/reports", s.runID)
+	if err := os.MkdirAll(reportDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(reportDir, fmt.Sprintf("%d.mta-sts.txt", task.RowID)), []byte(policy.Text()), 0644)
+}
@@ -0,0 +1,36 @@
+package scheduler
+
+import "testing"
+
+func TestMTASTSPolicyMode(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		mode    string
+		acme    bool
+		want    string // Empty for no policy
+	}{
+		{enabled: false, mode: "enforce", acme: true, want: ""},
+		{enabled: true, mode: "", acme: false, want: "testing"},
+		{enabled: true, mode: "none", acme: false, want: "none"},
+		{enabled: true, mode: "enforce", acme: true, want: "enforce"},
+		// Senders cannot fetch a policy behind a self-signed certificate
+		{enabled: true, mode: " Enforce", acme: false, want: "testing"},
+	}
+
+	for _, tt := range tests {
+		s := &Scheduler{appConfig: &Config{MTASTS: tt.enabled, MTASTSMode: tt.mode, ACME: tt.acme}}
+		task := &Task{Server: ServerConfig{Host: "mail", Domain: "example.com"}}
+
+		policy, err := s.mtaSTSPolicy(task)
+		if err != nil {
+			t.Fatalf("mtaSTSPolicy(%+v) = %v", tt, err)
+		}
+		got := ""
+		if policy != nil {
+			got = policy.Mode
+		}
+		if got != tt.want {
+			t.Errorf("mtaSTSPolicy(%+v) mode = %q, want %q", tt, got, tt.want)
+		}
+	}
+}
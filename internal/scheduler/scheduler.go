@@ -3,12 +3,22 @@ package scheduler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mailops/internal/acme"
 	"mailops/internal/deploy/profiles"
-	"mailops/internal/dns/cloudflare"
+	"mailops/internal/dkim"
+	"mailops/internal/dns"
+	_ "mailops/internal/dns/cloudflare" // Register the DNS providers
+	_ "mailops/internal/dns/rfc2136"
+	"mailops/internal/dns/verify"
+	_ "mailops/internal/dns/zonefile"
+	"mailops/internal/healthcheck"
+	"mailops/internal/mtasts"
 	"mailops/internal/protocol"
 	"mailops/internal/ssh"
 	"mailops/internal/security"
+	"mailops/internal/spf"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -30,18 +40,25 @@ type Task struct {
 	Ctx         context.Context
 	Cancel      context.CancelFunc
 	Report      *TaskReport
+	DNSSnapshot *DNSSnapshot // Records changed by dns_apply, kept across retries
+	serverLock  *serverLock  // Held from ssh_connect_test until the attempt ends
+	sshClient   *ssh.Client  // Connection shared by the steps of an attempt
 }
 
 // ServerConfig represents server configuration
 type ServerConfig struct {
 	RowID          int
-	CFAPIToken     string
-	CFZone         string
+	DNSProvider    string            // Registered DNS provider name, empty for the default
+	DNSToken       string            // DNS provider API token
+	DNSZone        string
+	DNSOptions     map[string]string // Provider specific settings from dns_options
+	DNSExtras      []string          // Optional record sets, nil for the profile or default set
 	ServerIP       string
 	ServerPort     int
 	ServerUser     string
 	ServerPassword string
 	ServerKeyPath  string
+	ServerHostKey  string // Expected SHA256 fingerprint of the SSH host key, empty for the host key policy
 	Host           string
 	Domain         string
 	DeployProfile  string
@@ -49,49 +66,72 @@ type ServerConfig struct {
 	Solution       string
 }
 
+// MailHostname returns the fully qualified name of the mail server, which
+// the profiles configure as Host.Domain
+func (c ServerConfig) MailHostname() string {
+	domain := strings.TrimSuffix(c.Domain, ".")
+	if c.Host == "" {
+		return domain
+	}
+	return c.Host + "." + domain
+}
+
 // TaskError represents a task error
 type TaskError struct {
-	Code    protocol.ErrorCode
-	Message string
+	Code        protocol.ErrorCode
+	Message     string
+	RetryAfter  time.Duration // Minimum wait before a retry, when the remote side asked for one
+	Diagnostics string        // Command output and logs explaining the failure
 }
 
 // TaskReport represents deployment report
+
 type TaskReport struct {
-	RowID         int               `json:"row_id"`
-	Domain        string            `json:"domain"`
-	ServerIP      string            `json:"server_ip"`
-	ServerPort    int               `json:"server_port"`
-	DeployProfile string            `json:"deploy_profile"`
-	Status        string            `json:"status"`
-	StartTime     string            `json:"start_time"`
-	EndTime       string            `json:"end_time"`
-	DurationMs    int64             `json:"duration_ms"`
-	Error         string            `json:"error,omitempty"`
-	Steps         []StepResult      `json:"steps"`
-	DNSChanges    []DNSChange       `json:"dns_changes,omitempty"`
-	HealthCheck   HealthCheckResult `json:"health_check"`
+	RowID           int               `json:"row_id"`
+	Domain          string            `json:"domain"`
+	ServerIP        string            `json:"server_ip"`
+	ServerPort      int               `json:"server_port"`
+	DeployProfile   string            `json:"deploy_profile"`
+	DNSProvider     string            `json:"dns_provider"`
+	Status          string            `json:"status"`
+	StartTime       string            `json:"start_time"`
+	EndTime         string            `json:"end_time"`
+	DurationMs      int64             `json:"duration_ms"`
+	Error           string            `json:"error,omitempty"`
+	Steps           []StepResult      `json:"steps"`
+	DNSStatus       string            `json:"dns_status,omitempty"`  // "applied", "dry_run", "handed_off", "rolled_back" or "rollback_failed"
+	DNSHandOff      string            `json:"dns_handoff,omitempty"` // Where handed off records were delivered
+	DNSZone         string            `json:"dns_zone,omitempty"`
+	DNSChanges      []DNSChange       `json:"dns_changes,omitempty"`
+	DNSVerification []verify.Result   `json:"dns_verification,omitempty"`
+	MTASTSPolicyID  string            `json:"mta_sts_policy_id,omitempty"`
+	Certificate     *CertificateInfo  `json:"certificate,omitempty"`
+	HealthCheck     HealthCheckResult `json:"health_check"`
 }
 
 // StepResult represents step execution result
 type StepResult struct {
-	Step     string `json:"step"`
-	Success  bool   `json:"success"`
-	Duration int64  `json:"duration_ms"`
-	Message  string `json:"message"`
+	Step        string `json:"step"`
+	Success     bool   `json:"success"`
+	Duration    int64  `json:"duration_ms"`
+	Message     string `json:"message"`
+	Diagnostics string `json:"diagnostics,omitempty"`
 }
 
 // DNSChange represents DNS change
 type DNSChange struct {
 	Type    string `json:"type"`
 	Name    string `json:"name"`
-	Content string `json:"content"`
-	Action  string `json:"action"` // "create" or "update"
+	Content  string `json:"content"`
+	Priority int    `json:"priority,omitempty"`
+	Action   string `json:"action"` // "create" or "update"
 }
 
 // HealthCheckResult represents health check results
 type HealthCheckResult struct {
-	Ports    map[string]bool   `json:"ports"`
-	Services map[string]string `json:"services"`
+	Ports      map[string]bool               `json:"ports"`
+	Services   map[string]string             `json:"services"`
+	ReverseDNS *healthcheck.ReverseDNSResult `json:"reverse_dns,omitempty"`
 }
 
 // Scheduler manages task execution
@@ -110,6 +150,8 @@ type Scheduler struct {
 	dnsDryRun    bool
 	runID        string
 	masker       *security.Masker
+	hosted       map[string][]ServerConfig // Rows by server, see serverKey
+	serverSlots  map[string]chan struct{}  // Held by the task working on a server
 }
 
 // Config represents app config
@@ -117,8 +159,44 @@ type Config struct {
 	SSHTimeoutMs   int
 	CmdTimeoutMs   int
 	DKIMSelector   string
+	DKIMKeyType    string // "rsa" or "ed25519"
+	DKIMKeyBits    int    // RSA key size
 	SPFTemplate    string
 	DMARCTemplate  string
+	DNSOnly        bool // Only validate input and apply DNS, skipping all server steps
+	
+	// ApprovedDNSPlans holds confirmed plans by row ID. When set, dns_apply
+	// applies the plan as reviewed instead of planning again.
+	ApprovedDNSPlans map[int]*DNSPlan
+	
+	// DNSProviderDefaults holds default options by provider name, from the
+	// app config. Row dns_options override them.
+	DNSProviderDefaults map[string]map[string]string
+	
+	DNSVerify         verify.Options
+	DNSVerifyRequired bool // Fail the task when records are not visible before the deadline
+	
+	DNSRollbackOnFailure bool // Undo applied DNS changes when a task fails
+	DNSRollbackOnCancel  bool // Undo applied DNS changes when a task is cancelled
+	
+	MTASTS       bool   // Publish an MTA-STS policy and TLS reporting record
+	MTASTSMode   string // "enforce", "testing" or "none"
+	MTASTSMaxAge int    // Policy max_age in seconds
+	TLSRPTRua    string // TLS report destinations, may use {domain}
+	
+	DNSExtras          []string            // Optional record sets published by default
+	DNSExtrasByProfile map[string][]string // Optional record sets by deploy profile, overriding the default
+	CAATemplate        string
+	BIMITemplate       string
+	
+	DKIMPublishWait    time.Duration // Wait between publishing a new DKIM key and signing with it
+	DKIMRetireWait     time.Duration // Wait between switching DKIM selectors and removing the old key
+	DKIMRotateInterval time.Duration // Start a new DKIM rotation this long after the last, 0 to rotate on request only
+	
+	ACME        bool // Obtain the TLS certificate of the mail host from an ACME CA
+	ACMEOptions acme.Options
+	
+	SSHHostKeys *ssh.HostKeyPolicy // Nil for ssh.DefaultHostKeyPolicy
 }
 
 // Logger interface for task logging
@@ -159,6 +237,7 @@ func (s *Scheduler) AddTask(task *Task) {
 		ServerIP:      task.Server.ServerIP,
 		ServerPort:    task.Server.ServerPort,
 		DeployProfile: task.Server.DeployProfile,
+		DNSProvider:   dnsProviderName(task.Server.DNSProvider),
 		Status:        "PENDING",
 		StartTime:     time.Now().Format(time.RFC3339),
 		Steps:         make([]StepResult, 0),
@@ -170,6 +249,7 @@ func (s *Scheduler) AddTask(task *Task) {
 	}
 	
 	s.tasks[task.RowID] = task
+	s.registerServer(task.Server)
 	s.taskQueue <- task
 }
 
@@ -252,6 +332,10 @@ func (s *Scheduler) worker(workerID int) {
 func (s *Scheduler) processTask(task *Task, workerID int) {
 	task.StartTime = time.Now()
 	
+	// The steps share one connection to the server, closed when the
+	// attempt ends
+	defer s.closeSSH(task)
+	
 	// Update state to validating
 	s.UpdateTaskState(task.RowID, protocol.Validating, task.Attempt)
 	
@@ -261,28 +345,34 @@ func (s *Scheduler) processTask(task *Task, workerID int) {
 		return
 	}
 	
+	// Rows sharing a server are deployed one at a time, and other runs are
+	// kept off the server by the lock ssh_connect_test takes
+	if !s.appConfig.DNSOnly {
+		release := s.acquireServer(task)
+		if release == nil {
+			s.handleTaskCancelled(task)
+			return
+		}
+		defer release()
+		defer s.unlockServer(task)
+	}
+	
 	// Update state to running
 	s.UpdateTaskState(task.RowID, protocol.Running, task.Attempt)
 	
-	// Execute task steps
-	steps := []string{
-		"validate_input",
-		"ssh_connect_test",
-		"server_prepare",
-		"deploy_mailstack",
-		"generate_dkim",
-		"dns_apply",
-		"healthcheck",
-		"finalize_report",
-	}
-	
-	for _, step := range steps {
+	for _, step := range s.steps() {
 		select {
 		case <-task.Ctx.Done():
 			s.handleTaskCancelled(task)
 			return
 		default:
 			if err := s.executeStep(task, step); err != nil {
+				// A step failing because the task was cancelled, such as
+				// while waiting for the server's lock, ends it as cancelled
+				if task.Ctx.Err() != nil {
+					s.handleTaskCancelled(task)
+					return
+				}
 				if protocol.IsRetryable(err.Code) && task.Attempt < s.retryMax {
 					s.handleTaskRetry(task, step, err)
 					return
@@ -306,20 +396,71 @@ func (s *Scheduler) processTask(task *Task, workerID int) {
 	s.writeTaskReport(task)
 }
 
+// steps returns the ordered pipeline executed for each task
+func (s *Scheduler) steps() []string {
+	if s.appConfig.DNSOnly {
+		return []string{
+			"validate_input",
+			"dns_apply",
+			"dns_verify",
+			"finalize_report",
+		}
+	}
+	
+	steps := []string{
+		"validate_input",
+		"ssh_connect_test",
+		"server_prepare",
+		"deploy_mailstack",
+		"generate_dkim",
+		"dns_apply",
+		"dns_verify",
+	}
+	if s.appConfig.ACME {
+		steps = append(steps, "issue_certificate")
+	}
+	return append(steps, "healthcheck", "finalize_report")
+}
+
 // validateInput validates task input
 func (s *Scheduler) validateInput(task *Task) *TaskError {
-	if task.Server.CFAPIToken == "" {
-		return &TaskError{Code: protocol.MissingRequiredField, Message: "CF API token is required"}
-	}
-	if task.Server.CFZone == "" {
-		return &TaskError{Code: protocol.MissingRequiredField, Message: "CF zone is required"}
+	if _, err := s.newDNSProvider(task); err != nil {
+		return dnsConfigError(err)
 	}
 	if task.Server.ServerIP == "" {
 		return &TaskError{Code: protocol.MissingRequiredField, Message: "Server IP is required"}
 	}
+	if task.Server.ServerHostKey != "" {
+		if err := ssh.CheckFingerprint(task.Server.ServerHostKey); err != nil {
+			return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("server_host_key: %v", err)}
+		}
+	}
 	if task.Server.Domain == "" {
 		return &TaskError{Code: protocol.MissingRequiredField, Message: "Domain is required"}
 	}
+	if _, err := s.mtaSTSPolicy(task); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
+	if err := s.validateDNSExtras(task); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
+	if _, err := spf.Parse(s.spfRecord(task)); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("invalid spf_template: %v", err)}
+	}
+	if err := dkim.CheckKeyParams(s.appConfig.DKIMKeyType, s.appConfig.DKIMKeyBits); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
+	if !s.appConfig.DNSOnly && !profiles.IsRegistered(task.Server.DeployProfile) {
+		return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("unknown deploy profile %q (available: %s)", task.Server.DeployProfile, strings.Join(profiles.Registered(), ", "))}
+	}
+	if !s.appConfig.DNSOnly {
+		if err := s.validateACME(task); err != nil {
+			return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+		}
+		if err := s.checkSharedServer(task); err != nil {
+			return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+		}
+	}
 	return nil
 }
 
@@ -334,8 +475,11 @@ func (s *Scheduler) executeStep(task *Task, step string) *TaskError {
 	
 	startTime := time.Now()
 	
-	// Execute step logic
-	err := s.executeStepLogic(task, step)
+	// Execute step logic, unless another run took the server over
+	err := checkServerLock(task)
+	if err == nil {
+		err = s.executeStepLogic(task, step)
+	}
 	
 	duration := time.Since(startTime).Milliseconds()
 	
@@ -348,6 +492,10 @@ func (s *Scheduler) executeStep(task *Task, step string) *TaskError {
 	}
 	if err != nil {
 		stepResult.Message = fmt.Sprintf("Step %s failed: %s", step, err.Message)
+		stepResult.Diagnostics = err.Diagnostics
+		if err.Diagnostics != "" {
+			s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("Diagnostics of %s:\n%s", step, err.Diagnostics))
+		}
 	}
 	task.Report.Steps = append(task.Report.Steps, stepResult)
 	
@@ -378,6 +526,10 @@ func (s *Scheduler) executeStepLogic(task *Task, step string) *TaskError {
 		return s.stepGenerateDKIM(task)
 	case "dns_apply":
 		return s.stepDNSApply(task)
+	case "dns_verify":
+		return s.stepDNSVerify(task)
+	case "issue_certificate":
+		return s.stepIssueCertificate(task)
 	case "healthcheck":
 		return s.stepHealthcheck(task)
 	case "finalize_report":
@@ -392,18 +544,44 @@ func (s *Scheduler) stepValidateInput(task *Task) *TaskError {
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Validating input configuration...")
 	
 	// Check required fields
-	if task.Server.CFAPIToken == "" {
-		return &TaskError{Code: protocol.MissingRequiredField, Message: "CF API token is required"}
-	}
-	if task.Server.CFZone == "" {
-		return &TaskError{Code: protocol.MissingRequiredField, Message: "CF zone is required"}
+	if _, err := s.newDNSProvider(task); err != nil {
+		return dnsConfigError(err)
 	}
 	if task.Server.ServerIP == "" {
 		return &TaskError{Code: protocol.MissingRequiredField, Message: "Server IP is required"}
 	}
+	if task.Server.ServerHostKey != "" {
+		if err := ssh.CheckFingerprint(task.Server.ServerHostKey); err != nil {
+			return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("server_host_key: %v", err)}
+		}
+	}
 	if task.Server.Domain == "" {
 		return &TaskError{Code: protocol.MissingRequiredField, Message: "Domain is required"}
 	}
+	if policy, err := s.mtaSTSPolicy(task); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	} else if policy != nil && !s.appConfig.ACME && strings.EqualFold(strings.TrimSpace(s.appConfig.MTASTSMode), mtasts.ModeEnforce) {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, "MTA-STS mode enforce needs acme.enabled for a certificate senders trust, publishing the policy in testing mode")
+	}
+	if err := s.validateDNSExtras(task); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
+	if _, err := spf.Parse(s.spfRecord(task)); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("invalid spf_template: %v", err)}
+	}
+	if err := dkim.CheckKeyParams(s.appConfig.DKIMKeyType, s.appConfig.DKIMKeyBits); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
+	if s.appConfig.DNSOnly {
+		s.logger.Log(s.runID, task.RowID, protocol.Info, "Input validation passed (DNS only)")
+		return nil
+	}
+	if err := s.validateACME(task); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
+	if err := s.checkSharedServer(task); err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
 	if task.Server.ServerPort == 0 {
 		return &TaskError{Code: protocol.InvalidConfig, Message: "Server port must be specified"}
 	}
@@ -419,22 +597,11 @@ func (s *Scheduler) stepValidateInput(task *Task) *TaskError {
 func (s *Scheduler) stepSSHConnectTest(task *Task) *TaskError {
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Testing SSH connection...")
 	
-	// Create SSH client config
-	sshConfig := ssh.Config{
-		Host:     task.Server.ServerIP,
-		Port:     task.Server.ServerPort,
-		User:     task.Server.ServerUser,
-		Password: task.Server.ServerPassword,
-		KeyPath:  task.Server.ServerKeyPath,
-		Timeout:  time.Duration(s.appConfig.SSHTimeoutMs) * time.Millisecond,
-	}
-	
-	// Create SSH client
-	client, err := ssh.NewClient(sshConfig)
+	// Dial the connection the following steps use
+	client, err := s.sshClient(task)
 	if err != nil {
-		return &TaskError{Code: protocol.SSHConn, Message: fmt.Sprintf("Failed to create SSH client: %v", err)}
+		return sshError("Failed to create SSH client", err)
 	}
-	defer client.Close()
 	
 	// Test connection
 	if err := client.TestConnection(); err != nil {
@@ -442,28 +609,18 @@ func (s *Scheduler) stepSSHConnectTest(task *Task) *TaskError {
 	}
 	
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "SSH connection successful")
-	return nil
+	
+	return s.lockServer(task)
 }
 
 // stepServerPrepare prepares the server for deployment
 func (s *Scheduler) stepServerPrepare(task *Task) *TaskError {
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Preparing server...")
 	
-	// Create SSH client
-	sshConfig := ssh.Config{
-		Host:     task.Server.ServerIP,
-		Port:     task.Server.ServerPort,
-		User:     task.Server.ServerUser,
-		Password: task.Server.ServerPassword,
-		KeyPath:  task.Server.ServerKeyPath,
-		Timeout:  time.Duration(s.appConfig.CmdTimeoutMs) * time.Millisecond,
-	}
-	
-	client, err := ssh.NewClient(sshConfig)
+	client, err := s.sshClient(task)
 	if err != nil {
-		return &TaskError{Code: protocol.SSHConn, Message: fmt.Sprintf("Failed to create SSH client: %v", err)}
+		return sshError("Failed to create SSH client", err)
 	}
-	defer client.Close()
 	
 	// Update package lists
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Updating package lists...")
@@ -499,136 +656,103 @@ func (s *Scheduler) stepServerPrepare(task *Task) *TaskError {
 func (s *Scheduler) stepDeployMailstack(task *Task) *TaskError {
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Deploying mail server stack...")
 	
-	// Create SSH client
-	sshConfig := ssh.Config{
-		Host:     task.Server.ServerIP,
-		Port:     task.Server.ServerPort,
-		User:     task.Server.ServerUser,
-		Password: task.Server.ServerPassword,
-		KeyPath:  task.Server.ServerKeyPath,
-		Timeout:  time.Duration(s.appConfig.CmdTimeoutMs) * time.Millisecond,
+	client, err := s.sshClient(task)
+	if err != nil {
+		return sshError("Failed to create SSH client", err)
 	}
 	
-	client, err := ssh.NewClient(sshConfig)
+	policy, err := s.mtaSTSPolicy(task)
 	if err != nil {
-		return &TaskError{Code: protocol.SSHConn, Message: fmt.Sprintf("Failed to create SSH client: %v", err)}
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
+	mtaSTSPolicy := ""
+	if policy != nil {
+		mtaSTSPolicy = policy.Text()
 	}
-	defer client.Close()
 	
-	var deployResult *profiles.DeployResult
+	opts := s.profileOptions(task)
+	key, err := s.dkimKey(task, opts.DKIMSelector)
+	if err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("Failed to prepare DKIM key: %v", err)}
+	}
+	opts.DKIMKey = key
+	opts.MTASTSPolicy = mtaSTSPolicy
+	profile, err := profiles.New(task.Server.DeployProfile, opts)
+	if err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
+	}
 	
-	switch task.Server.DeployProfile {
-	case "postfix_dovecot":
-		s.logger.Log(s.runID, task.RowID, protocol.Info, "Deploying Postfix + Dovecot profile...")
-		profile := &profiles.PostfixDovecotProfile{
-			Domain:       task.Server.Domain,
-			Hostname:     task.Server.Host,
-			DKIMSelector: s.appConfig.DKIMSelector,
-			DKIMKeySize:  2048,
-		}
-		deployResult, err = profile.Deploy(client)
-		if err != nil {
-			return &TaskError{Code: protocol.DeployFailed, Message: fmt.Sprintf("Deployment failed: %v", err)}
-		}
-		
-	case "docker_mailserver":
-		s.logger.Log(s.runID, task.RowID, protocol.Info, "Deploying Docker MailServer profile...")
-		profile := &profiles.DockerMailserverProfile{
-			Domain:        task.Server.Domain,
-			Hostname:      task.Server.Host,
-			ContainerName: fmt.Sprintf("mailserver-%d", task.RowID),
-		}
-		deployResult, err = profile.Deploy(client)
-			DKIMSelector:  s.appConfig.DKIMSelector,
-		if err != nil {
-			return &TaskError{Code: protocol.DeployFailed, Message: fmt.Sprintf("Deployment failed: %v", err)}
-		}
-		
-	default:
-		return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("Unknown deploy profile: %s", task.Server.DeployProfile)}
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Deploying %s profile...", profile.Describe()))
+	deployResult, err := profile.Deploy(client)
+	if err != nil {
+		return profileError("Deployment failed", err)
 	}
 	
 	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Deployment completed: %s", deployResult.Version))
+	
+	if multi, ok := profile.(profiles.MultiDomain); ok {
+		if domains, err := multi.ServerDomains(client); err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to list the domains of the server: %v", err))
+		} else if len(domains) > 1 {
+			s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Server %s hosts %s", task.Server.ServerIP, strings.Join(domains, ", ")))
+		}
+	}
 	return nil
 }
 
-// stepGenerateDKIM generates DKIM keys
+// profileOptions returns the options a task's deploy profile is
+// constructed with, apart from the ones only deployment needs
+func (s *Scheduler) profileOptions(task *Task) profiles.Options {
+	return profiles.Options{
+		Domain:       task.Server.Domain,
+		Hostname:     task.Server.Host,
+		RowID:        task.RowID,
+		DKIMSelector: s.dkimSelector(task),
+		ServerHost:   s.serverHost(task),
+		ACME:         s.appConfig.ACME,
+	}
+}
+
+// newProfile constructs a task's deploy profile to manage what is deployed
+func (s *Scheduler) newProfile(task *Task) (profiles.Profile, error) {
+	return profiles.New(task.Server.DeployProfile, s.profileOptions(task))
+}
+
+// profileError returns the task error of a failed deploy profile call,
+// with the diagnostics of a service that failed its config check or start
+func profileError(message string, err error) *TaskError {
+	taskErr := &TaskError{Code: protocol.DeployFailed, Message: fmt.Sprintf("%s: %v", message, err)}
+	var serviceErr *profiles.ServiceError
+	if errors.As(err, &serviceErr) {
+		taskErr.Diagnostics = serviceErr.Diagnostics()
+	}
+	return taskErr
+}
+
+// stepGenerateDKIM installs the locally generated DKIM key and signs with it
 func (s *Scheduler) stepGenerateDKIM(task *Task) *TaskError {
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Generating DKIM keys...")
 	
-	// Create SSH client
-	sshConfig := ssh.Config{
-		Host:     task.Server.ServerIP,
-		Port:     task.Server.ServerPort,
-		User:     task.Server.ServerUser,
-		Password: task.Server.ServerPassword,
-		KeyPath:  task.Server.ServerKeyPath,
-		Timeout:  time.Duration(s.appConfig.CmdTimeoutMs) * time.Millisecond,
+	client, err := s.sshClient(task)
+	if err != nil {
+		return sshError("Failed to create SSH client", err)
 	}
 	
-	client, err := ssh.NewClient(sshConfig)
+	dkimSelector := s.dkimSelector(task)
+	key, err := s.dkimKey(task, dkimSelector)
 	if err != nil {
-		return &TaskError{Code: protocol.SSHConn, Message: fmt.Sprintf("Failed to create SSH client: %v", err)}
+		return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("Failed to prepare DKIM key: %v", err)}
 	}
-	defer client.Close()
-	
-	var dkimPublicKey string
-	dkimSelector := s.appConfig.DKIMSelector
-	if dkimSelector == "" {
-		dkimSelector = "s1"  // Default selector
+	profile, err := s.newProfile(task)
+	if err != nil {
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
 	}
 	
-	// Different DKIM generation based on deploy profile
-	if task.Server.DeployProfile == "docker_mailserver" {
-		s.logger.Log(s.runID, task.RowID, protocol.Info, "Using docker-mailserver DKIM generation...")
-		
-		// Use docker-mailserver's profile method
-		profile := &profiles.DockerMailserverProfile{
-			Domain:        task.Server.Domain,
-			Hostname:      task.Server.Host,
-			ContainerName: fmt.Sprintf("mailserver-%d", task.RowID),
-			DKIMSelector:  dkimSelector,
-		}
-		
-		dkimPublicKey, err = profile.GenerateDKIM(client)
-		if err != nil {
-			return &TaskError{Code: protocol.DeployFailed, Message: fmt.Sprintf("Failed to generate DKIM with docker-mailserver: %v", err)}
-		}
-	} else {
-		// Use traditional opendkim-tools method
-		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Generating %d-bit DKIM key for %s...", 2048, task.Server.Domain))
-		
-		// Install opendkim-tools if needed
-		err = client.InstallPackage("opendkim-tools")
-		if err != nil {
-			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to install opendkim-tools: %v", err))
-		}
-		
-		// Create DKIM directory
-		mkdirCmd := fmt.Sprintf("mkdir -p /etc/opendkim/keys/%s", task.Server.Domain)
-		_, err = client.ExecuteCommandWithOutput(mkdirCmd, 30*time.Second)
-		if err != nil {
-			return &TaskError{Code: protocol.DeployFailed, Message: fmt.Sprintf("Failed to create DKIM directory: %v", err)}
-		}
-		
-		// Generate DKIM key
-		genKeyCmd := fmt.Sprintf("opendkim-genkey -b 2048 -r -s %s -d %s -D /etc/opendkim/keys/%s", 
-			dkimSelector, task.Server.Domain, task.Server.Domain)
-		output, err := client.ExecuteCommandWithOutput(genKeyCmd, 60*time.Second)
-		if err != nil {
-			return &TaskError{Code: protocol.DeployFailed, Message: fmt.Sprintf("Failed to generate DKIM key: %v, output: %s", err, output)}
-		}
-		
-		// Read DKIM public key
-		dkimKeyPath := fmt.Sprintf("/etc/opendkim/keys/%s/%s.txt", task.Server.Domain, dkimSelector)
-		dkimPublicKey, err = client.ExecuteCommandWithOutput(fmt.Sprintf("cat %s", dkimKeyPath), 30*time.Second)
-		if err != nil {
-			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to read DKIM public key: %v", err))
-			dkimPublicKey = ""
-		}
-		
-		// Normalize DKIM key
-		dkimPublicKey = normalizeDKIMKey(dkimPublicKey)
+	// Install the key and sign with it
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Installing %s DKIM key for selector %s of %s...", key.Type, dkimSelector, task.Server.Domain))
+	dkimPublicKey, err := profile.GenerateDKIM(client, dkimSelector, key)
+	if err != nil {
+		return profileError("DKIM setup failed", err)
 	}
 	
 	// Store DKIM public key in task report for DNS step
@@ -642,20 +766,17 @@ func (s *Scheduler) stepGenerateDKIM(task *Task) *TaskError {
 		})
 	}
 	
-	s.logger.Log(s.runID, task.RowID, protocol.Info, "DKIM keys generated successfully")
+	s.logger.Log(s.runID, task.RowID, protocol.Info, "DKIM key installed successfully")
 	return nil
 }
 
 
-// stepDNSApply applies DNS records to Cloudflare
+// stepDNSApply applies DNS records through the row's DNS provider
 func (s *Scheduler) stepDNSApply(task *Task) *TaskError {
-	s.logger.Log(s.runID, task.RowID, protocol.Info, "Applying DNS records to Cloudflare...")
+	s.logger.Log(s.runID, task.RowID, protocol.Info, "Applying DNS records...")
 	
 	// Get DKIM public key from task report (generated in stepGenerateDKIM)
-	dkimSelector := s.appConfig.DKIMSelector
-	if dkimSelector == "" {
-		dkimSelector = "s1"  // Default selector
-	}
+	dkimSelector := s.dkimSelector(task)
 	
 	// Look for DKIM key in DNS changes from previous step
 	dkimPublicKey := ""
@@ -668,139 +789,107 @@ func (s *Scheduler) stepDNSApply(task *Task) *TaskError {
 		}
 	}
 	
+	// Then the local key archive
+	if dkimPublicKey == "" {
+		dkimPublicKey = dkimRecord(task.Server.Domain, dkimSelector)
+	}
+	
 	// If not found in report, try to read from server (fallback for non-docker-mailserver)
 	if dkimPublicKey == "" {
-		sshConfig := ssh.Config{
-			Host:     task.Server.ServerIP,
-			Port:     task.Server.ServerPort,
-			User:     task.Server.ServerUser,
-			Password: task.Server.ServerPassword,
-			KeyPath:  task.Server.ServerKeyPath,
-			Timeout:  time.Duration(s.appConfig.SSHTimeoutMs) * time.Millisecond,
-		}
-		
-		client, err := ssh.NewClient(sshConfig)
+		client, err := s.sshClient(task)
 		if err == nil {
-			defer client.Close()
-			
-			var dkimKeyPath string
-			if task.Server.DeployProfile == "docker_mailserver" {
-				dkimKeyPath = fmt.Sprintf("/opt/mailserver/config/opendkim/%s.txt", dkimSelector)
-			} else {
-				dkimKeyPath = fmt.Sprintf("/etc/opendkim/keys/%s/%s.txt", task.Server.Domain, dkimSelector)
+			var profile profiles.Profile
+			if profile, err = s.newProfile(task); err == nil {
+				dkimPublicKey, err = profile.ReadDKIMKey(client, dkimSelector)
 			}
-			
-			dkimPublicKey, err = client.ExecuteCommandWithOutput(fmt.Sprintf("cat %s", dkimKeyPath), 30*time.Second)
 			if err != nil {
 				s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to read DKIM public key: %v", err))
 				dkimPublicKey = ""
-			} else {
-				dkimPublicKey = normalizeDKIMKey(dkimPublicKey)
 			}
 		}
 	}
 	
 	// Create DNS provider
-	dnsProvider := cloudflare.NewProvider(task.Server.CFAPIToken, s.dnsDryRun)
-	
-	// Render templates
-	variables := map[string]string{
-		"server_ip": task.Server.ServerIP,
-		"domain":    task.Server.Domain,
-		"host":      task.Server.Host,
-	}
-	
-	spfRecord := renderTemplate(s.appConfig.SPFTemplate, variables)
-	if spfRecord == "" {
-		spfRecord = "v=spf1 mx -all"
+	dnsProvider, err := s.newDNSProvider(task)
+	if err != nil {
+		return dnsConfigError(err)
 	}
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Using DNS provider: %s", dnsProvider.Name()))
 	
-	dmarcRecord := renderTemplate(s.appConfig.DMARCTemplate, variables)
-	if dmarcRecord == "" {
-		dmarcRecord = fmt.Sprintf("v=DMARC1; p=none; rua=mailto:dmarc@%s", task.Server.CFZone)
+	// Keep the MTA-STS policy with the report, so it can be hosted by hand
+	// when the server is not deployed by this run
+	if policy, err := s.mtaSTSPolicy(task); err == nil && policy != nil {
+		task.Report.MTASTSPolicyID = policy.ID()
+		if err := s.writeMTASTSPolicy(task, policy); err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to write MTA-STS policy: %v", err))
+		}
 	}
 	
-	// Apply DNS records with dry-run support
-	if s.dnsDryRun {
-		s.logger.Log(s.runID, task.RowID, protocol.Info, "[DRY-RUN] DNS changes that would be applied:")
-		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("  A: %s -> %s", task.Server.Host, task.Server.ServerIP))
-		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("  MX: %s -> %s (priority 10)", task.Server.Domain, task.Server.Host))
-		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("  TXT (@): %s", spfRecord))
-		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("  TXT (_dmarc): %s", dmarcRecord))
-		if dkimPublicKey != "" {
-			s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("  TXT (%s._domainkey): %s", dkimSelector, dkimPublicKey))
-		}
+	// Use the approved plan when this run executes a confirmed preview,
+	// otherwise plan against the current zone
+	plan, approved := s.appConfig.ApprovedDNSPlans[task.RowID]
+	if approved {
+		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Applying confirmed DNS plan from run %s", plan.RunID))
 	} else {
-		// Create A record (upsert)
-		s.logger.Log(s.runID, task.RowID, protocol.Info, "Creating/updating A record...")
-		err := dnsProvider.UpsertRecord("A", task.Server.Host, task.Server.ServerIP, nil)
-		if err != nil {
-			return &TaskError{Code: protocol.DNSAuthFailed, Message: fmt.Sprintf("Failed to create A record: %v", err)}
-		}
-		task.Report.DNSChanges = append(task.Report.DNSChanges, DNSChange{
-			Type:    "A",
-			Name:    task.Server.Host,
-			Content: task.Server.ServerIP,
-			Action:  "create",
-		})
+		desired := s.desiredDNSRecords(task, dkimSelector, dkimPublicKey)
 		
-		// Create MX record (upsert)
-		s.logger.Log(s.runID, task.RowID, protocol.Info, "Creating/updating MX record...")
-		priority := 10
-		err = dnsProvider.UpsertRecord("MX", task.Server.Domain, task.Server.Host, &priority)
+		plan, err = s.planDNS(dnsProvider, task, desired)
 		if err != nil {
-			return &TaskError{Code: protocol.DNSAuthFailed, Message: fmt.Sprintf("Failed to create MX record: %v", err)}
+			return dnsTaskError(fmt.Sprintf("Failed to plan DNS changes: %v", err), err)
 		}
-		task.Report.DNSChanges = append(task.Report.DNSChanges, DNSChange{
-			Type:    "MX",
-			Name:    task.Server.Domain,
-			Content: fmt.Sprintf("%s (priority %d)", task.Server.Host, priority),
-			Action:  "create",
-		})
 		
-		// Create SPF TXT record (upsert)
-		s.logger.Log(s.runID, task.RowID, protocol.Info, "Creating/updating SPF TXT record...")
-		err = dnsProvider.UpsertRecord("TXT", "@", spfRecord, nil)
-		if err != nil {
-			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to create SPF record: %v", err))
+		if err := s.writeDNSPlan(plan); err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to write DNS plan: %v", err))
+		}
+	}
+	
+	s.logDNSPlan(task, plan)
+	task.Report.DNSZone = plan.Zone
+	
+	// Providers that hand records off apply them even in dry-run mode, as
+	// they never touch live DNS
+	if handOff, ok := dnsProvider.(dns.HandOffProvider); ok {
+		if taskErr := s.applyDNSPlan(dnsProvider, task, plan, nil); taskErr != nil {
+			return taskErr
 		}
-		task.Report.DNSChanges = append(task.Report.DNSChanges, DNSChange{
-			Type:    "TXT",
-			Name:    "@",
-			Content: spfRecord,
-			Action:  "create",
-		})
 		
-		// Create DMARC TXT record (upsert)
-		s.logger.Log(s.runID, task.RowID, protocol.Info, "Creating/updating DMARC TXT record...")
-		err = dnsProvider.UpsertRecord("TXT", "_dmarc", dmarcRecord, nil)
+		location, err := handOff.HandOff()
 		if err != nil {
-			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to create DMARC record: %v", err))
+			return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("Failed to hand off DNS records: %v", err)}
 		}
-		task.Report.DNSChanges = append(task.Report.DNSChanges, DNSChange{
-			Type:    "TXT",
-			Name:    "_dmarc",
-			Content: dmarcRecord,
-			Action:  "create",
-		})
 		
-		// Create DKIM TXT record (upsert)
-		if dkimPublicKey != "" {
-			s.logger.Log(s.runID, task.RowID, protocol.Info, "Creating/updating DKIM TXT record...")
-			dkimRecordName := fmt.Sprintf("%s._domainkey", dkimSelector)
-			err = dnsProvider.UpsertRecord("TXT", dkimRecordName, dkimPublicKey, nil)
-			if err != nil {
-				s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to create DKIM record: %v", err))
-			}
-			task.Report.DNSChanges = append(task.Report.DNSChanges, DNSChange{
-				Type:    "TXT",
-				Name:    dkimRecordName,
-				Content: dkimPublicKey,
-				Action:  "create",
-			})
+		task.Report.DNSStatus = "handed_off"
+		task.Report.DNSHandOff = location
+		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("DNS records handed off: %s", location))
+		return nil
+	}
+	
+	if s.dnsDryRun {
+		for _, record := range plan.Records {
+			task.Report.DNSChanges = append(task.Report.DNSChanges, plannedChange(record))
 		}
+		task.Report.DNSStatus = "dry_run"
+		s.logger.Log(s.runID, task.RowID, protocol.Info, "[DRY-RUN] DNS plan saved, awaiting confirmation")
+		return nil
+	}
+	
+	// A retry keeps the snapshot of the first attempt, which holds the
+	// values from before the run
+	if task.DNSSnapshot == nil {
+		task.DNSSnapshot = &DNSSnapshot{
+			RunID:    s.runID,
+			RowID:    task.RowID,
+			Provider: dnsProvider.Name(),
+			Zone:     plan.Zone,
+			Domain:   plan.Domain,
+		}
+	}
+	
+	if taskErr := s.applyDNSPlan(dnsProvider, task, plan, task.DNSSnapshot); taskErr != nil {
+		return taskErr
 	}
 	
+	task.Report.DNSStatus = "applied"
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "DNS records applied successfully")
 	return nil
 }
@@ -810,27 +899,21 @@ func (s *Scheduler) stepDNSApply(task *Task) *TaskError {
 func (s *Scheduler) stepHealthcheck(task *Task) *TaskError {
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Performing health checks...")
 	
-	// Create SSH client
-	sshConfig := ssh.Config{
-		Host:     task.Server.ServerIP,
-		Port:     task.Server.ServerPort,
-		User:     task.Server.ServerUser,
-		Password: task.Server.ServerPassword,
-		KeyPath:  task.Server.ServerKeyPath,
-		Timeout:  time.Duration(s.appConfig.CmdTimeoutMs) * time.Millisecond,
+	client, err := s.sshClient(task)
+	if err != nil {
+		return sshError("Failed to create SSH client", err)
 	}
 	
-	client, err := ssh.NewClient(sshConfig)
+	profile, err := s.newProfile(task)
 	if err != nil {
-		return &TaskError{Code: protocol.SSHConn, Message: fmt.Sprintf("Failed to create SSH client: %v", err)}
+		return &TaskError{Code: protocol.InvalidConfig, Message: err.Error()}
 	}
-	defer client.Close()
+	spec := profile.HealthSpec()
 	
 	// Check ports
-	ports := []int{25, 587, 465, 143, 993}
-	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Checking ports: %v", ports))
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Checking ports: %v", spec.Ports))
 	
-	for _, port := range ports {
+	for _, port := range spec.Ports {
 		open := client.CheckPort(port, 10*time.Second)
 		task.Report.HealthCheck.Ports[strconv.Itoa(port)] = open
 		if open {
@@ -841,8 +924,7 @@ func (s *Scheduler) stepHealthcheck(task *Task) *TaskError {
 	}
 	
 	// Check service status
-	services := []string{"postfix", "dovecot"}
-	for _, svc := range services {
+	for _, svc := range spec.Services {
 		cmd := fmt.Sprintf("systemctl is-active %s", svc)
 		output, err := client.ExecuteCommandWithOutput(cmd, 10*time.Second)
 		status := "inactive"
@@ -853,6 +935,26 @@ func (s *Scheduler) stepHealthcheck(task *Task) *TaskError {
 		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Service %s: %s", svc, status))
 	}
 	
+	// Check that the PTR of the server address matches the host name the
+	// profile configured as myhostname, and resolves back to the address.
+	// Rows sharing a server share its host name.
+	hostname := s.serverHost(task)
+	s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Checking reverse DNS of %s (expecting %s)...", task.Server.ServerIP, hostname))
+	
+	ctx, cancel := context.WithTimeout(task.Ctx, 30*time.Second)
+	rdns := healthcheck.CheckReverseDNS(ctx, nil, task.Server.ServerIP, hostname)
+	cancel()
+	
+	task.Report.HealthCheck.ReverseDNS = &rdns
+	if rdns.Passed {
+		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Reverse DNS: %s -> %s (forward-confirmed)", task.Server.ServerIP, hostname))
+	} else {
+		s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Reverse DNS: %s", rdns.Problem))
+		if rdns.Action != "" {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Action required: %s", rdns.Action))
+		}
+	}
+	
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Health checks completed")
 	return nil
 }
@@ -929,6 +1031,16 @@ Time: %s
 		time.Now().Format("2006-01-02 15:04:05"),
 	)
 	
+	if rdns := task.Report.HealthCheck.ReverseDNS; rdns != nil && !rdns.Passed {
+		report += fmt.Sprintf(`
+Reverse DNS: %s
+Action required: %s
+`,
+			rdns.Problem,
+			rdns.Action,
+		)
+	}
+	
 	s.logger.Log(s.runID, task.RowID, protocol.Info, "Deployment report completed")
 	s.logger.Log(s.runID, task.RowID, protocol.Info, report)
 	
@@ -967,6 +1079,10 @@ func (s *Scheduler) handleTaskError(task *Task, taskErr *TaskError) {
 	task.Error = taskErr
 	task.State = protocol.Failed
 	
+	if s.appConfig.DNSRollbackOnFailure {
+		s.rollbackTaskDNS(task, "failed")
+	}
+	
 	if err := s.UpdateTaskState(task.RowID, protocol.Failed, task.Attempt); err != nil {
 		s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("Failed to update state: %v", err))
 	}
@@ -997,6 +1113,9 @@ func (s *Scheduler) handleTaskRetry(task *Task, step string, taskErr *TaskError)
 	
 	// Calculate backoff delay
 	backoff := s.retryBackoff * time.Duration(1<<uint(task.Attempt-1))
+	if taskErr.RetryAfter > backoff {
+		backoff = taskErr.RetryAfter
+	}
 	jitter := time.Duration(100) * time.Millisecond
 	delay := backoff + jitter
 	
@@ -1019,6 +1138,10 @@ func (s *Scheduler) handleTaskCancelled(task *Task) {
 	task.State = protocol.Cancelled
 	task.EndTime = time.Now()
 	
+	if s.appConfig.DNSRollbackOnCancel {
+		s.rollbackTaskDNS(task, "cancelled")
+	}
+	
 	if err := s.UpdateTaskState(task.RowID, protocol.Cancelled, task.Attempt); err != nil {
 		s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("Failed to update state: %v", err))
 	}
@@ -1106,37 +1229,6 @@ func (s *Scheduler) writeTaskReport(task *Task) {
 	}
 }
 
-// normalizeDKIMKey normalizes DKIM key by extracting p= value
-func normalizeDKIMKey(dkimContent string) string {
-	lines := strings.Split(dkimContent, "\n")
-	var keyParts []string
-	
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, ";") {
-			continue
-		}
-		if strings.Contains(line, "p=") {
-			// Extract the p= value
-			parts := strings.SplitN(line, "p=", 2)
-			if len(parts) == 2 {
-				keyValue := strings.TrimSpace(parts[1])
-				// Remove quotes and trailing semicolon
-				keyValue = strings.Trim(keyValue, `"`)
-				keyValue = strings.TrimSuffix(keyValue, ";")
-				keyValue = strings.TrimSpace(keyValue)
-				keyParts = append(keyParts, keyValue)
-			}
-		}
-	}
-	
-	if len(keyParts) == 0 {
-		return dkimContent
-	}
-	
-	return fmt.Sprintf("v=DKIM1; k=rsa; p=%s", keyParts[0])
-}
-
 // renderTemplate renders a template with given variables
 func renderTemplate(template string, variables map[string]string) string {
 	result := template
@@ -0,0 +1,113 @@
+package scheduler
+
+import (
+	"fmt"
+	"mailops/internal/deploy/profiles"
+	"mailops/internal/protocol"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// serverKey identifies the server of a row by its SSH address. Rows with
+// the same key deploy their domains to one server.
+func serverKey(server ServerConfig) string {
+	return net.JoinHostPort(server.ServerIP, strconv.Itoa(server.ServerPort))
+}
+
+// registerServer records the row of a task under its server, so rows
+// sharing it are validated together and take turns deploying. The caller
+// holds s.mu.
+func (s *Scheduler) registerServer(server ServerConfig) {
+	if s.hosted == nil {
+		s.hosted = make(map[string][]ServerConfig)
+	}
+	key := serverKey(server)
+	rows := s.hosted[key]
+	for i, row := range rows {
+		if row.RowID == server.RowID {
+			rows[i] = server
+			return
+		}
+	}
+	rows = append(rows, server)
+	sort.Slice(rows, func(i, j int) bool { return rows[i].RowID < rows[j].RowID })
+	s.hosted[key] = rows
+}
+
+// hostedRows returns the rows sharing the server of a task ordered by row
+// ID, the task's own row included
+func (s *Scheduler) hostedRows(task *Task) []ServerConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows := s.hosted[serverKey(task.Server)]
+	for _, row := range rows {
+		if row.RowID == task.RowID {
+			return append([]ServerConfig(nil), rows...)
+		}
+	}
+	return []ServerConfig{task.Server}
+}
+
+// serverHost returns the host name of a task's server, the mail host of
+// the row sharing it with the lowest ID
+func (s *Scheduler) serverHost(task *Task) string {
+	return s.hostedRows(task)[0].MailHostname()
+}
+
+// checkSharedServer rejects rows sharing a server that cannot be deployed
+// together: they must use one profile able to host several domains
+func (s *Scheduler) checkSharedServer(task *Task) error {
+	rows := s.hostedRows(task)
+	if len(rows) == 1 {
+		return nil
+	}
+
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = strconv.Itoa(row.RowID)
+	}
+	for _, row := range rows {
+		if row.DeployProfile != task.Server.DeployProfile {
+			return fmt.Errorf("rows %s share server %s but use different deploy profiles", strings.Join(ids, ", "), serverKey(task.Server))
+		}
+	}
+	profile, err := s.newProfile(task)
+	if err != nil {
+		return err
+	}
+	if _, ok := profile.(profiles.MultiDomain); !ok {
+		return fmt.Errorf("rows %s share server %s, but %s hosts a single domain per server", strings.Join(ids, ", "), serverKey(task.Server), task.Server.DeployProfile)
+	}
+	return nil
+}
+
+// acquireServer waits until no other task of the run works on the server of
+// a task and returns the function releasing it, or nil when the task was
+// cancelled while waiting
+func (s *Scheduler) acquireServer(task *Task) func() {
+	key := serverKey(task.Server)
+	s.mu.Lock()
+	if s.serverSlots == nil {
+		s.serverSlots = make(map[string]chan struct{})
+	}
+	slot, ok := s.serverSlots[key]
+	if !ok {
+		slot = make(chan struct{}, 1)
+		s.serverSlots[key] = slot
+	}
+	s.mu.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+	default:
+		s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("Waiting for another row deploying to %s...", key))
+		select {
+		case slot <- struct{}{}:
+		case <-task.Ctx.Done():
+			return nil
+		}
+	}
+	return func() { <-slot }
+}
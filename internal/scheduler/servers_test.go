@@ -0,0 +1,57 @@
+package scheduler
+
+import "testing"
+
+func TestServerHost(t *testing.T) {
+	rows := []ServerConfig{
+		{RowID: 3, ServerIP: "192.0.2.1", ServerPort: 22, Host: "mail", Domain: "third.example"},
+		{RowID: 1, ServerIP: "192.0.2.1", ServerPort: 22, Host: "mx", Domain: "first.example."},
+		{RowID: 2, ServerIP: "192.0.2.1", ServerPort: 2222, Host: "mail", Domain: "other-port.example"},
+		{RowID: 4, ServerIP: "192.0.2.2", ServerPort: 22, Host: "", Domain: "alone.example"},
+	}
+
+	s := &Scheduler{}
+	for _, row := range rows {
+		s.registerServer(row)
+	}
+
+	tests := []struct {
+		row  ServerConfig
+		want string
+	}{
+		{rows[0], "mx.first.example"},
+		{rows[1], "mx.first.example"},
+		{rows[2], "mail.other-port.example"},
+		{rows[3], "alone.example"},
+		// A row of another run shares nothing
+		{ServerConfig{RowID: 9, ServerIP: "192.0.2.1", ServerPort: 22, Host: "mail", Domain: "unregistered.example"}, "mail.unregistered.example"},
+	}
+
+	for _, tt := range tests {
+		task := &Task{RowID: tt.row.RowID, Server: tt.row}
+		if got := s.serverHost(task); got != tt.want {
+			t.Errorf("serverHost(row %d) = %q, want %q", tt.row.RowID, got, tt.want)
+		}
+	}
+
+	task := &Task{RowID: 3, Server: rows[0]}
+	if got := s.hostedRows(task); len(got) != 2 || got[0].RowID != 1 || got[1].RowID != 3 {
+		t.Errorf("hostedRows(row 3) = %+v, want rows 1 and 3", got)
+	}
+}
+
+func TestServerKey(t *testing.T) {
+	tests := []struct {
+		server ServerConfig
+		want   string
+	}{
+		{ServerConfig{ServerIP: "192.0.2.1", ServerPort: 22}, "192.0.2.1:22"},
+		{ServerConfig{ServerIP: "2001:db8::1", ServerPort: 2222}, "[2001:db8::1]:2222"},
+	}
+
+	for _, tt := range tests {
+		if got := serverKey(tt.server); got != tt.want {
+			t.Errorf("serverKey(%+v) = %q, want %q", tt.server, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"mailops/internal/protocol"
+	"mailops/internal/ssh"
+	"time"
+)
+
+// sshKeepAlive is how often an idle task connection is checked, so a
+// connection dropped between steps is dialed again instead of hanging
+const sshKeepAlive = 30 * time.Second
+
+// sshClient returns the connection of a task to its server. It is dialed
+// on first use and shared by the steps of the task until closeSSH.
+func (s *Scheduler) sshClient(task *Task) (*ssh.Client, error) {
+	s.mu.Lock()
+	client := task.sshClient
+	s.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	client, err := ssh.NewClient(ssh.Config{
+		Host:      task.Server.ServerIP,
+		Port:      task.Server.ServerPort,
+		User:      task.Server.ServerUser,
+		Password:  task.Server.ServerPassword,
+		KeyPath:   task.Server.ServerKeyPath,
+		Timeout:   time.Duration(s.appConfig.SSHTimeoutMs) * time.Millisecond,
+		KeepAlive: sshKeepAlive,
+
+		HostKeys:           s.appConfig.SSHHostKeys,
+		HostKeyFingerprint: task.Server.ServerHostKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if task.sshClient != nil {
+		client.Close()
+		return task.sshClient, nil
+	}
+	task.sshClient = client
+	return client, nil
+}
+
+// sshError returns the task error of a failure to connect to a server. A
+// host key that does not match is never retried: the same key would be
+// presented again.
+func sshError(message string, err error) *TaskError {
+	var mismatch *ssh.HostKeyError
+	if errors.As(err, &mismatch) {
+		return &TaskError{Code: protocol.SSHHostKeyMismatch, Message: fmt.Sprintf("%s: %v", message, err)}
+	}
+	var unknown *ssh.UnknownHostKeyError
+	if errors.As(err, &unknown) {
+		return &TaskError{Code: protocol.InvalidConfig, Message: fmt.Sprintf("%s: %v", message, err)}
+	}
+	return &TaskError{Code: protocol.SSHConn, Message: fmt.Sprintf("%s: %v", message, err)}
+}
+
+// closeSSH closes the connection of a task, if it has one
+func (s *Scheduler) closeSSH(task *Task) {
+	s.mu.Lock()
+	client := task.sshClient
+	task.sshClient = nil
+	s.mu.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+}
+
+// withSSH runs fn with the connection of a task to its server, holding the
+// server's lock unless the task already does. A task that did not hold the
+// lock has its connection closed afterwards. fn is not run when the task is
+// cancelled while waiting for the lock, or has lost it to another run.
+func (s *Scheduler) withSSH(task *Task, fn func(client *ssh.Client) (string, error)) (string, error) {
+	if task.serverLock == nil {
+		defer s.closeSSH(task)
+		if err := s.lockServer(task); err != nil {
+			return "", errors.New(err.Message)
+		}
+		defer s.unlockServer(task)
+	} else if err := checkServerLock(task); err != nil {
+		return "", errors.New(err.Message)
+	}
+	return s.runSSH(task, fn)
+}
+
+// runSSH runs fn with the connection of a task to its server
+func (s *Scheduler) runSSH(task *Task, fn func(client *ssh.Client) (string, error)) (string, error) {
+	client, err := s.sshClient(task)
+	if err != nil {
+		return "", fmt.Errorf("failed to create SSH client: %w", err)
+	}
+	return fn(client)
+}
@@ -0,0 +1,185 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailops/internal/deploy/profiles"
+	"mailops/internal/protocol"
+	"mailops/internal/ssh"
+	"mailops/internal/users"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UserReport is the outcome of the user commands run on one server
+type UserReport struct {
+	RunID    string             `json:"run_id"`
+	RowID    int                `json:"row_id"`
+	Domain   string             `json:"domain"`
+	ServerIP string             `json:"server_ip"`
+	Results  []UserResult       `json:"results"`
+	Users    *profiles.UserList `json:"users,omitempty"` // Listed by the last list command
+	Error    string             `json:"error,omitempty"` // Why the commands could not run
+}
+
+// UserResult is the outcome of one user command
+type UserResult struct {
+	Line        int    `json:"line"`
+	Action      string `json:"action"`
+	Address     string `json:"address,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Success     bool   `json:"success"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Failed reports whether the server could not be reached or a command
+// failed on it
+func (r *UserReport) Failed() bool {
+	if r.Error != "" {
+		return true
+	}
+	for _, result := range r.Results {
+		if !result.Success {
+			return true
+		}
+	}
+	return false
+}
+
+// ManageUsers runs mailbox and alias commands on the servers of their
+// domains, in the order given, and returns a report of each server that
+// had commands. A command that matches no server fails the whole run
+// before any server is changed.
+func (s *Scheduler) ManageUsers(servers []ServerConfig, commands []users.Command) ([]*UserReport, error) {
+	planned := make([][]users.Command, len(servers))
+	var errs []error
+	for _, command := range commands {
+		matched := false
+		for i, server := range servers {
+			if command.RowID != 0 && command.RowID != server.RowID {
+				continue
+			}
+			domain := command.Domain()
+			if domain != "" && !strings.EqualFold(domain, strings.TrimSuffix(server.Domain, ".")) {
+				continue
+			}
+			planned[i] = append(planned[i], command)
+			matched = true
+		}
+		if !matched {
+			errs = append(errs, fmt.Errorf("line %d: no server for %s", command.Line, describeTarget(command)))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	var reports []*UserReport
+	for i, server := range servers {
+		if len(planned[i]) == 0 {
+			continue
+		}
+		task := &Task{RowID: server.RowID, Server: server, Ctx: context.Background()}
+		report := s.manageUsers(task, planned[i])
+		if err := s.writeUserReport(report); err != nil {
+			s.logger.Log(s.runID, task.RowID, protocol.Warn, fmt.Sprintf("Failed to write user report: %v", err))
+		}
+		if report.Failed() {
+			errs = append(errs, fmt.Errorf("row %d: user commands failed", server.RowID))
+		}
+		reports = append(reports, report)
+	}
+	return reports, errors.Join(errs...)
+}
+
+// describeTarget names the servers a command was meant for
+func describeTarget(command users.Command) string {
+	target := "domain " + command.Domain()
+	if command.Domain() == "" {
+		target = "any domain"
+	}
+	if command.RowID != 0 {
+		target += fmt.Sprintf(" in row %d", command.RowID)
+	}
+	return target
+}
+
+// manageUsers runs the commands of one server over a single connection
+func (s *Scheduler) manageUsers(task *Task, commands []users.Command) *UserReport {
+	report := &UserReport{
+		RunID:    s.runID,
+		RowID:    task.RowID,
+		Domain:   task.Server.Domain,
+		ServerIP: task.Server.ServerIP,
+		Results:  []UserResult{},
+	}
+
+	profile, err := s.newProfile(task)
+	if err != nil {
+		report.Error = err.Error()
+		s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("Cannot manage users of %s: %v", task.Server.Domain, err))
+		return report
+	}
+
+	_, err = s.withSSH(task, func(client *ssh.Client) (string, error) {
+		for _, command := range commands {
+			name := strings.TrimSpace(command.Action + " " + command.Address)
+			result := UserResult{Line: command.Line, Action: command.Action, Address: command.Address, Destination: command.Destination}
+			list, err := runUserCommand(profile, client, command)
+			if err != nil {
+				result.Error = err.Error()
+				s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("%s failed: %v", name, err))
+			} else {
+				result.Success = true
+				s.logger.Log(s.runID, task.RowID, protocol.Info, fmt.Sprintf("%s done", name))
+			}
+			if list != nil {
+				report.Users = list
+			}
+			report.Results = append(report.Results, result)
+		}
+		return "", nil
+	})
+	if err != nil {
+		report.Error = err.Error()
+		s.logger.Log(s.runID, task.RowID, protocol.Error, fmt.Sprintf("Cannot manage users of %s: %v", task.Server.Domain, err))
+	}
+	return report
+}
+
+// runUserCommand runs one command with a profile, returning the listing of
+// a list command
+func runUserCommand(profile profiles.Profile, client *ssh.Client, command users.Command) (*profiles.UserList, error) {
+	switch command.Action {
+	case users.ActionAdd:
+		return nil, profile.AddMailbox(client, command.Address, command.Password)
+	case users.ActionRemove:
+		return nil, profile.RemoveMailbox(client, command.Address)
+	case users.ActionPasswd:
+		return nil, profile.SetPassword(client, command.Address, command.Password)
+	case users.ActionAliasAdd:
+		return nil, profile.AddAlias(client, command.Address, command.Destinations())
+	case users.ActionAliasRemove:
+		return nil, profile.RemoveAlias(client, command.Address, command.Destinations())
+	case users.ActionList:
+		return profile.ListUsers(client)
+	}
+	return nil, fmt.Errorf("unknown action %q", command.Action)
+}
+
+// writeUserReport persists the report of a server next to the task reports
+func (s *Scheduler) writeUserReport(report *UserReport) error {
+	reportDir := filepath.Join("output/reports", s.runID)
+	if err := os.MkdirAll(reportDir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal user report: %w", err)
+	}
+	return os.WriteFile(filepath.Join(reportDir, fmt.Sprintf("%d.users.json", report.RowID)), data, 0644)
+}
@@ -0,0 +1,83 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTokenInvalid is returned for malformed or forged confirm tokens
+	ErrTokenInvalid = errors.New("confirm token is invalid")
+	// ErrTokenExpired is returned for confirm tokens past their expiry
+	ErrTokenExpired = errors.New("confirm token has expired")
+)
+
+// ConfirmSigner issues and verifies expiring confirm tokens. A token is bound
+// to a run ID and a digest of what is being confirmed, so it cannot be reused
+// for another run or after the confirmed content changes.
+type ConfirmSigner struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewConfirmSigner creates a signer. An empty secret generates a random one,
+// which means tokens do not survive a process restart.
+func NewConfirmSigner(secret []byte, ttl time.Duration) (*ConfirmSigner, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate signing secret: %w", err)
+		}
+	}
+
+	return &ConfirmSigner{
+		secret: secret,
+		ttl:    ttl,
+		now:    time.Now,
+	}, nil
+}
+
+// Issue returns a token for the given run and digest, and its expiry time
+func (s *ConfirmSigner) Issue(runID, digest string) (string, time.Time) {
+	expiresAt := s.now().Add(s.ttl)
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expiry + "." + s.sign(runID, digest, expiry), expiresAt
+}
+
+// Verify checks that a token was issued for the run and digest and has not expired
+func (s *ConfirmSigner) Verify(token, runID, digest string) error {
+	expiry, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrTokenInvalid
+	}
+
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return ErrTokenInvalid
+	}
+
+	expected := s.sign(runID, digest, expiry)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrTokenInvalid
+	}
+
+	if s.now().After(time.Unix(unix, 0)) {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+func (s *ConfirmSigner) sign(runID, digest, expiry string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(runID + "\n" + digest + "\n" + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,72 @@
+package security
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfirmSigner(t *testing.T) {
+	issued := time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC)
+	signer, err := NewConfirmSigner([]byte("secret"), 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.now = func() time.Time { return issued }
+
+	token, expiresAt := signer.Issue("run-1", "digest-1")
+	if want := issued.Add(10 * time.Minute); !expiresAt.Equal(want) {
+		t.Errorf("Issue expires at %v, want %v", expiresAt, want)
+	}
+	expiry, sig, _ := strings.Cut(token, ".")
+	other, _ := NewConfirmSigner([]byte("other secret"), 10*time.Minute)
+	other.now = signer.now
+	otherToken, _ := other.Issue("run-1", "digest-1")
+
+	tests := []struct {
+		name   string
+		token  string
+		runID  string
+		digest string
+		now    time.Time
+		want   error
+	}{
+		{"valid", token, "run-1", "digest-1", issued, nil},
+		{"valid until its expiry", token, "run-1", "digest-1", expiresAt, nil},
+		{"expired", token, "run-1", "digest-1", expiresAt.Add(time.Second), ErrTokenExpired},
+		{"issued for another run", token, "run-2", "digest-1", issued, ErrTokenInvalid},
+		{"plan changed after it was confirmed", token, "run-1", "digest-2", issued, ErrTokenInvalid},
+		{"expiry extended", "9999999999." + sig, "run-1", "digest-1", issued, ErrTokenInvalid},
+		{"signed with another secret", otherToken, "run-1", "digest-1", issued, ErrTokenInvalid},
+		{"no signature", expiry, "run-1", "digest-1", issued, ErrTokenInvalid},
+		{"malformed expiry", "soon." + sig, "run-1", "digest-1", issued, ErrTokenInvalid},
+		{"empty", "", "run-1", "digest-1", issued, ErrTokenInvalid},
+	}
+
+	for _, tt := range tests {
+		signer.now = func() time.Time { return tt.now }
+		if err := signer.Verify(tt.token, tt.runID, tt.digest); !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestConfirmSignerRandomSecret(t *testing.T) {
+	a, err := NewConfirmSigner(nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewConfirmSigner(nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _ := a.Issue("run-1", "digest")
+	if err := a.Verify(token, "run-1", "digest"); err != nil {
+		t.Errorf("Verify with the issuing signer = %v", err)
+	}
+	if err := b.Verify(token, "run-1", "digest"); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("Verify with another process's signer = %v, want %v", err, ErrTokenInvalid)
+	}
+}
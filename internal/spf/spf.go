@@ -0,0 +1,277 @@
+// Package spf parses and merges SPF records (RFC 7208) and counts the DNS
+// lookups they cause, which receivers cap at MaxLookups.
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailops/internal/dns"
+	"strings"
+)
+
+// MaxLookups is the number of DNS-querying terms an SPF evaluation may use
+// before receivers return a permanent error
+const MaxLookups = 10
+
+// mechanisms lists the mechanism names of RFC 7208
+var mechanisms = map[string]bool{
+	"all":     true,
+	"include": true,
+	"a":       true,
+	"mx":      true,
+	"ptr":     true,
+	"ip4":     true,
+	"ip6":     true,
+	"exists":  true,
+}
+
+// Term is a mechanism or modifier of an SPF record
+type Term struct {
+	Qualifier string // "+", "-", "~", "?" or empty, mechanisms only
+	Name      string // Lower case mechanism or modifier name
+	Arg       string // Everything after the name, including the ':', '/' or '=' separator
+	Modifier  bool
+}
+
+func (t Term) String() string {
+	return t.Qualifier + t.Name + t.Arg
+}
+
+// key identifies a term regardless of case and of an explicit "+" qualifier
+func (t Term) key() string {
+	qualifier := t.Qualifier
+	if qualifier == "+" {
+		qualifier = ""
+	}
+	return qualifier + t.Name + strings.ToLower(t.Arg)
+}
+
+// target returns the domain a lookup term queries, if it names one
+func (t Term) target() string {
+	return strings.TrimLeft(t.Arg, ":=")
+}
+
+// Record is a parsed SPF record
+type Record struct {
+	Terms []Term
+}
+
+// IsSPF reports whether a TXT record is an SPF record
+func IsSPF(txt string) bool {
+	txt = strings.ToLower(dns.JoinTXT(txt))
+	return txt == "v=spf1" || strings.HasPrefix(txt, "v=spf1 ")
+}
+
+// Parse parses an SPF record
+func Parse(txt string) (*Record, error) {
+	fields := strings.Fields(dns.JoinTXT(txt))
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "v=spf1") {
+		return nil, fmt.Errorf("not an SPF record: %q", txt)
+	}
+
+	r := &Record{}
+	for _, field := range fields[1:] {
+		term, err := parseTerm(field)
+		if err != nil {
+			return nil, err
+		}
+		r.Terms = append(r.Terms, term)
+	}
+	return r, nil
+}
+
+func parseTerm(field string) (Term, error) {
+	var term Term
+	if strings.ContainsRune("+-~?", rune(field[0])) {
+		term.Qualifier = field[:1]
+		field = field[1:]
+	}
+
+	end := strings.IndexAny(field, ":/=")
+	if end < 0 {
+		end = len(field)
+	}
+	term.Name = strings.ToLower(field[:end])
+	term.Arg = field[end:]
+
+	if strings.HasPrefix(term.Arg, "=") {
+		if term.Qualifier != "" || term.Name == "" {
+			return Term{}, fmt.Errorf("invalid SPF modifier %q", field)
+		}
+		term.Modifier = true
+		return term, nil
+	}
+	if !mechanisms[term.Name] {
+		return Term{}, fmt.Errorf("unknown SPF mechanism %q", field)
+	}
+	return term, nil
+}
+
+// String renders the record
+func (r *Record) String() string {
+	parts := make([]string, 0, len(r.Terms)+1)
+	parts = append(parts, "v=spf1")
+	for _, term := range r.Terms {
+		parts = append(parts, term.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// all returns the all mechanism of the record, or nil
+func (r *Record) all() *Term {
+	for i := range r.Terms {
+		if !r.Terms[i].Modifier && r.Terms[i].Name == "all" {
+			return &r.Terms[i]
+		}
+	}
+	return nil
+}
+
+// modifier returns the named modifier of the record, or nil
+func (r *Record) modifier(name string) *Term {
+	for i := range r.Terms {
+		if r.Terms[i].Modifier && r.Terms[i].Name == name {
+			return &r.Terms[i]
+		}
+	}
+	return nil
+}
+
+// Merge adds the mechanisms of ours that existing lacks, keeping the
+// existing terms, their order and their policy. Added mechanisms go before
+// the all mechanism. The existing all, or redirect when there is no all,
+// decides the result for unlisted senders; ours only applies when existing
+// has neither.
+func Merge(existing, ours *Record) *Record {
+	seen := make(map[string]bool)
+	merged := &Record{}
+
+	for _, source := range []*Record{existing, ours} {
+		for _, term := range source.Terms {
+			if term.Modifier || term.Name == "all" || seen[term.key()] {
+				continue
+			}
+			seen[term.key()] = true
+			merged.Terms = append(merged.Terms, term)
+		}
+	}
+
+	switch {
+	case existing.all() != nil:
+		merged.Terms = append(merged.Terms, *existing.all())
+	case existing.modifier("redirect") != nil:
+	case ours.all() != nil:
+		merged.Terms = append(merged.Terms, *ours.all())
+	}
+
+	for _, term := range existing.Terms {
+		if term.Modifier {
+			merged.Terms = append(merged.Terms, term)
+		}
+	}
+	for _, term := range ours.Terms {
+		if term.Modifier && existing.modifier(term.Name) == nil {
+			merged.Terms = append(merged.Terms, term)
+		}
+	}
+
+	return merged
+}
+
+// Equal reports whether two records have the same terms in the same order
+func Equal(a, b *Record) bool {
+	if len(a.Terms) != len(b.Terms) {
+		return false
+	}
+	for i := range a.Terms {
+		if a.Terms[i].key() != b.Terms[i].key() {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolver looks up TXT records, as net.Resolver does
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// CountLookups counts the DNS lookups an evaluation of r can cause,
+// following include and redirect targets. Targets that cannot be resolved
+// or contain macros are counted once and reported in the returned error;
+// the count is still usable. Counting stops once MaxLookups is exceeded.
+func CountLookups(ctx context.Context, resolver Resolver, r *Record) (int, error) {
+	c := &counter{ctx: ctx, resolver: resolver, visited: make(map[string]bool)}
+	c.count(r)
+	return c.lookups, errors.Join(c.errs...)
+}
+
+type counter struct {
+	ctx      context.Context
+	resolver Resolver
+	visited  map[string]bool
+	lookups  int
+	errs     []error
+}
+
+func (c *counter) count(r *Record) {
+	redirect := r.modifier("redirect")
+	if r.all() != nil {
+		redirect = nil // Ignored when the record has an all mechanism
+	}
+
+	for _, term := range r.Terms {
+		if c.lookups > MaxLookups {
+			return
+		}
+		switch {
+		case !term.Modifier && (term.Name == "a" || term.Name == "mx" || term.Name == "ptr" || term.Name == "exists"):
+			c.lookups++
+		case !term.Modifier && term.Name == "include":
+			c.lookups++
+			c.follow(term.target())
+		case redirect != nil && term.Modifier && term.Name == "redirect":
+			c.lookups++
+			c.follow(term.target())
+		}
+	}
+}
+
+// follow counts the lookups of the SPF record published at domain
+func (c *counter) follow(domain string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if strings.Contains(domain, "%") {
+		c.errs = append(c.errs, fmt.Errorf("%s uses macros, its lookups are not counted", domain))
+		return
+	}
+	if c.visited[domain] {
+		c.errs = append(c.errs, fmt.Errorf("SPF record of %s is included more than once", domain))
+		return
+	}
+	c.visited[domain] = true
+
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		c.errs = append(c.errs, fmt.Errorf("failed to resolve SPF record of %s: %w", domain, err))
+		return
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if IsSPF(txt) {
+			records = append(records, txt)
+		}
+	}
+	if len(records) != 1 {
+		c.errs = append(c.errs, fmt.Errorf("%s has %d SPF records", domain, len(records)))
+		return
+	}
+
+	r, err := Parse(records[0])
+	if err != nil {
+		c.errs = append(c.errs, fmt.Errorf("SPF record of %s: %w", domain, err))
+		return
+	}
+	c.count(r)
+}
@@ -0,0 +1,203 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		txt     string
+		want    string // Rendered record, empty when parsing fails
+		wantErr bool
+	}{
+		{txt: "v=spf1 mx -all", want: "v=spf1 mx -all"},
+		{txt: "V=SPF1  MX  ip4:192.0.2.0/24 ~ALL", want: "v=spf1 mx ip4:192.0.2.0/24 ~all"},
+		{txt: `"v=spf1 include:_spf.example.net " "a:mail.example.com -all"`, want: "v=spf1 include:_spf.example.net a:mail.example.com -all"},
+		{txt: "v=spf1 a/24 +mx redirect=_spf.example.com", want: "v=spf1 a/24 +mx redirect=_spf.example.com"},
+		{txt: "v=spf1 exp=explain.example.com -all", want: "v=spf1 exp=explain.example.com -all"},
+		{txt: "v=spf1", want: "v=spf1"},
+		{txt: "v=spf10 mx", wantErr: true},
+		{txt: "v=DMARC1; p=none", wantErr: true},
+		{txt: "v=spf1 mx foo", wantErr: true},
+		{txt: "v=spf1 -redirect=_spf.example.com", wantErr: true},
+		{txt: "v=spf1 =example.com", wantErr: true},
+		{txt: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		r, err := Parse(tt.txt)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %q, want an error", tt.txt, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) = %v", tt.txt, err)
+			continue
+		}
+		if got := r.String(); got != tt.want {
+			t.Errorf("Parse(%q) = %q, want %q", tt.txt, got, tt.want)
+		}
+	}
+}
+
+func TestIsSPF(t *testing.T) {
+	tests := map[string]bool{
+		"v=spf1 mx -all":               true,
+		"V=SPF1":                       true,
+		`"v=spf1 " "-all"`:             true,
+		"v=spf10 mx":                   false,
+		"v=spf1-all":                   false,
+		"google-site-verification=abc": false,
+	}
+
+	for txt, want := range tests {
+		if got := IsSPF(txt); got != want {
+			t.Errorf("IsSPF(%q) = %v, want %v", txt, got, want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  string
+		ours      string
+		want      string
+		unchanged bool // Equal to existing
+	}{
+		{
+			name:     "adds missing mechanisms before all",
+			existing: "v=spf1 include:_spf.google.com ~all",
+			ours:     "v=spf1 mx a:mail.example.com -all",
+			want:     "v=spf1 include:_spf.google.com mx a:mail.example.com ~all",
+		},
+		{
+			name:      "does not repeat mechanisms",
+			existing:  "v=spf1 +MX ip4:192.0.2.1 -all",
+			ours:      "v=spf1 mx ip4:192.0.2.1 -all",
+			want:      "v=spf1 +mx ip4:192.0.2.1 -all",
+			unchanged: true,
+		},
+		{
+			name:     "a different qualifier is another mechanism",
+			existing: "v=spf1 ~mx -all",
+			ours:     "v=spf1 mx -all",
+			want:     "v=spf1 ~mx mx -all",
+		},
+		{
+			name:     "keeps the redirect policy",
+			existing: "v=spf1 ip4:192.0.2.1 redirect=_spf.example.net",
+			ours:     "v=spf1 mx -all",
+			want:     "v=spf1 ip4:192.0.2.1 mx redirect=_spf.example.net",
+		},
+		{
+			name:     "uses our all when existing has no policy",
+			existing: "v=spf1 ip4:192.0.2.1",
+			ours:     "v=spf1 mx -all",
+			want:     "v=spf1 ip4:192.0.2.1 mx -all",
+		},
+		{
+			name:     "keeps existing modifiers and adds ours",
+			existing: "v=spf1 mx exp=explain.example.com -all",
+			ours:     "v=spf1 mx exp=other.example.com redirect=_spf.example.net",
+			want:     "v=spf1 mx -all exp=explain.example.com redirect=_spf.example.net",
+		},
+		{
+			name:      "unchanged",
+			existing:  "v=spf1 mx -all",
+			ours:      "v=spf1 mx -all",
+			want:      "v=spf1 mx -all",
+			unchanged: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing, err := Parse(tt.existing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ours, err := Parse(tt.ours)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			merged := Merge(existing, ours)
+			if got := merged.String(); got != tt.want {
+				t.Errorf("Merge = %q, want %q", got, tt.want)
+			}
+			if got := Equal(existing, merged); got != tt.unchanged {
+				t.Errorf("Equal(existing, merged) = %v, want %v", got, tt.unchanged)
+			}
+		})
+	}
+}
+
+// fakeResolver serves TXT records from a map, failing for missing names
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return txts, nil
+}
+
+func TestCountLookups(t *testing.T) {
+	resolver := fakeResolver{
+		"_spf.example.net":    {"v=spf1 ip4:192.0.2.0/24 include:_spf2.example.net -all"},
+		"_spf2.example.net":   {"v=spf1 a mx -all", "unrelated"},
+		"_redirect.example":   {"v=spf1 mx a -all"},
+		"two.example":         {"v=spf1 -all", "v=spf1 mx -all"},
+		"loop.example":        {"v=spf1 include:loop.example -all"},
+		"invalid.example":     {"v=spf1 foo -all"},
+		"_spf.many.example":   {"v=spf1 " + strings.Repeat("a ", 12) + "-all"},
+		"nothing.example.net": {},
+	}
+
+	tests := []struct {
+		name    string
+		record  string
+		want    int
+		wantErr string // Substring of the error, empty for none
+	}{
+		{name: "no lookups", record: "v=spf1 ip4:192.0.2.1 ip6:2001:db8::/32 -all", want: 0},
+		{name: "direct", record: "v=spf1 a mx ptr exists:%{i}.example.com -all", want: 4},
+		{name: "nested includes", record: "v=spf1 mx include:_spf.example.net -all", want: 5},
+		{name: "redirect", record: "v=spf1 redirect=_redirect.example", want: 3},
+		{name: "redirect ignored with all", record: "v=spf1 mx redirect=_redirect.example -all", want: 1},
+		{name: "unresolvable", record: "v=spf1 include:missing.example -all", want: 1, wantErr: "failed to resolve"},
+		{name: "no SPF record", record: "v=spf1 include:nothing.example.net -all", want: 1, wantErr: "has 0 SPF records"},
+		{name: "two SPF records", record: "v=spf1 include:two.example -all", want: 1, wantErr: "has 2 SPF records"},
+		{name: "macro", record: "v=spf1 include:%{d}.spf.example -all", want: 1, wantErr: "uses macros"},
+		{name: "loop", record: "v=spf1 include:loop.example -all", want: 2, wantErr: "more than once"},
+		{name: "invalid include", record: "v=spf1 include:invalid.example -all", want: 1, wantErr: "unknown SPF mechanism"},
+		{name: "stops past the limit", record: "v=spf1 include:_spf.many.example include:_spf.example.net -all", want: MaxLookups + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Parse(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := CountLookups(context.Background(), resolver, r)
+			if got != tt.want {
+				t.Errorf("CountLookups = %d, want %d", got, tt.want)
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("CountLookups error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("CountLookups error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -12,23 +14,34 @@ import (
 
 // Config represents SSH client configuration
 type Config struct {
-	Host     string
-	Port     int
-	User     string
-	Password string
-	KeyPath  string
-	Timeout  time.Duration
+	Host      string
+	Port      int
+	User      string
+	Password  string
+	KeyPath   string
+	Timeout   time.Duration
+	KeepAlive time.Duration // Interval of keepalive requests, 0 to send none
+	
+	HostKeys           *HostKeyPolicy // Nil for DefaultHostKeyPolicy
+	HostKeyFingerprint string         // SHA256 fingerprint of the only host key accepted, overriding HostKeys
 }
 
-// Client represents an SSH client
+// Client represents an SSH client. A connection the server dropped is
+// dialed again before the next command.
 type Client struct {
-	host     string
-	port     int
-	user     string
-	password string
-	keyPath  string
-	timeout  time.Duration
-	client   *ssh.Client
+	host      string
+	port      int
+	user      string
+	password  string
+	keyPath   string
+	timeout   time.Duration
+	keepAlive time.Duration
+	hostKeys  *HostKeyPolicy
+	hostKeyFP string     // Expected host key fingerprint, if any
+	mu        sync.Mutex // Guards client while it is replaced
+	client    *ssh.Client
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // CommandResult represents the result of a command execution
@@ -41,26 +54,48 @@ type CommandResult struct {
 // NewClient creates a new SSH client
 func NewClient(config Config) (*Client, error) {
 	c := &Client{
-		host:     config.Host,
-		port:     config.Port,
-		user:     config.User,
-		password: config.Password,
-		keyPath:  config.KeyPath,
-		timeout:  config.Timeout,
+		host:      config.Host,
+		port:      config.Port,
+		user:      config.User,
+		password:  config.Password,
+		keyPath:   config.KeyPath,
+		timeout:   config.Timeout,
+		keepAlive: config.KeepAlive,
+		closed:    make(chan struct{}),
+	}
+	
+	policy := config.HostKeys
+	if policy == nil {
+		policy = DefaultHostKeyPolicy()
 	}
+	c.hostKeys = policy
+	c.hostKeyFP = config.HostKeyFingerprint
 	
 	if err := c.connect(); err != nil {
 		return nil, err
 	}
 	
+	if c.keepAlive > 0 {
+		go c.sendKeepAlives()
+	}
+	
 	return c, nil
 }
 
 func (c *Client) connect() error {
+	address := fmt.Sprintf("%s:%d", c.host, c.port)
+	
+	// The handshake error only has the text of a host key error
+	var hostKeyErr error
+	checkHostKey := c.hostKeys.callback(c.hostKeyFP)
 	sshConfig := &ssh.ClientConfig{
-		User:            c.user,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         c.timeout,
+		User: c.user,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = checkHostKey(hostname, remote, key)
+			return hostKeyErr
+		},
+		HostKeyAlgorithms: c.hostKeys.algorithms(c.hostKeyFP, address),
+		Timeout:           c.timeout,
 	}
 	
 	if c.keyPath != "" {
@@ -79,8 +114,10 @@ func (c *Client) connect() error {
 		return errors.New("no authentication method provided")
 	}
 	
-	address := fmt.Sprintf("%s:%d", c.host, c.port)
 	client, err := ssh.Dial("tcp", address, sshConfig)
+	if hostKeyErr != nil {
+		return fmt.Errorf("failed to dial: %w", hostKeyErr)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to dial: %w", err)
 	}
@@ -89,13 +126,64 @@ func (c *Client) connect() error {
 	return nil
 }
 
-// ExecuteCommand executes a command on the remote server
-func (c *Client) ExecuteCommand(cmd string, timeout time.Duration) (*CommandResult, error) {
+// newSession opens a session, dialing the server again when the connection
+// was lost. No command has run on a session that failed to open, so it is
+// safe to retry on a new connection.
+func (c *Client) newSession() (*ssh.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
 	if c.client == nil {
 		return nil, errors.New("SSH client not connected")
 	}
-	
 	session, err := c.client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+	
+	select {
+	case <-c.closed:
+		return nil, errors.New("SSH client closed")
+	default:
+	}
+	c.client.Close()
+	if err := c.connect(); err != nil {
+		return nil, fmt.Errorf("failed to reconnect: %w", err)
+	}
+	return c.client.NewSession()
+}
+
+// sendKeepAlives sends a keepalive request every keepAlive until the client
+// is closed. A connection that does not answer within keepAlive is closed,
+// which also ends the request waiting on it, so the next command dials again
+// instead of waiting on a dead connection.
+func (c *Client) sendKeepAlives() {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		
+		c.mu.Lock()
+		client := c.client
+		c.mu.Unlock()
+		
+		timeout := time.AfterFunc(c.keepAlive, func() { client.Close() })
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		if timeout.Stop() && err == nil {
+			continue
+		}
+		client.Close()
+	}
+}
+
+// ExecuteCommand executes a command on the remote server
+func (c *Client) ExecuteCommand(cmd string, timeout time.Duration) (*CommandResult, error) {
+	session, err := c.newSession()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %w", err)
 	}
@@ -129,6 +217,9 @@ func (c *Client) ExecuteCommand(cmd string, timeout time.Duration) (*CommandResu
 // ExecuteCommandWithOutput executes a command and returns combined output
 func (c *Client) ExecuteCommandWithOutput(cmd string, timeout time.Duration) (string, error) {
 	result, err := c.ExecuteCommand(cmd, timeout)
+	if err != nil && result == nil {
+		return "", err
+	}
 	if err != nil && result.ExitCode != 0 {
 		return result.Stdout, fmt.Errorf("command failed (exit code %d): %s", result.ExitCode, result.Stderr)
 	}
@@ -150,16 +241,18 @@ func (c *Client) CheckPort(port int, timeout time.Duration) bool {
 	return err == nil && result.ExitCode == 0
 }
 
-// TestConnection tests the SSH connection
+// TestConnection tests the SSH connection by running a command over it
 func (c *Client) TestConnection() error {
-	if err := c.connect(); err != nil {
-		return err
-	}
-	return c.Close()
+	_, err := c.ExecuteCommand("true", c.timeout+10*time.Second)
+	return err
 }
 
 // Close closes the SSH connection
 func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.client != nil {
 		return c.client.Close()
 	}
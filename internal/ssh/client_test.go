@@ -0,0 +1,225 @@
+package ssh
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// execServer is an SSH server accepting any password that answers each
+// command with its own text. It can drop its connections, and stop
+// answering keepalive requests.
+type execServer struct {
+	host string
+	port int
+
+	mu         sync.Mutex
+	conns      []net.Conn
+	dialed     int
+	closed     int  // Connections the client closed
+	unanswered bool // Keepalive requests are left unanswered
+}
+
+func newExecServer(t *testing.T) *execServer {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(ed25519Signer(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &execServer{host: "127.0.0.1", port: l.Addr().(*net.TCPAddr).Port}
+	t.Cleanup(func() {
+		l.Close()
+		srv.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.dialed++
+			srv.mu.Unlock()
+			go srv.serve(conn, config)
+		}
+	}()
+	return srv
+}
+
+func (srv *execServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go func() {
+		for req := range requests {
+			srv.mu.Lock()
+			unanswered := srv.unanswered
+			srv.mu.Unlock()
+			if !unanswered {
+				req.Reply(true, nil)
+			}
+		}
+	}()
+	go func() {
+		sshConn.Wait()
+		srv.mu.Lock()
+		srv.closed++
+		srv.mu.Unlock()
+	}()
+
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				ssh.Unmarshal(req.Payload, &exec)
+				req.Reply(true, nil)
+				channel.Write([]byte(exec.Command))
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+// drop closes the server side of every connection
+func (srv *execServer) drop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *execServer) counts() (dialed, closed int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.dialed, srv.closed
+}
+
+func (srv *execServer) client(t *testing.T, keepAlive time.Duration) *Client {
+	t.Helper()
+	client, err := NewClient(Config{
+		Host:      srv.host,
+		Port:      srv.port,
+		User:      "root",
+		Password:  "secret",
+		Timeout:   5 * time.Second,
+		KeepAlive: keepAlive,
+		HostKeys:  &HostKeyPolicy{Mode: HostKeyInsecure},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func mustRun(t *testing.T, client *Client, cmd string) {
+	t.Helper()
+	output, err := client.ExecuteCommandWithOutput(cmd, 5*time.Second)
+	if err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	if output != cmd {
+		t.Fatalf("%s printed %q", cmd, output)
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestReconnectAfterDroppedConnection(t *testing.T) {
+	srv := newExecServer(t)
+	client := srv.client(t, 0)
+
+	mustRun(t, client, "first")
+	mustRun(t, client, "second")
+	if dialed, _ := srv.counts(); dialed != 1 {
+		t.Fatalf("commands dialed %d connections, want 1 shared", dialed)
+	}
+
+	srv.drop()
+	mustRun(t, client, "after drop")
+	if dialed, _ := srv.counts(); dialed != 2 {
+		t.Errorf("dialed %d connections, want the dropped one dialed again", dialed)
+	}
+	mustRun(t, client, "after reconnect")
+	if dialed, _ := srv.counts(); dialed != 2 {
+		t.Errorf("dialed %d connections, want the new one shared", dialed)
+	}
+
+	client.Close()
+	srv.drop()
+	if _, err := client.ExecuteCommand("closed", 5*time.Second); err == nil {
+		t.Error("closed client ran a command")
+	}
+	if dialed, _ := srv.counts(); dialed != 2 {
+		t.Errorf("closed client dialed again, %d connections", dialed)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	srv := newExecServer(t)
+	client := srv.client(t, interval)
+
+	// An answered keepalive keeps the connection
+	time.Sleep(5 * interval)
+	if dialed, closed := srv.counts(); dialed != 1 || closed != 0 {
+		t.Fatalf("answered keepalives: %d dialed, %d closed, want the connection kept", dialed, closed)
+	}
+	mustRun(t, client, "kept")
+
+	// A keepalive left unanswered closes the connection, and the next
+	// command dials again
+	srv.mu.Lock()
+	srv.unanswered = true
+	srv.mu.Unlock()
+	waitFor(t, "the unanswered connection to be closed", func() bool {
+		_, closed := srv.counts()
+		return closed == 1
+	})
+	srv.mu.Lock()
+	srv.unanswered = false
+	srv.mu.Unlock()
+	mustRun(t, client, "redialed")
+	if dialed, _ := srv.counts(); dialed != 2 {
+		t.Errorf("dialed %d connections, want the closed one dialed again", dialed)
+	}
+
+	// Closing the client stops the keepalives with the connection
+	client.Close()
+	waitFor(t, "the client's connection to be closed", func() bool {
+		_, closed := srv.counts()
+		return closed == 2
+	})
+}
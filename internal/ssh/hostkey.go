@@ -0,0 +1,218 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key policies
+const (
+	HostKeyStrict   = "strict"   // Accept only keys listed in known_hosts or the store
+	HostKeyTOFU     = "tofu"     // Also accept the key of a new host, recording it in the store
+	HostKeyInsecure = "insecure" // Accept any key
+)
+
+// DefaultHostKeyStore is the known_hosts file mailops records host keys in
+const DefaultHostKeyStore = "output/known_hosts"
+
+// HostKeyPolicy decides which host keys a client accepts. A fingerprint
+// expected for a server overrides it.
+type HostKeyPolicy struct {
+	Mode       string   // HostKeyStrict, HostKeyTOFU or HostKeyInsecure
+	KnownHosts []string // OpenSSH known_hosts files, only read. Missing files are skipped.
+	Store      string   // known_hosts file owned by mailops, written on first use
+}
+
+// DefaultHostKeyPolicy trusts a host on first use and reads the user's
+// OpenSSH known_hosts
+func DefaultHostKeyPolicy() *HostKeyPolicy {
+	policy := &HostKeyPolicy{Mode: HostKeyTOFU, Store: DefaultHostKeyStore}
+	if home, err := os.UserHomeDir(); err == nil {
+		policy.KnownHosts = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	return policy
+}
+
+// HostKeyError reports a server presenting another key than the one known
+// for it: the server was reinstalled, or someone is in between
+type HostKeyError struct {
+	Host        string
+	Fingerprint string   // Of the key presented
+	Want        []string // Fingerprints of the known keys
+	Source      string   // Where the known keys are listed
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key of %s is %s, but %s lists %s", e.Host, e.Fingerprint, e.Source, strings.Join(e.Want, ", "))
+}
+
+// UnknownHostKeyError reports a server whose key is not known under the
+// strict policy
+type UnknownHostKeyError struct {
+	Host        string
+	Fingerprint string
+}
+
+func (e *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("host key %s of %s is not known, add it to known_hosts or the row's server_host_key", e.Fingerprint, e.Host)
+}
+
+// storeMu serializes writes to host key stores
+var storeMu sync.Mutex
+
+// hostKeyAlgorithms are the host key algorithms offered to servers, in the
+// order OpenSSH prefers them. x/crypto alone prefers ECDSA and RSA.
+var hostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+}
+
+// probeKey is a key no host has, checked against known_hosts to learn the
+// types of the keys known for a host
+var probeKey, _ = ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+
+// callback returns the host key check of the policy. A non-empty
+// fingerprint is the only key accepted.
+func (p *HostKeyPolicy) callback(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented := ssh.FingerprintSHA256(key)
+		if fingerprint != "" {
+			want := NormalizeFingerprint(fingerprint)
+			if presented == want {
+				return nil
+			}
+			return &HostKeyError{Host: hostname, Fingerprint: presented, Want: []string{want}, Source: "server_host_key"}
+		}
+		if p.Mode == HostKeyInsecure {
+			return nil
+		}
+
+		if files := p.files(); len(files) > 0 {
+			check, err := knownhosts.New(files...)
+			if err != nil {
+				return fmt.Errorf("failed to read known hosts: %w", err)
+			}
+			err = check(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			if err == nil || !errors.As(err, &keyErr) {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				mismatch := &HostKeyError{Host: hostname, Fingerprint: presented, Source: fmt.Sprintf("%s:%d", keyErr.Want[0].Filename, keyErr.Want[0].Line)}
+				for _, known := range keyErr.Want {
+					mismatch.Want = append(mismatch.Want, ssh.FingerprintSHA256(known.Key))
+				}
+				return mismatch
+			}
+		}
+
+		if p.Mode != HostKeyTOFU || p.Store == "" {
+			return &UnknownHostKeyError{Host: hostname, Fingerprint: presented}
+		}
+		return p.record(hostname, key)
+	}
+}
+
+// algorithms returns the host key algorithms to offer to a server: those
+// of the keys known for it, so it presents a key that can be checked
+// rather than one of another type that would look like a changed key
+func (p *HostKeyPolicy) algorithms(fingerprint, address string) []string {
+	files := p.files()
+	if fingerprint != "" || p.Mode == HostKeyInsecure || len(files) == 0 {
+		return hostKeyAlgorithms
+	}
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return hostKeyAlgorithms
+	}
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return hostKeyAlgorithms
+	}
+
+	var keyErr *knownhosts.KeyError
+	if err := check(address, remote, probeKey); !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return hostKeyAlgorithms
+	}
+	known := make(map[string]bool)
+	for _, want := range keyErr.Want {
+		known[want.Key.Type()] = true
+	}
+
+	var algorithms []string
+	for _, algorithm := range hostKeyAlgorithms {
+		keyType := algorithm
+		if algorithm == ssh.KeyAlgoRSASHA512 || algorithm == ssh.KeyAlgoRSASHA256 {
+			keyType = ssh.KeyAlgoRSA
+		}
+		if known[keyType] {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	if len(algorithms) == 0 {
+		return hostKeyAlgorithms
+	}
+	return algorithms
+}
+
+// files returns the known_hosts files of the policy that exist
+func (p *HostKeyPolicy) files() []string {
+	var files []string
+	for _, path := range append(append([]string(nil), p.KnownHosts...), p.Store) {
+		if _, err := os.Stat(path); path != "" && err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// record appends the key of a host seen for the first time to the store
+func (p *HostKeyPolicy) record(hostname string, key ssh.PublicKey) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(p.Store), 0755); err != nil {
+		return fmt.Errorf("failed to record host key: %w", err)
+	}
+	file, err := os.OpenFile(p.Store, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to record host key: %w", err)
+	}
+	defer file.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("failed to record host key: %w", err)
+	}
+	return nil
+}
+
+// NormalizeFingerprint returns a SHA256 fingerprint as ssh-keygen -l prints
+// it, accepting it without the SHA256: prefix or with base64 padding
+func NormalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimRight(strings.TrimSpace(fingerprint), "=")
+	if len(fingerprint) > 7 && strings.EqualFold(fingerprint[:7], "SHA256:") {
+		fingerprint = fingerprint[7:]
+	}
+	return "SHA256:" + fingerprint
+}
+
+// CheckFingerprint reports whether a fingerprint is a SHA256 fingerprint
+func CheckFingerprint(fingerprint string) error {
+	encoded := strings.TrimPrefix(NormalizeFingerprint(fingerprint), "SHA256:")
+	if len(encoded) != 43 || strings.Trim(encoded, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/") != "" {
+		return fmt.Errorf("invalid SHA256 host key fingerprint %q", fingerprint)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is an SSH server accepting any password and running no
+// commands, presenting the given host keys
+func testServer(t *testing.T, hostKeys ...ssh.Signer) (string, int) {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil },
+	}
+	for _, key := range hostKeys {
+		config.AddHostKey(key)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for channel := range channels {
+					channel.Reject(ssh.Prohibited, "no commands")
+				}
+			}()
+		}
+	}()
+	return "127.0.0.1", l.Addr().(*net.TCPAddr).Port
+}
+
+func ed25519Signer(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func ecdsaSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeKnownHosts writes a known_hosts file listing keys for a server
+func writeKnownHosts(t *testing.T, path, host string, port int, keys ...ssh.PublicKey) {
+	t.Helper()
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(port)))}, key))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dialTest(host string, port int, policy *HostKeyPolicy, fingerprint string) error {
+	client, err := NewClient(Config{
+		Host:               host,
+		Port:               port,
+		User:               "root",
+		Password:           "secret",
+		Timeout:            5 * time.Second,
+		HostKeys:           policy,
+		HostKeyFingerprint: fingerprint,
+	})
+	if err != nil {
+		return err
+	}
+	client.Close()
+	return nil
+}
+
+func TestHostKeyPolicy(t *testing.T) {
+	edKey := ed25519Signer(t)
+	ecKey := ecdsaSigner(t)
+	otherKey := ed25519Signer(t)
+	host, port := testServer(t, ecKey, edKey)
+
+	tests := []struct {
+		name        string
+		mode        string
+		knownHosts  []ssh.PublicKey // Listed in the user's known_hosts
+		fingerprint string
+		wantErr     any // Nil, *HostKeyError or *UnknownHostKeyError
+		wantStored  bool
+	}{
+		{name: "tofu records a new host", mode: HostKeyTOFU, wantStored: true},
+		{name: "strict rejects a new host", mode: HostKeyStrict, wantErr: &UnknownHostKeyError{}},
+		{name: "known ed25519 key", mode: HostKeyStrict, knownHosts: []ssh.PublicKey{edKey.PublicKey()}},
+		{name: "known ecdsa key", mode: HostKeyStrict, knownHosts: []ssh.PublicKey{ecKey.PublicKey()}},
+		{name: "changed key", mode: HostKeyTOFU, knownHosts: []ssh.PublicKey{otherKey.PublicKey()}, wantErr: &HostKeyError{}},
+		{name: "insecure", mode: HostKeyInsecure, knownHosts: []ssh.PublicKey{otherKey.PublicKey()}},
+		{name: "fingerprint", mode: HostKeyStrict, fingerprint: ssh.FingerprintSHA256(edKey.PublicKey())},
+		{name: "fingerprint without prefix", mode: HostKeyStrict, fingerprint: strings.TrimPrefix(ssh.FingerprintSHA256(edKey.PublicKey()), "SHA256:") + "="},
+		{name: "fingerprint overrides known_hosts", mode: HostKeyStrict, knownHosts: []ssh.PublicKey{otherKey.PublicKey()}, fingerprint: ssh.FingerprintSHA256(edKey.PublicKey())},
+		{name: "wrong fingerprint", mode: HostKeyInsecure, fingerprint: ssh.FingerprintSHA256(otherKey.PublicKey()), wantErr: &HostKeyError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			policy := &HostKeyPolicy{
+				Mode:       tt.mode,
+				KnownHosts: []string{filepath.Join(dir, "known_hosts"), filepath.Join(dir, "missing")},
+				Store:      filepath.Join(dir, "store", "known_hosts"),
+			}
+			if tt.knownHosts != nil {
+				writeKnownHosts(t, policy.KnownHosts[0], host, port, tt.knownHosts...)
+			}
+
+			err := dialTest(host, port, policy, tt.fingerprint)
+			switch tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("connect = %v", err)
+				}
+			case *HostKeyError:
+				var mismatch *HostKeyError
+				if !errors.As(err, &mismatch) {
+					t.Fatalf("connect = %v, want a host key mismatch", err)
+				}
+			case *UnknownHostKeyError:
+				var unknown *UnknownHostKeyError
+				if !errors.As(err, &unknown) {
+					t.Fatalf("connect = %v, want an unknown host key", err)
+				}
+			}
+
+			_, statErr := os.Stat(policy.Store)
+			if stored := statErr == nil; stored != tt.wantStored {
+				t.Errorf("store written = %v, want %v", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestHostKeyTOFUThenStrict(t *testing.T) {
+	edKey := ed25519Signer(t)
+	host, port := testServer(t, ecdsaSigner(t), edKey)
+	store := filepath.Join(t.TempDir(), "known_hosts")
+
+	if err := dialTest(host, port, &HostKeyPolicy{Mode: HostKeyTOFU, Store: store}, ""); err != nil {
+		t.Fatalf("first connect = %v", err)
+	}
+	data, err := os.ReadFile(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), ssh.KeyAlgoED25519) {
+		t.Errorf("recorded %q, want the ed25519 key OpenSSH would record", data)
+	}
+
+	if err := dialTest(host, port, &HostKeyPolicy{Mode: HostKeyStrict, Store: store}, ""); err != nil {
+		t.Errorf("connect with the recorded key = %v", err)
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		known       []ssh.PublicKey
+		fingerprint string
+		want        []string
+	}{
+		{"unknown host", nil, "", hostKeyAlgorithms},
+		{"ed25519", []ssh.PublicKey{ed25519Signer(t).PublicKey()}, "", []string{ssh.KeyAlgoED25519}},
+		{"ecdsa and ed25519", []ssh.PublicKey{ecdsaSigner(t).PublicKey(), ed25519Signer(t).PublicKey()}, "", []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256}},
+		{"rsa", []ssh.PublicKey{rsaKey}, "", []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}},
+		{"fingerprint", []ssh.PublicKey{rsaKey}, "SHA256:x", hostKeyAlgorithms},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			if tt.known != nil {
+				writeKnownHosts(t, path, "192.0.2.1", 2222, tt.known...)
+			}
+			policy := &HostKeyPolicy{Mode: HostKeyStrict, KnownHosts: []string{path}}
+
+			got := policy.algorithms(tt.fingerprint, "192.0.2.1:2222")
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("algorithms = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFingerprint(t *testing.T) {
+	valid := ssh.FingerprintSHA256(ed25519Signer(t).PublicKey())
+
+	tests := []struct {
+		fingerprint string
+		valid       bool
+	}{
+		{valid, true},
+		{strings.TrimPrefix(valid, "SHA256:"), true},
+		{" " + valid + "= ", true},
+		{"sha256:" + strings.TrimPrefix(valid, "SHA256:"), true},
+		{"SHA256:abc", false},
+		{"MD5:" + strings.TrimPrefix(valid, "SHA256:"), false},
+		{valid[:len(valid)-1] + "!", false},
+	}
+
+	for _, tt := range tests {
+		if err := CheckFingerprint(tt.fingerprint); (err == nil) != tt.valid {
+			t.Errorf("CheckFingerprint(%q) = %v, want valid %v", tt.fingerprint, err, tt.valid)
+		}
+	}
+}
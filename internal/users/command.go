@@ -0,0 +1,266 @@
+// Package users reads the mailbox and alias commands run against deployed
+// mail servers and hashes mailbox passwords.
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Actions of a command
+const (
+	ActionAdd         = "add"          // Create a mailbox
+	ActionRemove      = "remove"       // Remove a mailbox's login, keeping its mail
+	ActionPasswd      = "passwd"       // Change a mailbox's password
+	ActionAliasAdd    = "alias-add"    // Forward an address to destinations
+	ActionAliasRemove = "alias-remove" // Stop forwarding to a destination, or to all
+	ActionList        = "list"         // List the mailboxes and aliases of a domain
+)
+
+var (
+	localPattern  = regexp.MustCompile(`^[a-z0-9_%+=-]+(\.[a-z0-9_%+=-]+)*$`)
+	domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]([a-z0-9-]*[a-z0-9])?$`)
+)
+
+// Command is one change to, or listing of, the mailboxes and aliases of a
+// domain. It runs on the servers of the domain, or on RowID only.
+type Command struct {
+	Line        int    `json:"-"` // Where the command was read, for errors
+	RowID       int    `json:"row_id,omitempty"`
+	Action      string `json:"action"`
+	Address     string `json:"address"`               // The domain, or empty for every server, to list
+	Password    string `json:"password,omitempty"`    // add and passwd
+	Destination string `json:"destination,omitempty"` // Comma separated addresses, alias actions
+}
+
+// Domain returns the domain the command applies to, empty when a listing
+// applies to every server
+func (c *Command) Domain() string {
+	if c.Action == ActionList {
+		return c.Address
+	}
+	_, domain, _ := strings.Cut(c.Address, "@")
+	return domain
+}
+
+// Destinations returns the addresses of Destination
+func (c *Command) Destinations() []string {
+	var destinations []string
+	for _, destination := range strings.Split(c.Destination, ",") {
+		if destination = strings.TrimSpace(destination); destination != "" {
+			destinations = append(destinations, destination)
+		}
+	}
+	return destinations
+}
+
+// normalize lowercases addresses, which mail servers compare without case
+func (c *Command) normalize() {
+	c.Action = strings.ToLower(strings.TrimSpace(c.Action))
+	c.Address = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(c.Address), "."))
+	c.Destination = strings.ToLower(strings.Join(c.Destinations(), ","))
+}
+
+// Validate checks that the command is complete and that its addresses are
+// safe to pass to the server's tools
+func (c *Command) Validate() error {
+	switch c.Action {
+	case ActionAdd, ActionPasswd:
+		if err := checkAddress(c.Address, false); err != nil {
+			return err
+		}
+		if c.Password == "" {
+			return fmt.Errorf("%s of %s needs a password", c.Action, c.Address)
+		}
+		for _, r := range c.Password {
+			if r < ' ' || r == 0x7f {
+				return fmt.Errorf("password of %s contains a control character", c.Address)
+			}
+		}
+	case ActionRemove:
+		if err := checkAddress(c.Address, false); err != nil {
+			return err
+		}
+	case ActionAliasAdd, ActionAliasRemove:
+		// An alias without a local part catches all mail of its domain
+		if err := checkAddress(c.Address, true); err != nil {
+			return err
+		}
+		if c.Action == ActionAliasAdd && c.Destination == "" {
+			return fmt.Errorf("alias-add of %s needs a destination", c.Address)
+		}
+		for _, destination := range c.Destinations() {
+			if err := checkAddress(destination, false); err != nil {
+				return fmt.Errorf("destination: %w", err)
+			}
+		}
+	case ActionList:
+		if c.Address != "" && !domainPattern.MatchString(c.Address) {
+			return fmt.Errorf("list takes a domain, not %q", c.Address)
+		}
+	case "":
+		return errors.New("missing action")
+	default:
+		return fmt.Errorf("unknown action %q (available: %s, %s, %s, %s, %s, %s)", c.Action,
+			ActionAdd, ActionRemove, ActionPasswd, ActionAliasAdd, ActionAliasRemove, ActionList)
+	}
+	if c.Password != "" && c.Action != ActionAdd && c.Action != ActionPasswd {
+		return fmt.Errorf("%s takes no password", c.Action)
+	}
+	return nil
+}
+
+// checkAddress validates a mail address, allowing an empty local part for
+// catch-all aliases
+func checkAddress(address string, catchAll bool) error {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	if !domainPattern.MatchString(domain) {
+		return fmt.Errorf("invalid domain in address %q", address)
+	}
+	if local == "" && catchAll {
+		return nil
+	}
+	if len(local) > 64 || !localPattern.MatchString(local) {
+		return fmt.Errorf("invalid local part in address %q", address)
+	}
+	return nil
+}
+
+// ReadFile reads the commands of a CSV file, or of an NDJSON file with one
+// command object per line, told apart by the extension
+func ReadFile(path string) ([]Command, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commands: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ParseCSV(bytes.NewReader(data))
+	case ".ndjson", ".jsonl", ".json":
+		return ParseNDJSON(bytes.NewReader(data))
+	}
+	return nil, fmt.Errorf("unknown command file type %s (use .csv or .ndjson)", path)
+}
+
+// ParseCSV reads commands from CSV with a header naming the action, address,
+// password, destination and row_id columns. Only action and address are
+// required.
+func ParseCSV(r io.Reader) ([]Command, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	names, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV has no header")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV: %w", err)
+	}
+
+	header := make(map[string]int, len(names))
+	for i, name := range names {
+		header[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"action", "address"} {
+		if _, ok := header[name]; !ok {
+			return nil, fmt.Errorf("CSV header must contain an %s column", name)
+		}
+	}
+
+	var commands []Command
+	var errs []error
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		column := func(name string) string {
+			if idx, ok := header[name]; ok && idx < len(record) {
+				return strings.TrimSpace(record[idx])
+			}
+			return ""
+		}
+
+		command := Command{
+			Line:        line,
+			Action:      column("action"),
+			Address:     column("address"),
+			Destination: column("destination"),
+		}
+		// Passwords are taken as written, spaces included
+		if idx, ok := header["password"]; ok && idx < len(record) {
+			command.Password = record[idx]
+		}
+		if rowID := column("row_id"); rowID != "" {
+			if command.RowID, err = strconv.Atoi(rowID); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: invalid row_id %q", line, rowID))
+				continue
+			}
+		}
+		if err := command.prepare(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		commands = append(commands, command)
+	}
+	return commands, errors.Join(errs...)
+}
+
+// ParseNDJSON reads commands from newline delimited JSON objects. Blank
+// lines are skipped.
+func ParseNDJSON(r io.Reader) ([]Command, error) {
+	var commands []Command
+	var errs []error
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var command Command
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&command); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		command.Line = line
+		if err := command.prepare(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		commands = append(commands, command)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read NDJSON: %w", err)
+	}
+	return commands, errors.Join(errs...)
+}
+
+// prepare normalizes and validates a command read from line
+func (c *Command) prepare() error {
+	c.normalize()
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("line %d: %w", c.Line, err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package users
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCSV(t *testing.T) {
+	input := `# Mailbox changes for example.com
+Action,Address,Password,Destination,row_id
+add,Alice@Example.com., secret with spaces ,,
+passwd,bob@example.com,n3w,,2
+alias-add,postmaster@example.com,,"alice@example.com, Bob@Example.com",
+alias-add,@example.com,,alice@example.com,
+alias-remove,info@example.com,,,
+remove,carol@example.com,,,
+list,example.com,,,
+list,,,,
+`
+	commands, err := ParseCSV(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Command{
+		{Line: 3, Action: ActionAdd, Address: "alice@example.com", Password: " secret with spaces "},
+		{Line: 4, Action: ActionPasswd, Address: "bob@example.com", Password: "n3w", RowID: 2},
+		{Line: 5, Action: ActionAliasAdd, Address: "postmaster@example.com", Destination: "alice@example.com,bob@example.com"},
+		{Line: 6, Action: ActionAliasAdd, Address: "@example.com", Destination: "alice@example.com"},
+		{Line: 7, Action: ActionAliasRemove, Address: "info@example.com"},
+		{Line: 8, Action: ActionRemove, Address: "carol@example.com"},
+		{Line: 9, Action: ActionList, Address: "example.com"},
+		{Line: 10, Action: ActionList},
+	}
+	if len(commands) != len(want) {
+		t.Fatalf("ParseCSV = %+v, want %d commands", commands, len(want))
+	}
+	for i := range want {
+		if commands[i] != want[i] {
+			t.Errorf("command %d = %+v, want %+v", i, commands[i], want[i])
+		}
+	}
+	if got := commands[6].Domain(); got != "example.com" {
+		t.Errorf("Domain of list = %q", got)
+	}
+	if got := commands[2].Domain(); got != "example.com" {
+		t.Errorf("Domain of alias = %q", got)
+	}
+}
+
+func TestParseCSVErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string // Substrings of the error
+		valid int      // Commands still returned
+	}{
+		{name: "empty", input: "", want: []string{"no header"}},
+		{name: "no address column", input: "action,password\nadd,x\n", want: []string{"address column"}},
+		{
+			name: "invalid rows",
+			input: "action,address,password,destination,row_id\n" +
+				"add,alice@example.com,,,\n" +
+				"add,bob@example.com,pw,,x\n" +
+				"frobnicate,carol@example.com,,,\n" +
+				"remove,dave@example.com,pw,,\n" +
+				"alias-add,info@example.com,,,\n" +
+				"alias-add,info@example.com,,not-an-address,\n" +
+				"add,'; rm -rf /@example.com,pw,,\n" +
+				"add,eve@example.com,\"pass\nword\",,\n" +
+				"list,alice@example.com,,,\n" +
+				"remove,frank@example.com,,,\n",
+			want: []string{
+				"line 2: add of alice@example.com needs a password",
+				`line 3: invalid row_id "x"`,
+				`line 4: unknown action "frobnicate"`,
+				"line 5: remove takes no password",
+				"line 6: alias-add of info@example.com needs a destination",
+				"line 7: destination: invalid address",
+				"line 8: invalid local part",
+				"line 9: password of eve@example.com contains a control character",
+				"line 11: list takes a domain",
+			},
+			valid: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, err := ParseCSV(strings.NewReader(tt.input))
+			if err == nil {
+				t.Fatalf("ParseCSV = %+v, want an error", commands)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+			if len(commands) != tt.valid {
+				t.Errorf("ParseCSV returned %d commands, want %d", len(commands), tt.valid)
+			}
+		})
+	}
+}
+
+func TestParseNDJSON(t *testing.T) {
+	input := `{"action": "add", "address": "Alice@Example.com", "password": "secret"}
+
+{"action": "alias-add", "address": "@example.com", "destination": "alice@example.com", "row_id": 3}
+{"action": "add", "address": "bob@example.com", "passwd": "typo"}
+{"action": "list", "address": "example.com"
+{"action": "remove", "address": "bob"}
+`
+	commands, err := ParseNDJSON(strings.NewReader(input))
+
+	want := []Command{
+		{Line: 1, Action: ActionAdd, Address: "alice@example.com", Password: "secret"},
+		{Line: 3, Action: ActionAliasAdd, Address: "@example.com", Destination: "alice@example.com", RowID: 3},
+	}
+	if len(commands) != len(want) {
+		t.Fatalf("ParseNDJSON = %+v, want %d commands", commands, len(want))
+	}
+	for i := range want {
+		if commands[i] != want[i] {
+			t.Errorf("command %d = %+v, want %+v", i, commands[i], want[i])
+		}
+	}
+
+	for _, want := range []string{`line 4: json: unknown field "passwd"`, "line 5: unexpected EOF", `line 6: invalid address "bob"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v does not contain %q", err, want)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"users.csv":    "action,address,password\nadd,alice@example.com,secret\n",
+		"users.ndjson": `{"action": "add", "address": "alice@example.com", "password": "secret"}` + "\n",
+		"users.JSONL":  `{"action": "add", "address": "alice@example.com", "password": "secret"}` + "\n",
+		"users.txt":    "add alice@example.com secret\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"users.csv", "users.ndjson", "users.JSONL"} {
+		commands, err := ReadFile(filepath.Join(dir, name))
+		if err != nil || len(commands) != 1 || commands[0].Address != "alice@example.com" {
+			t.Errorf("ReadFile(%s) = %+v, %v", name, commands, err)
+		}
+	}
+	if _, err := ReadFile(filepath.Join(dir, "users.txt")); err == nil || !strings.Contains(err.Error(), "unknown command file type") {
+		t.Errorf("ReadFile(users.txt) = %v, want an unknown type error", err)
+	}
+	if _, err := ReadFile(filepath.Join(dir, "missing.csv")); err == nil {
+		t.Error("ReadFile of a missing file succeeded")
+	}
+}
@@ -0,0 +1,131 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	// cryptRounds is the SHA-crypt default, used without a rounds= prefix
+	cryptRounds = 5000
+
+	// saltLength is the longest salt SHA-crypt uses
+	saltLength = 16
+
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// HashPassword hashes a mailbox password with SHA512-CRYPT, prefixed with
+// the scheme as Dovecot's passwd-file expects. The password never leaves
+// this machine in plain text.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	for i := range salt {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(cryptAlphabet))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+		salt[i] = cryptAlphabet[n.Int64()]
+	}
+	return "{SHA512-CRYPT}" + sha512Crypt(password, string(salt)), nil
+}
+
+// sha512Crypt returns the $6$ crypt(3) hash of password, as specified in
+// "Unix crypt using SHA-256 and SHA-512" by Ulrich Drepper
+func sha512Crypt(password, salt string) string {
+	if len(salt) > saltLength {
+		salt = salt[:saltLength]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	alternate := sha512.New()
+	alternate.Write(p)
+	alternate.Write(s)
+	alternate.Write(p)
+	b := alternate.Sum(nil)
+
+	digest := sha512.New()
+	digest.Write(p)
+	digest.Write(s)
+	digest.Write(repeat(b, len(p)))
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			digest.Write(b)
+		} else {
+			digest.Write(p)
+		}
+	}
+	a := digest.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pBytes := repeat(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(a[0]); i++ {
+		ds.Write(s)
+	}
+	sBytes := repeat(ds.Sum(nil), len(s))
+
+	c := a
+	for i := 0; i < cryptRounds; i++ {
+		round := sha512.New()
+		if i%2 != 0 {
+			round.Write(pBytes)
+		} else {
+			round.Write(c)
+		}
+		if i%3 != 0 {
+			round.Write(sBytes)
+		}
+		if i%7 != 0 {
+			round.Write(pBytes)
+		}
+		if i%2 != 0 {
+			round.Write(c)
+		} else {
+			round.Write(pBytes)
+		}
+		c = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$" + salt + "$")
+	// The digest is encoded in 3 byte groups in this order, the last byte alone
+	for i := 0; i < 21; i++ {
+		j, k, l := i, i+21, i+42
+		switch i % 3 {
+		case 1:
+			j, k, l = i+21, i+42, i
+		case 2:
+			j, k, l = i+42, i, i+21
+		}
+		encode24(&out, c[j], c[k], c[l], 4)
+	}
+	encode24(&out, 0, 0, c[63], 2)
+	return out.String()
+}
+
+// repeat returns the first n bytes of b repeated
+func repeat(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+// encode24 writes n characters of the crypt base64 encoding of three bytes,
+// least significant bits first
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,57 @@
+package users
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	// Drepper's reference vector and glibc crypt(3) output
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"x", "toolongsaltstring_x", "$6$toolongsaltstrin$m5UCdGkMg16fnZB/afayhHcFYEQvnTRoKod8GIJKB0rGGl9IQGUPKeGHHw5xPOFVPjhTAcuzioT6ZcDqsMKJ80"},
+		{"", "ab", "$6$ab$xnh5Qsr2NdbFw1PgdZie7nLON3gv.S.23iQDBqAzkdoXPtDnVSpludXkM5UWybQO3OI7hBj9wHg9Ow6sUWD60/"},
+		{"p", "", "$6$$i4E0AZmQBmd1HZRWzuPsBXzyuqM/i3W7xjIw9M4wSBK4PtSgGiTmKchDvSN1vJQtZMPNCb9peE7d1rMFg9v8h0"},
+		{
+			"a long password with spaces and ünïcödé, longer than sixty-four bytes to cover the repeat loop",
+			"Xy.9/ZzQw1",
+			"$6$Xy.9/ZzQw1$Q6GnXphU3aoC55MLbj4/vPHTe0stXc/foB/crZw9xPGqHgwwzlF2FWSC.eQZJzeOEK7bolk5IHatdK6/4u8re/",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := sha512Crypt(tt.password, tt.salt); got != tt.want {
+			t.Errorf("sha512Crypt(%q, %q) = %q, want %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "{SHA512-CRYPT}$6$") {
+		t.Fatalf("HashPassword = %q, want a {SHA512-CRYPT}$6$ hash", hash)
+	}
+
+	fields := strings.Split(strings.TrimPrefix(hash, "{SHA512-CRYPT}"), "$")
+	if len(fields) != 4 || len(fields[2]) != saltLength || len(fields[3]) != 86 {
+		t.Fatalf("HashPassword = %q, want a %d character salt and 86 character hash", hash, saltLength)
+	}
+	if got := sha512Crypt("secret", fields[2]); "{SHA512-CRYPT}"+got != hash {
+		t.Errorf("hash does not verify: %q, want %q", got, hash)
+	}
+
+	other, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hash {
+		t.Error("two hashes of the same password share their salt")
+	}
+}